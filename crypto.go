@@ -4,28 +4,100 @@ package gopay
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math/big"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/blockfrost/blockfrost-go"
 )
 
 // Chains represents a slice of Chain objects. Each Chain can represent a different blockchain network.
+// Its methods look chains up by scanning the slice; the chains configured by Setup are looked up by name
+// through their ChainIndex instead.
 type Chains []Chain
 
+// ChainIndex maps chain names to their configuration for constant-time lookup.
+type ChainIndex map[string]*Chain
+
 // Chain represents a blockchain network, such as Ethereum (EVM) or Cardano. It includes network details like its name, explorer URL,
 // contract address, associated tokens, type, and network mode.
 type Chain struct {
-	Name            string        `json:"name" mapstructure:"name"`                        // Name of the blockchain network
-	Explorer        string        `json:"explorer" mapstructure:"explorer"`                // URL of the block explorer for the network
-	ContractAddress string        `json:"contract_address" mapstructure:"contractaddress"` // Address of the contract associated with the network
-	Tokens          []CryptoToken `json:"-" mapstructure:"tokens"`                         // List of tokens associated with the blockchain, hidden in JSON output
-	Type            NetworkType   `json:"type" mapstructure:"type"`                        // Type of blockchain (e.g., EVM, Cardano)
-	Mode            NetworkMode   `json:"mode" mapstructure:"mode"`                        // Network operation mode (e.g., mainnet, testnet)
-	ApiKey          string        `json:"-" mapstructure:"apikey"`                         // API key for interacting with the blockchain explorer, hidden in JSON output
+	Name              string        `json:"name" mapstructure:"name"`                        // Name of the blockchain network
+	Explorer          string        `json:"explorer" mapstructure:"explorer"`                // URL of the block explorer for the network
+	ContractAddress   string        `json:"contract_address" mapstructure:"contractaddress"` // Address of the contract associated with the network
+	WalletAddress     string        `json:"wallet_address" mapstructure:"walletaddress"`     // Wallet whose transfers are listed by EVM explorers, in addition to ContractAddress
+	Tokens            []CryptoToken `json:"-" mapstructure:"tokens"`                         // List of tokens associated with the blockchain, hidden in JSON output
+	Type              NetworkType   `json:"type" mapstructure:"type"`                        // Type of blockchain (e.g., EVM, Cardano)
+	Mode              NetworkMode   `json:"mode" mapstructure:"mode"`                        // Network operation mode (e.g., mainnet, testnet)
+	ApiKey            string        `json:"-" mapstructure:"apikey"`                         // API key for interacting with the blockchain explorer, hidden in JSON output
+	UseDirectTXLookup bool          `json:"-" mapstructure:"usedirecttxlookup"`              // Query EVM explorers by transaction hash instead of listing all transfers of the contract address (not for native transfers)
+	ExplorerType      ExplorerType  `json:"explorer_type" mapstructure:"explorertype"`       // Flavour of the EVM explorer API; empty means Etherscan
+	HTTPClient        *http.Client  `json:"-" mapstructure:"-"`                              // Client used to query EVM explorers; defaults to one with a 30s timeout
+	ExplorerWebURL    string        `json:"explorer_web_url" mapstructure:"explorerweburl"`  // Website of the block explorer used for links; derived from the chain type when empty
+
+	UseReceiptForConfirmations bool `json:"-" mapstructure:"usereceiptforconfirmations"` // Count EVM confirmations from the transaction receipt and latest block instead of the explorer's possibly stale transfer listing
+}
+
+// defaultHTTPClient is used to query EVM explorers when the chain has no HTTPClient.
+var defaultHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// httpClient returns the chain's HTTPClient, or a default client with a timeout if none is set.
+func (c Chain) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return defaultHTTPClient
+}
+
+// Default explorer endpoints and chain IDs of the preconfigured EVM networks.
+const (
+	polygonExplorer       = "https://api.polygonscan.com/api"
+	bscExplorer           = "https://api.bscscan.com/api"
+	polygonMainnetChainID = 137
+	polygonTestnetChainID = 80002
+)
+
+// Websites of the block explorers, keyed by explorer type (or Cardano) and network mode, used for links
+// when a chain has no ExplorerWebURL.
+var explorerWebURLs = map[string]map[NetworkMode]string{
+	string(ETHERSCAN):   {MAINNET: "https://etherscan.io", TESTNET: "https://sepolia.etherscan.io"},
+	string(POLYGONSCAN): {MAINNET: "https://polygonscan.com", TESTNET: "https://amoy.polygonscan.com"},
+	string(BSCSCAN):     {MAINNET: "https://bscscan.com", TESTNET: "https://testnet.bscscan.com"},
+	string(CARDANO):     {MAINNET: "https://cardanoscan.io", TESTNET: "https://preprod.cardanoscan.io"},
+}
+
+// NewPolygonChain returns a Polygon mainnet chain queried through Polygonscan. On Polygon the contract address
+// is the wallet receiving the payments rather than a token contract.
+func NewPolygonChain(apiKey, contractAddr string, tokens []CryptoToken) Chain {
+	return Chain{
+		Name:            "POLYGON",
+		Explorer:        polygonExplorer,
+		ExplorerType:    POLYGONSCAN,
+		ContractAddress: contractAddr,
+		Tokens:          tokens,
+		Type:            EVM,
+		Mode:            MAINNET,
+		ApiKey:          apiKey,
+	}
+}
+
+// NewBSCChain returns a Binance Smart Chain mainnet chain queried through BscScan.
+func NewBSCChain(apiKey, contractAddr string, tokens []CryptoToken) Chain {
+	return Chain{
+		Name:            "BSC",
+		Explorer:        bscExplorer,
+		ExplorerType:    BSCSCAN,
+		ContractAddress: contractAddr,
+		Tokens:          tokens,
+		Type:            EVM,
+		Mode:            MAINNET,
+		ApiKey:          apiKey,
+	}
 }
 
 // CryptoToken represents a specific token on a blockchain. It includes the token's name, symbol, address, and the number of decimals it uses.
@@ -36,18 +108,25 @@ type CryptoToken struct {
 	Decimals int    `json:"decimals" mapstructure:"decimals"` // Number of decimal places the token supports
 }
 
+// NativeTokenAddress is the sentinel address used for a chain's native currency (e.g., ETH or ADA),
+// which has no token contract address.
+const NativeTokenAddress = "native"
+
 // CryptoTransactionInfo contains details about a transaction on the blockchain, such as transaction hash, amount,
 // sender and recipient addresses, token details, confirmation status, and date.
 type CryptoTransactionInfo struct {
-	TxHash      string      `json:"txhash"`       // Transaction hash (unique identifier for the transaction)
-	TotalAmount float64     `json:"total_amount"` // Total amount of tokens transferred in the transaction
-	To          string      `json:"to"`           // Address of the recipient
-	From        string      `json:"from"`         // Address of the sender
-	Token       CryptoToken `json:"token"`        // Token associated with the transaction
-	Date        time.Time   `json:"date"`         // Date and time of the transaction
-	Confirmed   bool        `json:"confirmed"`    // Confirmation status of the transaction (e.g., confirmed or not)
-	Message     string      `json:"message"`      // Optional message associated with the transaction
-	Meta        interface{} `json:"meta"`         // Additional metadata associated with the transaction
+	TxHash      string                 `json:"txhash"`             // Transaction hash (unique identifier for the transaction)
+	TotalAmount float64                `json:"total_amount"`       // Total amount of tokens transferred in the transaction
+	To          string                 `json:"to"`                 // Address of the recipient
+	From        string                 `json:"from"`               // Address of the sender
+	Token       CryptoToken            `json:"token"`              // Token associated with the transaction
+	Date        time.Time              `json:"date"`               // Date and time of the transaction
+	Confirmed   bool                   `json:"confirmed"`          // Confirmation status of the transaction (e.g., confirmed or not)
+	Message     string                 `json:"message"`            // Optional message associated with the transaction
+	Meta        interface{}            `json:"meta"`               // Additional metadata associated with the transaction
+	ExplorerURL string                 `json:"explorer_url"`       // Link to the transaction on the block explorer, if known
+	Metadata    map[string]interface{} `json:"metadata,omitempty"` // On-chain metadata attached to the transaction by label (Cardano only)
+	NetworkType NetworkType            `json:"network_type"`       // Type of the blockchain the transaction was made on, set by the chain lookups
 }
 
 // EvmTokenTransferResponse is the structure of the response received from an EVM-compatible blockchain explorer API.
@@ -72,6 +151,7 @@ type EvmTokenTransferResponse struct {
 	CumulativeGasUsed string `json:"cumulativeGasUsed"` // Total gas used in the block up to the transaction
 	Input             string `json:"input"`             // Input data (for contract calls)
 	Confirmations     string `json:"confirmations"`     // Number of confirmations the transaction has received
+	IsError           string `json:"isError"`           // "1" if the transaction failed; only listed for native transfers
 }
 
 type CardanoTokenTransferResponse struct {
@@ -80,23 +160,132 @@ type CardanoTokenTransferResponse struct {
 	Block blockfrost.Block              `json:"block"`
 }
 
+// TokenInfo describes a supported token together with the blockchain network it belongs to.
+type TokenInfo struct {
+	ChainName   string      `json:"chain_name"`   // Name of the blockchain network
+	NetworkType NetworkType `json:"network_type"` // Type of blockchain (e.g., EVM, Cardano)
+	NetworkMode NetworkMode `json:"network_mode"` // Network operation mode (e.g., mainnet, testnet)
+	Token       CryptoToken `json:"token"`        // The supported token
+}
+
+// ChainTokenPair is a configured token along with the chain it is configured on.
+type ChainTokenPair struct {
+	Chain *Chain
+	Token *CryptoToken
+}
+
+// NetworkInfo describes a supported blockchain network without any of its credentials, for frontend use.
+type NetworkInfo struct {
+	Name   string        `json:"name"`   // Name of the blockchain network
+	Type   NetworkType   `json:"type"`   // Type of blockchain (e.g., EVM, Cardano)
+	Mode   NetworkMode   `json:"mode"`   // Network operation mode (e.g., mainnet, testnet)
+	Tokens []CryptoToken `json:"tokens"` // Tokens accepted on the network
+}
+
 // CryptoParams holds parameters used to retrieve transaction information, such as the transaction hash and token address.
 type CryptoParams struct {
-	TxHash       string // The transaction hash (ID) for the blockchain transaction.
-	TokenAddress string // The address of the token associated with the transaction.
+	TxHash           string // The transaction hash (ID) for the blockchain transaction.
+	TokenAddress     string // The address of the token associated with the transaction.
+	RecipientAddress string // The address expected to receive the transfer; not checked when empty.
+	ChainName        string // Name of the chain to look the transaction up on; only needed if several chains have the token.
+	FromBlock        string // First block EVM explorers list transfers from; all blocks when empty.
+	ToBlock          string // Last block EVM explorers list transfers up to; the latest block when empty.
 }
 
+// ErrAmbiguousChain is returned when the token address is configured on several chains and CryptoParams.ChainName
+// does not say which one to use.
+var ErrAmbiguousChain = &Error{Code: ErrCodeValidation, Message: "token address is configured on multiple chains"}
+
+// ErrAPIUnreachable is returned, wrapping the underlying error, when a chain's explorer API cannot be reached or
+// does not answer as expected; see Chain.HealthCheck.
+var ErrAPIUnreachable = &Error{Code: ErrCodeExternalService, Message: "blockchain explorer API is unreachable"}
+
+// ErrWrongRecipient is returned when an on-chain transaction was not sent to the expected recipient address.
+var ErrWrongRecipient = &Error{Code: ErrCodeValidation, Message: "transaction was not sent to the expected recipient"}
+
 // GetTXInfo retrieves the transaction information based on the transaction hash and token. It identifies the appropriate blockchain
 // (EVM or Cardano) based on the chain configuration and calls the corresponding method to retrieve transaction details.
-func (c Chain) GetTXInfo(txHash string, token CryptoToken) (*CryptoTransactionInfo, error) {
+// Polling stops early with the context error once ctx is cancelled or its deadline expires.
+func (c Chain) GetTXInfo(ctx context.Context, txHash string, token CryptoToken) (*CryptoTransactionInfo, error) {
+	return c.getTXInfo(ctx, CryptoParams{TxHash: txHash}, token, pollTXLookup)
+}
+
+// txLookup controls how long a transaction lookup waits for the transaction.
+type txLookup struct {
+	attempts      int  // Number of times the explorer is queried before giving up, a second apart.
+	waitConfirmed bool // Whether to keep polling until the transaction is confirmed.
+}
+
+var (
+	// pollTXLookup waits for the transaction to be found and confirmed.
+	pollTXLookup = txLookup{attempts: 20, waitConfirmed: true}
+	// singleTXLookup queries the explorer once and reports the transaction whether it is confirmed or not.
+	singleTXLookup = txLookup{attempts: 1}
+)
+
+// getTXInfo is like GetTXInfo but, on chains where a transaction has several outputs, reports the
+// output sent to recipientAddress when one exists. lookup controls how long it waits for the transaction.
+func (c Chain) getTXInfo(ctx context.Context, params CryptoParams, token CryptoToken, lookup txLookup) (*CryptoTransactionInfo, error) {
+	var (
+		info *CryptoTransactionInfo
+		err  error
+	)
 	switch c.Type {
 	case EVM:
-		return c.getEvmTXInfo(txHash, token)
+		info, err = c.getEvmTXInfo(ctx, params.TxHash, token, params.RecipientAddress, params.FromBlock, params.ToBlock, lookup)
 	case CARDANO:
-		return c.getCardanoTXInfo(txHash, token)
+		info, err = c.getCardanoTXInfo(ctx, params.TxHash, token, params.RecipientAddress, lookup)
 	default:
-		return nil, fmt.Errorf("unknown crypto env")
+		return nil, newError(ErrCodeValidation, nil, "unknown crypto env")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info.ExplorerURL = c.TransactionURL(params.TxHash)
+	info.NetworkType = c.Type
+	return info, nil
+}
+
+// explorerWebURL returns the website of the chain's block explorer, or an empty string if it is unknown.
+func (c Chain) explorerWebURL() string {
+	if c.ExplorerWebURL != "" {
+		return strings.TrimSuffix(c.ExplorerWebURL, "/")
+	}
+	key := string(c.ExplorerType)
+	if c.Type == CARDANO {
+		key = string(CARDANO)
+	} else if key == "" {
+		key = string(ETHERSCAN)
+	}
+	mode := c.Mode
+	if mode != TESTNET {
+		mode = MAINNET
+	}
+	return explorerWebURLs[key][mode]
+}
+
+// TransactionURL returns the link to the transaction on the chain's block explorer, or an empty string if
+// the explorer website is unknown.
+func (c Chain) TransactionURL(txHash string) string {
+	base := c.explorerWebURL()
+	if base == "" {
+		return ""
+	}
+	if c.Type == CARDANO {
+		return fmt.Sprintf("%s/transaction/%s", base, txHash)
+	}
+	return fmt.Sprintf("%s/tx/%s", base, txHash)
+}
+
+// AddressURL returns the link to the address on the chain's block explorer, or an empty string if the
+// explorer website is unknown.
+func (c Chain) AddressURL(address string) string {
+	base := c.explorerWebURL()
+	if base == "" {
+		return ""
 	}
+	return fmt.Sprintf("%s/address/%s", base, address)
 }
 
 // ID returns the transaction hash as a string identifier for the CryptoTransactionInfo.
@@ -104,54 +293,223 @@ func (t CryptoTransactionInfo) ID() string {
 	return t.TxHash
 }
 
+// Sender returns the address that most likely sent the transaction. EVM transactions have a single sender, which
+// is returned lowercased as EVM addresses are case-insensitive. Cardano transactions may spend inputs of several
+// addresses, so the one contributing the most lovelace is returned rather than the first input's in From.
+func (t CryptoTransactionInfo) Sender() string {
+	switch t.NetworkType {
+	case EVM:
+		return strings.ToLower(t.From)
+	case CARDANO:
+		if meta, ok := t.cardanoMeta(); ok {
+			if sender := cardanoLargestInput(meta.Utxos.Inputs); sender != "" {
+				return sender
+			}
+		}
+	}
+	return t.From
+}
+
+// Receiver returns the recipient reported in To, lowercased on EVM chains like Sender.
+func (t CryptoTransactionInfo) Receiver() string {
+	if t.NetworkType == EVM {
+		return strings.ToLower(t.To)
+	}
+	return t.To
+}
+
+// IsIncoming reports whether the transaction was sent to address, compared case-insensitively. On Cardano every
+// output counts, not only the one reported in To.
+func (t CryptoTransactionInfo) IsIncoming(address string) bool {
+	if address == "" {
+		return false
+	}
+	if strings.EqualFold(t.To, address) {
+		return true
+	}
+	if meta, ok := t.cardanoMeta(); ok {
+		for _, out := range meta.Utxos.Outputs {
+			if strings.EqualFold(out.Address, address) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cardanoMeta returns the Blockfrost responses the transaction info was built from, if it is a Cardano transaction.
+func (t CryptoTransactionInfo) cardanoMeta() (*CardanoTokenTransferResponse, bool) {
+	switch meta := t.Meta.(type) {
+	case CardanoTokenTransferResponse:
+		return &meta, true
+	case *CardanoTokenTransferResponse:
+		return meta, meta != nil
+	default:
+		return nil, false
+	}
+}
+
+// cardanoLargestInput returns the address whose inputs add up to the most lovelace, or an empty string if there are
+// no inputs. Ties go to the address spent first.
+func cardanoLargestInput(inputs []blockfrost.TransactionInput) string {
+	totals := make(map[string]*big.Int, len(inputs))
+	var addresses []string
+	for _, in := range inputs {
+		// Collateral and reference inputs are not spent by a successful transaction
+		if in.Collateral || (in.Reference != nil && *in.Reference) {
+			continue
+		}
+		total, ok := totals[in.Address]
+		if !ok {
+			total = new(big.Int)
+			totals[in.Address] = total
+			addresses = append(addresses, in.Address)
+		}
+		for _, am := range in.Amount {
+			if am.Unit != "lovelace" {
+				continue
+			}
+			if quantity, ok := new(big.Int).SetString(am.Quantity, 10); ok {
+				total.Add(total, quantity)
+			}
+		}
+	}
+
+	var sender string
+	for _, address := range addresses {
+		if sender == "" || totals[address].Cmp(totals[sender]) > 0 {
+			sender = address
+		}
+	}
+	return sender
+}
+
+// NetAmount returns the amount transferred minus the blockchain fees paid by the sender. Fees are paid in the
+// chain's native currency, so for token transfers (e.g., ERC-20) it equals TotalAmount. For native transfers
+// the fee is taken from the gas used and gas price on EVM chains and from the transaction fees on Cardano.
+// It returns 0 if the fee data of a native transfer is unavailable.
+func (t CryptoTransactionInfo) NetAmount() float64 {
+	if t.Token.Address != NativeTokenAddress {
+		return t.TotalAmount
+	}
+
+	var (
+		fee float64
+		err error
+	)
+	switch meta := t.Meta.(type) {
+	case *EvmTokenTransferResponse:
+		gasUsed, okUsed := new(big.Int).SetString(meta.GasUsed, 10)
+		gasPrice, okPrice := new(big.Int).SetString(meta.GasPrice, 10)
+		if !okUsed || !okPrice {
+			return 0
+		}
+		// Gas is paid in wei (1e-18 ETH)
+		fee, err = fromStrTokenValueToNumber(new(big.Int).Mul(gasUsed, gasPrice).String(), "18")
+	case CardanoTokenTransferResponse:
+		// Fees are paid in lovelace (1e-6 ADA)
+		fee, err = fromStrTokenValueToNumber(meta.Info.Fees, "6")
+	default:
+		return 0
+	}
+	if err != nil {
+		return 0
+	}
+
+	return t.TotalAmount - fee
+}
+
+// evmExplorerURL builds an account query (e.g., "tokentx" or "tokenbalance") against the chain's explorer,
+// adding the parameters required by its explorer type.
+func (c Chain) evmExplorerURL(action, filter string) string {
+	return c.evmExplorerModuleURL("account", action, filter)
+}
+
+// evmExplorerModuleURL is like evmExplorerURL for any module of the explorer API, e.g., "proxy".
+func (c Chain) evmExplorerModuleURL(module, action, filter string) string {
+	url := fmt.Sprintf("%s?module=%s&action=%s", c.Explorer, module, action)
+	if filter != "" {
+		url += "&" + filter
+	}
+	url = fmt.Sprintf("%s&apikey=%s", url, c.ApiKey)
+	if c.ExplorerType == POLYGONSCAN {
+		chainID := polygonMainnetChainID
+		if c.Mode == TESTNET {
+			chainID = polygonTestnetChainID
+		}
+		url = fmt.Sprintf("%s&chainid=%d", url, chainID)
+	}
+	return url
+}
+
 // getEvmTXInfo retrieves detailed transaction information from an Ethereum-like blockchain (EVM) using a block explorer API.
-func (c Chain) getEvmTXInfo(txHash string, token CryptoToken) (*CryptoTransactionInfo, error) {
+// Only transfers of the token itself are considered; if the transaction has several, the one sent to recipientAddress is reported.
+func (c Chain) getEvmTXInfo(ctx context.Context, txHash string, token CryptoToken, recipientAddress, fromBlock, toBlock string, lookup txLookup) (*CryptoTransactionInfo, error) {
 
 	var (
-		maxRetries = 20          // Maximum number of retries
-		retryDelay = time.Second // Delay between retries
+		maxRetries = lookup.attempts // Maximum number of retries
+		retryDelay = time.Second     // Delay between retries
 		evmInfo    *EvmTokenTransferResponse
-		resp       *http.Response
 		err        error
-		response   struct {
-			Status  string
-			Message string
-			Result  []EvmTokenTransferResponse
-		}
 	)
 
+	// Native transfers are listed with the account's transactions rather than its token transfers, and cannot
+	// be looked up by hash
+	action, direct := "tokentx", c.UseDirectTXLookup
+	if token.Address == NativeTokenAddress {
+		action, direct = "txlist", false
+	}
 	for retry := 0; retry < maxRetries; retry++ {
-		url := fmt.Sprintf("%s?module=account&action=tokentx&address=%s&apikey=%s", c.Explorer, c.ContractAddress, c.ApiKey)
-		resp, err = http.Get(url)
-		if err != nil {
-			fmt.Printf("Attempt %d: Error making HTTP request: %v\n", retry+1, err)
-			time.Sleep(retryDelay)
-			continue
+		// Stop polling if the caller has given up
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
 		}
-		defer resp.Body.Close()
 
-		if resp.StatusCode != http.StatusOK {
-			err = fmt.Errorf("attempt %d: unexpected HTTP status: %s", retry+1, resp.Status)
-			fmt.Printf("Attempt %d: Unexpected HTTP status: %s\n", retry+1, resp.Status)
-			time.Sleep(retryDelay)
-			continue
+		filters := c.evmAddressFilters(fromBlock, toBlock)
+		if direct {
+			filters = []string{fmt.Sprintf("txhash=%s", txHash)}
 		}
 
-		if err = json.NewDecoder(resp.Body).Decode(&response); err != nil {
-			fmt.Printf("Attempt %d: Error decoding JSON: %v\n", retry+1, err)
-			time.Sleep(retryDelay)
+		// Merge the transfers listed for every filter
+		var (
+			results  []EvmTokenTransferResponse
+			fallback bool
+		)
+		err = nil
+		for _, filter := range filters {
+			var response *evmTransfersResponse
+			response, err = c.fetchEvmTransfers(ctx, retry+1, action, filter)
+			if err != nil {
+				break
+			}
+			// Fall back to listing the address transfers if the explorer does not support direct lookups
+			if direct && response.Status == "0" && response.Message == "No transactions found" {
+				fallback = true
+				break
+			}
+			results = append(results, response.Result...)
+		}
+		if fallback {
+			// Falling back does not use up an attempt
+			config.logger().Debugf("Attempt %d: direct lookup of %s unsupported, falling back to address query", retry+1, txHash)
+			direct = false
+			retry--
 			continue
 		}
-
-		for _, res := range response.Result {
-			if res.Hash == txHash {
-				evmInfo = &res
+		if err != nil {
+			if err := sleepBeforeRetry(ctx, retry, maxRetries, retryDelay); err != nil {
+				return nil, err
 			}
+			continue
 		}
 
+		evmInfo = c.evmTransferOf(results, txHash, token, recipientAddress)
+
 		if evmInfo == nil {
-			fmt.Printf("Attempt %d: transaction %s not found\n", retry+1, txHash)
-			time.Sleep(retryDelay)
+			config.logger().Debugf("Attempt %d: transaction %s not found", retry+1, txHash)
+			if err := sleepBeforeRetry(ctx, retry, maxRetries, retryDelay); err != nil {
+				return nil, err
+			}
 			continue
 		}
 
@@ -161,19 +519,38 @@ func (c Chain) getEvmTXInfo(txHash string, token CryptoToken) (*CryptoTransactio
 
 	// If all retries fail, return the last error
 	if err != nil || evmInfo == nil {
-		return nil, fmt.Errorf("failed after %d retries: %v", maxRetries, err)
+		return nil, newError(ErrCodeExternalService, err, "failed after %d retries", maxRetries)
 	}
 
 	confirms, _ := strconv.Atoi(evmInfo.Confirmations)
+	if c.UseReceiptForConfirmations {
+		if n, err := c.evmReceiptConfirmations(ctx, txHash); err != nil {
+			config.logger().Errorf("Failed to count confirmations of %s from its receipt, using the explorer's count: %v", txHash, err)
+		} else {
+			confirms = n
+		}
+	}
 	// Redo if blocks confirms are less that 10 blocks
-	if confirms < 10 {
-		time.Sleep(time.Second)
-		return c.getEvmTXInfo(txHash, token)
+	if confirms < 10 && lookup.waitConfirmed {
+		if err := sleepContext(ctx, time.Second); err != nil {
+			return nil, err
+		}
+		return c.getEvmTXInfo(ctx, txHash, token, recipientAddress, fromBlock, toBlock, lookup)
+	}
+
+	decimals := evmInfo.TokenDecimal
+	if decimals == "" {
+		// Native transfers do not list the decimals of the currency
+		decimals = strconv.Itoa(token.Decimals)
+	}
+	total, err := fromStrTokenValueToNumber(evmInfo.Value, decimals)
+	if err != nil {
+		return nil, err
 	}
 
 	return &CryptoTransactionInfo{
 		TxHash:      txHash,
-		TotalAmount: fromStrTokenValueToNumber(evmInfo.Value, evmInfo.TokenDecimal),
+		TotalAmount: total,
 		Date:        fromStrTimestampToTime(evmInfo.TimeStamp),
 		From:        evmInfo.From,
 		To:          evmInfo.To,
@@ -183,8 +560,101 @@ func (c Chain) getEvmTXInfo(txHash string, token CryptoToken) (*CryptoTransactio
 	}, nil
 }
 
-// getCardanoTXInfo is a function for retrieving Cardano transaction information
-func (c Chain) getCardanoTXInfo(txHash string, token CryptoToken) (*CryptoTransactionInfo, error) {
+// evmTransferOf returns the transfer of the token made by the transaction, preferring the one sent to recipientAddress.
+// Transfers of other tokens in the same transaction are ignored, so that a worthless token sent along cannot be
+// mistaken for the payment. It returns nil if the transaction made no transfer of the token.
+func (c Chain) evmTransferOf(transfers []EvmTokenTransferResponse, txHash string, token CryptoToken, recipientAddress string) *EvmTokenTransferResponse {
+	var found *EvmTokenTransferResponse
+	for i, t := range transfers {
+		if t.Hash != txHash || t.IsError == "1" || !c.isEvmTransferOf(t, token) {
+			continue
+		}
+		if recipientAddress == "" || c.sameAddress(t.To, recipientAddress) {
+			return &transfers[i]
+		}
+		// Keep the transfer to report it was sent to the wrong recipient
+		if found == nil {
+			found = &transfers[i]
+		}
+	}
+	return found
+}
+
+// isEvmTransferOf reports whether the transfer moved the token. Native transfers are made by the transaction
+// itself rather than a token contract.
+func (c Chain) isEvmTransferOf(t EvmTokenTransferResponse, token CryptoToken) bool {
+	if token.Address == NativeTokenAddress {
+		return t.ContractAddress == ""
+	}
+	return c.sameAddress(t.ContractAddress, token.Address)
+}
+
+// evmTransfersResponse is the body of an EVM explorer's token transfer or transaction listing.
+type evmTransfersResponse struct {
+	Status  string
+	Message string
+	Result  []EvmTokenTransferResponse
+}
+
+// evmAddressFilters returns the explorer filters listing the transfers of the chain's wallet and contract
+// addresses, restricted to the given block range if set.
+func (c Chain) evmAddressFilters(fromBlock, toBlock string) []string {
+	addresses := []string{c.ContractAddress}
+	if c.WalletAddress != "" {
+		addresses = []string{c.WalletAddress}
+		if c.ContractAddress != "" && !strings.EqualFold(c.ContractAddress, c.WalletAddress) {
+			addresses = append(addresses, c.ContractAddress)
+		}
+	}
+
+	filters := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		filter := fmt.Sprintf("address=%s", address)
+		if fromBlock != "" {
+			filter += fmt.Sprintf("&startblock=%s", fromBlock)
+		}
+		if toBlock != "" {
+			filter += fmt.Sprintf("&endblock=%s", toBlock)
+		}
+		filters = append(filters, filter)
+	}
+	return filters
+}
+
+// fetchEvmTransfers lists the transfers matching filter on the chain's explorer with action ("tokentx" or "txlist"), logging failures
+// as part of the given attempt.
+func (c Chain) fetchEvmTransfers(ctx context.Context, attempt int, action, filter string) (*evmTransfersResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.evmExplorerURL(action, filter), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		config.logger().Errorf("Attempt %d: Error making HTTP request: %v", attempt, err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		config.logger().Errorf("Attempt %d: Unexpected HTTP status: %s", attempt, resp.Status)
+		return nil, newError(ErrCodeExternalService, nil, "attempt %d: unexpected HTTP status: %s", attempt, resp.Status)
+	}
+
+	response := new(evmTransfersResponse)
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		config.logger().Errorf("Attempt %d: Error decoding JSON: %v", attempt, err)
+		return nil, err
+	}
+	return response, nil
+}
+
+// cardanoMessageLabel is the metadata label of transaction messages, see CIP-20.
+const cardanoMessageLabel = "674"
+
+// getCardanoTXInfo is a function for retrieving Cardano transaction information.
+// If an output was sent to recipientAddress its token amount is reported, otherwise the token amounts
+// of all outputs are summed up. The transaction's metadata is reported too, with its CIP-20 message if any.
+func (c Chain) getCardanoTXInfo(ctx context.Context, txHash string, token CryptoToken, recipientAddress string, lookup txLookup) (*CryptoTransactionInfo, error) {
 	api := blockfrost.NewAPIClient(
 		blockfrost.APIClientOptions{
 			Server:    c.Explorer,
@@ -192,40 +662,61 @@ func (c Chain) getCardanoTXInfo(txHash string, token CryptoToken) (*CryptoTransa
 		},
 	)
 
-	ctx := context.Background()
-	maxRetries := 20          // Maximum number of retries
-	retryDelay := time.Second // Delay between retries
+	maxRetries := lookup.attempts // Maximum number of retries
+	retryDelay := time.Second     // Delay between retries
 
 	var (
-		tx    blockfrost.TransactionContent
-		utxos blockfrost.TransactionUTXOs
-		block blockfrost.Block
-		err   error
+		tx       blockfrost.TransactionContent
+		utxos    blockfrost.TransactionUTXOs
+		block    blockfrost.Block
+		metadata []blockfrost.TransactionMetadata
+		err      error
 	)
 
 	// Retry loop
 	for retry := 0; retry < maxRetries; retry++ {
+		// Stop polling if the caller has given up
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+
 		// Fetch transaction details
 		tx, err = api.Transaction(ctx, txHash)
 		if err != nil {
-			fmt.Printf("Attempt %d: Error fetching transaction: %v\n", retry+1, err)
-			time.Sleep(retryDelay)
+			config.logger().Errorf("Attempt %d: Error fetching transaction: %v", retry+1, err)
+			if err := sleepBeforeRetry(ctx, retry, maxRetries, retryDelay); err != nil {
+				return nil, err
+			}
 			continue
 		}
 
 		// Fetch transaction UTXOs
 		utxos, err = api.TransactionUTXOs(ctx, txHash)
 		if err != nil {
-			fmt.Printf("Attempt %d: Error fetching transaction UTXOs: %v\n", retry+1, err)
-			time.Sleep(retryDelay)
+			config.logger().Errorf("Attempt %d: Error fetching transaction UTXOs: %v", retry+1, err)
+			if err := sleepBeforeRetry(ctx, retry, maxRetries, retryDelay); err != nil {
+				return nil, err
+			}
 			continue
 		}
 
 		// Fetch block details
 		block, err = api.Block(ctx, tx.Block)
 		if err != nil {
-			fmt.Printf("Attempt %d: Error fetching block: %v\n", retry+1, err)
-			time.Sleep(retryDelay)
+			config.logger().Errorf("Attempt %d: Error fetching block: %v", retry+1, err)
+			if err := sleepBeforeRetry(ctx, retry, maxRetries, retryDelay); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// Fetch transaction metadata
+		metadata, err = api.TransactionMetadata(ctx, txHash)
+		if err != nil {
+			config.logger().Errorf("Attempt %d: Error fetching transaction metadata: %v", retry+1, err)
+			if err := sleepBeforeRetry(ctx, retry, maxRetries, retryDelay); err != nil {
+				return nil, err
+			}
 			continue
 		}
 
@@ -235,13 +726,38 @@ func (c Chain) getCardanoTXInfo(txHash string, token CryptoToken) (*CryptoTransa
 
 	// If all retries fail, return the last error
 	if err != nil {
-		return nil, fmt.Errorf("failed after %d retries: %v", maxRetries, err)
+		return nil, newError(ErrCodeExternalService, err, "failed after %d retries", maxRetries)
+	}
+	if len(utxos.Inputs) == 0 || len(utxos.Outputs) == 0 {
+		return nil, newError(ErrCodeExternalService, nil, "transaction %s has no inputs or outputs", txHash)
 	}
+
+	// Sum the outputs paying the recipient, which may be split over several outputs. Without a recipient, or if
+	// none pays it, sum the outputs not going back to the input addresses, which are change.
+	outputs := cardanoOutputsTo(utxos.Outputs, recipientAddress)
+	if len(outputs) == 0 {
+		outputs = cardanoPaidOutputs(utxos)
+	}
+	to := outputs[0].Address
+
 	var total float64
+	for _, out := range outputs {
+		for _, am := range out.Amount {
+			if matchCardanoAddress(am.Unit, token.Address) {
+				amount, err := fromStrTokenValueToNumber(am.Quantity, fmt.Sprintf("%d", token.Decimals))
+				if err != nil {
+					return nil, err
+				}
+				total += amount
+			}
+		}
+	}
 
-	for _, am := range utxos.Outputs[0].Amount {
-		if matchAddress(token.Address, am.Unit) {
-			total = fromStrTokenValueToNumber(am.Quantity, fmt.Sprintf("%d", token.Decimals))
+	var meta map[string]interface{}
+	if len(metadata) > 0 {
+		meta = make(map[string]interface{}, len(metadata))
+		for _, m := range metadata {
+			meta[m.Label] = m.JsonMetadata
 		}
 	}
 
@@ -250,22 +766,546 @@ func (c Chain) getCardanoTXInfo(txHash string, token CryptoToken) (*CryptoTransa
 		TotalAmount: total,
 		Date:        time.Unix(int64(block.Time), 0),
 		From:        utxos.Inputs[0].Address,
-		To:          utxos.Outputs[0].Address,
+		To:          to,
+		Message:     cardanoMessage(meta[cardanoMessageLabel]),
 		Meta:        CardanoTokenTransferResponse{tx, utxos, block},
+		Metadata:    meta,
 		Token:       token,
 		Confirmed:   true,
 	}, nil
 }
 
-// TransactionInfo searches for a specific token and transaction hash, retrieves the appropriate chain, and returns transaction details.
-func (chains Chains) TransactionInfo(params CryptoParams) (*CryptoTransactionInfo, error) {
+// cardanoOutputsTo returns the outputs sent to address, if any.
+func cardanoOutputsTo(outputs []blockfrost.TransactionOutput, address string) []blockfrost.TransactionOutput {
+	if address == "" {
+		return nil
+	}
+	var matched []blockfrost.TransactionOutput
+	for _, out := range outputs {
+		if out.Address == address {
+			matched = append(matched, out)
+		}
+	}
+	return matched
+}
+
+// cardanoPaidOutputs returns the outputs of the transaction that are not change, i.e., not sent back to one of
+// its input addresses. All outputs are returned if they are all change, e.g., for a transfer to oneself.
+func cardanoPaidOutputs(utxos blockfrost.TransactionUTXOs) []blockfrost.TransactionOutput {
+	inputs := make(map[string]bool, len(utxos.Inputs))
+	for _, in := range utxos.Inputs {
+		inputs[in.Address] = true
+	}
+	var paid []blockfrost.TransactionOutput
+	for _, out := range utxos.Outputs {
+		if !inputs[out.Address] {
+			paid = append(paid, out)
+		}
+	}
+	if len(paid) == 0 {
+		return utxos.Outputs
+	}
+	return paid
+}
+
+// cardanoMessage extracts the message from CIP-20 metadata, i.e., {"msg": ["line", ...]}, joining its lines.
+// A single string is accepted too, as some wallets write one.
+func cardanoMessage(metadata interface{}) string {
+	m, ok := metadata.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	switch msg := m["msg"].(type) {
+	case string:
+		return msg
+	case []interface{}:
+		lines := make([]string, 0, len(msg))
+		for _, line := range msg {
+			if s, ok := line.(string); ok {
+				lines = append(lines, s)
+			}
+		}
+		return strings.Join(lines, "\n")
+	default:
+		return ""
+	}
+}
+
+// GetTokenBalance returns the balance of the token held by the wallet, in token units (e.g., 1.5 USDC
+// rather than 1500000). Native currencies are looked up when the token uses NativeTokenAddress.
+func (c Chain) GetTokenBalance(walletAddress string, token CryptoToken) (float64, error) {
+	switch c.Type {
+	case EVM:
+		return c.getEvmTokenBalance(walletAddress, token)
+	case CARDANO:
+		return c.getCardanoTokenBalance(walletAddress, token)
+	default:
+		return 0, newError(ErrCodeValidation, nil, "unknown crypto env")
+	}
+}
+
+// getEvmTokenBalance queries the explorer for the wallet's token balance.
+func (c Chain) getEvmTokenBalance(walletAddress string, token CryptoToken) (float64, error) {
+	url := c.evmExplorerURL("tokenbalance", fmt.Sprintf("contractaddress=%s&address=%s&tag=latest", token.Address, walletAddress))
+	if token.Address == NativeTokenAddress {
+		url = c.evmExplorerURL("balance", fmt.Sprintf("address=%s&tag=latest", walletAddress))
+	}
+
+	resp, err := c.httpClient().Get(url)
+	if err != nil {
+		return 0, newError(ErrCodeExternalService, err, "failed to fetch balance")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, newError(ErrCodeExternalService, nil, "unexpected HTTP status: %s", resp.Status)
+	}
+
+	var response struct {
+		Status  string
+		Message string
+		Result  string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return 0, newError(ErrCodeExternalService, err, "failed to decode balance")
+	}
+	if response.Status != "1" {
+		return 0, newError(ErrCodeExternalService, nil, "failed to fetch balance: %s: %s", response.Message, response.Result)
+	}
+
+	return fromStrTokenValueToNumber(response.Result, fmt.Sprintf("%d", token.Decimals))
+}
+
+// getCardanoTokenBalance sums the wallet's amounts of the token on Blockfrost.
+func (c Chain) getCardanoTokenBalance(walletAddress string, token CryptoToken) (float64, error) {
+	api := blockfrost.NewAPIClient(
+		blockfrost.APIClientOptions{
+			Server:    c.Explorer,
+			ProjectID: c.ApiKey,
+		},
+	)
+
+	addr, err := api.Address(context.Background(), walletAddress)
+	if err != nil {
+		return 0, newError(ErrCodeExternalService, err, "failed to fetch address")
+	}
+
+	var total float64
+	for _, am := range addr.Amount {
+		if !matchCardanoAddress(am.Unit, token.Address) {
+			continue
+		}
+		amount, err := fromStrTokenValueToNumber(am.Quantity, fmt.Sprintf("%d", token.Decimals))
+		if err != nil {
+			return 0, err
+		}
+		total += amount
+	}
+	return total, nil
+}
+
+// HealthCheck verifies that the chain's explorer API is reachable with a lightweight call: the latest block
+// number for EVM explorers and the health endpoint for Blockfrost. It returns an error matching
+// ErrAPIUnreachable if the call fails.
+func (c Chain) HealthCheck(ctx context.Context) error {
+	var err error
+	switch c.Type {
+	case EVM:
+		err = c.evmHealthCheck(ctx)
+	case CARDANO:
+		err = c.cardanoHealthCheck(ctx)
+	default:
+		return newError(ErrCodeValidation, nil, "unknown crypto env")
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrAPIUnreachable, c.Name, err)
+	}
+	return nil
+}
+
+// evmHealthCheck fetches the latest block number from the explorer.
+func (c Chain) evmHealthCheck(ctx context.Context) error {
+	_, err := c.evmBlockNumber(ctx)
+	return err
+}
+
+// evmProxyCall runs a JSON-RPC call through the explorer's proxy module and returns its raw result.
+func (c Chain) evmProxyCall(ctx context.Context, action, filter string) (json.RawMessage, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.evmExplorerModuleURL("proxy", action, filter), nil)
+	if err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to create %s request", action)
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to call %s", action)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newError(ErrCodeExternalService, nil, "unexpected HTTP status: %s", resp.Status)
+	}
+
+	// Explorers answer with a JSON-RPC result, or with a status and message on errors such as an invalid API key
+	var response struct {
+		Message string
+		Result  json.RawMessage
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to decode %s result", action)
+	}
+	var message string
+	if json.Unmarshal(response.Result, &message) == nil && !strings.HasPrefix(message, "0x") {
+		return nil, newError(ErrCodeExternalService, nil, "failed to call %s: %s: %s", action, response.Message, message)
+	}
+	return response.Result, nil
+}
+
+// evmBlockNumber returns the number of the latest block.
+func (c Chain) evmBlockNumber(ctx context.Context) (uint64, error) {
+	result, err := c.evmProxyCall(ctx, "eth_blockNumber", "")
+	if err != nil {
+		return 0, err
+	}
+	var hex string
+	if err := json.Unmarshal(result, &hex); err != nil {
+		return 0, newError(ErrCodeExternalService, err, "failed to decode block number")
+	}
+	number, err := strconv.ParseUint(strings.TrimPrefix(hex, "0x"), 16, 64)
+	if err != nil {
+		return 0, newError(ErrCodeExternalService, err, "invalid block number %q", hex)
+	}
+	return number, nil
+}
+
+// evmReceiptConfirmations counts the confirmations of the transaction from the block of its receipt up to the
+// latest block. A transaction without a receipt is not mined yet and has no confirmations.
+func (c Chain) evmReceiptConfirmations(ctx context.Context, txHash string) (int, error) {
+	result, err := c.evmProxyCall(ctx, "eth_getTransactionReceipt", fmt.Sprintf("txhash=%s", txHash))
+	if err != nil {
+		return 0, err
+	}
+	var receipt *struct {
+		BlockNumber string `json:"blockNumber"`
+	}
+	if err := json.Unmarshal(result, &receipt); err != nil {
+		return 0, newError(ErrCodeExternalService, err, "failed to decode transaction receipt")
+	}
+	if receipt == nil || receipt.BlockNumber == "" {
+		return 0, nil
+	}
+	block, err := strconv.ParseUint(strings.TrimPrefix(receipt.BlockNumber, "0x"), 16, 64)
+	if err != nil {
+		return 0, newError(ErrCodeExternalService, err, "invalid receipt block number %q", receipt.BlockNumber)
+	}
+
+	latest, err := c.evmBlockNumber(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if latest < block {
+		return 0, nil
+	}
+	return int(latest-block) + 1, nil
+}
+
+// cardanoHealthCheck queries the Blockfrost health endpoint.
+func (c Chain) cardanoHealthCheck(ctx context.Context) error {
+	api := blockfrost.NewAPIClient(
+		blockfrost.APIClientOptions{
+			Server:    c.Explorer,
+			ProjectID: c.ApiKey,
+		},
+	)
+
+	health, err := api.Health(ctx)
+	if err != nil {
+		return err
+	}
+	if !health.IsHealthy {
+		return errors.New("blockfrost reports it is not healthy")
+	}
+	return nil
+}
+
+// HealthCheck verifies the explorer APIs of all chains concurrently and returns the result of each, keyed by
+// chain name; a nil error means the chain is healthy.
+func (chains Chains) HealthCheck(ctx context.Context) map[string]error {
+	results := make(map[string]error, len(chains))
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, c := range chains {
+		wg.Add(1)
+		go func(c Chain) {
+			defer wg.Done()
+			err := c.HealthCheck(ctx)
+			mu.Lock()
+			defer mu.Unlock()
+			results[c.Name] = err
+		}(c)
+	}
+	wg.Wait()
+	return results
+}
+
+// Validate checks that the token is fully configured. Native currencies must use NativeTokenAddress as their address.
+func (t CryptoToken) Validate() error {
+	var errs []error
+	if t.Name == "" {
+		errs = append(errs, fmt.Errorf("token name is required"))
+	}
+	if t.Symbol == "" {
+		errs = append(errs, fmt.Errorf("token %s: symbol is required", t.Name))
+	}
+	if t.Address == "" {
+		errs = append(errs, fmt.Errorf("token %s: address is required (use %q for native currencies)", t.Name, NativeTokenAddress))
+	}
+	if t.Decimals < 0 || t.Decimals > 77 {
+		errs = append(errs, fmt.Errorf("token %s: decimals must be between 0 and 77, got %d", t.Name, t.Decimals))
+	}
+	return validationError(errs)
+}
+
+// Validate checks that the chain and all of its tokens are fully configured.
+func (c Chain) Validate() error {
+	var errs []error
+	if c.Name == "" {
+		errs = append(errs, fmt.Errorf("chain name is required"))
+	}
+	if c.Explorer == "" {
+		errs = append(errs, fmt.Errorf("chain %s: explorer is required", c.Name))
+	}
+	switch c.ExplorerType {
+	case "", ETHERSCAN, POLYGONSCAN, BSCSCAN:
+	default:
+		errs = append(errs, fmt.Errorf("chain %s: unknown explorer type %s", c.Name, c.ExplorerType))
+	}
+	for _, t := range c.Tokens {
+		errs = append(errs, prefixErrors(fmt.Sprintf("chain %s", c.Name), t.Validate())...)
+	}
+	return validationError(errs)
+}
+
+// Validate checks every chain and returns an error listing all violations.
+func (chains Chains) Validate() error {
+	var errs []error
+	for _, c := range chains {
+		if err := c.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return validationError(errs)
+}
+
+// FindByName returns the chain configured under the given name.
+func (chains Chains) FindByName(name string) (*Chain, bool) {
+	for i := range chains {
+		if chains[i].Name == name {
+			return &chains[i], true
+		}
+	}
+	return nil, false
+}
+
+// FindByTokenAddress returns the chain and token configured for the given token address.
+func (chains Chains) FindByTokenAddress(tokenAddress string) (*Chain, *CryptoToken, bool) {
+	for i := range chains {
+		for j := range chains[i].Tokens {
+			if strings.EqualFold(chains[i].Tokens[j].Address, tokenAddress) {
+				return &chains[i], &chains[i].Tokens[j], true
+			}
+		}
+	}
+	return nil, nil, false
+}
+
+// FindAllByTokenAddress returns every chain the given token address is configured on, e.g., the native token
+// address on several EVM chains.
+func (chains Chains) FindAllByTokenAddress(tokenAddress string) []ChainTokenPair {
+	var pairs []ChainTokenPair
+	for i := range chains {
+		for j := range chains[i].Tokens {
+			if strings.EqualFold(chains[i].Tokens[j].Address, tokenAddress) {
+				pairs = append(pairs, ChainTokenPair{Chain: &chains[i], Token: &chains[i].Tokens[j]})
+			}
+		}
+	}
+	return pairs
+}
+
+// findForParams returns the chain and token the transaction of params is looked up on. It returns
+// ErrAmbiguousChain if the token is configured on several chains and params.ChainName is empty.
+func (chains Chains) findForParams(params CryptoParams) (*Chain, *CryptoToken, error) {
+	pairs := chains.FindAllByTokenAddress(params.TokenAddress)
+	if params.ChainName != "" {
+		for _, pair := range pairs {
+			if pair.Chain.Name == params.ChainName {
+				return pair.Chain, pair.Token, nil
+			}
+		}
+		return nil, nil, newError(ErrCodeNotFound, nil, "token address %s not found on chain %s", params.TokenAddress, params.ChainName)
+	}
+
+	switch len(pairs) {
+	case 0:
+		return nil, nil, newError(ErrCodeNotFound, nil, "token address %s not found", params.TokenAddress)
+	case 1:
+		return pairs[0].Chain, pairs[0].Token, nil
+	default:
+		return nil, nil, fmt.Errorf("%w: %s", ErrAmbiguousChain, params.TokenAddress)
+	}
+}
+
+// SupportedTokens returns a flat list of all configured tokens along with their network details.
+func (chains Chains) SupportedTokens() []TokenInfo {
+	tokens := []TokenInfo{}
 	for _, c := range chains {
 		for _, t := range c.Tokens {
-			if strings.EqualFold(t.Address, params.TokenAddress) {
-				return c.GetTXInfo(params.TxHash, t)
+			tokens = append(tokens, TokenInfo{
+				ChainName:   c.Name,
+				NetworkType: c.Type,
+				NetworkMode: c.Mode,
+				Token:       t,
+			})
+		}
+	}
+	return tokens
+}
+
+// SupportedNetworks returns the configured networks with their tokens, omitting API keys and contract addresses.
+func (chains Chains) SupportedNetworks() []NetworkInfo {
+	networks := make([]NetworkInfo, 0, len(chains))
+	for _, c := range chains {
+		networks = append(networks, NetworkInfo{
+			Name:   c.Name,
+			Type:   c.Type,
+			Mode:   c.Mode,
+			Tokens: append([]CryptoToken{}, c.Tokens...),
+		})
+	}
+	return networks
+}
+
+// FilterByMode returns the chains operating in the given network mode.
+func (chains Chains) FilterByMode(mode NetworkMode) Chains {
+	filtered := Chains{}
+	for _, c := range chains {
+		if c.Mode == mode {
+			filtered = append(filtered, c)
+		}
+	}
+	return filtered
+}
+
+// FilterByType returns the chains of the given network type.
+func (chains Chains) FilterByType(t NetworkType) Chains {
+	filtered := Chains{}
+	for _, c := range chains {
+		if c.Type == t {
+			filtered = append(filtered, c)
+		}
+	}
+	return filtered
+}
+
+// BuildIndex builds a name-keyed index of the chains. It returns an error if two chains share the same name.
+func (chains Chains) BuildIndex() (ChainIndex, error) {
+	index := make(ChainIndex, len(chains))
+	for i := range chains {
+		if _, exists := index[chains[i].Name]; exists {
+			return nil, newError(ErrCodeDuplicate, nil, "duplicate chain name %s", chains[i].Name)
+		}
+		index[chains[i].Name] = &chains[i]
+	}
+	return index, nil
+}
+
+// FindByName returns the chain indexed under the given name.
+func (index ChainIndex) FindByName(name string) (*Chain, bool) {
+	c, ok := index[name]
+	return c, ok
+}
+
+// TransactionInfo searches for a specific token and transaction hash, retrieves the appropriate chain, and returns transaction details.
+// If the token is configured on several chains, params.ChainName selects the chain; otherwise ErrAmbiguousChain is returned.
+func (chains Chains) TransactionInfo(params CryptoParams) (*CryptoTransactionInfo, error) {
+	return chains.TransactionInfoCtx(context.Background(), params)
+}
+
+// TransactionInfoCtx is like TransactionInfo but stops polling the chain once ctx is done.
+func (chains Chains) TransactionInfoCtx(ctx context.Context, params CryptoParams) (*CryptoTransactionInfo, error) {
+	return chains.transactionInfo(ctx, params, pollTXLookup)
+}
+
+// transactionInfo is like TransactionInfoCtx, with lookup controlling how long it waits for the transaction.
+func (chains Chains) transactionInfo(ctx context.Context, params CryptoParams, lookup txLookup) (*CryptoTransactionInfo, error) {
+	c, t, err := chains.findForParams(params)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := c.getTXInfo(ctx, params, *t, lookup)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.RecipientAddress != "" && !c.sameAddress(info.To, params.RecipientAddress) {
+		return info, fmt.Errorf("%w: expected %s but got %s", ErrWrongRecipient, params.RecipientAddress, info.To)
+	}
+
+	return info, nil
+}
+
+// WatchTransaction polls the chain for the transaction in a goroutine, querying the explorer once per attempt and
+// waiting interval between attempts, and calls callback once it is found and confirmed. Lookup errors of the explorer are retried, while permanent
+// failures (e.g., an unknown token or a wrong recipient) are reported with callback(nil, err).
+// Calling the returned cancel function, or cancelling ctx, stops the goroutine without calling callback.
+func (chains Chains) WatchTransaction(ctx context.Context, params CryptoParams, interval time.Duration, callback func(*CryptoTransactionInfo, error)) (cancel func()) {
+	ctx, cancel = context.WithCancel(ctx)
+	go func() {
+		defer cancel()
+		for attempt := 1; ; attempt++ {
+			info, err := chains.transactionInfo(ctx, params, singleTXLookup)
+			if ctx.Err() != nil {
+				return
+			}
+			switch {
+			case err == nil && info.Confirmed:
+				callback(info, nil)
+				return
+			case err != nil && ErrorCodeOf(err) != ErrCodeExternalService:
+				callback(nil, err)
+				return
+			case err != nil:
+				config.logger().Debugf("Watch attempt %d: transaction %s not available yet: %v", attempt, params.TxHash, err)
+			default:
+				config.logger().Debugf("Watch attempt %d: transaction %s not confirmed yet", attempt, params.TxHash)
+			}
+
+			if err := sleepContext(ctx, interval); err != nil {
+				return
 			}
 		}
+	}()
+	return cancel
+}
+
+// GetTokenBalance returns the balance held by the wallet of the token with the given address, on the chain
+// the token belongs to. See Chain.GetTokenBalance.
+func (chains Chains) GetTokenBalance(walletAddress, tokenAddress string) (float64, error) {
+	c, t, ok := chains.FindByTokenAddress(tokenAddress)
+	if !ok {
+		return 0, newError(ErrCodeNotFound, nil, "token address %s not found", tokenAddress)
 	}
+	return c.GetTokenBalance(walletAddress, *t)
+}
 
-	return nil, fmt.Errorf("token address %s not found", params.TokenAddress)
+// sameAddress compares two addresses on the chain. EVM addresses are compared case-insensitively
+// since their checksum casing is optional.
+func (c Chain) sameAddress(addr1, addr2 string) bool {
+	if c.Type == EVM {
+		return strings.EqualFold(addr1, addr2)
+	}
+	return addr1 == addr2
 }
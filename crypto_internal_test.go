@@ -0,0 +1,51 @@
+package gopay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// proxyTransport answers the EVM explorer proxy calls with the response or error for their action.
+type proxyTransport map[string]func() (*http.Response, error)
+
+func (t proxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t[req.URL.Query().Get("action")]()
+}
+
+// proxyResponse answers with an HTTP response of the given status and body.
+func proxyResponse(status int, body string) func() (*http.Response, error) {
+	return func() (*http.Response, error) {
+		return &http.Response{StatusCode: status, Status: http.StatusText(status), Body: io.NopCloser(strings.NewReader(body))}, nil
+	}
+}
+
+func TestEVMProxyErrorsAreExternal(t *testing.T) {
+	receipt := proxyResponse(http.StatusOK, `{"jsonrpc": "2.0", "id": 1, "result": {"blockNumber": "0x100"}}`)
+	cases := []struct {
+		name      string
+		transport proxyTransport
+	}{
+		{"unreachable", proxyTransport{"eth_getTransactionReceipt": func() (*http.Response, error) {
+			return nil, errors.New("connection refused")
+		}}},
+		{"HTTP status", proxyTransport{"eth_getTransactionReceipt": proxyResponse(http.StatusBadGateway, "")}},
+		{"invalid JSON", proxyTransport{"eth_getTransactionReceipt": proxyResponse(http.StatusOK, `not json`)}},
+		{"explorer error", proxyTransport{"eth_getTransactionReceipt": proxyResponse(http.StatusOK, `{"status": "0", "message": "NOTOK", "result": "Invalid API Key"}`)}},
+		{"invalid receipt", proxyTransport{"eth_getTransactionReceipt": proxyResponse(http.StatusOK, `{"result": {"blockNumber": "0xZZ"}}`)}},
+		{"invalid block number", proxyTransport{
+			"eth_getTransactionReceipt": receipt,
+			"eth_blockNumber":           proxyResponse(http.StatusOK, `{"result": "0xZZ"}`),
+		}},
+	}
+	for _, c := range cases {
+		chain := Chain{Name: "Ethereum", Explorer: "https://api.etherscan.io/api", Type: EVM, HTTPClient: &http.Client{Transport: c.transport}}
+		_, err := chain.evmReceiptConfirmations(context.Background(), "0xTransactionHash")
+		if ErrorCodeOf(err) != ErrCodeExternalService {
+			t.Errorf("%s: expected an external service error, but got %v", c.name, err)
+		}
+	}
+}
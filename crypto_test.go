@@ -1,8 +1,18 @@
 package gopay_test
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/socious-io/gopay"
 )
@@ -15,6 +25,7 @@ func mockEtherscanResponseBody() *mockReadCloser {
 		"result": [{
 			"hash": "0xTransactionHash",
 			"from": "0xFromAddress",
+			"contractAddress": "0xTokenAddress",
 			"to": "0xToAddress",
 			"value": "1000000000000000000", 
 			"tokenName": "ETH",
@@ -58,12 +69,10 @@ func TestGetTXInfo(t *testing.T) {
 	}
 
 	// Use the mock client in the test
-	originalHTTPClient := http.DefaultClient
-	http.DefaultClient = &http.Client{Transport: mockClient}
-	defer func() { http.DefaultClient = originalHTTPClient }() // Restore the original client after the test
+	chain.HTTPClient = &http.Client{Transport: mockClient}
 
 	// Call GetTXInfo
-	result, err := chain.GetTXInfo(txHash, token)
+	result, err := chain.GetTXInfo(context.Background(), txHash, token)
 
 	// Validate results
 	if err != nil {
@@ -85,9 +94,542 @@ func TestGetTXInfo(t *testing.T) {
 	if result.To != "0xToAddress" {
 		t.Errorf("Expected To address 0xToAddress, but got %s", result.To)
 	}
+	if result.ExplorerURL != "https://etherscan.io/tx/0xTransactionHash" {
+		t.Errorf("Expected explorer URL https://etherscan.io/tx/0xTransactionHash, but got %s", result.ExplorerURL)
+	}
 	t.Log("crypto tests successfully done")
 }
 
+func TestTransactionInfoWrongRecipient(t *testing.T) {
+	chains := gopay.Chains{{
+		Name:            "Ethereum",
+		Explorer:        "https://api.etherscan.io/api",
+		ContractAddress: "0xToAddress",
+		Type:            gopay.EVM,
+		Tokens:          []gopay.CryptoToken{{Name: "Ether", Symbol: "ETH", Address: "0xTokenAddress", Decimals: 18}},
+	}}
+
+	cases := []struct {
+		recipient string
+		wantErr   bool
+	}{
+		{"0xToAddress", false},
+		{"0xTOADDRESS", false},
+		{"", false},
+		{"0xAttackerAddress", true},
+	}
+
+	for _, c := range cases {
+		chains[0].HTTPClient = &http.Client{Transport: &MockHTTPClient{
+			Response: &http.Response{StatusCode: http.StatusOK, Body: mockEtherscanResponseBody()},
+		}}
+
+		_, err := chains.TransactionInfoCtx(context.Background(), gopay.CryptoParams{
+			TxHash:           "0xTransactionHash",
+			TokenAddress:     "0xTokenAddress",
+			RecipientAddress: c.recipient,
+		})
+		if errors.Is(err, gopay.ErrWrongRecipient) != c.wantErr {
+			t.Errorf("recipient %q: expected wrong recipient error %v, but got %v", c.recipient, c.wantErr, err)
+		}
+	}
+}
+
+func TestTransactionInfoSpoofedToken(t *testing.T) {
+	usdc := gopay.CryptoToken{Name: "USD Coin", Symbol: "USDC", Address: "0xUSDC", Decimals: 6}
+	// A worthless token with many decimals sent to the platform alongside the transfers of the transaction
+	spoof := `{"hash": "0xTransactionHash", "contractAddress": "0xFake", "to": "0xPlatform", "value": "1000000000000000000000", "tokenDecimal": "18", "confirmations": "12"}`
+	transfer := func(to, value string) string {
+		return `{"hash": "0xTransactionHash", "contractAddress": "0xusdc", "to": "` + to + `", "value": "` + value + `", "tokenDecimal": "6", "confirmations": "12"}`
+	}
+
+	cases := []struct {
+		name      string
+		transfers []string
+		amount    float64
+		wrong     bool
+	}{
+		{"token sent to the platform", []string{spoof, transfer("0xOther", "5000000"), transfer("0xplatform", "10000000")}, 10, false},
+		{"token sent elsewhere", []string{transfer("0xAttacker", "10000000"), spoof}, 10, true},
+	}
+	for _, c := range cases {
+		body := `{"status": "1", "message": "OK", "result": [` + strings.Join(c.transfers, ",") + `]}`
+		chains := gopay.Chains{{
+			Name:              "Ethereum",
+			Explorer:          "https://api.etherscan.io/api",
+			ContractAddress:   "0xPlatform",
+			Type:              gopay.EVM,
+			UseDirectTXLookup: true,
+			Tokens:            []gopay.CryptoToken{usdc},
+			HTTPClient: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusOK, Body: &mockReadCloser{[]byte(body)}}, nil
+			})},
+		}}
+
+		info, err := chains.TransactionInfo(gopay.CryptoParams{TxHash: "0xTransactionHash", TokenAddress: "0xUSDC", RecipientAddress: "0xPlatform"})
+		if errors.Is(err, gopay.ErrWrongRecipient) != c.wrong {
+			t.Errorf("%s: expected wrong recipient error %v, but got %v", c.name, c.wrong, err)
+		}
+		if info == nil || info.TotalAmount != c.amount || info.Token.Symbol != "USDC" {
+			t.Errorf("%s: expected a USDC transfer of %v, but got %+v", c.name, c.amount, info)
+		}
+	}
+}
+
+func TestTransactionInfoNativeETH(t *testing.T) {
+	var queries []url.Values
+	chains := gopay.Chains{{
+		Name:              "Ethereum",
+		Explorer:          "https://api.etherscan.io/api",
+		ContractAddress:   "0xPlatform",
+		Type:              gopay.EVM,
+		UseDirectTXLookup: true,
+		Tokens:            []gopay.CryptoToken{gopay.NativeETH},
+		HTTPClient: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			queries = append(queries, req.URL.Query())
+			// Ether is transferred by the transaction itself, which lists no token contract or decimals
+			body := `{"status": "1", "message": "OK", "result": [{"hash": "0xTransactionHash", "from": "0xPayer", "to": "0xplatform",
+				"value": "1500000000000000000", "contractAddress": "", "isError": "0", "gasUsed": "21000", "gasPrice": "1000000000", "confirmations": "12"}]}`
+			return &http.Response{StatusCode: http.StatusOK, Body: &mockReadCloser{[]byte(body)}}, nil
+		})},
+	}}
+
+	token, ok := gopay.KnownToken("ETH", "ethereum")
+	if !ok {
+		t.Fatal("Expected ETH to be a known token")
+	}
+	info, err := chains.TransactionInfo(gopay.CryptoParams{TxHash: "0xTransactionHash", TokenAddress: token.Address, RecipientAddress: "0xPlatform"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if !info.Confirmed || info.TotalAmount != 1.5 || math.Abs(info.NetAmount()-1.499979) > 1e-9 {
+		t.Errorf("Expected a confirmed transfer of 1.5 ETH, but got %+v", info)
+	}
+	if len(queries) != 1 || queries[0].Get("action") != "txlist" || queries[0].Get("address") != "0xPlatform" {
+		t.Errorf("Expected the platform's transactions to be listed, but got %v", queries)
+	}
+}
+
+func TestGetTXInfoDirectLookup(t *testing.T) {
+	token := gopay.CryptoToken{Name: "Ether", Symbol: "ETH", Address: "0xTokenAddress", Decimals: 18}
+
+	cases := []struct {
+		name        string
+		direct      bool
+		unsupported bool
+		queries     []string
+	}{
+		{"address query", false, false, []string{"address=0xContract"}},
+		{"direct query", true, false, []string{"txhash=0xTransactionHash"}},
+		{"direct query fallback", true, true, []string{"txhash=0xTransactionHash", "address=0xContract"}},
+	}
+
+	for _, c := range cases {
+		var queries []string
+		client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			queries = append(queries, req.URL.RawQuery)
+			body := mockEtherscanResponseBody()
+			if c.unsupported && req.URL.Query().Get("txhash") != "" {
+				body = &mockReadCloser{[]byte(`{"status": "0", "message": "No transactions found", "result": []}`)}
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: body}, nil
+		})}
+
+		chain := gopay.Chain{
+			Name:              "Ethereum",
+			Explorer:          "https://api.etherscan.io/api",
+			ContractAddress:   "0xContract",
+			Type:              gopay.EVM,
+			UseDirectTXLookup: c.direct,
+			HTTPClient:        client,
+		}
+		result, err := chain.GetTXInfo(context.Background(), "0xTransactionHash", token)
+		if err != nil {
+			t.Errorf("%s: expected no error, but got %v", c.name, err)
+			continue
+		}
+		if result.TxHash != "0xTransactionHash" {
+			t.Errorf("%s: expected txHash 0xTransactionHash, but got %s", c.name, result.TxHash)
+		}
+		if len(queries) != len(c.queries) {
+			t.Errorf("%s: expected %d queries, but got %v", c.name, len(c.queries), queries)
+			continue
+		}
+		for i, q := range c.queries {
+			if !strings.Contains(queries[i], q) {
+				t.Errorf("%s: expected query %d to contain %s, but got %s", c.name, i, q, queries[i])
+			}
+		}
+	}
+}
+
+func TestTransactionInfoWalletAndBlockRange(t *testing.T) {
+	token := gopay.CryptoToken{Name: "Ether", Symbol: "ETH", Address: "0xTokenAddress", Decimals: 18}
+
+	var queries []url.Values
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		queries = append(queries, req.URL.Query())
+		// Only the contract address lists the transaction
+		body := &mockReadCloser{[]byte(`{"status": "1", "message": "OK", "result": [{"hash": "0xOtherHash", "confirmations": "12"}]}`)}
+		if req.URL.Query().Get("address") == "0xContract" {
+			body = mockEtherscanResponseBody()
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: body}, nil
+	})}
+
+	chains := gopay.Chains{{
+		Name:            "Ethereum",
+		Explorer:        "https://api.etherscan.io/api",
+		ContractAddress: "0xContract",
+		WalletAddress:   "0xWallet",
+		Type:            gopay.EVM,
+		Tokens:          []gopay.CryptoToken{token},
+		HTTPClient:      client,
+	}}
+	info, err := chains.TransactionInfo(gopay.CryptoParams{
+		TxHash:       "0xTransactionHash",
+		TokenAddress: "0xTokenAddress",
+		FromBlock:    "100",
+		ToBlock:      "200",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if info.TxHash != "0xTransactionHash" {
+		t.Errorf("Expected txHash 0xTransactionHash, but got %s", info.TxHash)
+	}
+
+	if len(queries) != 2 || queries[0].Get("address") != "0xWallet" || queries[1].Get("address") != "0xContract" {
+		t.Fatalf("Expected the wallet and contract to be queried, but got %v", queries)
+	}
+	for _, q := range queries {
+		if q.Get("startblock") != "100" || q.Get("endblock") != "200" {
+			t.Errorf("Expected the query to be limited to blocks 100-200, but got %v", q)
+		}
+	}
+}
+
+func TestTransactionInfoReceiptConfirmations(t *testing.T) {
+	token := gopay.CryptoToken{Name: "Tether", Symbol: "USDT", Address: "0xToken", Decimals: 6}
+
+	var actions []string
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		q := req.URL.Query()
+		actions = append(actions, q.Get("action"))
+		var body string
+		switch q.Get("action") {
+		case "tokentx":
+			// The listing lags behind and reports too few confirmations
+			body = `{"status": "1", "message": "OK", "result": [{"hash": "0xTransactionHash", "contractAddress": "0xToken", "value": "1000000", "tokenDecimal": "6", "confirmations": "3"}]}`
+		case "eth_getTransactionReceipt":
+			if q.Get("txhash") != "0xTransactionHash" {
+				t.Errorf("Expected the receipt of 0xTransactionHash, but got %v", q)
+			}
+			body = `{"jsonrpc": "2.0", "id": 1, "result": {"blockNumber": "0x100", "status": "0x1"}}`
+		case "eth_blockNumber":
+			body = `{"jsonrpc": "2.0", "id": 83, "result": "0x110"}`
+		default:
+			t.Errorf("Unexpected query %v", q)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: &mockReadCloser{[]byte(body)}}, nil
+	})}
+
+	chains := gopay.Chains{{
+		Name:                       "Ethereum",
+		Explorer:                   "https://api.etherscan.io/api",
+		ContractAddress:            "0xContract",
+		Type:                       gopay.EVM,
+		Tokens:                     []gopay.CryptoToken{token},
+		HTTPClient:                 client,
+		UseReceiptForConfirmations: true,
+	}}
+	info, err := chains.TransactionInfo(gopay.CryptoParams{TxHash: "0xTransactionHash", TokenAddress: "0xToken"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if !info.Confirmed || info.TotalAmount != 1 {
+		t.Errorf("Expected a confirmed transfer of 1, but got %+v", info)
+	}
+	if !reflect.DeepEqual(actions, []string{"tokentx", "eth_getTransactionReceipt", "eth_blockNumber"}) {
+		t.Errorf("Expected the transfer, receipt and latest block to be queried, but got %v", actions)
+	}
+}
+
+func TestPresetEVMChains(t *testing.T) {
+	token := gopay.CryptoToken{Name: "Tether", Symbol: "USDT", Address: "0xTokenAddress", Decimals: 6}
+	cases := []struct {
+		chain   gopay.Chain
+		host    string
+		chainID string
+	}{
+		{gopay.NewPolygonChain("key", "0xContract", []gopay.CryptoToken{token}), "api.polygonscan.com", "137"},
+		{gopay.NewBSCChain("key", "0xContract", []gopay.CryptoToken{token}), "api.bscscan.com", ""},
+	}
+
+	for _, c := range cases {
+		if err := c.chain.Validate(); err != nil {
+			t.Errorf("%s: expected a valid chain, but got %v", c.chain.Name, err)
+		}
+
+		var req *http.Request
+		c.chain.HTTPClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			req = r
+			return &http.Response{StatusCode: http.StatusOK, Body: mockEtherscanResponseBody()}, nil
+		})}
+		if _, err := c.chain.GetTXInfo(context.Background(), "0xTransactionHash", token); err != nil {
+			t.Errorf("%s: expected no error, but got %v", c.chain.Name, err)
+			continue
+		}
+		if req.URL.Host != c.host {
+			t.Errorf("%s: expected host %s, but got %s", c.chain.Name, c.host, req.URL.Host)
+		}
+		if got := req.URL.Query().Get("chainid"); got != c.chainID {
+			t.Errorf("%s: expected chainid %q, but got %q", c.chain.Name, c.chainID, got)
+		}
+	}
+}
+
+func TestGetTXInfoCanceled(t *testing.T) {
+	chain := gopay.Chain{
+		Name:     "Ethereum",
+		Explorer: "https://api.etherscan.io/api",
+		Type:     gopay.EVM,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := chain.GetTXInfo(ctx, "0xTransactionHash", gopay.CryptoToken{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context canceled error, but got %v", err)
+	}
+}
+
+func TestGetTXInfoRetryLogging(t *testing.T) {
+	logger := new(recordingLogger)
+	gopay.SetLogger(logger)
+	defer gopay.SetLogger(nil)
+
+	chain := gopay.Chain{
+		Name:     "Ethereum",
+		Explorer: "https://api.etherscan.io/api",
+		Type:     gopay.EVM,
+		HTTPClient: &http.Client{Transport: &MockHTTPClient{
+			Response: &http.Response{
+				StatusCode: http.StatusInternalServerError,
+				Status:     "500 Internal Server Error",
+				Body:       &mockReadCloser{},
+			},
+		}},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if _, err := chain.GetTXInfo(ctx, "0xTransactionHash", gopay.CryptoToken{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded error, but got %v", err)
+	}
+	if !logger.contains("ERROR: Attempt 1: Unexpected HTTP status: 500 Internal Server Error") {
+		t.Errorf("Expected retry to be logged, but got %v", logger.lines)
+	}
+}
+
+func TestSetLoggerWhileLogging(t *testing.T) {
+	defer gopay.SetLogger(nil)
+
+	chains := gopay.Chains{{
+		Name:     "Ethereum",
+		Explorer: "https://api.etherscan.io/api",
+		Type:     gopay.EVM,
+		Tokens:   []gopay.CryptoToken{{Name: "Ether", Symbol: "ETH", Address: "0xTokenAddress", Decimals: 18}},
+		HTTPClient: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusInternalServerError, Status: "500 Internal Server Error", Body: &mockReadCloser{}}, nil
+		})},
+	}}
+	cancel := chains.WatchTransaction(context.Background(), gopay.CryptoParams{TxHash: "0xTransactionHash", TokenAddress: "0xTokenAddress"}, time.Millisecond,
+		func(*gopay.CryptoTransactionInfo, error) {})
+	defer cancel()
+
+	// The logger can be replaced while the watch logs its attempts
+	logger := new(recordingLogger)
+	for i := 0; i < 50; i++ {
+		gopay.SetLogger(new(recordingLogger))
+		time.Sleep(time.Millisecond)
+	}
+	gopay.SetLogger(logger)
+	for deadline := time.Now().Add(5 * time.Second); !logger.contains("ERROR: Attempt 1: Unexpected HTTP status: 500 Internal Server Error"); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the watch to log through the new logger")
+		}
+	}
+}
+
+func TestChainsFindByTokenAddress(t *testing.T) {
+	chains := gopay.Chains{
+		{
+			Name: "Ethereum",
+			Type: gopay.EVM,
+			Mode: gopay.MAINNET,
+			Tokens: []gopay.CryptoToken{
+				{Name: "USD Coin", Symbol: "USDC", Address: "0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48", Decimals: 6},
+			},
+		},
+		{
+			Name: "Cardano",
+			Type: gopay.CARDANO,
+			Mode: gopay.MAINNET,
+			Tokens: []gopay.CryptoToken{
+				{Name: "USDM", Symbol: "USDM", Address: "c48cbb3d5e57ed56e276bc45f99ab39abe94e6cd7ac39fb402da47ad0014df105553444d", Decimals: 6},
+			},
+		},
+	}
+
+	c, token, ok := chains.FindByTokenAddress("0xa0b86991c6218b36c1d19d4a2e9eb0ce3606eb48")
+	if !ok {
+		t.Fatalf("Expected token to be found")
+	}
+	if c.Name != "Ethereum" || token.Symbol != "USDC" {
+		t.Errorf("Expected Ethereum USDC, but got %s %s", c.Name, token.Symbol)
+	}
+	if _, _, ok := chains.FindByTokenAddress("0xUnknown"); ok {
+		t.Errorf("Expected unknown token not to be found")
+	}
+
+	tokens := chains.SupportedTokens()
+	if len(tokens) != 2 {
+		t.Fatalf("Expected 2 supported tokens, but got %d", len(tokens))
+	}
+	if tokens[1].ChainName != "Cardano" || tokens[1].NetworkType != gopay.CARDANO || tokens[1].Token.Symbol != "USDM" {
+		t.Errorf("Unexpected token info %+v", tokens[1])
+	}
+}
+
+func TestTransactionInfoMultipleChains(t *testing.T) {
+	token := gopay.CryptoToken{Name: "Ether", Symbol: "ETH", Address: "0xTokenAddress", Decimals: 18}
+	newChain := func(name, recipient string) gopay.Chain {
+		return gopay.Chain{
+			Name:            name,
+			Explorer:        "https://api.etherscan.io/api",
+			ContractAddress: recipient,
+			Type:            gopay.EVM,
+			Tokens:          []gopay.CryptoToken{token},
+			HTTPClient: &http.Client{Transport: &MockHTTPClient{
+				Response: &http.Response{StatusCode: http.StatusOK, Body: mockEtherscanResponseBody()},
+			}},
+		}
+	}
+	chains := gopay.Chains{newChain("Ethereum", "0xOtherAddress"), newChain("Base", "0xToAddress")}
+
+	pairs := chains.FindAllByTokenAddress("0xTokenAddress")
+	if len(pairs) != 2 || pairs[0].Chain.Name != "Ethereum" || pairs[1].Chain.Name != "Base" || pairs[1].Token.Symbol != "ETH" {
+		t.Errorf("Expected the token on both chains, but got %+v", pairs)
+	}
+
+	params := gopay.CryptoParams{TxHash: "0xTransactionHash", TokenAddress: "0xTokenAddress", RecipientAddress: "0xToAddress"}
+	if _, err := chains.TransactionInfo(params); !errors.Is(err, gopay.ErrAmbiguousChain) {
+		t.Errorf("Expected ErrAmbiguousChain, but got %v", err)
+	}
+
+	params.ChainName = "Base"
+	info, err := chains.TransactionInfo(params)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if info.To != "0xToAddress" {
+		t.Errorf("Expected the transaction on Base, but got %+v", info)
+	}
+
+	params.ChainName = "Polygon"
+	if _, err := chains.TransactionInfo(params); !gopay.IsNotFound(err) {
+		t.Errorf("Expected the token not to be found on an unknown chain, but got %v", err)
+	}
+}
+
+func TestCryptoTokenValidate(t *testing.T) {
+	valid := gopay.CryptoToken{Name: "USD Coin", Symbol: "USDC", Address: "0xTokenAddress", Decimals: 6}
+
+	cases := []struct {
+		name    string
+		mutate  func(*gopay.CryptoToken)
+		wantErr bool
+	}{
+		{"valid", func(t *gopay.CryptoToken) {}, false},
+		{"native", func(t *gopay.CryptoToken) { t.Address = gopay.NativeTokenAddress }, false},
+		{"zero decimals", func(t *gopay.CryptoToken) { t.Decimals = 0 }, false},
+		{"max decimals", func(t *gopay.CryptoToken) { t.Decimals = 77 }, false},
+		{"empty name", func(t *gopay.CryptoToken) { t.Name = "" }, true},
+		{"empty symbol", func(t *gopay.CryptoToken) { t.Symbol = "" }, true},
+		{"empty address", func(t *gopay.CryptoToken) { t.Address = "" }, true},
+		{"negative decimals", func(t *gopay.CryptoToken) { t.Decimals = -1 }, true},
+		{"too many decimals", func(t *gopay.CryptoToken) { t.Decimals = 78 }, true},
+	}
+
+	for _, c := range cases {
+		token := valid
+		c.mutate(&token)
+		if err := token.Validate(); (err != nil) != c.wantErr {
+			t.Errorf("%s: expected error %v, but got %v", c.name, c.wantErr, err)
+		}
+	}
+}
+
+func TestChainValidate(t *testing.T) {
+	chain := gopay.Chain{
+		Name:     "Ethereum",
+		Explorer: "https://api.etherscan.io/api",
+		Tokens:   []gopay.CryptoToken{{Name: "USD Coin", Symbol: "USDC", Address: "0xTokenAddress", Decimals: 6}},
+	}
+	if err := chain.Validate(); err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+
+	chains := gopay.Chains{
+		chain,
+		{Name: "", Explorer: ""},
+		{Name: "Cardano", Explorer: "https://cardano-mainnet.blockfrost.io/api/v0", Tokens: []gopay.CryptoToken{{Name: "USDM", Decimals: 6}}},
+	}
+	err := chains.Validate()
+	if err == nil {
+		t.Fatalf("Expected validation error, but got nil")
+	}
+	for _, violation := range []string{
+		"chain name is required",
+		"chain : explorer is required",
+		"chain Cardano: token USDM: symbol is required",
+		"chain Cardano: token USDM: address is required",
+	} {
+		if !strings.Contains(err.Error(), violation) {
+			t.Errorf("Expected error to contain %q, but got %v", violation, err)
+		}
+	}
+}
+
+func TestChainsSupportedNetworks(t *testing.T) {
+	chains := gopay.Chains{
+		{Name: "Ethereum", Type: gopay.EVM, Mode: gopay.MAINNET, ApiKey: "secret-etherscan-key", ContractAddress: "0xContract"},
+		{Name: "Sepolia", Type: gopay.EVM, Mode: gopay.TESTNET, ApiKey: "secret-sepolia-key"},
+		{Name: "Cardano", Type: gopay.CARDANO, Mode: gopay.MAINNET, ApiKey: "secret-blockfrost-key"},
+	}
+
+	networks := chains.SupportedNetworks()
+	if len(networks) != 3 {
+		t.Fatalf("Expected 3 networks, but got %d", len(networks))
+	}
+	data, err := json.Marshal(networks)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if strings.Contains(string(data), "secret") || strings.Contains(string(data), "0xContract") {
+		t.Errorf("Expected credentials to be omitted, but got %s", data)
+	}
+
+	if mainnet := chains.FilterByMode(gopay.MAINNET); len(mainnet) != 2 || mainnet[0].Name != "Ethereum" || mainnet[1].Name != "Cardano" {
+		t.Errorf("Unexpected mainnet chains %v", mainnet)
+	}
+	if evmTestnet := chains.FilterByType(gopay.EVM).FilterByMode(gopay.TESTNET); len(evmTestnet) != 1 || evmTestnet[0].Name != "Sepolia" {
+		t.Errorf("Unexpected EVM testnet chains %v", evmTestnet)
+	}
+}
+
 func TestCardanoTXInfo(t *testing.T) {
 	// Setup
 	chain := gopay.Chain{
@@ -107,10 +649,521 @@ func TestCardanoTXInfo(t *testing.T) {
 		Decimals: 6,
 	}
 	// Call GetTXInfo
-	_, err := chain.GetTXInfo(txHash, token)
+	_, err := chain.GetTXInfo(context.Background(), txHash, token)
 
 	if err != nil {
 		t.Error(err)
 	}
 
 }
+
+func TestChainsBuildIndex(t *testing.T) {
+	chains := gopay.Chains{
+		{Name: "Ethereum", Type: gopay.EVM},
+		{Name: "Cardano", Type: gopay.CARDANO},
+	}
+
+	index, err := chains.BuildIndex()
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if c, ok := index.FindByName("Cardano"); !ok || c.Type != gopay.CARDANO {
+		t.Errorf("Expected Cardano chain to be indexed, but got %v", c)
+	}
+	if c, ok := chains.FindByName("Ethereum"); !ok || c.Type != gopay.EVM {
+		t.Errorf("Expected Ethereum chain to be found, but got %v", c)
+	}
+	if _, ok := chains.FindByName("Solana"); ok {
+		t.Errorf("Expected Solana chain not to be found")
+	}
+
+	chains = append(chains, gopay.Chain{Name: "Ethereum"})
+	if _, err := chains.BuildIndex(); err == nil {
+		t.Errorf("Expected duplicate chain name error, but got nil")
+	}
+}
+
+func TestCardanoTXInfoMultipleOutputs(t *testing.T) {
+	const (
+		sender    = "addr1sender"
+		recipient = "addr1recipient"
+		unit      = "c48cbb3d5e57ed56e276bc45f99ab39abe94e6cd7ac39fb402da47ad0014df105553444d"
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/txs/0xCardanoTx":
+			w.Write([]byte(`{"hash": "0xCardanoTx", "block": "block1"}`))
+		case "/txs/0xCardanoTx/utxos":
+			w.Write([]byte(`{"hash": "0xCardanoTx",
+				"inputs": [{"address": "` + sender + `", "amount": [{"unit": "` + unit + `", "quantity": "35000000"}]}],
+				"outputs": [
+					{"address": "` + sender + `", "amount": [{"unit": "lovelace", "quantity": "1000000"}, {"unit": "` + unit + `", "quantity": "20000000"}]},
+					{"address": "` + recipient + `", "amount": [{"unit": "lovelace", "quantity": "1500000"}, {"unit": "` + unit + `", "quantity": "10000000"}]},
+					{"address": "` + recipient + `", "amount": [{"unit": "lovelace", "quantity": "1500000"}, {"unit": "` + unit + `", "quantity": "5000000"}]}
+				]}`))
+		case "/blocks/block1":
+			w.Write([]byte(`{"hash": "block1", "time": 1700000000}`))
+		case "/txs/0xCardanoTx/metadata":
+			w.Write([]byte(`[]`))
+		default:
+			t.Errorf("Unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	token := gopay.CryptoToken{Name: "USDM", Symbol: "USDM", Address: unit, Decimals: 6}
+	chains := gopay.Chains{{
+		Name:     "Cardano",
+		Explorer: server.URL,
+		ApiKey:   "mainnetKey",
+		Type:     gopay.CARDANO,
+		Tokens:   []gopay.CryptoToken{token},
+	}}
+
+	cases := []struct {
+		name      string
+		recipient string
+		to        string
+		total     float64
+		err       error
+	}{
+		{"recipient outputs", recipient, recipient, 15, nil},
+		{"no recipient skips change", "", recipient, 15, nil},
+		{"unknown recipient", "addr1other", recipient, 15, gopay.ErrWrongRecipient},
+	}
+	for _, c := range cases {
+		info, err := chains.TransactionInfo(gopay.CryptoParams{TxHash: "0xCardanoTx", TokenAddress: unit, RecipientAddress: c.recipient})
+		if !errors.Is(err, c.err) {
+			t.Errorf("%s: expected error %v, but got %v", c.name, c.err, err)
+		}
+		if info == nil {
+			continue
+		}
+		if info.To != c.to {
+			t.Errorf("%s: expected recipient %s, but got %s", c.name, c.to, info.To)
+		}
+		if info.TotalAmount != c.total {
+			t.Errorf("%s: expected total %v, but got %v", c.name, c.total, info.TotalAmount)
+		}
+		if info.From != sender {
+			t.Errorf("%s: expected sender %s, but got %s", c.name, sender, info.From)
+		}
+	}
+}
+
+func TestCardanoTXInfoMetadata(t *testing.T) {
+	const unit = "c48cbb3d5e57ed56e276bc45f99ab39abe94e6cd7ac39fb402da47ad0014df105553444d"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/txs/0xCardanoTx":
+			w.Write([]byte(`{"hash": "0xCardanoTx", "block": "block1"}`))
+		case "/txs/0xCardanoTx/utxos":
+			w.Write([]byte(`{"hash": "0xCardanoTx",
+				"inputs": [{"address": "addr1sender", "amount": [{"unit": "` + unit + `", "quantity": "10000000"}]}],
+				"outputs": [{"address": "addr1recipient", "amount": [{"unit": "` + unit + `", "quantity": "10000000"}]}]}`))
+		case "/blocks/block1":
+			w.Write([]byte(`{"hash": "block1", "time": 1700000000}`))
+		case "/txs/0xCardanoTx/metadata":
+			w.Write([]byte(`[
+				{"label": "674", "json_metadata": {"msg": ["payment", "ref-123"]}},
+				{"label": "1967", "json_metadata": {"hash": "abc"}}
+			]`))
+		default:
+			t.Errorf("Unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	chains := gopay.Chains{{
+		Name:     "Cardano",
+		Explorer: server.URL,
+		ApiKey:   "mainnetKey",
+		Type:     gopay.CARDANO,
+		Tokens:   []gopay.CryptoToken{{Name: "USDM", Symbol: "USDM", Address: unit, Decimals: 6}},
+	}}
+
+	info, err := chains.TransactionInfo(gopay.CryptoParams{TxHash: "0xCardanoTx", TokenAddress: unit})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if info.Message != "payment\nref-123" {
+		t.Errorf("Expected the CIP-20 message, but got %q", info.Message)
+	}
+	if len(info.Metadata) != 2 || info.Metadata["1967"] == nil {
+		t.Errorf("Expected the full metadata by label, but got %v", info.Metadata)
+	}
+}
+
+func TestCryptoTransactionParties(t *testing.T) {
+	const unit = "c48cbb3d5e57ed56e276bc45f99ab39abe94e6cd7ac39fb402da47ad0014df105553444d"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/txs/0xCardanoTx":
+			w.Write([]byte(`{"hash": "0xCardanoTx", "block": "block1"}`))
+		case "/txs/0xCardanoTx/utxos":
+			w.Write([]byte(`{"hash": "0xCardanoTx",
+				"inputs": [
+					{"address": "addr1fee", "amount": [{"unit": "lovelace", "quantity": "2000000"}]},
+					{"address": "addr1payer", "amount": [{"unit": "lovelace", "quantity": "1500000"}, {"unit": "` + unit + `", "quantity": "10000000"}]},
+					{"address": "addr1payer", "amount": [{"unit": "lovelace", "quantity": "1500000"}]},
+					{"address": "addr1collateral", "amount": [{"unit": "lovelace", "quantity": "9000000"}], "collateral": true}
+				],
+				"outputs": [
+					{"address": "addr1change", "amount": [{"unit": "lovelace", "quantity": "3000000"}]},
+					{"address": "addr1recipient", "amount": [{"unit": "lovelace", "quantity": "1500000"}, {"unit": "` + unit + `", "quantity": "10000000"}]}
+				]}`))
+		case "/blocks/block1":
+			w.Write([]byte(`{"hash": "block1", "time": 1700000000}`))
+		case "/txs/0xCardanoTx/metadata":
+			w.Write([]byte(`[]`))
+		default:
+			t.Errorf("Unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	chains := gopay.Chains{{
+		Name:     "Cardano",
+		Explorer: server.URL,
+		ApiKey:   "mainnetKey",
+		Type:     gopay.CARDANO,
+		Tokens:   []gopay.CryptoToken{{Name: "USDM", Symbol: "USDM", Address: unit, Decimals: 6}},
+	}}
+	info, err := chains.TransactionInfo(gopay.CryptoParams{TxHash: "0xCardanoTx", TokenAddress: unit, RecipientAddress: "addr1recipient"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if info.NetworkType != gopay.CARDANO {
+		t.Errorf("Expected the network type to be set, but got %q", info.NetworkType)
+	}
+	// addr1fee is the first input, but addr1payer spends the most lovelace across its inputs
+	if info.From != "addr1fee" || info.Sender() != "addr1payer" {
+		t.Errorf("Expected sender addr1payer, but got %s (from %s)", info.Sender(), info.From)
+	}
+	if info.Receiver() != "addr1recipient" {
+		t.Errorf("Expected receiver addr1recipient, but got %s", info.Receiver())
+	}
+	for address, incoming := range map[string]bool{"addr1recipient": true, "ADDR1CHANGE": true, "addr1payer": false, "": false} {
+		if got := info.IsIncoming(address); got != incoming {
+			t.Errorf("%q: expected incoming %v, but got %v", address, incoming, got)
+		}
+	}
+
+	evm := gopay.CryptoTransactionInfo{NetworkType: gopay.EVM, From: "0xAbC", To: "0xDeF"}
+	if evm.Sender() != "0xabc" || evm.Receiver() != "0xdef" {
+		t.Errorf("Expected lowercased EVM addresses, but got %s and %s", evm.Sender(), evm.Receiver())
+	}
+	if !evm.IsIncoming("0xDEF") || evm.IsIncoming("0xAbC") {
+		t.Errorf("Expected only the recipient to match case-insensitively")
+	}
+}
+
+func TestChainsHealthCheck(t *testing.T) {
+	evmClient := func(body string) *http.Client {
+		return &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			if q := req.URL.Query(); q.Get("module") != "proxy" || q.Get("action") != "eth_blockNumber" {
+				t.Errorf("Unexpected EVM health query %v", q)
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: &mockReadCloser{[]byte(body)}}, nil
+		})}
+	}
+
+	cardano := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			t.Errorf("Unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"is_healthy": true}`))
+	}))
+	defer cardano.Close()
+
+	chains := gopay.Chains{
+		{Name: "Ethereum", Explorer: "https://api.etherscan.io/api", Type: gopay.EVM, HTTPClient: evmClient(`{"jsonrpc": "2.0", "id": 83, "result": "0x10d4f"}`)},
+		{Name: "BSC", Explorer: "https://api.bscscan.com/api", Type: gopay.EVM, HTTPClient: evmClient(`{"status": "0", "message": "NOTOK", "result": "Invalid API Key"}`)},
+		{Name: "Cardano", Explorer: cardano.URL, ApiKey: "mainnetKey", Type: gopay.CARDANO},
+	}
+
+	results := chains.HealthCheck(context.Background())
+	if len(results) != 3 {
+		t.Fatalf("Expected a result for each chain, but got %v", results)
+	}
+	if err := results["Ethereum"]; err != nil {
+		t.Errorf("Expected Ethereum to be healthy, but got %v", err)
+	}
+	if err := results["Cardano"]; err != nil {
+		t.Errorf("Expected Cardano to be healthy, but got %v", err)
+	}
+	if err := results["BSC"]; !errors.Is(err, gopay.ErrAPIUnreachable) || !strings.Contains(err.Error(), "Invalid API Key") {
+		t.Errorf("Expected BSC to be unreachable, but got %v", err)
+	}
+}
+
+func TestGetTokenBalance(t *testing.T) {
+	const unit = "c48cbb3d5e57ed56e276bc45f99ab39abe94e6cd7ac39fb402da47ad0014df105553444d"
+	var evmQuery url.Values
+	evmClient := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		evmQuery = req.URL.Query()
+		result := `"2500000"`
+		if evmQuery.Get("action") == "balance" {
+			result = `"1500000000000000000"`
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: &mockReadCloser{[]byte(`{"status": "1", "message": "OK", "result": ` + result + `}`)}}, nil
+	})}
+
+	cardano := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/addresses/addr1wallet" {
+			t.Errorf("Unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"address": "addr1wallet", "amount": [
+			{"unit": "lovelace", "quantity": "3000000"},
+			{"unit": "` + unit + `", "quantity": "42500000"}
+		]}`))
+	}))
+	defer cardano.Close()
+
+	usdc := gopay.CryptoToken{Name: "USD Coin", Symbol: "USDC", Address: "0xToken", Decimals: 6}
+	usdm := gopay.CryptoToken{Name: "USDM", Symbol: "USDM", Address: unit, Decimals: 6}
+	ada := gopay.CryptoToken{Name: "Ada", Symbol: "ADA", Address: gopay.NativeTokenAddress, Decimals: 6}
+	chains := gopay.Chains{
+		{Name: "Ethereum", Explorer: "https://api.etherscan.io/api", Type: gopay.EVM, Tokens: []gopay.CryptoToken{usdc}, HTTPClient: evmClient},
+		{Name: "Cardano", Explorer: cardano.URL, ApiKey: "mainnetKey", Type: gopay.CARDANO, Tokens: []gopay.CryptoToken{usdm}},
+	}
+
+	balance, err := chains.GetTokenBalance("0xWallet", "0xToken")
+	if err != nil || balance != 2.5 {
+		t.Errorf("Expected EVM balance 2.5, but got %v (%v)", balance, err)
+	}
+	if evmQuery.Get("action") != "tokenbalance" || evmQuery.Get("contractaddress") != "0xToken" || evmQuery.Get("address") != "0xWallet" {
+		t.Errorf("Unexpected EVM balance query %v", evmQuery)
+	}
+
+	eth := gopay.Chain{Name: "Ethereum", Explorer: "https://api.etherscan.io/api", Type: gopay.EVM, HTTPClient: evmClient}
+	if balance, err := eth.GetTokenBalance("0xWallet", gopay.NativeETH); err != nil || balance != 1.5 {
+		t.Errorf("Expected native balance 1.5, but got %v (%v)", balance, err)
+	}
+
+	if balance, err := chains.GetTokenBalance("addr1wallet", unit); err != nil || balance != 42.5 {
+		t.Errorf("Expected Cardano balance 42.5, but got %v (%v)", balance, err)
+	}
+	if balance, err := chains[1].GetTokenBalance("addr1wallet", ada); err != nil || balance != 3 {
+		t.Errorf("Expected ADA balance 3, but got %v (%v)", balance, err)
+	}
+
+	if _, err := chains.GetTokenBalance("0xWallet", "0xUnknown"); err == nil {
+		t.Error("Expected an error for an unknown token, but got nil")
+	}
+}
+
+func TestCryptoTransactionInfoNetAmount(t *testing.T) {
+	eth := gopay.CryptoToken{Name: "Ether", Symbol: "ETH", Address: gopay.NativeTokenAddress, Decimals: 18}
+	ada := gopay.CryptoToken{Name: "Cardano", Symbol: "ADA", Address: gopay.NativeTokenAddress, Decimals: 6}
+	usdc := gopay.CryptoToken{Name: "USD Coin", Symbol: "USDC", Address: "0xTokenAddress", Decimals: 6}
+
+	var cardanoMeta gopay.CardanoTokenTransferResponse
+	cardanoMeta.Info.Fees = "170000"
+
+	tests := []struct {
+		name string
+		info gopay.CryptoTransactionInfo
+		want float64
+	}{
+		{
+			name: "token transfer",
+			info: gopay.CryptoTransactionInfo{TotalAmount: 10, Token: usdc, Meta: &gopay.EvmTokenTransferResponse{GasUsed: "21000", GasPrice: "1000000000"}},
+			want: 10,
+		},
+		{
+			name: "native EVM transfer",
+			info: gopay.CryptoTransactionInfo{TotalAmount: 1, Token: eth, Meta: &gopay.EvmTokenTransferResponse{GasUsed: "21000", GasPrice: "1000000000"}},
+			want: 1 - 0.000021,
+		},
+		{
+			name: "native Cardano transfer",
+			info: gopay.CryptoTransactionInfo{TotalAmount: 5, Token: ada, Meta: cardanoMeta},
+			want: 5 - 0.17,
+		},
+		{
+			name: "missing fee data",
+			info: gopay.CryptoTransactionInfo{TotalAmount: 1, Token: eth, Meta: &gopay.EvmTokenTransferResponse{}},
+			want: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		if got := tt.info.NetAmount(); math.Abs(got-tt.want) > 1e-12 {
+			t.Errorf("%s: Expected net amount %v, but got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestWatchTransaction(t *testing.T) {
+	token := gopay.CryptoToken{Name: "Ether", Symbol: "ETH", Address: "0xTokenAddress", Decimals: 18}
+	chains := gopay.Chains{{
+		Name:            "Ethereum",
+		Explorer:        "https://api.etherscan.io/api",
+		ContractAddress: "0xContract",
+		Type:            gopay.EVM,
+		Tokens:          []gopay.CryptoToken{token},
+		HTTPClient: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Body: mockEtherscanResponseBody()}, nil
+		})},
+	}}
+
+	found := make(chan *gopay.CryptoTransactionInfo, 1)
+	chains.WatchTransaction(context.Background(), gopay.CryptoParams{TxHash: "0xTransactionHash", TokenAddress: "0xTokenAddress"}, time.Millisecond,
+		func(info *gopay.CryptoTransactionInfo, err error) {
+			if err != nil {
+				t.Errorf("Expected no error, but got %v", err)
+			}
+			found <- info
+		})
+	select {
+	case info := <-found:
+		if info == nil || info.TxHash != "0xTransactionHash" {
+			t.Errorf("Expected transaction 0xTransactionHash, but got %v", info)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the transaction to be reported")
+	}
+
+	failed := make(chan error, 1)
+	chains.WatchTransaction(context.Background(), gopay.CryptoParams{TxHash: "0xTransactionHash", TokenAddress: "0xUnknown"}, time.Millisecond,
+		func(info *gopay.CryptoTransactionInfo, err error) { failed <- err })
+	select {
+	case err := <-failed:
+		if !gopay.IsNotFound(err) {
+			t.Errorf("Expected an unknown token error, but got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the permanent failure to be reported")
+	}
+}
+
+func TestWatchTransactionUnconfirmed(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	chains := gopay.Chains{{
+		Name:     "Ethereum",
+		Explorer: "https://api.etherscan.io/api",
+		Type:     gopay.EVM,
+		Tokens:   []gopay.CryptoToken{{Name: "Ether", Symbol: "ETH", Address: "0xTokenAddress", Decimals: 18}},
+		HTTPClient: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			requests++
+			if requests < 3 {
+				body := strings.Replace(string(mockEtherscanResponseBody().data), `"confirmations": "12"`, `"confirmations": "3"`, 1)
+				return &http.Response{StatusCode: http.StatusOK, Body: &mockReadCloser{[]byte(body)}}, nil
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: mockEtherscanResponseBody()}, nil
+		})},
+	}}
+
+	start := time.Now()
+	found := make(chan *gopay.CryptoTransactionInfo, 1)
+	chains.WatchTransaction(context.Background(), gopay.CryptoParams{TxHash: "0xTransactionHash", TokenAddress: "0xTokenAddress"}, 10*time.Millisecond,
+		func(info *gopay.CryptoTransactionInfo, err error) {
+			if err != nil {
+				t.Errorf("Expected no error, but got %v", err)
+			}
+			found <- info
+		})
+	select {
+	case info := <-found:
+		if info == nil || !info.Confirmed {
+			t.Errorf("Expected a confirmed transaction, but got %v", info)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the transaction to be reported once confirmed")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 3 {
+		t.Errorf("Expected one explorer query per attempt, but got %d queries", requests)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("Expected attempts to be interval apart, but the watch took %v", elapsed)
+	}
+}
+
+func TestWatchTransactionCancel(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	chains := gopay.Chains{{
+		Name:     "Ethereum",
+		Explorer: "https://api.etherscan.io/api",
+		Type:     gopay.EVM,
+		Tokens:   []gopay.CryptoToken{{Name: "Ether", Symbol: "ETH", Address: "0xTokenAddress", Decimals: 18}},
+		HTTPClient: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			mu.Lock()
+			requests++
+			mu.Unlock()
+			return &http.Response{StatusCode: http.StatusInternalServerError, Status: "500 Internal Server Error", Body: &mockReadCloser{}}, nil
+		})},
+	}}
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+
+	called := make(chan struct{}, 1)
+	cancel := chains.WatchTransaction(context.Background(), gopay.CryptoParams{TxHash: "0xTransactionHash", TokenAddress: "0xTokenAddress"}, time.Millisecond,
+		func(*gopay.CryptoTransactionInfo, error) { called <- struct{}{} })
+
+	for deadline := time.Now().Add(5 * time.Second); count() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the explorer to be polled")
+		}
+	}
+	cancel()
+
+	time.Sleep(50 * time.Millisecond)
+	stopped := count()
+	time.Sleep(1500 * time.Millisecond)
+	if count() != stopped {
+		t.Errorf("Expected polling to stop after cancel, but got %d more requests", count()-stopped)
+	}
+	select {
+	case <-called:
+		t.Error("Expected the callback not to be called after cancel")
+	default:
+	}
+}
+
+func TestChainExplorerURLs(t *testing.T) {
+	cases := []struct {
+		chain   gopay.Chain
+		tx      string
+		address string
+	}{
+		{gopay.Chain{Type: gopay.EVM, Mode: gopay.MAINNET}, "https://etherscan.io/tx/0xHash", "https://etherscan.io/address/0xWallet"},
+		{gopay.Chain{Type: gopay.EVM, Mode: gopay.TESTNET}, "https://sepolia.etherscan.io/tx/0xHash", "https://sepolia.etherscan.io/address/0xWallet"},
+		{gopay.NewPolygonChain("key", "0xContract", nil), "https://polygonscan.com/tx/0xHash", "https://polygonscan.com/address/0xWallet"},
+		{gopay.NewBSCChain("key", "0xContract", nil), "https://bscscan.com/tx/0xHash", "https://bscscan.com/address/0xWallet"},
+		{gopay.Chain{Type: gopay.CARDANO, Mode: gopay.MAINNET}, "https://cardanoscan.io/transaction/0xHash", "https://cardanoscan.io/address/0xWallet"},
+		{gopay.Chain{Type: gopay.EVM, ExplorerWebURL: "https://explorer.example.com/"}, "https://explorer.example.com/tx/0xHash", "https://explorer.example.com/address/0xWallet"},
+		{gopay.Chain{Type: gopay.EVM, ExplorerType: "unknown"}, "", ""},
+	}
+
+	for _, c := range cases {
+		if got := c.chain.TransactionURL("0xHash"); got != c.tx {
+			t.Errorf("Expected transaction URL %q, but got %q", c.tx, got)
+		}
+		if got := c.chain.AddressURL("0xWallet"); got != c.address {
+			t.Errorf("Expected address URL %q, but got %q", c.address, got)
+		}
+	}
+}
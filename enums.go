@@ -1,6 +1,10 @@
 package gopay
 
-import "fmt"
+import (
+	"math"
+	"strconv"
+	"strings"
+)
 
 // TransactionType represents the type of transaction (Deposit or Payout).
 type TransactionType string
@@ -23,6 +27,9 @@ type TransactionStatus string
 // PaymentType represents the type of payment (Fiat or Crypto).
 type PaymentType string
 
+// ExplorerType identifies the flavour of Etherscan-compatible API an EVM chain's explorer exposes.
+type ExplorerType string
+
 // FiatService defines the payment service used for Fiat transactions (e.g., STRIPE).
 type FiatService string
 
@@ -34,8 +41,9 @@ const (
 
 // Constants for transaction types.
 const (
-	DEPOSIT TransactionType = "DEPOSIT" // Type of transaction where funds are deposited.
-	PAYOUT  TransactionType = "PAYOUT"  // Type of transaction where funds are paid out.
+	DEPOSIT        TransactionType = "DEPOSIT"        // Type of transaction where funds are deposited.
+	PAYOUT         TransactionType = "PAYOUT"         // Type of transaction where funds are paid out.
+	PARTIAL_REFUND TransactionType = "PARTIAL_REFUND" // Type of transaction where part of the deposit is refunded.
 )
 
 // Constants for network types.
@@ -50,28 +58,124 @@ const (
 	TESTNET NetworkMode = "TESTNET" // Testnet mode of operation.
 )
 
+// Constants for EVM explorer types.
+const (
+	ETHERSCAN   ExplorerType = "etherscan"   // Etherscan API (default).
+	POLYGONSCAN ExplorerType = "polygonscan" // Polygonscan API, which expects a chain ID.
+	BSCSCAN     ExplorerType = "bscscan"     // BscScan API, identical to Etherscan.
+)
+
 // Constants for currencies.
 const (
 	USD Currency = "USD" // US Dollar currency.
 	JPY Currency = "JPY" // Japanese Yen currency.
+	EUR Currency = "EUR" // Euro currency.
+	GBP Currency = "GBP" // British Pound currency.
 )
 
+// DecimalPlaces returns the number of digits after the decimal point of the currency's minor unit, per ISO 4217.
+// Unknown currencies default to 2.
+func (c Currency) DecimalPlaces() int {
+	switch c {
+	case USD, EUR, GBP:
+		return 2
+	case JPY:
+		return 0
+	default:
+		return 2
+	}
+}
+
+// Symbol returns the currency's symbol, e.g., "$" for USD, or its code for unknown currencies.
+func (c Currency) Symbol() string {
+	switch c {
+	case USD:
+		return "$"
+	case JPY:
+		return "¥"
+	case EUR:
+		return "€"
+	case GBP:
+		return "£"
+	default:
+		return string(c)
+	}
+}
+
+// FormatAmount formats the amount for display with the currency's symbol, decimal places and thousands
+// separators, e.g., "$1,250.50" or "¥1,250". Unknown currencies are formatted with their code, e.g., "12.50 CHF".
+func (c Currency) FormatAmount(amount float64) string {
+	decimals := c.DecimalPlaces()
+
+	// Only keep the sign of amounts that do not round to zero
+	sign := ""
+	if math.Round(amount*math.Pow10(decimals)) < 0 {
+		sign = "-"
+	}
+
+	whole, fraction, _ := strings.Cut(strconv.FormatFloat(math.Abs(amount), 'f', decimals, 64), ".")
+	var number strings.Builder
+	for i, digit := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			number.WriteByte(',')
+		}
+		number.WriteRune(digit)
+	}
+	if fraction != "" {
+		number.WriteString("." + fraction)
+	}
+
+	switch c {
+	case USD, JPY, EUR, GBP:
+		return sign + c.Symbol() + number.String()
+	default:
+		return sign + number.String() + " " + string(c)
+	}
+}
+
 // Constants for payment status.
 const (
-	INITIATED       PaymentStatus = "INITIATED"       // Payment has been initiated.
-	PENDING_DEPOSIT PaymentStatus = "PENDING_DEPOSIT" // Payment is awaiting deposit.
-	DEPOSITED       PaymentStatus = "DEPOSITED"       // Payment has been deposited.
-	ON_HOLD         PaymentStatus = "ON_HOLD"         // Payment is on hold.
-	PAID_OUT        PaymentStatus = "PAID_OUT"        // Payment has been paid out.
-	CANCLED         PaymentStatus = "CANCELED"        // Payment has been canceled.
-	REFUNDED        PaymentStatus = "REFUNDED"        // Payment has been refunded.
+	INITIATED        PaymentStatus = "INITIATED"       // Payment has been initiated.
+	PENDING_DEPOSIT  PaymentStatus = "PENDING_DEPOSIT" // Payment is awaiting deposit.
+	DEPOSITED        PaymentStatus = "DEPOSITED"       // Payment has been deposited.
+	ON_HOLD          PaymentStatus = "ON_HOLD"         // Payment is on hold.
+	AUTHORIZED       PaymentStatus = "AUTHORIZED"      // Payment has been authorized and awaits capture.
+	PAID_OUT         PaymentStatus = "PAID_OUT"        // Payment has been paid out.
+	CANCLED          PaymentStatus = "CANCELED"        // Payment has been canceled.
+	REFUNDED         PaymentStatus = "REFUNDED"        // Payment has been refunded.
+	PAYMENT_DISPUTED PaymentStatus = "DISPUTED"        // Payment is frozen by a dispute until it is resolved.
 )
 
+// terminalStatuses lists the final payment statuses, see PaymentStatus.IsTerminal.
+var terminalStatuses = []PaymentStatus{PAID_OUT, CANCLED, REFUNDED}
+
+// IsTerminal reports whether the payment has reached a final status and can no longer change.
+func (s PaymentStatus) IsTerminal() bool {
+	for _, status := range terminalStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// IsActive reports whether the payment is still in progress, i.e., it has a known status that is not terminal.
+func (s PaymentStatus) IsActive() bool {
+	switch s {
+	case INITIATED, PENDING_DEPOSIT, ON_HOLD, AUTHORIZED, DEPOSITED, PAYMENT_DISPUTED:
+		return true
+	default:
+		return false
+	}
+}
+
 // Constants for transaction status.
 const (
-	CANCELED        TransactionStatus = "CANCELED" // Transaction has been canceled.
-	VERIFIED        TransactionStatus = "VERIFIED" // Transaction has been verified.
-	ACTION_REQUIRED TransactionStatus = "ACTION_REQUIRED"
+	PENDING         TransactionStatus = "PENDING"         // Transaction has been submitted but not yet confirmed.
+	CANCELED        TransactionStatus = "CANCELED"        // Transaction has been canceled.
+	VERIFIED        TransactionStatus = "VERIFIED"        // Transaction has been verified.
+	ACTION_REQUIRED TransactionStatus = "ACTION_REQUIRED" // Transaction awaits customer action (e.g., 3D Secure).
+	DISPUTED        TransactionStatus = "DISPUTED"        // Transaction has been disputed (e.g., a chargeback).
 )
 
 // Constants for fiat services.
@@ -88,7 +192,7 @@ func scanEnum(value interface{}, target interface{}) error {
 	case string:
 		*target.(*string) = v // Assign string value.
 	default:
-		return fmt.Errorf("failed to scan type: %v", value) // Error on unsupported type.
+		return newError(ErrCodeDB, nil, "failed to scan type: %v", value) // Error on unsupported type.
 	}
 	return nil
 }
@@ -108,6 +212,15 @@ func (c *NetworkMode) Scan(value interface{}) error {
 	return scanEnum(value, (*string)(c)) // Calls scanEnum to handle the scanning process.
 }
 
+// Valid reports whether the currency is one of the supported currencies.
+func (c Currency) Valid() bool {
+	switch c {
+	case USD, JPY, EUR, GBP:
+		return true
+	}
+	return false
+}
+
 // Scan method for the Currency type. It scans a value and stores it as a Currency.
 func (c *Currency) Scan(value interface{}) error {
 	return scanEnum(value, (*string)(c)) // Calls scanEnum to handle the scanning process.
@@ -0,0 +1,69 @@
+package gopay_test
+
+import (
+	"testing"
+
+	"github.com/socious-io/gopay"
+)
+
+func TestCurrencyFormatting(t *testing.T) {
+	tests := []struct {
+		currency gopay.Currency
+		decimals int
+		symbol   string
+		amount   float64
+		expected string
+	}{
+		{gopay.USD, 2, "$", 12.5, "$12.50"},
+		{gopay.USD, 2, "$", 1234567.891, "$1,234,567.89"},
+		{gopay.USD, 2, "$", -1250, "-$1,250.00"},
+		{gopay.USD, 2, "$", -0.001, "$0.00"},
+		{gopay.JPY, 0, "¥", 1250, "¥1,250"},
+		{gopay.EUR, 2, "€", 999.999, "€1,000.00"},
+		{gopay.GBP, 2, "£", 100, "£100.00"},
+		{gopay.Currency("CHF"), 2, "CHF", 12.5, "12.50 CHF"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.currency.DecimalPlaces(); got != tt.decimals {
+			t.Errorf("Expected %s to have %d decimal places, but got %d", tt.currency, tt.decimals, got)
+		}
+		if got := tt.currency.Symbol(); got != tt.symbol {
+			t.Errorf("Expected %s symbol %q, but got %q", tt.currency, tt.symbol, got)
+		}
+		if got := tt.currency.FormatAmount(tt.amount); got != tt.expected {
+			t.Errorf("Expected %s %v to be formatted as %q, but got %q", tt.currency, tt.amount, tt.expected, got)
+		}
+	}
+}
+
+func TestPaymentStatusStates(t *testing.T) {
+	tests := []struct {
+		status   gopay.PaymentStatus
+		terminal bool
+		active   bool
+	}{
+		{gopay.INITIATED, false, true},
+		{gopay.PENDING_DEPOSIT, false, true},
+		{gopay.ON_HOLD, false, true},
+		{gopay.AUTHORIZED, false, true},
+		{gopay.DEPOSITED, false, true},
+		{gopay.PAID_OUT, true, false},
+		{gopay.CANCLED, true, false},
+		{gopay.REFUNDED, true, false},
+		{gopay.PAYMENT_DISPUTED, false, true},
+		{gopay.PaymentStatus("UNKNOWN"), false, false},
+	}
+	for _, tt := range tests {
+		if got := tt.status.IsTerminal(); got != tt.terminal {
+			t.Errorf("%s: expected terminal %v, but got %v", tt.status, tt.terminal, got)
+		}
+		if got := tt.status.IsActive(); got != tt.active {
+			t.Errorf("%s: expected active %v, but got %v", tt.status, tt.active, got)
+		}
+		p := &gopay.Payment{Status: tt.status}
+		if p.IsTerminal() != tt.terminal || p.IsActive() != tt.active {
+			t.Errorf("%s: expected the payment helpers to match the status", tt.status)
+		}
+	}
+}
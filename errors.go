@@ -0,0 +1,137 @@
+package gopay
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrorCode classifies the errors returned by the package, e.g., to map them to HTTP status codes.
+type ErrorCode string
+
+const (
+	ErrCodeNotFound        ErrorCode = "not_found"        // A payment, transaction, service or token does not exist.
+	ErrCodeDuplicate       ErrorCode = "duplicate"        // A unique value (e.g., a payment's unique reference) is already taken.
+	ErrCodeConflict        ErrorCode = "conflict"         // The resource is being processed concurrently.
+	ErrCodeInvalidStatus   ErrorCode = "invalid_status"   // The operation is not allowed in the current status or mode.
+	ErrCodeExternalService ErrorCode = "external_service" // A payment gateway or blockchain explorer failed.
+	ErrCodeValidation      ErrorCode = "validation"       // The input or configuration is invalid.
+	ErrCodeDB              ErrorCode = "db"               // A database query failed.
+)
+
+// ErrCodes describes every ErrorCode by its value, e.g., to document the errors of an API built on the package.
+var ErrCodes = map[string]string{
+	string(ErrCodeNotFound):        "The specified payment, transaction, service or token does not exist",
+	string(ErrCodeDuplicate):       "A unique value, such as a payment's unique reference, is already taken",
+	string(ErrCodeConflict):        "The resource is being processed concurrently, retry later",
+	string(ErrCodeInvalidStatus):   "The operation is not allowed in the current status or mode of the resource",
+	string(ErrCodeExternalService): "A payment gateway or blockchain explorer failed or could not be reached",
+	string(ErrCodeValidation):      "The input or configuration is invalid",
+	string(ErrCodeDB):              "A database query failed",
+}
+
+// Error is the error type returned by the package. Use errors.As to extract its Code.
+type Error struct {
+	Code    ErrorCode // Category of the error.
+	Message string    // Description of what failed.
+	Cause   error     // Underlying error, if any.
+}
+
+// Error returns the message followed by the cause, if any.
+func (e *Error) Error() string {
+	switch {
+	case e.Cause == nil:
+		return e.Message
+	case e.Message == "":
+		return e.Cause.Error()
+	default:
+		return fmt.Sprintf("%s: %v", e.Message, e.Cause)
+	}
+}
+
+// Unwrap returns the underlying cause so it can be matched with errors.Is and errors.As.
+func (e *Error) Unwrap() error {
+	return e.Cause
+}
+
+// newError creates an *Error with the given code and cause, formatting its message like fmt.Sprintf.
+func newError(code ErrorCode, cause error, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...), Cause: cause}
+}
+
+// validationError joins the given violations into a single ErrCodeValidation error, or returns nil if there are none.
+func validationError(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return &Error{Code: ErrCodeValidation, Cause: errors.Join(errs...)}
+}
+
+// ErrorCodeOf returns the code of the first *Error in err's chain, or an empty code if there is none.
+func ErrorCodeOf(err error) ErrorCode {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ""
+}
+
+// IsNotFound reports whether err means that the requested resource does not exist, including
+// sql.ErrNoRows returned by the Fetch functions.
+func IsNotFound(err error) bool {
+	return ErrorCodeOf(err) == ErrCodeNotFound || errors.Is(err, sql.ErrNoRows)
+}
+
+// IsConflict reports whether err is caused by a duplicate unique value or concurrent processing.
+func IsConflict(err error) bool {
+	code := ErrorCodeOf(err)
+	return code == ErrCodeDuplicate || code == ErrCodeConflict
+}
+
+// ErrorFromCode returns an *Error with the given code and its description from ErrCodes as the message,
+// or nil if the code is unknown.
+func ErrorFromCode(code string) *Error {
+	description, ok := ErrCodes[code]
+	if !ok {
+		return nil
+	}
+	return &Error{Code: ErrorCode(code), Message: description}
+}
+
+// GenerateErrorSchema returns a JSON Schema "definitions" block describing the error codes in ErrCodes and the
+// error object carrying them, to be embedded in an OpenAPI spec.
+func GenerateErrorSchema() string {
+	codes := make([]string, 0, len(ErrCodes))
+	for code := range ErrCodes {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	values := make([]map[string]string, len(codes))
+	for i, code := range codes {
+		values[i] = map[string]string{"const": code, "description": ErrCodes[code]}
+	}
+	schema := map[string]interface{}{
+		"definitions": map[string]interface{}{
+			"ErrorCode": map[string]interface{}{
+				"type":        "string",
+				"description": "Category of the error",
+				"enum":        codes,
+				"oneOf":       values,
+			},
+			"Error": map[string]interface{}{
+				"type":     "object",
+				"required": []string{"code", "message"},
+				"properties": map[string]interface{}{
+					"code":    map[string]string{"$ref": "#/definitions/ErrorCode"},
+					"message": map[string]string{"type": "string", "description": "Description of what failed"},
+				},
+			},
+		},
+	}
+	// The schema only holds strings, slices and maps, so marshaling cannot fail
+	b, _ := json.MarshalIndent(schema, "", "  ")
+	return string(b)
+}
@@ -0,0 +1,149 @@
+package gopay_test
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/socious-io/gopay"
+	"github.com/socious-io/gopay/testutil"
+)
+
+func TestErrorCodes(t *testing.T) {
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error": {"type": "api_error", "message": "boom"}}`))
+	})
+	fiats := gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}
+	serviceName := "stripe"
+
+	_, newErr := gopay.New(gopay.PaymentParams{})
+	_, exportErr := (&gopay.Payment{}).Export("xml")
+	_, tokenErr := gopay.Chains{}.TransactionInfo(gopay.CryptoParams{TxHash: "0xTransactionHash", TokenAddress: "0xUnknown"})
+	_, _, serviceErr := fiats.ListCustomers("unknown", 10, "")
+	_, _, stripeErr := fiats.ListCustomers("stripe", 10, "")
+
+	cases := []struct {
+		name string
+		err  error
+		code gopay.ErrorCode
+	}{
+		{"invalid params", newErr, gopay.ErrCodeValidation},
+		{"invalid config", gopay.Config{}.Validate(), gopay.ErrCodeValidation},
+		{"unsupported export format", exportErr, gopay.ErrCodeValidation},
+		{"unallocated amount", (&gopay.Payment{TotalAmount: 100, Type: gopay.FIAT, FiatServiceName: &serviceName}).ValidateForDeposit(), gopay.ErrCodeValidation},
+		{"fiat service not set", (&gopay.Payment{Type: gopay.FIAT}).ConfirmPayment("pi_123"), gopay.ErrCodeInvalidStatus},
+		{"not deposited", (&gopay.Payment{Status: gopay.INITIATED}).MarkPaidOut(), gopay.ErrCodeInvalidStatus},
+		{"unknown token", tokenErr, gopay.ErrCodeNotFound},
+		{"unknown service", serviceErr, gopay.ErrCodeNotFound},
+		{"gateway failure", stripeErr, gopay.ErrCodeExternalService},
+		{"locked", gopay.ErrPaymentLocked, gopay.ErrCodeConflict},
+		{"unique reference conflict", &gopay.PaymentConflictError{Existing: &gopay.Payment{}}, gopay.ErrCodeDuplicate},
+	}
+
+	for _, c := range cases {
+		var gerr *gopay.Error
+		if !errors.As(c.err, &gerr) {
+			t.Errorf("%s: Expected a *gopay.Error, but got %v", c.name, c.err)
+			continue
+		}
+		if gerr.Code != c.code {
+			t.Errorf("%s: Expected code %s, but got %s (%v)", c.name, c.code, gerr.Code, c.err)
+		}
+	}
+}
+
+func TestErrorHelpers(t *testing.T) {
+	cause := errors.New("connection reset")
+	err := &gopay.Error{Code: gopay.ErrCodeDB, Message: "failed to update payment", Cause: cause}
+	if err.Error() != "failed to update payment: connection reset" {
+		t.Errorf("Expected message to include the cause, but got %q", err.Error())
+	}
+	if !errors.Is(err, cause) {
+		t.Errorf("Expected the error to unwrap to its cause")
+	}
+
+	if !gopay.IsNotFound(fmt.Errorf("fetch: %w", sql.ErrNoRows)) {
+		t.Errorf("Expected sql.ErrNoRows to be reported as not found")
+	}
+	if !gopay.IsNotFound(&gopay.Error{Code: gopay.ErrCodeNotFound}) {
+		t.Errorf("Expected ErrCodeNotFound to be reported as not found")
+	}
+	if gopay.IsNotFound(err) {
+		t.Errorf("Expected a DB error not to be reported as not found")
+	}
+
+	if !gopay.IsConflict(fmt.Errorf("deposit: %w", gopay.ErrPaymentLocked)) {
+		t.Errorf("Expected ErrPaymentLocked to be reported as a conflict")
+	}
+	if !gopay.IsConflict(&gopay.PaymentConflictError{Existing: &gopay.Payment{}}) {
+		t.Errorf("Expected PaymentConflictError to be reported as a conflict")
+	}
+	if gopay.IsConflict(err) {
+		t.Errorf("Expected a DB error not to be reported as a conflict")
+	}
+}
+
+func TestErrCodes(t *testing.T) {
+	// Collect the ErrorCode constants from the source so that new codes cannot be left undocumented
+	file, err := parser.ParseFile(token.NewFileSet(), "errors.go", nil, 0)
+	if err != nil {
+		t.Fatalf("Failed to parse errors.go: %v", err)
+	}
+	var codes []string
+	ast.Inspect(file, func(n ast.Node) bool {
+		spec, ok := n.(*ast.ValueSpec)
+		if !ok {
+			return true
+		}
+		if ident, ok := spec.Type.(*ast.Ident); !ok || ident.Name != "ErrorCode" {
+			return true
+		}
+		for _, v := range spec.Values {
+			if lit, ok := v.(*ast.BasicLit); ok {
+				code, _ := strconv.Unquote(lit.Value)
+				codes = append(codes, code)
+			}
+		}
+		return true
+	})
+	if len(codes) == 0 {
+		t.Fatalf("Expected to find the ErrorCode constants in errors.go")
+	}
+	if len(codes) != len(gopay.ErrCodes) {
+		t.Errorf("Expected %d documented codes, but got %d", len(codes), len(gopay.ErrCodes))
+	}
+
+	for _, code := range codes {
+		if gopay.ErrCodes[code] == "" {
+			t.Errorf("Expected code %q to be documented in ErrCodes", code)
+		}
+		if err := gopay.ErrorFromCode(code); err == nil || string(err.Code) != code || err.Message != gopay.ErrCodes[code] {
+			t.Errorf("Expected ErrorFromCode to return code %q with its description, but got %v", code, err)
+		}
+	}
+	if err := gopay.ErrorFromCode("unknown"); err != nil {
+		t.Errorf("Expected nil for an unknown code, but got %v", err)
+	}
+
+	var schema struct {
+		Definitions struct {
+			ErrorCode struct {
+				Enum []string `json:"enum"`
+			} `json:"ErrorCode"`
+		} `json:"definitions"`
+	}
+	if err := json.Unmarshal([]byte(gopay.GenerateErrorSchema()), &schema); err != nil {
+		t.Fatalf("Expected a valid JSON schema, but got %v", err)
+	}
+	if len(schema.Definitions.ErrorCode.Enum) != len(codes) {
+		t.Errorf("Expected the schema to list %d codes, but got %v", len(codes), schema.Definitions.ErrorCode.Enum)
+	}
+}
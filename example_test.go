@@ -0,0 +1,33 @@
+package gopay_test
+
+import (
+	"log"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/socious-io/gopay"
+)
+
+func ExampleSetup() {
+	var db *sqlx.DB // e.g., sqlx.Connect("postgres", dsn)
+
+	err := gopay.Setup(
+		gopay.WithDB(db),
+		gopay.WithPrefix("myapp"),
+		gopay.WithFiats(gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}),
+		gopay.WithChains(gopay.Chains{gopay.NewPolygonChain("polygonscan-key", "0xWallet", []gopay.CryptoToken{gopay.USDCPolygon})}),
+		gopay.WithWebhookSecrets(map[string]string{"stripe": "whsec_..."}),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func ExampleNewConfig() {
+	var db *sqlx.DB // e.g., sqlx.Connect("postgres", dsn)
+
+	cfg := gopay.NewConfig(gopay.WithDB(db), gopay.WithPrefix("myapp"))
+	cfg.Logger = gopay.DefaultLogger{}
+	if err := gopay.SetupWithConfig(cfg); err != nil {
+		log.Fatal(err)
+	}
+}
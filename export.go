@@ -0,0 +1,99 @@
+package gopay
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ErrUnsupportedExportFormat is returned when exporting payments to a format other than "json" or "csv".
+var ErrUnsupportedExportFormat = &Error{Code: ErrCodeValidation, Message: "unsupported export format"}
+
+// Export formats supported by Payment.Export and ExportPayments.
+const (
+	ExportJSON = "json"
+	ExportCSV  = "csv"
+)
+
+// exportCSVHeader lists the columns of CSV exports, one row per transaction.
+var exportCSVHeader = []string{
+	"id", "tag", "currency", "total_amount", "status",
+	"transaction_id", "transaction_type", "transaction_amount", "transaction_fee", "identity_account", "verified_at",
+}
+
+// Export serializes the payment for reporting, see ExportPayments.
+func (p *Payment) Export(format string) ([]byte, error) {
+	if format == ExportJSON {
+		return json.Marshal(p)
+	}
+	return ExportPayments([]Payment{*p}, format)
+}
+
+// ExportPayments serializes payments for reporting. The "json" format marshals the payments with their loaded
+// identities and transactions, while "csv" writes one row per transaction with the payment fields repeated,
+// or a single row without transaction fields for payments that have none.
+// It returns ErrUnsupportedExportFormat for any other format.
+func ExportPayments(payments []Payment, format string) ([]byte, error) {
+	switch format {
+	case ExportJSON:
+		return json.Marshal(payments)
+	case ExportCSV:
+		return exportCSV(payments)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedExportFormat, format)
+	}
+}
+
+// exportCSV writes the payments as CSV rows with exportCSVHeader columns.
+func exportCSV(payments []Payment) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.Write(exportCSVHeader); err != nil {
+		return nil, err
+	}
+
+	for _, p := range payments {
+		paymentFields := []string{
+			p.ID.String(), p.Tag, string(p.Currency), formatAmount(p.TotalAmount), string(p.Status),
+		}
+		if len(p.Transactions) == 0 {
+			if err := w.Write(append(paymentFields, make([]string, len(exportCSVHeader)-len(paymentFields))...)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// Resolve the account of each transaction's identity
+		accounts := make(map[string]string, len(p.Identities))
+		for _, i := range p.Identities {
+			accounts[i.IdentityID.String()] = i.Account
+		}
+
+		for _, t := range p.Transactions {
+			var verifiedAt string
+			if t.VerfiedAt != nil {
+				verifiedAt = t.VerfiedAt.UTC().Format(time.RFC3339)
+			}
+			row := append(append([]string{}, paymentFields...),
+				t.ID.String(), string(t.Type), formatAmount(t.Amount), formatAmount(t.Fee), accounts[t.IdentityID.String()], verifiedAt,
+			)
+			if err := w.Write(row); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// formatAmount formats an amount without trailing zeros or exponent notation.
+func formatAmount(amount float64) string {
+	return strconv.FormatFloat(amount, 'f', -1, 64)
+}
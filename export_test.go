@@ -0,0 +1,86 @@
+package gopay_test
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/socious-io/gopay"
+)
+
+func exportFixture() gopay.Payment {
+	identityID := uuid.New()
+	verifiedAt := time.Date(2025, 8, 1, 12, 0, 0, 0, time.UTC)
+	return gopay.Payment{
+		ID:          uuid.New(),
+		Tag:         "order",
+		Currency:    gopay.USD,
+		TotalAmount: 100.5,
+		Status:      gopay.DEPOSITED,
+		Identities:  []gopay.PaymentIdentity{{IdentityID: identityID, Account: "acct_123", AllocatedAmount: 100.5}},
+		Transactions: []gopay.Transaction{
+			{ID: uuid.New(), IdentityID: identityID, Type: gopay.DEPOSIT, Amount: 100.5, Fee: 2.5, VerfiedAt: &verifiedAt},
+			{ID: uuid.New(), IdentityID: identityID, Type: gopay.PARTIAL_REFUND, Amount: 10},
+		},
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	p := exportFixture()
+	data, err := p.Export(gopay.ExportCSV)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	rows, err := csv.NewReader(strings.NewReader(string(data))).ReadAll()
+	if err != nil {
+		t.Fatalf("Expected valid CSV, but got %v", err)
+	}
+	header := "id,tag,currency,total_amount,status,transaction_id,transaction_type,transaction_amount,transaction_fee,identity_account,verified_at"
+	if strings.Join(rows[0], ",") != header {
+		t.Errorf("Expected header %s, but got %s", header, strings.Join(rows[0], ","))
+	}
+	if len(rows) != 3 {
+		t.Fatalf("Expected a row per transaction, but got %d rows", len(rows)-1)
+	}
+	want := []string{p.ID.String(), "order", "USD", "100.5", "DEPOSITED", p.Transactions[0].ID.String(), "DEPOSIT", "100.5", "2.5", "acct_123", "2025-08-01T12:00:00Z"}
+	if strings.Join(rows[1], ",") != strings.Join(want, ",") {
+		t.Errorf("Expected row %v, but got %v", want, rows[1])
+	}
+	if rows[2][10] != "" {
+		t.Errorf("Expected an empty verified_at for unverified transactions, but got %s", rows[2][10])
+	}
+
+	data, err = gopay.ExportPayments([]gopay.Payment{{Tag: "empty"}}, gopay.ExportCSV)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if rows, _ := csv.NewReader(strings.NewReader(string(data))).ReadAll(); len(rows) != 2 || rows[1][1] != "empty" {
+		t.Errorf("Expected a single row for a payment without transactions, but got %v", rows)
+	}
+}
+
+func TestExportJSON(t *testing.T) {
+	payments := []gopay.Payment{exportFixture(), exportFixture()}
+	data, err := gopay.ExportPayments(payments, gopay.ExportJSON)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	var decoded []gopay.Payment
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Expected valid JSON, but got %v", err)
+	}
+	if len(decoded) != 2 || decoded[0].ID != payments[0].ID || len(decoded[0].Transactions) != 2 ||
+		decoded[0].Identities[0].Account != "acct_123" || decoded[0].Transactions[0].Fee != 2.5 {
+		t.Errorf("Expected payments to round-trip, but got %+v", decoded)
+	}
+
+	if _, err := payments[0].Export("xml"); !errors.Is(err, gopay.ErrUnsupportedExportFormat) {
+		t.Errorf("Expected ErrUnsupportedExportFormat, but got %v", err)
+	}
+}
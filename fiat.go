@@ -1,24 +1,48 @@
 package gopay
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/stripe/stripe-go/v81"
 	"github.com/stripe/stripe-go/v81/account"
 	"github.com/stripe/stripe-go/v81/accountlink"
+	"github.com/stripe/stripe-go/v81/balance"
+	"github.com/stripe/stripe-go/v81/balancetransaction"
+	"github.com/stripe/stripe-go/v81/bankaccount"
+	portalconfiguration "github.com/stripe/stripe-go/v81/billingportal/configuration"
+	portalsession "github.com/stripe/stripe-go/v81/billingportal/session"
 	"github.com/stripe/stripe-go/v81/customer"
+	"github.com/stripe/stripe-go/v81/dispute"
+	"github.com/stripe/stripe-go/v81/ephemeralkey"
+	"github.com/stripe/stripe-go/v81/invoice"
+	"github.com/stripe/stripe-go/v81/invoiceitem"
 	"github.com/stripe/stripe-go/v81/paymentintent"
+	"github.com/stripe/stripe-go/v81/paymentlink"
 	"github.com/stripe/stripe-go/v81/paymentmethod"
+	"github.com/stripe/stripe-go/v81/payout"
+	"github.com/stripe/stripe-go/v81/price"
+	"github.com/stripe/stripe-go/v81/refund"
+	"github.com/stripe/stripe-go/v81/setupintent"
+	"github.com/stripe/stripe-go/v81/transfer"
 )
 
-// Fiats represents a slice of Fiat payment services.
+// ErrFiatServiceUnreachable is returned, wrapping the underlying error, when a fiat service cannot be reached or
+// rejects its API key; see Fiat.HealthCheck.
+var ErrFiatServiceUnreachable = &Error{Code: ErrCodeExternalService, Message: "fiat service is unreachable"}
+
+// Fiats represents a slice of Fiat payment services. Its methods look the service up by scanning the slice;
+// the services configured by Setup are looked up through their FiatIndex instead.
 type Fiats []Fiat
 
 // Fiat represents a single fiat payment service provider such as Stripe.
 type Fiat struct {
-	Name     string      `mapstructure:"name"`     // The name of the payment service provider (e.g., "STRIPE").
+	Name     string      `mapstructure:"name"`     // The unique name of the configured service (e.g., "STRIPE"), stored as the payment's fiat_service_name.
 	ApiKey   string      `mapstructure:"apikey"`   // The API key used to authenticate requests to the payment service.
 	Callback string      `mapstructure:"callback"` // The API key used to authenticate requests to the payment service.
 	Service  FiatService `mapstructure:"service"`  // The specific fiat service type (e.g., STRIPE).
@@ -30,274 +54,2138 @@ type Transfer struct {
 	Destination string  // The destination account for the transfer.
 }
 
+// MultiTransfer is one of the transfers splitting a payment between several connected accounts.
+type MultiTransfer struct {
+	Amount      float64 // The amount to transfer.
+	Destination string  // The destination account for the transfer.
+	Description string  // A description of the transfer (optional).
+}
+
 // FiatTransactionInfo holds information about a fiat transaction.
 type FiatTransactionInfo struct {
 	TXID           string      `json:"tx_id"`        // Transaction ID from payment gateway.
-	TotalAmount    int64       `json:"total_amount"` // Total transaction amount in minor units (e.g., cents).
+	TotalAmount    float64     `json:"total_amount"` // Total transaction amount in the currency's units (e.g., dollars, not cents).
 	Currency       string      `json:"currency"`     // The currency used for the transaction.
 	Meta           interface{} `json:"meta"`         // Metadata or additional information about the transaction.
 	Date           time.Time   `json:"date"`         // The date the transaction was created.
 	Confirmed      bool        `json:"confirmed"`    // Whether the payment has been confirmed.
 	RequiresAction bool        `json:"requires_action"`
 	ClientSecret   string      `json:"client_secret"`
+	TransferIDs    []string    `json:"transfer_ids,omitempty"` // Transfers made after the payment to all but the first of FiatParams.Transfers.
+	RefundedAmount float64     `json:"refunded_amount"`        // Amount refunded from the charge so far, in the currency's units.
+	ChargeID       string      `json:"charge_id,omitempty"`    // ID of the charge made by the payment, if any.
+}
+
+// FiatParams contains parameters necessary for initiating a fiat transaction.
+type FiatParams struct {
+	ServiceName string            // The name of the service provider (e.g., "STRIPE").
+	Customer    string            // Customer ID on the payment provider's system.
+	Description string            // A description of the payment.
+	Amount      float64           // The amount to be paid.
+	Currency    Currency          // The currency for the payment (e.g., USD, JPY).
+	Transfer    *Transfer         // Information about a transfer (optional).
+	Transfers   []MultiTransfer   // Transfers splitting the payment between several accounts (optional); takes precedence over Transfer.
+	Metadata    map[string]string // Key-value data attached to the payment, returned in webhook events.
+}
+
+// transfers returns the transfers of the payment, Transfer being a single transfer.
+func (params FiatParams) transfers() []MultiTransfer {
+	if len(params.Transfers) > 0 {
+		return params.Transfers
+	}
+	if params.Transfer != nil {
+		return []MultiTransfer{{Amount: params.Transfer.Amount, Destination: params.Transfer.Destination}}
+	}
+	return nil
+}
+
+// FiatPaymentConfirmParams contains parameters necessary for confirming a fiat transaction.
+type FiatPaymentConfirmParams struct {
+	ServiceName     string // The name of the service provider (e.g., "STRIPE").
+	PaymentIntentID string
+}
+
+// FiatRefundParams contains parameters necessary for refunding a fiat transaction.
+type FiatRefundParams struct {
+	ServiceName     string   // The name of the service provider (e.g., "STRIPE").
+	PaymentIntentID string   // The payment intent to refund.
+	Amount          float64  // The amount to be refunded.
+	Currency        Currency // The currency of the refunded payment (e.g., USD, JPY).
+	Reason          string   // The reason for the refund.
+}
+
+// InvoiceParams contains parameters necessary for issuing an invoice to a customer.
+type InvoiceParams struct {
+	ServiceName string            // The name of the service provider (e.g., "STRIPE").
+	CustomerID  string            // Customer ID on the payment provider's system.
+	Description string            // A description of the invoiced goods or services.
+	Amount      float64           // The amount to be invoiced.
+	Currency    Currency          // The currency for the invoice (e.g., USD, JPY).
+	DueDate     time.Time         // The date by which the invoice must be paid.
+	Metadata    map[string]string // Additional key-value data attached to the invoice.
+}
+
+// InvoicePayParams contains parameters necessary for paying an issued invoice.
+type InvoicePayParams struct {
+	ServiceName string // The name of the service provider (e.g., "STRIPE").
+	InvoiceID   string // Invoice ID on the payment provider's system.
+}
+
+// PaymentLinkParams contains parameters necessary for creating a hosted payment link.
+type PaymentLinkParams struct {
+	Amount        float64           // The amount to be paid.
+	Currency      Currency          // The currency for the payment (e.g., USD, JPY).
+	Description   string            // A description of the payment, shown to the customer.
+	CustomerEmail string            // The email of the customer the link is intended for (optional).
+	SuccessURL    string            // The URL the customer is redirected to after paying (optional).
+	Metadata      map[string]string // Additional key-value data attached to the payment link.
+}
+
+// OnboardingStatus describes how far a connected account has progressed through onboarding.
+type OnboardingStatus struct {
+	ChargesEnabled   bool     `json:"charges_enabled"`   // Whether the account can accept charges.
+	PayoutsEnabled   bool     `json:"payouts_enabled"`   // Whether the account can receive payouts.
+	DetailsSubmitted bool     `json:"details_submitted"` // Whether the account holder has submitted their details.
+	Requirements     []string `json:"requirements"`      // Requirements currently due before onboarding is complete.
+}
+
+// ConnectedAccountDetails is the part of a connected account needed to manage it, decoupled from the Stripe SDK.
+type ConnectedAccountDetails struct {
+	ID               string   `json:"id"`
+	Email            string   `json:"email"`
+	Country          string   `json:"country"`
+	BusinessType     string   `json:"business_type"` // e.g., "individual" or "company"; empty until provided.
+	ChargesEnabled   bool     `json:"charges_enabled"`
+	PayoutsEnabled   bool     `json:"payouts_enabled"`
+	DetailsSubmitted bool     `json:"details_submitted"`
+	Requirements     []string `json:"requirements"` // Requirements currently due, as in OnboardingStatus.
+	DefaultCurrency  string   `json:"default_currency"`
+}
+
+// PortalFeatures selects what customers can do in the self-service customer portal.
+type PortalFeatures struct {
+	PaymentMethodUpdate bool     // Allow customers to add, remove and change their saved cards.
+	InvoiceHistory      bool     // Show the customer's invoice history.
+	CustomerUpdate      []string // Customer details they may edit (e.g., "email", "address"); disabled when empty.
+	SubscriptionCancel  bool     // Allow customers to cancel their subscriptions.
+	DefaultReturnURL    string   // The URL customers return to when a session has no return URL (optional).
+}
+
+// DisputeEvidence holds the evidence submitted to contest a dispute (chargeback). Empty fields are left unchanged.
+// Documentation fields expect the ID of a file uploaded to the payment service.
+type DisputeEvidence struct {
+	CustomerName           string // Name of the customer.
+	CustomerEmailAddress   string // Email address of the customer.
+	CustomerPurchaseIP     string // IP address the customer purchased from.
+	BillingAddress         string // Billing address provided by the customer.
+	ProductDescription     string // Description of the product or service sold.
+	ServiceDate            string // Date the service was provided.
+	ShippingAddress        string // Address the product was shipped to.
+	ShippingCarrier        string // Carrier that shipped the product.
+	ShippingDate           string // Date the product was shipped.
+	ShippingTrackingNumber string // Tracking number of the shipment.
+	RefundPolicyDisclosure string // How the refund policy was shown to the customer.
+	CancellationRebuttal   string // Why the customer is not entitled to a cancellation.
+	CustomerCommunication  string // File with communication with the customer.
+	Receipt                string // File with the receipt sent to the customer.
+	UncategorizedText      string // Any additional evidence or statements.
+	Submit                 bool   // Submit the evidence to the bank now, rather than staging it.
+}
+
+// stripeParams converts the evidence to Stripe dispute update params.
+func (e DisputeEvidence) stripeParams() *stripe.DisputeParams {
+	optional := func(value string) *string {
+		if value == "" {
+			return nil
+		}
+		return stripe.String(value)
+	}
+	return &stripe.DisputeParams{
+		Evidence: &stripe.DisputeEvidenceParams{
+			CustomerName:           optional(e.CustomerName),
+			CustomerEmailAddress:   optional(e.CustomerEmailAddress),
+			CustomerPurchaseIP:     optional(e.CustomerPurchaseIP),
+			BillingAddress:         optional(e.BillingAddress),
+			ProductDescription:     optional(e.ProductDescription),
+			ServiceDate:            optional(e.ServiceDate),
+			ShippingAddress:        optional(e.ShippingAddress),
+			ShippingCarrier:        optional(e.ShippingCarrier),
+			ShippingDate:           optional(e.ShippingDate),
+			ShippingTrackingNumber: optional(e.ShippingTrackingNumber),
+			RefundPolicyDisclosure: optional(e.RefundPolicyDisclosure),
+			CancellationRebuttal:   optional(e.CancellationRebuttal),
+			CustomerCommunication:  optional(e.CustomerCommunication),
+			Receipt:                optional(e.Receipt),
+			UncategorizedText:      optional(e.UncategorizedText),
+		},
+		Submit: stripe.Bool(e.Submit),
+	}
+}
+
+// StripeTransferListParams filters the transfers returned by Fiat.ListTransfers.
+type StripeTransferListParams struct {
+	Destination   *string // Only return transfers to this connected account (optional).
+	Limit         int64   // Maximum number of transfers to return; all matching transfers when zero.
+	CreatedAfter  *int64  // Only return transfers created at or after this Unix timestamp (optional).
+	CreatedBefore *int64  // Only return transfers created at or before this Unix timestamp (optional).
+}
+
+type FiatPaymentConfirmInfo struct {
+	PaymentIntent  *stripe.PaymentIntent `json:"payment_intent"`
+	IsConfirmed    bool                  `json:"is_confirmed"`
+	IsAuthorized   bool                  `json:"is_authorized"`       // Whether the funds are held for a manual capture rather than charged.
+	Amount         int64                 `json:"amount"`              // Amount of the payment intent in the currency's smallest unit (e.g., cents).
+	AmountRefunded int64                 `json:"amount_refunded"`     // Amount refunded from its latest charge in the currency's smallest unit.
+	ChargeID       string                `json:"charge_id,omitempty"` // ID of its latest charge, if any.
+}
+
+// FiatIndex maps fiat service names to their configuration for constant-time lookup.
+type FiatIndex map[string]*Fiat
+
+// Validate checks that the fiat service is fully configured.
+func (f Fiat) Validate() error {
+	var errs []error
+	if f.Name == "" {
+		errs = append(errs, fmt.Errorf("fiat service name is required"))
+	}
+	if f.ApiKey == "" {
+		errs = append(errs, fmt.Errorf("fiat service %s: api key is required", f.Name))
+	}
+	return validationError(errs)
+}
+
+// Validate checks every fiat service and rejects duplicate names, returning an error listing all violations.
+func (fiats Fiats) Validate() error {
+	var errs []error
+	names := make(map[string]struct{}, len(fiats))
+	for _, f := range fiats {
+		if err := f.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+		if _, exists := names[f.Name]; exists {
+			errs = append(errs, fmt.Errorf("duplicate fiat service name %s", f.Name))
+		}
+		names[f.Name] = struct{}{}
+	}
+	return validationError(errs)
+}
+
+// FindByName returns the fiat service configured under the given name.
+func (fiats Fiats) FindByName(name string) (*Fiat, bool) {
+	for i := range fiats {
+		if fiats[i].Name == name {
+			return &fiats[i], true
+		}
+	}
+	return nil, false
+}
+
+// BuildIndex builds a name-keyed index of the fiat services. It returns an error if two services share the same name.
+func (fiats Fiats) BuildIndex() (FiatIndex, error) {
+	index := make(FiatIndex, len(fiats))
+	for i := range fiats {
+		if _, exists := index[fiats[i].Name]; exists {
+			return nil, newError(ErrCodeDuplicate, nil, "duplicate fiat service name %s", fiats[i].Name)
+		}
+		index[fiats[i].Name] = &fiats[i]
+	}
+	return index, nil
+}
+
+// HealthCheck verifies all fiat services concurrently and returns the result of each, keyed by service name;
+// a nil error means the service is healthy.
+func (fiats Fiats) HealthCheck(ctx context.Context) map[string]error {
+	results := make(map[string]error, len(fiats))
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, f := range fiats {
+		wg.Add(1)
+		go func(f Fiat) {
+			defer wg.Done()
+			err := f.HealthCheck(ctx)
+			mu.Lock()
+			defer mu.Unlock()
+			results[f.Name] = err
+		}(f)
+	}
+	wg.Wait()
+	return results
+}
+
+// Pay attempts to pay the specified service using the provided parameters.
+func (fiats Fiats) Pay(params FiatParams) (*FiatTransactionInfo, error) {
+	f, ok := fiats.FindByName(params.ServiceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", params.ServiceName)
+	}
+	return f.pay(params)
+}
+
+// Authorize authorizes a payment on the specified service without capturing it.
+func (fiats Fiats) Authorize(params FiatParams) (*FiatTransactionInfo, error) {
+	f, ok := fiats.FindByName(params.ServiceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", params.ServiceName)
+	}
+	return f.authorize(params)
+}
+
+// Capture captures an authorized payment on the specified service; see Fiat.StripeCapture for the amount.
+func (fiats Fiats) Capture(serviceName, paymentIntentID string, amount int64) error {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	return f.capture(paymentIntentID, amount)
+}
+
+// CreateSplitTransfers transfers parts of a succeeded payment to connected accounts on the specified service.
+func (fiats Fiats) CreateSplitTransfers(serviceName, paymentIntentID string, currency Currency, transfers []MultiTransfer) ([]string, error) {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	return f.createSplitTransfers(paymentIntentID, currency, transfers)
+}
+
+// ConfirmPayment confirms a payment on the specified service using the provided parameters.
+func (fiats Fiats) ConfirmPayment(params FiatPaymentConfirmParams) (*FiatPaymentConfirmInfo, error) {
+	f, ok := fiats.FindByName(params.ServiceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", params.ServiceName)
+	}
+	return f.confirmPayment(params)
+}
+
+// CancelPaymentIntent cancels a payment intent on the specified service.
+func (fiats Fiats) CancelPaymentIntent(serviceName, intentID string) error {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	return f.cancelPaymentIntent(intentID)
+}
+
+// CreateInvoice issues an invoice on the specified service using the provided parameters.
+func (fiats Fiats) CreateInvoice(params InvoiceParams) (*stripe.Invoice, error) {
+	f, ok := fiats.FindByName(params.ServiceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", params.ServiceName)
+	}
+	switch f.Service {
+	// TODO: add new invoice services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		return f.StripeCreateInvoice(params)
+	}
+}
+
+// FinalizeInvoice finalizes a draft invoice on the specified service so it can be paid.
+func (fiats Fiats) FinalizeInvoice(params InvoicePayParams) (*stripe.Invoice, error) {
+	f, ok := fiats.FindByName(params.ServiceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", params.ServiceName)
+	}
+	switch f.Service {
+	// TODO: add new invoice services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		return f.StripeFinalizeInvoice(params.InvoiceID)
+	}
+}
+
+// PayInvoice pays an issued invoice on the specified service and returns the resulting transaction info.
+func (fiats Fiats) PayInvoice(params InvoicePayParams) (*FiatTransactionInfo, error) {
+	f, ok := fiats.FindByName(params.ServiceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", params.ServiceName)
+	}
+
+	var (
+		inv *stripe.Invoice
+		err error
+	)
+	switch f.Service {
+	// TODO: add new invoice services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		inv, err = f.StripePayInvoice(params.InvoiceID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	total, err := FromStripeAmount(inv.AmountPaid, Currency(strings.ToUpper(string(inv.Currency))))
+	if err != nil {
+		// The invoice has been paid at this point, so report it without its amount
+		config.logger().Errorf("invoice %s: %v", inv.ID, err)
+	}
+	info := &FiatTransactionInfo{
+		TotalAmount: total,
+		Date:        time.Now(),
+		Currency:    string(inv.Currency),
+		Meta:        inv,
+		Confirmed:   inv.Status == stripe.InvoiceStatusPaid,
+	}
+	if inv.PaymentIntent != nil {
+		info.TXID = inv.PaymentIntent.ID
+	}
+	return info, nil
+}
+
+// Refund refunds the provided amount on the specified service.
+func (fiats Fiats) Refund(params FiatRefundParams) (*FiatTransactionInfo, error) {
+	f, ok := fiats.FindByName(params.ServiceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", params.ServiceName)
+	}
+	return f.refund(params)
+}
+
+// GetAccountOnboardingStatus returns the onboarding status of a connected account on the specified service.
+func (fiats Fiats) GetAccountOnboardingStatus(serviceName, accountID string) (OnboardingStatus, error) {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return OnboardingStatus{}, newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	return f.GetAccountOnboardingStatus(accountID)
+}
+
+// GetConnectedAccountDetails returns the details of a connected account on the specified service.
+func (fiats Fiats) GetConnectedAccountDetails(serviceName, accountID string) (*ConnectedAccountDetails, error) {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	return f.GetConnectedAccountDetails(accountID)
+}
+
+// UpdateConnectedAccount updates the email and business URL of a connected account on the specified service.
+func (fiats Fiats) UpdateConnectedAccount(serviceName, accountID, email, businessURL string) error {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	return f.UpdateConnectedAccount(accountID, email, businessURL)
+}
+
+// CreatePaymentLink creates a hosted payment link for a one-off amount on the specified service.
+// The link's URL is the page to share with the customer.
+func (fiats Fiats) CreatePaymentLink(serviceName string, params PaymentLinkParams) (*stripe.PaymentLink, error) {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	return f.createPaymentLink(params)
+}
+
+// ListCustomers returns a page of customers on the specified service together with the cursor of the next page,
+// which is empty once the last page has been reached.
+func (fiats Fiats) ListCustomers(serviceName string, limit int64, cursor string) ([]*stripe.Customer, string, error) {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return nil, "", newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	switch f.Service {
+	// TODO: add new customer services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		return f.StripeListCustomers(limit, cursor)
+	}
+}
+
+// SearchCustomers finds the customers with the given email on the specified service.
+func (fiats Fiats) SearchCustomers(serviceName, email string) ([]*stripe.Customer, error) {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	switch f.Service {
+	// TODO: add new customer services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		return f.StripeSearchCustomers(email)
+	}
+}
+
+// CreateCustomerPortalSession opens a self-service portal session for the customer on the specified service
+// and returns its URL.
+func (fiats Fiats) CreateCustomerPortalSession(serviceName, customerID, returnURL string) (string, error) {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return "", newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	switch f.Service {
+	// TODO: add new customer portal services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		return f.StripeCreateCustomerPortalSession(customerID, returnURL)
+	}
+}
+
+// EphemeralKey creates an ephemeral key for the customer on the specified service, for use by mobile SDKs.
+func (fiats Fiats) EphemeralKey(serviceName, customerID, stripeVersion string) (string, error) {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return "", newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	switch f.Service {
+	// TODO: add new ephemeral key services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		return f.StripeEphemeralKey(customerID, stripeVersion)
+	}
+}
+
+// CreateUSBankAccountPM adds a US bank account payment method to the customer on the specified service, returning the
+// setup intent to verify it with VerifyMicrodeposits.
+func (fiats Fiats) CreateUSBankAccountPM(serviceName, customerID, routingNumber, accountNumber, accountType string) (*stripe.SetupIntent, error) {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	switch f.Service {
+	// TODO: add new bank account services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		return f.StripeCreateUSBankAccountPM(customerID, routingNumber, accountNumber, accountType)
+	}
+}
+
+// VerifyMicrodeposits verifies a bank account on the specified service with the microdeposit amounts.
+func (fiats Fiats) VerifyMicrodeposits(serviceName, setupIntentID string, amounts []int32) error {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	switch f.Service {
+	// TODO: add new bank account services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		return f.StripeVerifyMicrodeposits(setupIntentID, amounts)
+	}
+}
+
+// CreateSEPASetupIntent starts collecting a SEPA Direct Debit mandate for the customer on the specified service.
+func (fiats Fiats) CreateSEPASetupIntent(serviceName, customerID, email string) (*stripe.SetupIntent, error) {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	switch f.Service {
+	// TODO: add new bank account services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		return f.StripeCreateSetupIntentForSEPA(customerID, email)
+	}
+}
+
+// ConfirmSEPASetupIntent confirms a SEPA Direct Debit setup with the IBAN payment method on the specified service.
+func (fiats Fiats) ConfirmSEPASetupIntent(serviceName, setupIntentID, ibanPM string) (*stripe.SetupIntent, error) {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	switch f.Service {
+	// TODO: add new bank account services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		return f.StripeConfirmSEPASetupIntent(setupIntentID, ibanPM)
+	}
+}
+
+// DisputeRespond submits evidence for a dispute on the specified service.
+func (fiats Fiats) DisputeRespond(serviceName, disputeID string, evidence DisputeEvidence) (*stripe.Dispute, error) {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	switch f.Service {
+	// TODO: add new dispute services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		return f.StripeDisputeRespond(disputeID, evidence)
+	}
+}
+
+// GetDispute retrieves a dispute on the specified service.
+func (fiats Fiats) GetDispute(serviceName, disputeID string) (*stripe.Dispute, error) {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	switch f.Service {
+	// TODO: add new dispute services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		return f.StripeGetDispute(disputeID)
+	}
+}
+
+// ListDisputes lists the most recent disputes on the specified service.
+func (fiats Fiats) ListDisputes(serviceName string, limit int64) ([]*stripe.Dispute, error) {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	switch f.Service {
+	// TODO: add new dispute services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		return f.StripeListDisputes(limit)
+	}
+}
+
+// ListPaymentIntents lists the customer's most recent payment intents on the specified service, optionally
+// filtered by status.
+func (fiats Fiats) ListPaymentIntents(serviceName, customerID string, limit int64, status string) ([]*stripe.PaymentIntent, error) {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	switch f.Service {
+	// TODO: add new payment intent services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		return f.StripeListPaymentIntents(customerID, limit, status)
+	}
+}
+
+// GetBalance retrieves the platform's own balance on the specified service.
+func (fiats Fiats) GetBalance(serviceName string) (*stripe.Balance, error) {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	switch f.Service {
+	// TODO: add new balance services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		return f.StripeGetBalance()
+	}
+}
+
+// GetBalanceTransaction retrieves the balance impact of a charge, refund or transfer on the specified service.
+func (fiats Fiats) GetBalanceTransaction(serviceName, txID string) (*stripe.BalanceTransaction, error) {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	switch f.Service {
+	// TODO: add new balance services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		return f.StripeGetBalanceTransaction(txID)
+	}
+}
+
+// PayoutToBank pays out the platform's balance to one of its bank accounts on the specified service.
+func (fiats Fiats) PayoutToBank(serviceName, descriptor, bankAccountID string, amount int64, currency Currency) (*stripe.Payout, error) {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	switch f.Service {
+	// TODO: add new payout services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		return f.StripePayoutToBank(descriptor, bankAccountID, amount, currency)
+	}
+}
+
+// AddBankAccount registers a bank account for payouts on the platform's own account on the specified service.
+func (fiats Fiats) AddBankAccount(serviceName, bankToken string) (*stripe.BankAccount, error) {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	switch f.Service {
+	// TODO: add new payout services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		return f.StripeAddBankAccount(bankToken)
+	}
+}
+
+// CreatePaymentMethod creates a payment method on the specified service.
+func (fiats Fiats) CreatePaymentMethod(serviceName string, params PaymentMethodCreateParams) (*stripe.PaymentMethod, error) {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	switch f.Service {
+	// TODO: add new payment method services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		return f.StripeCreatePaymentMethod(params)
+	}
+}
+
+// SetDefaultPaymentMethod makes a payment method the customer's default on the specified service.
+func (fiats Fiats) SetDefaultPaymentMethod(serviceName, customerID, pmID string) error {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	switch f.Service {
+	// TODO: add new payment method services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		return f.StripeSetDefaultPaymentMethod(customerID, pmID)
+	}
+}
+
+// GetDefaultPaymentMethod returns the customer's default payment method on the specified service.
+func (fiats Fiats) GetDefaultPaymentMethod(serviceName, customerID string) (*stripe.PaymentMethod, error) {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	switch f.Service {
+	// TODO: add new payment method services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		return f.StripeGetDefaultPaymentMethod(customerID)
+	}
+}
+
+// DeleteCustomer permanently deletes the customer on the specified service; see Fiat.DeleteCustomer.
+func (fiats Fiats) DeleteCustomer(serviceName, customerID string) error {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	return f.DeleteCustomer(customerID)
+}
+
+// AnonymizeCustomer redacts the customer's personal data on the specified service; see Fiat.AnonymizeCustomer.
+func (fiats Fiats) AnonymizeCustomer(serviceName, customerID string) error {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	return f.AnonymizeCustomer(customerID)
+}
+
+// GetTransferStatus retrieves a transfer on the specified service; see Fiat.GetTransferStatus.
+func (fiats Fiats) GetTransferStatus(serviceName, transferID string) (*stripe.Transfer, error) {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	return f.GetTransferStatus(transferID)
+}
+
+// ListTransfers lists the transfers on the specified service; see Fiat.ListTransfers.
+func (fiats Fiats) ListTransfers(serviceName string, params StripeTransferListParams) ([]*stripe.Transfer, error) {
+	f, ok := fiats.FindByName(serviceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	return f.ListTransfers(params)
+}
+
+// FindByName returns the fiat service indexed under the given name.
+func (index FiatIndex) FindByName(name string) (*Fiat, bool) {
+	f, ok := index[name]
+	return f, ok
+}
+
+// Pay attempts to pay the specified service using the provided parameters.
+func (index FiatIndex) Pay(params FiatParams) (*FiatTransactionInfo, error) {
+	f, ok := index.FindByName(params.ServiceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", params.ServiceName)
+	}
+	return f.pay(params)
+}
+
+// ConfirmPayment confirms a payment on the specified service using the provided parameters.
+func (index FiatIndex) ConfirmPayment(params FiatPaymentConfirmParams) (*FiatPaymentConfirmInfo, error) {
+	f, ok := index.FindByName(params.ServiceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", params.ServiceName)
+	}
+	return f.confirmPayment(params)
+}
+
+// Refund refunds the provided amount on the specified service.
+func (index FiatIndex) Refund(params FiatRefundParams) (*FiatTransactionInfo, error) {
+	f, ok := index.FindByName(params.ServiceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", params.ServiceName)
+	}
+	return f.refund(params)
+}
+
+// CancelPaymentIntent cancels a payment intent on the specified service.
+func (index FiatIndex) CancelPaymentIntent(serviceName, intentID string) error {
+	f, ok := index.FindByName(serviceName)
+	if !ok {
+		return newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	return f.cancelPaymentIntent(intentID)
 }
 
-// FiatParams contains parameters necessary for initiating a fiat transaction.
-type FiatParams struct {
-	ServiceName string    // The name of the service provider (e.g., "STRIPE").
-	Customer    string    // Customer ID on the payment provider's system.
-	Description string    // A description of the payment.
-	Amount      float64   // The amount to be paid.
-	Currency    Currency  // The currency for the payment (e.g., USD, JPY).
-	Transfer    *Transfer // Information about a transfer (optional).
-}
+// Authorize authorizes a payment on the specified service without capturing it.
+func (index FiatIndex) Authorize(params FiatParams) (*FiatTransactionInfo, error) {
+	f, ok := index.FindByName(params.ServiceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", params.ServiceName)
+	}
+	return f.authorize(params)
+}
+
+// Capture captures an authorized payment on the specified service.
+func (index FiatIndex) Capture(serviceName, paymentIntentID string, amount int64) error {
+	f, ok := index.FindByName(serviceName)
+	if !ok {
+		return newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	return f.capture(paymentIntentID, amount)
+}
+
+// CreateSplitTransfers transfers parts of a succeeded payment to connected accounts on the specified service.
+func (index FiatIndex) CreateSplitTransfers(serviceName, paymentIntentID string, currency Currency, transfers []MultiTransfer) ([]string, error) {
+	f, ok := index.FindByName(serviceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	return f.createSplitTransfers(paymentIntentID, currency, transfers)
+}
+
+// CreatePaymentLink creates a hosted payment link for a one-off amount on the specified service.
+func (index FiatIndex) CreatePaymentLink(serviceName string, params PaymentLinkParams) (*stripe.PaymentLink, error) {
+	f, ok := index.FindByName(serviceName)
+	if !ok {
+		return nil, newError(ErrCodeNotFound, nil, "service %s could not found", serviceName)
+	}
+	return f.createPaymentLink(params)
+}
+
+// pay dispatches the payment to the underlying fiat service.
+func (f Fiat) pay(params FiatParams) (*FiatTransactionInfo, error) {
+	switch f.Service {
+	// TODO: add new fiat services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		return f.StripePay(params)
+	}
+}
+
+// authorize dispatches the authorization to the underlying fiat service.
+func (f Fiat) authorize(params FiatParams) (*FiatTransactionInfo, error) {
+	switch f.Service {
+	// TODO: add new authorization services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		return f.StripeAuthorize(params)
+	}
+}
+
+// capture dispatches the capture to the underlying fiat service.
+func (f Fiat) capture(paymentIntentID string, amount int64) error {
+	switch f.Service {
+	// TODO: add new capture services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		return f.StripeCapture(paymentIntentID, amount)
+	}
+}
+
+// createSplitTransfers dispatches the split transfers to the underlying fiat service.
+func (f Fiat) createSplitTransfers(paymentIntentID string, currency Currency, transfers []MultiTransfer) ([]string, error) {
+	switch f.Service {
+	// TODO: add new transfer services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		return f.StripeCreateSplitTransfers(paymentIntentID, currency, transfers)
+	}
+}
+
+// confirmPayment dispatches the payment confirmation to the underlying fiat service.
+func (f Fiat) confirmPayment(params FiatPaymentConfirmParams) (*FiatPaymentConfirmInfo, error) {
+	switch f.Service {
+	// TODO: add new confirm services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		return f.StripeConfirmPayment(params)
+	}
+}
+
+// refund dispatches the refund to the underlying fiat service.
+func (f Fiat) refund(params FiatRefundParams) (*FiatTransactionInfo, error) {
+	switch f.Service {
+	// TODO: add new refund services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		return f.StripeRefund(params)
+	}
+}
+
+// cancelPaymentIntent dispatches the payment intent cancellation to the underlying fiat service.
+func (f Fiat) cancelPaymentIntent(intentID string) error {
+	switch f.Service {
+	// TODO: add new cancel services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		return f.StripeCancelPaymentIntent(intentID)
+	}
+}
+
+// createPaymentLink dispatches the payment link creation to the underlying fiat service.
+func (f Fiat) createPaymentLink(params PaymentLinkParams) (*stripe.PaymentLink, error) {
+	switch f.Service {
+	// TODO: add new payment link services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		return f.stripeCreatePaymentLink(params)
+	}
+}
+
+// StripePay handles a payment using the Stripe payment gateway.
+func (f Fiat) StripePay(params FiatParams) (*FiatTransactionInfo, error) {
+	return f.stripePay(params, stripe.PaymentIntentCaptureMethodAutomatic)
+}
+
+// StripeAuthorize places a hold on the customer's card for the payment without capturing it, so that it can be
+// charged later with StripeCapture. The returned info is Confirmed once the amount has been authorized.
+func (f Fiat) StripeAuthorize(params FiatParams) (*FiatTransactionInfo, error) {
+	return f.stripePay(params, stripe.PaymentIntentCaptureMethodManual)
+}
+
+// StripeCapture captures an authorized Stripe payment intent. The amount is in the currency's smallest unit and
+// may be lower than the authorized amount, in which case the rest is released; zero captures the whole amount.
+func (f Fiat) StripeCapture(paymentIntentID string, amount int64) error {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	params := &stripe.PaymentIntentCaptureParams{}
+	if amount > 0 {
+		params.AmountToCapture = stripe.Int64(amount)
+	}
+	if _, err := paymentintent.Capture(paymentIntentID, params); err != nil {
+		return newError(ErrCodeExternalService, err, "failed to capture payment intent")
+	}
+	return nil
+}
+
+// StripeCreateSplitTransfers transfers parts of a succeeded payment intent to connected accounts, e.g., the
+// transfers beyond the first of a payment split between several accounts. The transfers are funded by the
+// intent's charge and grouped under the intent ID. Retrying is safe: a transfer already made is not made again.
+func (f Fiat) StripeCreateSplitTransfers(paymentIntentID string, currency Currency, transfers []MultiTransfer) ([]string, error) {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	intent, err := paymentintent.Get(paymentIntentID, nil)
+	if err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to retrieve payment intent")
+	}
+	if intent.Status != stripe.PaymentIntentStatusSucceeded {
+		return nil, newError(ErrCodeInvalidStatus, nil, "payment intent %s is in the %s status", paymentIntentID, intent.Status)
+	}
+	return f.stripeSplitTransfers(intent, currency, transfers)
+}
+
+// stripeSplitTransfers makes the transfers funded by the charge of a succeeded payment intent and returns their IDs.
+func (f Fiat) stripeSplitTransfers(intent *stripe.PaymentIntent, currency Currency, transfers []MultiTransfer) ([]string, error) {
+	if intent.LatestCharge == nil {
+		return nil, newError(ErrCodeInvalidStatus, nil, "payment intent %s has no charge to transfer from", intent.ID)
+	}
+
+	ids := make([]string, 0, len(transfers))
+	for i, t := range transfers {
+		params := &stripe.TransferParams{
+			Amount:            stripe.Int64(stripeAmount(t.Amount, currency)),
+			Currency:          stripe.String(string(currency)),
+			Destination:       stripe.String(t.Destination),
+			SourceTransaction: stripe.String(intent.LatestCharge.ID),
+			TransferGroup:     stripe.String(intent.ID),
+		}
+		if t.Description != "" {
+			params.Description = stripe.String(t.Description)
+		}
+		params.SetIdempotencyKey(fmt.Sprintf("gopay-transfer-%s-%d-%s", intent.ID, i, t.Destination))
+
+		result, err := transfer.New(params)
+		if err != nil {
+			return ids, newError(ErrCodeExternalService, err, "failed to create transfer to %s", t.Destination)
+		}
+		ids = append(ids, result.ID)
+	}
+	return ids, nil
+}
+
+// stripePay creates and confirms a Stripe payment intent with the given capture method. Automatically captured
+// intents are complete once they succeed, manually captured ones once they await capture.
+func (f Fiat) stripePay(params FiatParams, captureMethod stripe.PaymentIntentCaptureMethod) (*FiatTransactionInfo, error) {
+	// Set up the Stripe API key for authentication.
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	// List payment methods for the customer.
+	list := paymentmethod.List(&stripe.PaymentMethodListParams{
+		Customer: stripe.String(params.Customer),
+		Type:     stripe.String("card"),
+	})
+	var method *stripe.PaymentMethod
+	for list.Next() {
+		method = list.PaymentMethod() // Get the first payment method.
+	}
+	if err := list.Err(); err != nil {
+		return nil, err // Return any error encountered during payment method listing.
+	}
+	if method == nil {
+		return nil, newError(ErrCodeNotFound, nil, "card method %s could not be found", params.Customer)
+	}
+
+	// Create payment intent parameters.
+	intentParams := &stripe.PaymentIntentParams{
+		Amount:        stripe.Int64(stripeAmount(params.Amount, params.Currency)),
+		Currency:      stripe.String(string(params.Currency)),
+		Customer:      stripe.String(params.Customer),
+		PaymentMethod: stripe.String(method.ID),
+		Description:   stripe.String(params.Description),
+		Confirm:       stripe.Bool(true),
+		CaptureMethod: stripe.String(string(captureMethod)),
+		AutomaticPaymentMethods: &stripe.PaymentIntentAutomaticPaymentMethodsParams{
+			Enabled:        stripe.Bool(true),
+			AllowRedirects: stripe.String("never"), // Block redirect-based methods
+		},
+		PaymentMethodOptions: &stripe.PaymentIntentPaymentMethodOptionsParams{
+			Card: &stripe.PaymentIntentPaymentMethodOptionsCardParams{
+				RequestThreeDSecure: stripe.String("automatic"), // Let Stripe decide when 3DS is needed
+			},
+		},
+		SetupFutureUsage: stripe.String(string(stripe.PaymentIntentSetupFutureUsageOffSession)),
+	}
+	intentParams.Metadata = params.Metadata
+
+	// If there are transfers, the first one is made by the payment intent itself. The application fee keeps the
+	// rest on the platform: its own fee and the amounts of the other transfers, made once the payment succeeds.
+	transfers := params.transfers()
+	if len(transfers) > 0 {
+		intentParams.ConfirmationMethod = stripe.String(string(stripe.PaymentIntentConfirmationMethodAutomatic))
+		intentParams.ReturnURL = stripe.String(f.Callback)
+		intentParams.Confirm = stripe.Bool(true)
+		intentParams.ApplicationFeeAmount = stripe.Int64(stripeAmount(params.Amount, params.Currency) - stripeAmount(transfers[0].Amount, params.Currency))
+		intentParams.OnBehalfOf = stripe.String(transfers[0].Destination)
+		intentParams.TransferData = &stripe.PaymentIntentTransferDataParams{
+			Destination: stripe.String(transfers[0].Destination),
+		}
+	}
+
+	// Expand the charge to report how much of it has been refunded
+	intentParams.AddExpand("latest_charge")
+
+	// Create the payment intent in Stripe.
+	result, err := paymentintent.New(intentParams)
+	if err != nil {
+		return nil, err // Return any error encountered while creating the payment intent.
+	}
+	config.logger().Infof("payment intent: %v", result)
+	total, err := FromStripeAmount(result.Amount, params.Currency)
+	if err != nil {
+		return nil, err
+	}
+	// Create transaction info using the result from Stripe.
+	info := &FiatTransactionInfo{
+		TXID:        result.ID,
+		TotalAmount: total,
+		Date:        time.Now(),
+		Currency:    string(result.Currency),
+		Meta:        result,
+	}
+
+	if result.Status == stripe.PaymentIntentStatusRequiresAction {
+		info.RequiresAction = true
+		info.ClientSecret = result.ClientSecret
+		return info, nil
+	}
+
+	if result.Status == stripe.PaymentIntentStatusRequiresConfirmation {
+		confirmParams := &stripe.PaymentIntentConfirmParams{}
+		confirmParams.AddExpand("latest_charge")
+		confirmed, err := paymentintent.Confirm(result.ID, confirmParams)
+		if err != nil {
+			return info, err
+		}
+		result = confirmed
+	}
+
+	var refunded int64
+	info.ChargeID, refunded = stripeLatestCharge(result)
+	if info.RefundedAmount, err = FromStripeAmount(refunded, params.Currency); err != nil {
+		return info, err
+	}
+
+	completed := stripe.PaymentIntentStatusSucceeded
+	if captureMethod == stripe.PaymentIntentCaptureMethodManual {
+		completed = stripe.PaymentIntentStatusRequiresCapture
+	}
+	if result.Status != completed {
+		return info, newError(ErrCodeInvalidStatus, nil, "Payment is not completed and is in the %s status", result.Status)
+	}
+
+	info.Confirmed = true
+
+	// Authorized payments are only transferred once captured, see Payment.Capture
+	if captureMethod != stripe.PaymentIntentCaptureMethodManual && len(transfers) > 1 {
+		// The payment has been made, so a failed transfer is left to be retried with CreateSplitTransfers
+		ids, err := f.stripeSplitTransfers(result, params.Currency, transfers[1:])
+		info.TransferIDs = ids
+		if err != nil {
+			config.logger().Errorf("failed to create split transfers of payment intent %s: %v", result.ID, err)
+		}
+	}
+	return info, nil
+
+	// // Confirm the payment intent using the selected payment method.
+	// if _, err := paymentintent.Confirm(
+	// 	result.ID,
+	// 	&stripe.PaymentIntentConfirmParams{
+	// 		PaymentMethod: stripe.String(method.ID),
+	// 	},
+	// ); err != nil {
+	// 	return info, err // Return the transaction info and any errors during confirmation.
+	// }
+}
+
+func (f Fiat) StripeConfirmPayment(params FiatPaymentConfirmParams) (*FiatPaymentConfirmInfo, error) {
+	// Set up the Stripe API key for authentication.
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	intentParams := &stripe.PaymentIntentParams{}
+	intentParams.AddExpand("latest_charge")
+	intent, err := paymentintent.Get(params.PaymentIntentID, intentParams)
+	if err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to retrieve payment intent")
+	}
+
+	info := &FiatPaymentConfirmInfo{
+		PaymentIntent: intent,
+		IsConfirmed:   false,
+		Amount:        intent.Amount,
+	}
+	info.ChargeID, info.AmountRefunded = stripeLatestCharge(intent)
+
+	switch intent.Status {
+	case stripe.PaymentIntentStatusSucceeded:
+		info.IsConfirmed = true
+	case stripe.PaymentIntentStatusRequiresCapture:
+		// A manually captured payment intent is authorized once the payer has authenticated
+		info.IsAuthorized = true
+	}
+
+	return info, nil
+}
+
+// stripeLatestCharge returns the ID and refunded amount, in the smallest currency unit, of the intent's latest
+// charge. The refunded amount is only known if the charge has been expanded.
+func stripeLatestCharge(intent *stripe.PaymentIntent) (string, int64) {
+	if intent.LatestCharge == nil {
+		return "", 0
+	}
+	return intent.LatestCharge.ID, intent.LatestCharge.AmountRefunded
+}
+
+// StripeCancelPaymentIntent cancels a Stripe payment intent, e.g., one whose 3DS authentication has expired.
+func (f Fiat) StripeCancelPaymentIntent(intentID string) error {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	if _, err := paymentintent.Cancel(intentID, nil); err != nil {
+		return newError(ErrCodeExternalService, err, "failed to cancel payment intent")
+	}
+	return nil
+}
+
+// StripeRefund refunds the provided amount of a Stripe payment intent.
+func (f Fiat) StripeRefund(params FiatRefundParams) (*FiatTransactionInfo, error) {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	result, err := refund.New(&stripe.RefundParams{
+		PaymentIntent: stripe.String(params.PaymentIntentID),
+		Amount:        stripe.Int64(stripeAmount(params.Amount, params.Currency)),
+		Metadata:      map[string]string{"reason": params.Reason},
+	})
+	if err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to create refund")
+	}
+	total, err := FromStripeAmount(result.Amount, params.Currency)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FiatTransactionInfo{
+		TXID:        result.ID,
+		TotalAmount: total,
+		Date:        time.Now(),
+		Currency:    string(result.Currency),
+		Meta:        result,
+		Confirmed:   result.Status == stripe.RefundStatusSucceeded || result.Status == stripe.RefundStatusPending,
+	}, nil
+}
+
+// StripeCreateInvoice creates a draft Stripe invoice for the customer with a single line item.
+// The invoice is collected by sending it to the customer rather than charging immediately.
+func (f Fiat) StripeCreateInvoice(params InvoiceParams) (*stripe.Invoice, error) {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	// Create the pending line item which the invoice will pick up.
+	if _, err := invoiceitem.New(&stripe.InvoiceItemParams{
+		Customer:    stripe.String(params.CustomerID),
+		Amount:      stripe.Int64(stripeAmount(params.Amount, params.Currency)),
+		Currency:    stripe.String(string(params.Currency)),
+		Description: stripe.String(params.Description),
+		Metadata:    params.Metadata,
+	}); err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to create invoice item")
+	}
+
+	inv, err := invoice.New(&stripe.InvoiceParams{
+		Customer:                    stripe.String(params.CustomerID),
+		Description:                 stripe.String(params.Description),
+		Currency:                    stripe.String(string(params.Currency)),
+		CollectionMethod:            stripe.String(string(stripe.InvoiceCollectionMethodSendInvoice)),
+		DueDate:                     stripe.Int64(params.DueDate.Unix()),
+		PendingInvoiceItemsBehavior: stripe.String("include"),
+		Metadata:                    params.Metadata,
+	})
+	if err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to create invoice")
+	}
+
+	return inv, nil
+}
+
+// StripeFinalizeInvoice finalizes a draft Stripe invoice so that it can be paid.
+func (f Fiat) StripeFinalizeInvoice(invoiceID string) (*stripe.Invoice, error) {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	inv, err := invoice.FinalizeInvoice(invoiceID, nil)
+	if err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to finalize invoice")
+	}
+
+	return inv, nil
+}
+
+// StripePayInvoice pays a finalized Stripe invoice using the customer's default payment method.
+func (f Fiat) StripePayInvoice(invoiceID string) (*stripe.Invoice, error) {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	inv, err := invoice.Pay(invoiceID, nil)
+	if err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to pay invoice")
+	}
+
+	return inv, nil
+}
+
+// StripeCreatePaymentLink creates a Stripe payment link for a one-off amount and returns its shareable URL.
+func (f Fiat) StripeCreatePaymentLink(params PaymentLinkParams) (string, error) {
+	link, err := f.stripeCreatePaymentLink(params)
+	if err != nil {
+		return "", err
+	}
+	return link.URL, nil
+}
+
+// stripeCreatePaymentLink creates an ad-hoc price for the amount and a Stripe payment link selling it.
+func (f Fiat) stripeCreatePaymentLink(params PaymentLinkParams) (*stripe.PaymentLink, error) {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	metadata := map[string]string{}
+	for k, v := range params.Metadata {
+		metadata[k] = v
+	}
+	if params.CustomerEmail != "" {
+		metadata["customer_email"] = params.CustomerEmail
+	}
+
+	// Payment links sell prices, so create a one-off price for the amount.
+	p, err := price.New(&stripe.PriceParams{
+		Currency:   stripe.String(string(params.Currency)),
+		UnitAmount: stripe.Int64(stripeAmount(params.Amount, params.Currency)),
+		ProductData: &stripe.PriceProductDataParams{
+			Name: stripe.String(params.Description),
+		},
+	})
+	if err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to create price")
+	}
+
+	linkParams := &stripe.PaymentLinkParams{
+		LineItems: []*stripe.PaymentLinkLineItemParams{
+			{
+				Price:    stripe.String(p.ID),
+				Quantity: stripe.Int64(1),
+			},
+		},
+	}
+	linkParams.Metadata = metadata
+	if params.SuccessURL != "" {
+		linkParams.AfterCompletion = &stripe.PaymentLinkAfterCompletionParams{
+			Type: stripe.String(string(stripe.PaymentLinkAfterCompletionTypeRedirect)),
+			Redirect: &stripe.PaymentLinkAfterCompletionRedirectParams{
+				URL: stripe.String(params.SuccessURL),
+			},
+		}
+	}
+
+	link, err := paymentlink.New(linkParams)
+	if err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to create payment link")
+	}
+
+	return link, nil
+}
+
+// stripeAmount converts a floating point amount to the appropriate integer amount for the selected currency.
+func stripeAmount(amount float64, currency Currency) int64 {
+	switch currency {
+	case USD, EUR, GBP:
+		// Convert the amount to cents, rounding away floating point errors (e.g., 19.99 * 100 = 1998.9999).
+		return int64(math.Round(amount * 100))
+	case JPY:
+		// JPY is typically in whole units, so no conversion necessary.
+		return int64(math.Round(amount))
+	default:
+		// Default case returns 0 if the currency is unrecognized.
+		return 0
+	}
+}
+
+// FromStripeAmount converts an amount in Stripe's minor units back to the currency's units, the inverse of
+// the conversion applied when sending amounts to Stripe (e.g., 1999 cents to 19.99 USD, unchanged for JPY).
+func FromStripeAmount(amount int64, currency Currency) (float64, error) {
+	switch currency {
+	case USD, EUR, GBP:
+		return float64(amount) / 100, nil
+	case JPY:
+		return float64(amount), nil
+	default:
+		return 0, newError(ErrCodeValidation, nil, "unsupported currency %q", currency)
+	}
+}
+
+func (f Fiat) AddCustomer(email string) (*stripe.Customer, error) {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	c, err := customer.New(&stripe.CustomerParams{
+		Email: stripe.String(email),
+	})
+	if err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to create customer")
+	}
+
+	return c, nil
+}
+
+// StripeListCustomers returns up to limit customers created before the customer startingAfter (all customers
+// from the newest when empty), along with the ID to pass as startingAfter to fetch the next page.
+// The returned cursor is empty when there are no more customers.
+func (f Fiat) StripeListCustomers(limit int64, startingAfter string) ([]*stripe.Customer, string, error) {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	params := &stripe.CustomerListParams{}
+	params.Limit = stripe.Int64(limit)
+	if startingAfter != "" {
+		params.StartingAfter = stripe.String(startingAfter)
+	}
+
+	iter := customer.List(params)
+	var (
+		customers []*stripe.Customer
+		hasMore   bool
+	)
+
+	for int64(len(customers)) < limit && iter.Next() {
+		customers = append(customers, iter.Customer())
+		hasMore = iter.CustomerList().HasMore
+	}
+
+	if err := iter.Err(); err != nil {
+		return nil, "", newError(ErrCodeExternalService, err, "failed to list customers")
+	}
+
+	var cursor string
+	if hasMore && len(customers) > 0 {
+		cursor = customers[len(customers)-1].ID
+	}
+	return customers, cursor, nil
+}
+
+// StripeSearchCustomers finds the customers with the given email using Stripe's search API.
+// Newly created customers may take up to a minute to become searchable.
+func (f Fiat) StripeSearchCustomers(email string) ([]*stripe.Customer, error) {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	query := fmt.Sprintf("email:'%s'", strings.ReplaceAll(email, "'", "\\'"))
+	iter := customer.Search(&stripe.CustomerSearchParams{
+		SearchParams: stripe.SearchParams{Query: query},
+	})
+	var customers []*stripe.Customer
+
+	for iter.Next() {
+		customers = append(customers, iter.Customer())
+	}
+
+	if err := iter.Err(); err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to search customers")
+	}
+
+	return customers, nil
+}
+
+// StripeCreateCustomerPortalSession creates a Stripe Billing Portal session where the customer can manage
+// their saved cards and subscriptions, and returns the session URL to redirect them to.
+func (f Fiat) StripeCreateCustomerPortalSession(customerID, returnURL string) (string, error) {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	params := &stripe.BillingPortalSessionParams{
+		Customer: stripe.String(customerID),
+	}
+	if returnURL != "" {
+		params.ReturnURL = stripe.String(returnURL)
+	}
+
+	session, err := portalsession.New(params)
+	if err != nil {
+		return "", newError(ErrCodeExternalService, err, "failed to create customer portal session")
+	}
+	return session.URL, nil
+}
+
+// StripeConfigurePortal applies the features to the account's default Billing Portal configuration,
+// creating one if the account does not have a default configuration yet.
+func (f Fiat) StripeConfigurePortal(features PortalFeatures) error {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	params := &stripe.BillingPortalConfigurationParams{
+		Features: &stripe.BillingPortalConfigurationFeaturesParams{
+			PaymentMethodUpdate: &stripe.BillingPortalConfigurationFeaturesPaymentMethodUpdateParams{
+				Enabled: stripe.Bool(features.PaymentMethodUpdate),
+			},
+			InvoiceHistory: &stripe.BillingPortalConfigurationFeaturesInvoiceHistoryParams{
+				Enabled: stripe.Bool(features.InvoiceHistory),
+			},
+			CustomerUpdate: &stripe.BillingPortalConfigurationFeaturesCustomerUpdateParams{
+				Enabled:        stripe.Bool(len(features.CustomerUpdate) > 0),
+				AllowedUpdates: stripe.StringSlice(features.CustomerUpdate),
+			},
+			SubscriptionCancel: &stripe.BillingPortalConfigurationFeaturesSubscriptionCancelParams{
+				Enabled: stripe.Bool(features.SubscriptionCancel),
+			},
+		},
+	}
+	if features.DefaultReturnURL != "" {
+		params.DefaultReturnURL = stripe.String(features.DefaultReturnURL)
+	}
+
+	// Update the default configuration in place so that sessions without an explicit configuration pick it up
+	listParams := &stripe.BillingPortalConfigurationListParams{IsDefault: stripe.Bool(true)}
+	listParams.Limit = stripe.Int64(1)
+	iter := portalconfiguration.List(listParams)
+	if iter.Next() {
+		if _, err := portalconfiguration.Update(iter.BillingPortalConfiguration().ID, params); err != nil {
+			return newError(ErrCodeExternalService, err, "failed to update customer portal configuration")
+		}
+		return nil
+	}
+	if err := iter.Err(); err != nil {
+		return newError(ErrCodeExternalService, err, "failed to list customer portal configurations")
+	}
+
+	if _, err := portalconfiguration.New(params); err != nil {
+		return newError(ErrCodeExternalService, err, "failed to create customer portal configuration")
+	}
+	return nil
+}
+
+// StripeEphemeralKey creates a short-lived key giving Stripe's mobile SDKs access to the customer, e.g., for
+// PaymentSheet. The stripeVersion must be the API version the mobile SDK was built for. It returns the raw
+// JSON of the key, which is passed to the SDK as is.
+func (f Fiat) StripeEphemeralKey(customerID, stripeVersion string) (string, error) {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	key, err := ephemeralkey.New(&stripe.EphemeralKeyParams{
+		Customer:      stripe.String(customerID),
+		StripeVersion: stripe.String(stripeVersion),
+	})
+	if err != nil {
+		return "", newError(ErrCodeExternalService, err, "failed to create ephemeral key")
+	}
+	return string(key.RawJSON), nil
+}
+
+// DeleteCustomer permanently deletes the customer after detaching all of their cards, e.g., to honour a
+// GDPR right-to-erasure request. Deletion cannot be undone; use AnonymizeCustomer to keep the history instead.
+func (f Fiat) DeleteCustomer(customerID string) error {
+	cards, err := f.FetchCards(customerID)
+	if err != nil {
+		return newError(ErrCodeExternalService, err, "failed to fetch cards")
+	}
+	for _, card := range cards {
+		if err := f.DeleteCard(card.ID); err != nil {
+			return err
+		}
+	}
+
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	if _, err := customer.Del(customerID, nil); err != nil {
+		return newError(ErrCodeExternalService, err, "failed to delete customer")
+	}
+
+	return nil
+}
+
+// AnonymizeCustomer redacts the customer's personal data while keeping the customer and its
+// transaction history in place.
+func (f Fiat) AnonymizeCustomer(customerID string) error {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	if _, err := customer.Update(customerID, &stripe.CustomerParams{
+		Email: stripe.String(""),
+		Name:  stripe.String(""),
+	}); err != nil {
+		return newError(ErrCodeExternalService, err, "failed to anonymize customer")
+	}
+
+	return nil
+}
+
+// BillingDetails holds the billing information of a payment method's owner.
+type BillingDetails struct {
+	Name         string
+	Email        string
+	Phone        string
+	AddressLine1 string
+	City         string
+	Country      string // Two-letter country code (e.g., "US").
+	PostalCode   string
+}
+
+// stripeParams converts the billing details to Stripe parameters, leaving out empty fields.
+func (b BillingDetails) stripeParams() *stripe.PaymentMethodBillingDetailsParams {
+	optional := func(v string) *string {
+		if v == "" {
+			return nil
+		}
+		return stripe.String(v)
+	}
+
+	params := &stripe.PaymentMethodBillingDetailsParams{
+		Name:  optional(b.Name),
+		Email: optional(b.Email),
+		Phone: optional(b.Phone),
+	}
+	if b.AddressLine1 != "" || b.City != "" || b.Country != "" || b.PostalCode != "" {
+		params.Address = &stripe.AddressParams{
+			Line1:      optional(b.AddressLine1),
+			City:       optional(b.City),
+			Country:    optional(b.Country),
+			PostalCode: optional(b.PostalCode),
+		}
+	}
+	return params
+}
+
+// PaymentMethodCreateParams describes a payment method to create. Type selects which of the details is used:
+//   - "card": CardToken, a token created by Stripe.js or the mobile SDKs (tok_...).
+//   - "us_bank_account": FinancialConnectionsAccount, the ID of a Financial Connections account (fca_...).
+//   - "sepa_debit": SEPAIban, the IBAN of the bank account; Stripe requires the name and email billing details.
+type PaymentMethodCreateParams struct {
+	Type                        string
+	CardToken                   *string
+	FinancialConnectionsAccount *string
+	SEPAIban                    *string
+	BillingDetails              *BillingDetails
+}
+
+// stripeParams converts the params to Stripe parameters, checking that the details of the type are set.
+func (params PaymentMethodCreateParams) stripeParams() (*stripe.PaymentMethodParams, error) {
+	pmParams := &stripe.PaymentMethodParams{Type: stripe.String(params.Type)}
+	switch stripe.PaymentMethodType(params.Type) {
+	case stripe.PaymentMethodTypeCard:
+		if params.CardToken == nil {
+			return nil, newError(ErrCodeValidation, nil, "card token is required for card payment methods")
+		}
+		pmParams.Card = &stripe.PaymentMethodCardParams{Token: params.CardToken}
+	case stripe.PaymentMethodTypeUSBankAccount:
+		if params.FinancialConnectionsAccount == nil {
+			return nil, newError(ErrCodeValidation, nil, "financial connections account is required for us_bank_account payment methods")
+		}
+		pmParams.USBankAccount = &stripe.PaymentMethodUSBankAccountParams{FinancialConnectionsAccount: params.FinancialConnectionsAccount}
+	case stripe.PaymentMethodTypeSEPADebit:
+		if params.SEPAIban == nil {
+			return nil, newError(ErrCodeValidation, nil, "IBAN is required for sepa_debit payment methods")
+		}
+		pmParams.SEPADebit = &stripe.PaymentMethodSEPADebitParams{IBAN: params.SEPAIban}
+	default:
+		return nil, newError(ErrCodeValidation, nil, "unsupported payment method type %q", params.Type)
+	}
+
+	if params.BillingDetails != nil {
+		pmParams.BillingDetails = params.BillingDetails.stripeParams()
+	}
+	return pmParams, nil
+}
+
+// StripeCreatePaymentMethod creates a Stripe payment method of the given type, without attaching it to a customer.
+func (f Fiat) StripeCreatePaymentMethod(params PaymentMethodCreateParams) (*stripe.PaymentMethod, error) {
+	pmParams, err := params.stripeParams()
+	if err != nil {
+		return nil, err
+	}
+
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	pm, err := paymentmethod.New(pmParams)
+	if err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to create payment method")
+	}
+	return pm, nil
+}
+
+// AttachPaymentMethod creates a payment method, attaches it to the customer and makes it their default one.
+func (f Fiat) AttachPaymentMethod(customerID string, params PaymentMethodCreateParams) (*stripe.PaymentMethod, error) {
+	pm, err := f.StripeCreatePaymentMethod(params)
+	if err != nil {
+		return nil, err
+	}
+
+	// Attach payment method to customer
+	if _, err := paymentmethod.Attach(pm.ID, &stripe.PaymentMethodAttachParams{
+		Customer: stripe.String(customerID),
+	}); err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to attach payment method")
+	}
+
+	_, err = customer.Update(customerID, &stripe.CustomerParams{
+		InvoiceSettings: &stripe.CustomerInvoiceSettingsParams{
+			DefaultPaymentMethod: stripe.String(pm.ID),
+		},
+	})
+	if err != nil {
+		return pm, newError(ErrCodeExternalService, err, "attached payment method but failed to set as default")
+	}
+	return pm, nil
+}
+
+// StripeCreateUSBankAccountPM creates a US bank account (ACH) payment method and sets it up for the customer with a
+// confirmed SetupIntent, which records the mandate, as offline since the payer's IP address and user agent are
+// not known here. The customer's name, or their email when they have none, is used as the account holder name.
+// accountType is "checking" or "savings"; Stripe defaults to checking when it is empty. The account must then be
+// verified with microdeposits, passing the returned intent's ID to StripeVerifyMicrodeposits, before it can be
+// debited; Stripe attaches the payment method to the customer once it is verified.
+func (f Fiat) StripeCreateUSBankAccountPM(customerID, routingNumber, accountNumber, accountType string) (*stripe.SetupIntent, error) {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	// Stripe requires the account holder's name on US bank accounts
+	c, err := customer.Get(customerID, nil)
+	if err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to get customer")
+	}
+	holder := c.Name
+	if holder == "" {
+		holder = c.Email
+	}
+
+	bankAccount := &stripe.PaymentMethodUSBankAccountParams{
+		AccountHolderType: stripe.String("individual"),
+		RoutingNumber:     stripe.String(routingNumber),
+		AccountNumber:     stripe.String(accountNumber),
+	}
+	if accountType != "" {
+		bankAccount.AccountType = stripe.String(accountType)
+	}
+
+	pm, err := paymentmethod.New(&stripe.PaymentMethodParams{
+		Type:          stripe.String("us_bank_account"),
+		USBankAccount: bankAccount,
+		BillingDetails: &stripe.PaymentMethodBillingDetailsParams{
+			Name: stripe.String(holder),
+		},
+	})
+	if err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to create payment method")
+	}
+
+	// Stripe verifies bank accounts, and only then attaches them, through the SetupIntent which sets them up
+	si, err := setupintent.New(&stripe.SetupIntentParams{
+		Customer:           stripe.String(customerID),
+		PaymentMethod:      stripe.String(pm.ID),
+		PaymentMethodTypes: []*string{stripe.String("us_bank_account")},
+		PaymentMethodOptions: &stripe.SetupIntentPaymentMethodOptionsParams{
+			USBankAccount: &stripe.SetupIntentPaymentMethodOptionsUSBankAccountParams{
+				VerificationMethod: stripe.String("microdeposits"),
+			},
+		},
+		Usage:   stripe.String(string(stripe.SetupIntentUsageOffSession)),
+		Confirm: stripe.Bool(true),
+		MandateData: &stripe.SetupIntentMandateDataParams{
+			CustomerAcceptance: &stripe.SetupIntentMandateDataCustomerAcceptanceParams{
+				Type:    stripe.MandateCustomerAcceptanceTypeOffline,
+				Offline: &stripe.SetupIntentMandateDataCustomerAcceptanceOfflineParams{},
+			},
+		},
+	})
+	if err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to create setup intent")
+	}
+	return si, nil
+}
+
+// StripeVerifyMicrodeposits verifies a US bank account with the two microdeposit amounts, in cents, that Stripe
+// sent to it. Stripe verifies microdeposits against the SetupIntent which set up the bank account, rather than
+// against the payment method itself.
+func (f Fiat) StripeVerifyMicrodeposits(setupIntentID string, amounts []int32) error {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	params := &stripe.SetupIntentVerifyMicrodepositsParams{}
+	for _, amount := range amounts {
+		params.Amounts = append(params.Amounts, stripe.Int64(int64(amount)))
+	}
+
+	if _, err := setupintent.VerifyMicrodeposits(setupIntentID, params); err != nil {
+		return newError(ErrCodeExternalService, err, "failed to verify microdeposits")
+	}
+	return nil
+}
+
+// StripeCreateSetupIntentForSEPA creates a Stripe SetupIntent collecting a SEPA Direct Debit mandate, which is
+// required before the customer's bank account can be debited. The payer's email is recorded in the intent's
+// metadata; Stripe sends the mandate notification to the email in the payment method's billing details.
+func (f Fiat) StripeCreateSetupIntentForSEPA(customerID, email string) (*stripe.SetupIntent, error) {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	params := &stripe.SetupIntentParams{
+		Customer:           stripe.String(customerID),
+		PaymentMethodTypes: []*string{stripe.String("sepa_debit")},
+		Usage:              stripe.String(string(stripe.SetupIntentUsageOffSession)),
+	}
+	params.AddMetadata("email", email)
+
+	si, err := setupintent.New(params)
+	if err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to create setup intent")
+	}
+	return si, nil
+}
+
+// StripeConfirmSEPASetupIntent confirms a SEPA SetupIntent with a sepa_debit payment method (e.g., created by
+// CreatePaymentMethod with a SEPAIban), which creates the mandate. Stripe only accepts mandate data on
+// confirmation, and since the payer's IP address and user agent are not known here, the acceptance is
+// recorded as offline. Once confirmed, the intent's PaymentMethod can be used for future payments.
+func (f Fiat) StripeConfirmSEPASetupIntent(setupIntentID, ibanPM string) (*stripe.SetupIntent, error) {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	si, err := setupintent.Confirm(setupIntentID, &stripe.SetupIntentConfirmParams{
+		PaymentMethod: stripe.String(ibanPM),
+		MandateData: &stripe.SetupIntentMandateDataParams{
+			CustomerAcceptance: &stripe.SetupIntentMandateDataCustomerAcceptanceParams{
+				Type:    stripe.MandateCustomerAcceptanceTypeOffline,
+				Offline: &stripe.SetupIntentMandateDataCustomerAcceptanceOfflineParams{},
+			},
+		},
+	})
+	if err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to confirm setup intent")
+	}
+	return si, nil
+}
+
+// StripeDisputeRespond stages the evidence on a Stripe dispute, submitting it to the bank if evidence.Submit is set.
+func (f Fiat) StripeDisputeRespond(disputeID string, evidence DisputeEvidence) (*stripe.Dispute, error) {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	d, err := dispute.Update(disputeID, evidence.stripeParams())
+	if err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to respond to dispute")
+	}
+	return d, nil
+}
+
+// StripeGetDispute retrieves a Stripe dispute, e.g., to check its status and evidence deadline.
+func (f Fiat) StripeGetDispute(disputeID string) (*stripe.Dispute, error) {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	d, err := dispute.Get(disputeID, nil)
+	if err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to get dispute")
+	}
+	return d, nil
+}
+
+// StripeListDisputes lists up to limit of the most recent Stripe disputes.
+func (f Fiat) StripeListDisputes(limit int64) ([]*stripe.Dispute, error) {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	params := &stripe.DisputeListParams{}
+	params.Limit = stripe.Int64(limit)
+
+	iter := dispute.List(params)
+	var disputes []*stripe.Dispute
+
+	for int64(len(disputes)) < limit && iter.Next() {
+		disputes = append(disputes, iter.Dispute())
+	}
 
-// FiatPaymentConfirmParams contains parameters necessary for confirming a fiat transaction.
-type FiatPaymentConfirmParams struct {
-	ServiceName     string // The name of the service provider (e.g., "STRIPE").
-	PaymentIntentID string
-}
+	if err := iter.Err(); err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to list disputes")
+	}
 
-type FiatPaymentConfirmInfo struct {
-	PaymentIntent *stripe.PaymentIntent `json:"payment_intent"`
-	IsConfirmed   bool                  `json:"is_confirmed"`
+	return disputes, nil
 }
 
-// Pay attempts to pay the specified service using the provided parameters.
-func (fiats Fiats) Pay(params FiatParams) (*FiatTransactionInfo, error) {
-	for _, f := range fiats {
-		if params.ServiceName != f.Name {
-			continue // Skip the service if it does not match the provided name.
-		}
-		switch f.Service {
-		// TODO: add new fiat services here.
-		default:
-			// Default to Stripe if no specific service is added.
-			return f.StripePay(params)
-		}
+// StripeListPaymentIntents lists up to limit of the customer's most recent Stripe payment intents. If status is
+// not empty, only the intents in that status (e.g., "requires_action" for pending 3DS authentications) are
+// returned; since Stripe cannot filter intents by status, they are filtered while paging through the list.
+func (f Fiat) StripeListPaymentIntents(customerID string, limit int64, status string) ([]*stripe.PaymentIntent, error) {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	params := &stripe.PaymentIntentListParams{
+		Customer: stripe.String(customerID),
 	}
-	return nil, fmt.Errorf("service %s could not found", params.ServiceName)
-}
+	params.Limit = stripe.Int64(limit)
 
-// Pay attempts to pay the specified service using the provided parameters.
-func (fiats Fiats) ConfirmPayment(params FiatPaymentConfirmParams) (*FiatPaymentConfirmInfo, error) {
-	for _, f := range fiats {
-		if params.ServiceName != f.Name {
-			continue // Skip the service if it does not match the provided name.
-		}
-		switch f.Service {
-		// TODO: add new confirm services here.
-		default:
-			// Default to Stripe if no specific service is added.
-			return f.StripeConfirmPayment(params)
+	iter := paymentintent.List(params)
+	var intents []*stripe.PaymentIntent
+
+	for int64(len(intents)) < limit && iter.Next() {
+		intent := iter.PaymentIntent()
+		if status != "" && string(intent.Status) != status {
+			continue
 		}
+		intents = append(intents, intent)
+	}
+
+	if err := iter.Err(); err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to list payment intents")
 	}
-	return nil, fmt.Errorf("service %s could not found", params.ServiceName)
+
+	return intents, nil
 }
 
-// StripePay handles a payment using the Stripe payment gateway.
-func (f Fiat) StripePay(params FiatParams) (*FiatTransactionInfo, error) {
-	// Set up the Stripe API key for authentication.
+// StripeGetBalance retrieves the platform's own Stripe balance, e.g., to monitor the funds held in escrow.
+func (f Fiat) StripeGetBalance() (*stripe.Balance, error) {
 	// @FIXME: it may cause data race
 	stripe.Key = f.ApiKey
 
-	// List payment methods for the customer.
-	list := paymentmethod.List(&stripe.PaymentMethodListParams{
-		Customer: stripe.String(params.Customer),
-		Type:     stripe.String("card"),
-	})
-	var method *stripe.PaymentMethod
-	for list.Next() {
-		method = list.PaymentMethod() // Get the first payment method.
+	b, err := balance.Get(nil)
+	if err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to get balance")
 	}
-	if err := list.Err(); err != nil {
-		return nil, err // Return any error encountered during payment method listing.
+	return b, nil
+}
+
+// HealthCheck verifies that the fiat service is reachable and accepts its API key with a minimal API call.
+// It returns an error matching ErrFiatServiceUnreachable if the call fails.
+func (f Fiat) HealthCheck(ctx context.Context) error {
+	var err error
+	switch f.Service {
+	// TODO: add new health check services here.
+	default:
+		// Default to Stripe if no specific service is added.
+		err = f.StripeHealthCheck(ctx)
 	}
-	if method == nil {
-		return nil, fmt.Errorf("card method %s could not be found", params.Customer)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrFiatServiceUnreachable, f.Name, err)
 	}
+	return nil
+}
 
-	// Create payment intent parameters.
-	intentParams := &stripe.PaymentIntentParams{
-		Amount:        stripe.Int64(stripeAmount(params.Amount, params.Currency)),
-		Currency:      stripe.String(string(params.Currency)),
-		Customer:      stripe.String(params.Customer),
-		PaymentMethod: stripe.String(method.ID),
-		Description:   stripe.String(params.Description),
-		Confirm:       stripe.Bool(true),
-		CaptureMethod: stripe.String(string(stripe.PaymentIntentCaptureMethodAutomatic)),
-		AutomaticPaymentMethods: &stripe.PaymentIntentAutomaticPaymentMethodsParams{
-			Enabled:        stripe.Bool(true),
-			AllowRedirects: stripe.String("never"), // Block redirect-based methods
-		},
-		PaymentMethodOptions: &stripe.PaymentIntentPaymentMethodOptionsParams{
-			Card: &stripe.PaymentIntentPaymentMethodOptionsCardParams{
-				RequestThreeDSecure: stripe.String("automatic"), // Let Stripe decide when 3DS is needed
-			},
-		},
-		SetupFutureUsage: stripe.String(string(stripe.PaymentIntentSetupFutureUsageOffSession)),
-	}
+// StripeHealthCheck retrieves the platform's balance, the cheapest call requiring a valid API key. Unlike the
+// other Stripe calls it does not set the global key, so that the services can be checked concurrently.
+func (f Fiat) StripeHealthCheck(ctx context.Context) error {
+	params := &stripe.BalanceParams{}
+	params.Context = ctx
 
-	// If there is a transfer, add related data to the payment intent.
-	if params.Transfer != nil {
-		intentParams.ConfirmationMethod = stripe.String(string(stripe.PaymentIntentConfirmationMethodAutomatic))
-		intentParams.ReturnURL = stripe.String(f.Callback)
-		intentParams.Confirm = stripe.Bool(true)
-		intentParams.ApplicationFeeAmount = stripe.Int64(int64(params.Amount - params.Transfer.Amount))
-		intentParams.OnBehalfOf = stripe.String(params.Transfer.Destination)
-		intentParams.TransferData = &stripe.PaymentIntentTransferDataParams{
-			Destination: stripe.String(params.Transfer.Destination),
-		}
-	}
+	client := balance.Client{B: stripe.GetBackend(stripe.APIBackend), Key: f.ApiKey}
+	_, err := client.Get(params)
+	return err
+}
 
-	// Create the payment intent in Stripe.
-	result, err := paymentintent.New(intentParams)
+// StripeGetBalanceTransaction retrieves a Stripe balance transaction (txn_...), which details the amount,
+// fees and availability date a charge, refund or transfer added to the balance.
+func (f Fiat) StripeGetBalanceTransaction(txID string) (*stripe.BalanceTransaction, error) {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	bt, err := balancetransaction.Get(txID, nil)
 	if err != nil {
-		return nil, err // Return any error encountered while creating the payment intent.
-	}
-	log.Printf("payment intent: %v", result)
-	// Create transaction info using the result from Stripe.
-	info := &FiatTransactionInfo{
-		TXID:        result.ID,
-		TotalAmount: result.Amount,
-		Date:        time.Now(),
-		Currency:    string(result.Currency),
-		Meta:        result,
+		return nil, newError(ErrCodeExternalService, err, "failed to get balance transaction")
 	}
+	return bt, nil
+}
 
-	if result.Status == stripe.PaymentIntentStatusRequiresAction {
-		info.RequiresAction = true
-		info.ClientSecret = result.ClientSecret
-		return info, nil
-	}
+// StripePayoutToBank pays out the platform's own Stripe balance to one of its bank accounts (ba_...), as opposed
+// to the Connect transfers made to connected accounts. The amount is in the currency's smallest unit and the
+// descriptor, if not empty, is shown on the bank statement.
+func (f Fiat) StripePayoutToBank(descriptor, bankAccountID string, amount int64, currency Currency) (*stripe.Payout, error) {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
 
-	if result.Status == stripe.PaymentIntentStatusRequiresConfirmation {
-		confirmed, err := paymentintent.Confirm(result.ID, nil)
-		if err != nil {
-			return info, err
-		}
-		result = confirmed
+	params := &stripe.PayoutParams{
+		Amount:      stripe.Int64(amount),
+		Currency:    stripe.String(string(currency)),
+		Destination: stripe.String(bankAccountID),
 	}
-
-	if result.Status != stripe.PaymentIntentStatusSucceeded {
-		return info, fmt.Errorf("Payment is not completed and is in the %s status", result.Status)
+	if descriptor != "" {
+		params.StatementDescriptor = stripe.String(descriptor)
 	}
 
-	info.Confirmed = true
-	return info, nil
-
-	// // Confirm the payment intent using the selected payment method.
-	// if _, err := paymentintent.Confirm(
-	// 	result.ID,
-	// 	&stripe.PaymentIntentConfirmParams{
-	// 		PaymentMethod: stripe.String(method.ID),
-	// 	},
-	// ); err != nil {
-	// 	return info, err // Return the transaction info and any errors during confirmation.
-	// }
+	p, err := payout.New(params)
+	if err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to create payout")
+	}
+	return p, nil
 }
 
-func (f Fiat) StripeConfirmPayment(params FiatPaymentConfirmParams) (*FiatPaymentConfirmInfo, error) {
-	// Set up the Stripe API key for authentication.
+// StripeAddBankAccount registers a bank account, given as a token (btok_...) created client-side, as an external
+// account of the platform's own Stripe account so it can receive payouts.
+func (f Fiat) StripeAddBankAccount(bankToken string) (*stripe.BankAccount, error) {
 	// @FIXME: it may cause data race
 	stripe.Key = f.ApiKey
 
-	intent, err := paymentintent.Get(params.PaymentIntentID, nil)
+	platform, err := account.Get()
 	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve payment intent: %v", err)
+		return nil, newError(ErrCodeExternalService, err, "failed to get platform account")
 	}
 
-	info := &FiatPaymentConfirmInfo{
-		PaymentIntent: intent,
-		IsConfirmed:   false,
+	ba, err := bankaccount.New(&stripe.BankAccountParams{
+		Account: stripe.String(platform.ID),
+		Token:   stripe.String(bankToken),
+	})
+	if err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to add bank account")
+	}
+	return ba, nil
+}
+
+func (f Fiat) FetchCards(customerID string) ([]*stripe.PaymentMethod, error) {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+	params := &stripe.PaymentMethodListParams{
+		Customer: stripe.String(customerID),
+		Type:     stripe.String("card"),
 	}
 
-	if intent.Status == stripe.PaymentIntentStatusSucceeded {
-		info.IsConfirmed = true
+	iter := paymentmethod.List(params)
+	var cards []*stripe.PaymentMethod
+
+	for iter.Next() {
+		pm := iter.PaymentMethod()
+		cards = append(cards, pm)
 	}
 
-	return info, nil
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	return cards, nil
 }
 
-// stripeAmount converts a floating point amount to the appropriate integer amount for the selected currency.
-func stripeAmount(amount float64, currency Currency) int64 {
-	switch currency {
-	case USD:
-		// Convert USD amount to cents.
-		return int64(amount * 100)
-	case JPY:
-		// JPY is typically in whole units, so no conversion necessary.
-		return int64(amount)
-	default:
-		// Default case returns 0 if the currency is unrecognized.
-		return 0
+// PaymentMethodDetails is the part of a payment method that is safe to display, e.g., "Visa ending in 4242".
+// For bank accounts, Brand holds the bank name if known and the expiry is empty.
+type PaymentMethodDetails struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	Last4     string `json:"last4"`
+	Brand     string `json:"brand"`
+	ExpMonth  string `json:"exp_month"` // Two-digit month, e.g., "04"
+	ExpYear   string `json:"exp_year"`
+	IsDefault bool   `json:"is_default"` // Whether it is the customer's default payment method for invoices
+}
+
+// newPaymentMethodDetails maps a Stripe payment method to its displayable details.
+func newPaymentMethodDetails(pm *stripe.PaymentMethod, defaultID string) *PaymentMethodDetails {
+	details := &PaymentMethodDetails{
+		ID:        pm.ID,
+		Type:      string(pm.Type),
+		IsDefault: pm.ID == defaultID,
+	}
+	switch {
+	case pm.Card != nil:
+		details.Last4 = pm.Card.Last4
+		details.Brand = string(pm.Card.Brand)
+		details.ExpMonth = fmt.Sprintf("%02d", pm.Card.ExpMonth)
+		details.ExpYear = strconv.FormatInt(pm.Card.ExpYear, 10)
+	case pm.USBankAccount != nil:
+		details.Last4 = pm.USBankAccount.Last4
+		details.Brand = pm.USBankAccount.BankName
+	case pm.SEPADebit != nil:
+		details.Last4 = pm.SEPADebit.Last4
 	}
+	return details
 }
 
-func (f Fiat) AddCustomer(email string) (*stripe.Customer, error) {
+// stripeDefaultPaymentMethodID returns the ID of the customer's default payment method for invoices, if any.
+func stripeDefaultPaymentMethodID(customerID string) (string, error) {
+	c, err := customer.Get(customerID, nil)
+	if err != nil {
+		return "", newError(ErrCodeExternalService, err, "failed to get customer")
+	}
+	if c.InvoiceSettings == nil || c.InvoiceSettings.DefaultPaymentMethod == nil {
+		return "", nil
+	}
+	return c.InvoiceSettings.DefaultPaymentMethod.ID, nil
+}
+
+// StripeGetPaymentMethodDetails retrieves the displayable details of a Stripe payment method, without the rest
+// of the Stripe object. IsDefault is set from the default payment method of the customer it is attached to.
+func (f Fiat) StripeGetPaymentMethodDetails(pmID string) (*PaymentMethodDetails, error) {
 	// @FIXME: it may cause data race
 	stripe.Key = f.ApiKey
 
-	c, err := customer.New(&stripe.CustomerParams{
-		Email: stripe.String(email),
-	})
+	pm, err := paymentmethod.Get(pmID, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create customer: %v", err)
+		return nil, newError(ErrCodeExternalService, err, "failed to get payment method")
 	}
 
-	return c, nil
+	var defaultID string
+	if pm.Customer != nil {
+		if defaultID, err = stripeDefaultPaymentMethodID(pm.Customer.ID); err != nil {
+			return nil, err
+		}
+	}
+	return newPaymentMethodDetails(pm, defaultID), nil
 }
 
-func (f Fiat) AttachPaymentMethod(customerID string, cardToken string) (*stripe.PaymentMethod, error) {
+// StripeListPaymentMethodDetails lists the displayable details of all the customer's Stripe payment methods.
+func (f Fiat) StripeListPaymentMethodDetails(customerID string) ([]*PaymentMethodDetails, error) {
 	// @FIXME: it may cause data race
 	stripe.Key = f.ApiKey
 
-	pm, err := paymentmethod.New(&stripe.PaymentMethodParams{
-		Type: stripe.String("card"),
-		Card: &stripe.PaymentMethodCardParams{
-			Token: stripe.String(cardToken),
-		},
-	})
+	defaultID, err := stripeDefaultPaymentMethodID(customerID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create payment method: %v", err)
+		return nil, err
 	}
-	// 3. Attach payment method to customer
-	paymentmethod.Attach(pm.ID, &stripe.PaymentMethodAttachParams{
+
+	iter := paymentmethod.List(&stripe.PaymentMethodListParams{
 		Customer: stripe.String(customerID),
 	})
+	details := []*PaymentMethodDetails{}
+	for iter.Next() {
+		details = append(details, newPaymentMethodDetails(iter.PaymentMethod(), defaultID))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to list payment methods")
+	}
+	return details, nil
+}
 
-	_, err = customer.Update(customerID, &stripe.CustomerParams{
+// StripeSetDefaultPaymentMethod makes an attached payment method the customer's default for invoices and
+// off-session payments, e.g., when a user switches between saved cards.
+func (f Fiat) StripeSetDefaultPaymentMethod(customerID, pmID string) error {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	if _, err := customer.Update(customerID, &stripe.CustomerParams{
 		InvoiceSettings: &stripe.CustomerInvoiceSettingsParams{
-			DefaultPaymentMethod: stripe.String(pm.ID),
+			DefaultPaymentMethod: stripe.String(pmID),
 		},
-	})
+	}); err != nil {
+		return newError(ErrCodeExternalService, err, "failed to set default payment method")
+	}
+	return nil
+}
+
+// StripeGetDefaultPaymentMethod returns the customer's default payment method, or a not found error if the
+// customer has none.
+func (f Fiat) StripeGetDefaultPaymentMethod(customerID string) (*stripe.PaymentMethod, error) {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	pmID, err := stripeDefaultPaymentMethodID(customerID)
+	if err != nil {
+		return nil, err
+	}
+	if pmID == "" {
+		return nil, newError(ErrCodeNotFound, nil, "customer %s has no default payment method", customerID)
+	}
+
+	pm, err := paymentmethod.Get(pmID, nil)
 	if err != nil {
-		return pm, fmt.Errorf("attached payment method but failed to set as default: %w", err)
+		return nil, newError(ErrCodeExternalService, err, "failed to get payment method")
 	}
 	return pm, nil
 }
 
-func (f Fiat) FetchCards(customerID string) ([]*stripe.PaymentMethod, error) {
+// GetTransferStatus retrieves a Stripe transfer so its status (amount reversed, destination payment, etc.) can be inspected.
+func (f Fiat) GetTransferStatus(transferID string) (*stripe.Transfer, error) {
 	// @FIXME: it may cause data race
 	stripe.Key = f.ApiKey
-	params := &stripe.PaymentMethodListParams{
-		Customer: stripe.String(customerID),
-		Type:     stripe.String("card"),
+
+	t, err := transfer.Get(transferID, nil)
+	if err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to get transfer")
 	}
+	return t, nil
+}
 
-	iter := paymentmethod.List(params)
-	var cards []*stripe.PaymentMethod
+// ListTransfers lists Stripe transfers, newest first, matching the given filters.
+func (f Fiat) ListTransfers(params StripeTransferListParams) ([]*stripe.Transfer, error) {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	listParams := &stripe.TransferListParams{Destination: params.Destination}
+	if params.CreatedAfter != nil || params.CreatedBefore != nil {
+		listParams.CreatedRange = &stripe.RangeQueryParams{}
+		if params.CreatedAfter != nil {
+			listParams.CreatedRange.GreaterThanOrEqual = *params.CreatedAfter
+		}
+		if params.CreatedBefore != nil {
+			listParams.CreatedRange.LesserThanOrEqual = *params.CreatedBefore
+		}
+	}
+	if params.Limit > 0 {
+		listParams.Limit = stripe.Int64(params.Limit)
+	}
+
+	iter := transfer.List(listParams)
+	var transfers []*stripe.Transfer
 
 	for iter.Next() {
-		pm := iter.PaymentMethod()
-		cards = append(cards, pm)
+		transfers = append(transfers, iter.Transfer())
+		if params.Limit > 0 && int64(len(transfers)) >= params.Limit {
+			break
+		}
 	}
 
 	if err := iter.Err(); err != nil {
-		return nil, err
+		return nil, newError(ErrCodeExternalService, err, "failed to list transfers")
 	}
 
-	return cards, nil
+	return transfers, nil
 }
 
 func (f Fiat) DeleteCard(paymentMethodID string) error {
@@ -305,7 +2193,7 @@ func (f Fiat) DeleteCard(paymentMethodID string) error {
 	stripe.Key = f.ApiKey
 
 	if _, err := paymentmethod.Detach(paymentMethodID, nil); err != nil {
-		return fmt.Errorf("failed to detach payment method: %v", err)
+		return newError(ErrCodeExternalService, err, "failed to detach payment method")
 	}
 
 	return nil
@@ -336,7 +2224,7 @@ func (f Fiat) CreateAccount(country string) (*stripe.Account, error) {
 	})
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to create account: %v", err)
+		return nil, newError(ErrCodeExternalService, err, "failed to create account")
 	}
 
 	return acc, nil
@@ -354,7 +2242,7 @@ func (f Fiat) CreateAccountLink(account *stripe.Account, redirectURL string) (*s
 	})
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to create account link: %v", err)
+		return nil, newError(ErrCodeExternalService, err, "failed to create account link")
 	}
 
 	return accountLink, nil
@@ -367,8 +2255,78 @@ func (f Fiat) FetchAccount(accountID string) (*stripe.Account, error) {
 	acc, err := account.GetByID(accountID, nil)
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to create account link: %v", err)
+		return nil, newError(ErrCodeExternalService, err, "failed to create account link")
 	}
 
 	return acc, nil
 }
+
+// GetAccountOnboardingStatus reports whether a connected account has completed onboarding.
+func (f Fiat) GetAccountOnboardingStatus(accountID string) (OnboardingStatus, error) {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	acc, err := account.GetByID(accountID, nil)
+	if err != nil {
+		return OnboardingStatus{}, newError(ErrCodeExternalService, err, "failed to fetch account")
+	}
+
+	status := OnboardingStatus{
+		ChargesEnabled:   acc.ChargesEnabled,
+		PayoutsEnabled:   acc.PayoutsEnabled,
+		DetailsSubmitted: acc.DetailsSubmitted,
+		Requirements:     []string{},
+	}
+	if acc.Requirements != nil {
+		status.Requirements = append(status.Requirements, acc.Requirements.CurrentlyDue...)
+	}
+
+	return status, nil
+}
+
+// GetConnectedAccountDetails fetches a connected account and maps it to ConnectedAccountDetails.
+func (f Fiat) GetConnectedAccountDetails(accountID string) (*ConnectedAccountDetails, error) {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	acc, err := account.GetByID(accountID, nil)
+	if err != nil {
+		return nil, newError(ErrCodeExternalService, err, "failed to fetch account")
+	}
+
+	details := &ConnectedAccountDetails{
+		ID:               acc.ID,
+		Email:            acc.Email,
+		Country:          acc.Country,
+		BusinessType:     string(acc.BusinessType),
+		ChargesEnabled:   acc.ChargesEnabled,
+		PayoutsEnabled:   acc.PayoutsEnabled,
+		DetailsSubmitted: acc.DetailsSubmitted,
+		Requirements:     []string{},
+		DefaultCurrency:  string(acc.DefaultCurrency),
+	}
+	if acc.Requirements != nil {
+		details.Requirements = append(details.Requirements, acc.Requirements.CurrentlyDue...)
+	}
+
+	return details, nil
+}
+
+// UpdateConnectedAccount updates the email and business website of a connected account. Empty values are left unchanged.
+func (f Fiat) UpdateConnectedAccount(accountID string, email, businessURL string) error {
+	// @FIXME: it may cause data race
+	stripe.Key = f.ApiKey
+
+	params := &stripe.AccountParams{}
+	if email != "" {
+		params.Email = stripe.String(email)
+	}
+	if businessURL != "" {
+		params.BusinessProfile = &stripe.AccountBusinessProfileParams{URL: stripe.String(businessURL)}
+	}
+
+	if _, err := account.Update(accountID, params); err != nil {
+		return newError(ErrCodeExternalService, err, "failed to update account")
+	}
+	return nil
+}
@@ -0,0 +1,1280 @@
+package gopay_test
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/socious-io/gopay"
+	"github.com/socious-io/gopay/testutil"
+	"github.com/stripe/stripe-go/v81"
+)
+
+func TestFiatsBuildIndex(t *testing.T) {
+	fiats := gopay.Fiats{
+		{Name: "stripe", Service: gopay.STRIPE},
+		{Name: "stripe-jp", Service: gopay.STRIPE},
+	}
+
+	index, err := fiats.BuildIndex()
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if f, ok := index.FindByName("stripe-jp"); !ok || f.Name != "stripe-jp" {
+		t.Errorf("Expected stripe-jp service to be indexed, but got %v", f)
+	}
+	if _, ok := fiats.FindByName("paypal"); ok {
+		t.Errorf("Expected paypal service not to be found")
+	}
+
+	fiats = append(fiats, gopay.Fiat{Name: "stripe"})
+	if _, err := fiats.BuildIndex(); err == nil {
+		t.Errorf("Expected duplicate fiat service name error, but got nil")
+	}
+}
+
+func TestFiatValidate(t *testing.T) {
+	if err := (gopay.Fiat{Name: "stripe", ApiKey: "sk_test"}).Validate(); err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+	if err := (gopay.Fiat{Name: "stripe"}).Validate(); err == nil {
+		t.Errorf("Expected missing api key error, but got nil")
+	}
+	if err := (gopay.Fiat{ApiKey: "sk_test"}).Validate(); err == nil {
+		t.Errorf("Expected missing name error, but got nil")
+	}
+
+	fiats := gopay.Fiats{
+		{Name: "stripe", ApiKey: "sk_test"},
+		{Name: "stripe", ApiKey: "sk_test"},
+	}
+	if err := fiats.Validate(); err == nil || !strings.Contains(err.Error(), "duplicate fiat service name stripe") {
+		t.Errorf("Expected duplicate name error, but got %v", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := gopay.Config{
+		Fiats:  gopay.Fiats{{Name: "stripe"}},
+		Chains: gopay.Chains{{Name: "Ethereum"}},
+	}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatalf("Expected validation error, but got nil")
+	}
+	for _, violation := range []string{
+		"database connection is required",
+		"fiat service stripe: api key is required",
+		"chain Ethereum: explorer is required",
+	} {
+		if !strings.Contains(err.Error(), violation) {
+			t.Errorf("Expected error to contain %q, but got %v", violation, err)
+		}
+	}
+}
+
+func TestStripeCreatePaymentLink(t *testing.T) {
+	var linkForm url.Values
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.URL.Path {
+		case "/v1/prices":
+			if r.Form.Get("unit_amount") != "1250" || r.Form.Get("currency") != "USD" {
+				t.Errorf("Unexpected price params %v", r.Form)
+			}
+			w.Write([]byte(`{"id": "price_123", "object": "price"}`))
+		case "/v1/payment_links":
+			linkForm = r.Form
+			w.Write([]byte(`{"id": "plink_123", "object": "payment_link", "url": "https://buy.stripe.com/test_123"}`))
+		default:
+			t.Errorf("Unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	fiats := gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}
+	link, err := fiats.CreatePaymentLink("stripe", gopay.PaymentLinkParams{
+		Amount:        12.5,
+		Currency:      gopay.USD,
+		Description:   "Consulting",
+		CustomerEmail: "customer@example.com",
+		SuccessURL:    "https://example.com/thanks",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if link.ID != "plink_123" || link.URL != "https://buy.stripe.com/test_123" {
+		t.Errorf("Expected payment link plink_123 at its URL, but got %s %s", link.ID, link.URL)
+	}
+	if linkForm.Get("line_items[0][price]") != "price_123" {
+		t.Errorf("Expected payment link to sell price_123, but got %v", linkForm)
+	}
+	if linkForm.Get("after_completion[redirect][url]") != "https://example.com/thanks" {
+		t.Errorf("Expected success redirect, but got %v", linkForm)
+	}
+	if linkForm.Get("metadata[customer_email]") != "customer@example.com" {
+		t.Errorf("Expected customer email metadata, but got %v", linkForm)
+	}
+}
+
+func TestStripeInvoiceLifecycle(t *testing.T) {
+	var itemForm, invoiceForm url.Values
+	var calls []string
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		calls = append(calls, r.URL.Path)
+		switch r.URL.Path {
+		case "/v1/invoiceitems":
+			itemForm = r.Form
+			w.Write([]byte(`{"id": "ii_123", "object": "invoiceitem"}`))
+		case "/v1/invoices":
+			invoiceForm = r.Form
+			w.Write([]byte(`{"id": "in_123", "object": "invoice", "status": "draft", "currency": "usd"}`))
+		case "/v1/invoices/in_123/finalize":
+			w.Write([]byte(`{"id": "in_123", "object": "invoice", "status": "open", "currency": "usd"}`))
+		case "/v1/invoices/in_123/pay":
+			w.Write([]byte(`{"id": "in_123", "object": "invoice", "status": "paid", "currency": "usd", "amount_paid": 4999, "payment_intent": "pi_123"}`))
+		default:
+			t.Errorf("Unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	fiats := gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}
+	due := time.Date(2025, 9, 1, 0, 0, 0, 0, time.UTC)
+	inv, err := fiats.CreateInvoice(gopay.InvoiceParams{
+		ServiceName: "stripe",
+		CustomerID:  "cus_123",
+		Description: "Consulting",
+		Amount:      49.99,
+		Currency:    gopay.USD,
+		DueDate:     due,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if inv.ID != "in_123" || inv.Status != stripe.InvoiceStatusDraft {
+		t.Errorf("Expected a draft invoice, but got %+v", inv)
+	}
+	if itemForm.Get("customer") != "cus_123" || itemForm.Get("amount") != "4999" {
+		t.Errorf("Unexpected invoice item params %v", itemForm)
+	}
+	if invoiceForm.Get("collection_method") != "send_invoice" || invoiceForm.Get("due_date") != fmt.Sprint(due.Unix()) || invoiceForm.Get("pending_invoice_items_behavior") != "include" {
+		t.Errorf("Unexpected invoice params %v", invoiceForm)
+	}
+
+	inv, err = fiats.FinalizeInvoice(gopay.InvoicePayParams{ServiceName: "stripe", InvoiceID: "in_123"})
+	if err != nil || inv.Status != stripe.InvoiceStatusOpen {
+		t.Fatalf("Expected the invoice to be finalized, but got %+v, %v", inv, err)
+	}
+
+	info, err := fiats.PayInvoice(gopay.InvoicePayParams{ServiceName: "stripe", InvoiceID: "in_123"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if !info.Confirmed || info.TotalAmount != 49.99 || info.TXID != "pi_123" {
+		t.Errorf("Expected the paid invoice info, but got %+v", info)
+	}
+	if !reflect.DeepEqual(calls, []string{"/v1/invoiceitems", "/v1/invoices", "/v1/invoices/in_123/finalize", "/v1/invoices/in_123/pay"}) {
+		t.Errorf("Unexpected Stripe calls %v", calls)
+	}
+
+	if _, err := fiats.PayInvoice(gopay.InvoicePayParams{ServiceName: "unknown", InvoiceID: "in_123"}); !gopay.IsNotFound(err) {
+		t.Errorf("Expected an unknown service to be rejected, but got %v", err)
+	}
+}
+
+func TestStripePayAmountCurrencies(t *testing.T) {
+	var amount string
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.URL.Path {
+		case "/v1/payment_methods":
+			w.Write([]byte(`{"object": "list", "data": [{"id": "pm_123", "object": "payment_method"}], "has_more": false}`))
+		case "/v1/payment_intents":
+			amount = r.Form.Get("amount")
+			w.Write([]byte(`{"id": "pi_123", "object": "payment_intent", "amount": 1225, "currency": "eur", "status": "succeeded"}`))
+		default:
+			t.Errorf("Unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	cases := []struct {
+		currency gopay.Currency
+		expected string
+	}{
+		{gopay.USD, "1225"},
+		{gopay.EUR, "1225"},
+		{gopay.GBP, "1225"},
+		{gopay.JPY, "12"},
+	}
+	f := gopay.Fiat{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}
+	for _, c := range cases {
+		if _, err := f.StripePay(gopay.FiatParams{Customer: "cus_123", Amount: 12.25, Currency: c.currency}); err != nil {
+			t.Fatalf("%s: expected no error, but got %v", c.currency, err)
+		}
+		if amount != c.expected {
+			t.Errorf("%s: expected amount %s, but got %s", c.currency, c.expected, amount)
+		}
+	}
+}
+
+func TestStripePayMetadata(t *testing.T) {
+	var intentForm url.Values
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.URL.Path {
+		case "/v1/payment_methods":
+			w.Write([]byte(`{"object": "list", "data": [{"id": "pm_123", "object": "payment_method"}], "has_more": false}`))
+		case "/v1/payment_intents":
+			intentForm = r.Form
+			w.Write([]byte(`{"id": "pi_123", "object": "payment_intent", "amount": 1000, "currency": "usd", "status": "succeeded"}`))
+		default:
+			t.Errorf("Unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	f := gopay.Fiat{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}
+	info, err := f.StripePay(gopay.FiatParams{
+		Customer: "cus_123",
+		Amount:   10,
+		Currency: gopay.USD,
+		Metadata: map[string]string{gopay.PaymentIDMetadataKey: "payment-id"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if !info.Confirmed || info.TXID != "pi_123" {
+		t.Errorf("Unexpected transaction info %+v", info)
+	}
+	if intentForm.Get("metadata[gopay_payment_id]") != "payment-id" {
+		t.Errorf("Expected payment ID metadata on the intent, but got %v", intentForm)
+	}
+}
+
+func TestStripePayMultiTransfer(t *testing.T) {
+	var intentForm url.Values
+	var transferForms []url.Values
+	idempotencyKeys := map[string]bool{}
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.URL.Path {
+		case "/v1/payment_methods":
+			w.Write([]byte(`{"object": "list", "data": [{"id": "pm_123", "object": "payment_method"}], "has_more": false}`))
+		case "/v1/payment_intents":
+			intentForm = r.Form
+			w.Write([]byte(`{"id": "pi_123", "object": "payment_intent", "amount": 10000, "currency": "usd", "status": "succeeded", "latest_charge": "ch_123"}`))
+		case "/v1/transfers":
+			transferForms = append(transferForms, r.Form)
+			idempotencyKeys[r.Header.Get("Idempotency-Key")] = true
+			fmt.Fprintf(w, `{"id": "tr_%d", "object": "transfer"}`, len(transferForms))
+		default:
+			t.Errorf("Unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	f := gopay.Fiat{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}
+	info, err := f.StripePay(gopay.FiatParams{
+		Customer: "cus_123",
+		Amount:   100,
+		Currency: gopay.USD,
+		Transfers: []gopay.MultiTransfer{
+			{Amount: 70, Destination: "acct_seller"},
+			{Amount: 15.5, Destination: "acct_referrer", Description: "referrer"},
+			{Amount: 4.5, Destination: "acct_partner"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	// The platform keeps $10 as its fee and $20 for the other transfers
+	if intentForm.Get("transfer_data[destination]") != "acct_seller" || intentForm.Get("application_fee_amount") != "3000" {
+		t.Errorf("Unexpected payment intent params %v", intentForm)
+	}
+	if len(transferForms) != 2 || len(idempotencyKeys) != 2 {
+		t.Fatalf("Expected 2 separate transfers with distinct idempotency keys, but got %v", transferForms)
+	}
+	expected := []struct{ destination, amount, description string }{
+		{"acct_referrer", "1550", "referrer"},
+		{"acct_partner", "450", ""},
+	}
+	for i, e := range expected {
+		form := transferForms[i]
+		if form.Get("destination") != e.destination || form.Get("amount") != e.amount || form.Get("description") != e.description ||
+			form.Get("source_transaction") != "ch_123" || form.Get("transfer_group") != "pi_123" {
+			t.Errorf("Unexpected transfer params %v", form)
+		}
+	}
+	if !info.Confirmed || strings.Join(info.TransferIDs, ",") != "tr_1,tr_2" {
+		t.Errorf("Unexpected transaction info %+v", info)
+	}
+}
+
+func TestStripeChargeState(t *testing.T) {
+	const intent = `{"id": "pi_123", "object": "payment_intent", "amount": 10000, "currency": "usd", "status": "succeeded",
+		"latest_charge": {"id": "ch_123", "object": "charge", "amount_refunded": 2550}}`
+	var expands []string
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.URL.Path {
+		case "/v1/payment_methods":
+			w.Write([]byte(`{"object": "list", "data": [{"id": "pm_123", "object": "payment_method"}], "has_more": false}`))
+		case "/v1/payment_intents", "/v1/payment_intents/pi_123":
+			expands = append(expands, r.Form.Get("expand[0]"))
+			w.Write([]byte(intent))
+		default:
+			t.Errorf("Unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	f := gopay.Fiat{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}
+	info, err := f.StripePay(gopay.FiatParams{Customer: "cus_123", Amount: 100, Currency: gopay.USD})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if info.ChargeID != "ch_123" || info.RefundedAmount != 25.5 {
+		t.Errorf("Expected charge ch_123 with 25.5 refunded, but got %s with %v", info.ChargeID, info.RefundedAmount)
+	}
+
+	confirm, err := f.StripeConfirmPayment(gopay.FiatPaymentConfirmParams{PaymentIntentID: "pi_123"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if !confirm.IsConfirmed || confirm.Amount != 10000 || confirm.AmountRefunded != 2550 || confirm.ChargeID != "ch_123" {
+		t.Errorf("Unexpected confirm info %+v", confirm)
+	}
+
+	for _, expand := range expands {
+		if expand != "latest_charge" {
+			t.Errorf("Expected the latest charge to be expanded, but got %v", expands)
+		}
+	}
+}
+
+func TestDeleteCustomer(t *testing.T) {
+	var requests []string
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		switch r.URL.Path {
+		case "/v1/payment_methods":
+			w.Write([]byte(`{"object": "list", "data": [{"id": "pm_1", "object": "payment_method"}, {"id": "pm_2", "object": "payment_method"}], "has_more": false}`))
+		case "/v1/payment_methods/pm_1/detach", "/v1/payment_methods/pm_2/detach":
+			w.Write([]byte(`{"id": "pm", "object": "payment_method"}`))
+		case "/v1/customers/cus_123":
+			w.Write([]byte(`{"id": "cus_123", "object": "customer", "deleted": true}`))
+		default:
+			t.Errorf("Unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	fiats := gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}
+	if err := fiats.DeleteCustomer("stripe", "cus_123"); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	expected := []string{
+		"GET /v1/payment_methods",
+		"POST /v1/payment_methods/pm_1/detach",
+		"POST /v1/payment_methods/pm_2/detach",
+		"DELETE /v1/customers/cus_123",
+	}
+	if strings.Join(requests, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("Expected requests %v, but got %v", expected, requests)
+	}
+}
+
+func TestAnonymizeCustomer(t *testing.T) {
+	var form url.Values
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/customers/cus_123" {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		r.ParseForm()
+		form = r.Form
+		w.Write([]byte(`{"id": "cus_123", "object": "customer"}`))
+	})
+
+	fiats := gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}
+	if err := fiats.AnonymizeCustomer("stripe", "cus_123"); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if _, ok := form["email"]; !ok || form.Get("email") != "" {
+		t.Errorf("Expected email to be cleared, but got %v", form)
+	}
+	if _, ok := form["name"]; !ok || form.Get("name") != "" {
+		t.Errorf("Expected name to be cleared, but got %v", form)
+	}
+}
+
+func TestListTransfers(t *testing.T) {
+	var query url.Values
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/transfers" {
+			t.Errorf("Unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		query = r.URL.Query()
+		w.Write([]byte(`{"object": "list", "data": [
+			{"id": "tr_1", "object": "transfer", "amount": 500},
+			{"id": "tr_2", "object": "transfer", "amount": 700}
+		], "has_more": true}`))
+	})
+
+	fiats := gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}
+	transfers, err := fiats.ListTransfers("stripe", gopay.StripeTransferListParams{
+		Destination:  stripe.String("acct_123"),
+		Limit:        2,
+		CreatedAfter: stripe.Int64(1700000000),
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if len(transfers) != 2 || transfers[0].ID != "tr_1" {
+		t.Errorf("Expected transfers tr_1 and tr_2, but got %v", transfers)
+	}
+	if query.Get("destination") != "acct_123" || query.Get("limit") != "2" || query.Get("created[gte]") != "1700000000" {
+		t.Errorf("Unexpected transfer list params %v", query)
+	}
+}
+
+func TestListCustomers(t *testing.T) {
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/customers" {
+			t.Errorf("Unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("starting_after") == "cus_2" {
+			w.Write([]byte(`{"object": "list", "data": [{"id": "cus_3", "object": "customer"}], "has_more": false}`))
+			return
+		}
+		w.Write([]byte(`{"object": "list", "data": [
+			{"id": "cus_1", "object": "customer"},
+			{"id": "cus_2", "object": "customer"}
+		], "has_more": true}`))
+	})
+
+	fiats := gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}
+	customers, cursor, err := fiats.ListCustomers("stripe", 2, "")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if len(customers) != 2 || cursor != "cus_2" {
+		t.Errorf("Expected 2 customers and cursor cus_2, but got %d and %q", len(customers), cursor)
+	}
+
+	customers, cursor, err = fiats.ListCustomers("stripe", 2, cursor)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if len(customers) != 1 || customers[0].ID != "cus_3" || cursor != "" {
+		t.Errorf("Expected last page with cus_3 and no cursor, but got %v and %q", customers, cursor)
+	}
+}
+
+func TestSearchCustomers(t *testing.T) {
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/customers/search" {
+			t.Errorf("Unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if q := r.URL.Query().Get("query"); q != "email:'jane@example.com'" {
+			t.Errorf("Unexpected search query %s", q)
+		}
+		w.Write([]byte(`{"object": "search_result", "data": [{"id": "cus_1", "object": "customer", "email": "jane@example.com"}], "has_more": false}`))
+	})
+
+	fiats := gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}
+	customers, err := fiats.SearchCustomers("stripe", "jane@example.com")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if len(customers) != 1 || customers[0].ID != "cus_1" {
+		t.Errorf("Expected customer cus_1, but got %v", customers)
+	}
+}
+
+func TestCreateCustomerPortalSession(t *testing.T) {
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.URL.Path != "/v1/billing_portal/sessions" {
+			t.Errorf("Unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Form.Get("customer") != "cus_123" || r.Form.Get("return_url") != "https://example.com/account" {
+			t.Errorf("Unexpected portal session params %v", r.Form)
+		}
+		w.Write([]byte(`{"id": "bps_123", "object": "billing_portal.session", "url": "https://billing.stripe.com/p/session/test_123"}`))
+	})
+
+	fiats := gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}
+	url, err := fiats.CreateCustomerPortalSession("stripe", "cus_123", "https://example.com/account")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if url != "https://billing.stripe.com/p/session/test_123" {
+		t.Errorf("Expected portal session URL, but got %s", url)
+	}
+}
+
+func TestStripeConfigurePortal(t *testing.T) {
+	var updated url.Values
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/billing_portal/configurations":
+			if r.URL.Query().Get("is_default") != "true" {
+				t.Errorf("Expected to look up the default configuration, but got %v", r.URL.Query())
+			}
+			w.Write([]byte(`{"object": "list", "data": [{"id": "bpc_123", "object": "billing_portal.configuration", "is_default": true}], "has_more": false}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/billing_portal/configurations/bpc_123":
+			updated = r.Form
+			w.Write([]byte(`{"id": "bpc_123", "object": "billing_portal.configuration", "is_default": true}`))
+		default:
+			t.Errorf("Unexpected request to %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	fiat := gopay.Fiat{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}
+	err := fiat.StripeConfigurePortal(gopay.PortalFeatures{
+		PaymentMethodUpdate: true,
+		InvoiceHistory:      true,
+		CustomerUpdate:      []string{"email"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if updated.Get("features[payment_method_update][enabled]") != "true" ||
+		updated.Get("features[customer_update][allowed_updates][0]") != "email" ||
+		updated.Get("features[subscription_cancel][enabled]") != "false" {
+		t.Errorf("Unexpected portal configuration params %v", updated)
+	}
+}
+
+func TestEphemeralKey(t *testing.T) {
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.URL.Path != "/v1/ephemeral_keys" {
+			t.Errorf("Unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if v := r.Header.Get("Stripe-Version"); v != "2024-06-20" {
+			t.Errorf("Expected Stripe-Version 2024-06-20, but got %s", v)
+		}
+		w.Write([]byte(`{"id": "ephkey_123", "object": "ephemeral_key", "secret": "ek_test_123",
+			"associated_objects": [{"id": "` + r.Form.Get("customer") + `", "type": "customer"}]}`))
+	})
+
+	fiats := gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}
+	raw, err := fiats.EphemeralKey("stripe", "cus_123", "2024-06-20")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	var key struct {
+		Secret            string `json:"secret"`
+		AssociatedObjects []struct {
+			ID   string `json:"id"`
+			Type string `json:"type"`
+		} `json:"associated_objects"`
+	}
+	if err := json.Unmarshal([]byte(raw), &key); err != nil {
+		t.Fatalf("Expected the key to be JSON, but got %v", err)
+	}
+	if key.Secret != "ek_test_123" || len(key.AssociatedObjects) != 1 ||
+		key.AssociatedObjects[0].Type != "customer" || key.AssociatedObjects[0].ID != "cus_123" {
+		t.Errorf("Expected a key for customer cus_123, but got %s", raw)
+	}
+}
+
+func TestCreateUSBankAccountPM(t *testing.T) {
+	var pmForm, siForm url.Values
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.URL.Path {
+		case "/v1/customers/cus_123":
+			w.Write([]byte(`{"id": "cus_123", "object": "customer", "name": "Jane Doe"}`))
+		case "/v1/payment_methods":
+			pmForm = r.Form
+			w.Write([]byte(`{"id": "pm_123", "object": "payment_method", "type": "us_bank_account"}`))
+		case "/v1/setup_intents":
+			siForm = r.Form
+			w.Write([]byte(`{"id": "seti_123", "object": "setup_intent", "payment_method": "pm_123", "status": "requires_action", "next_action": {"type": "verify_with_microdeposits"}}`))
+		default:
+			t.Errorf("Unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	fiats := gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}
+	si, err := fiats.CreateUSBankAccountPM("stripe", "cus_123", "110000000", "000123456789", "savings")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if si.ID != "seti_123" || si.PaymentMethod == nil || si.PaymentMethod.ID != "pm_123" {
+		t.Errorf("Expected setup intent seti_123 for pm_123, but got %+v", si)
+	}
+	if pmForm.Get("type") != "us_bank_account" ||
+		pmForm.Get("us_bank_account[routing_number]") != "110000000" ||
+		pmForm.Get("us_bank_account[account_number]") != "000123456789" ||
+		pmForm.Get("us_bank_account[account_type]") != "savings" ||
+		pmForm.Get("billing_details[name]") != "Jane Doe" {
+		t.Errorf("Unexpected payment method params %v", pmForm)
+	}
+	if siForm.Get("customer") != "cus_123" ||
+		siForm.Get("payment_method") != "pm_123" ||
+		siForm.Get("payment_method_types[0]") != "us_bank_account" ||
+		siForm.Get("payment_method_options[us_bank_account][verification_method]") != "microdeposits" ||
+		siForm.Get("confirm") != "true" ||
+		siForm.Get("mandate_data[customer_acceptance][type]") != "offline" {
+		t.Errorf("Unexpected setup intent params %v", siForm)
+	}
+}
+
+func TestVerifyMicrodeposits(t *testing.T) {
+	var form url.Values
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.URL.Path != "/v1/setup_intents/seti_123/verify_microdeposits" {
+			t.Errorf("Unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		form = r.Form
+		w.Write([]byte(`{"id": "seti_123", "object": "setup_intent", "status": "succeeded"}`))
+	})
+
+	fiats := gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}
+	if err := fiats.VerifyMicrodeposits("stripe", "seti_123", []int32{32, 45}); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if form.Get("amounts[0]") != "32" || form.Get("amounts[1]") != "45" {
+		t.Errorf("Unexpected microdeposit params %v", form)
+	}
+}
+
+func TestUSBankAccountCreateAndVerify(t *testing.T) {
+	verified := false
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.URL.Path {
+		case "/v1/customers/cus_123":
+			w.Write([]byte(`{"id": "cus_123", "object": "customer", "email": "jane@example.com"}`))
+		case "/v1/payment_methods":
+			w.Write([]byte(`{"id": "pm_123", "object": "payment_method", "type": "us_bank_account"}`))
+		case "/v1/setup_intents":
+			w.Write([]byte(`{"id": "seti_123", "object": "setup_intent", "payment_method": "pm_123", "status": "requires_action"}`))
+		case "/v1/setup_intents/seti_123/verify_microdeposits":
+			verified = true
+			w.Write([]byte(`{"id": "seti_123", "object": "setup_intent", "payment_method": "pm_123", "status": "succeeded"}`))
+		default:
+			t.Errorf("Unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	fiats := gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}
+	si, err := fiats.CreateUSBankAccountPM("stripe", "cus_123", "110000000", "000123456789", "")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if err := fiats.VerifyMicrodeposits("stripe", si.ID, []int32{32, 45}); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if !verified {
+		t.Error("Expected the setup intent created with the bank account to be verified")
+	}
+}
+
+func TestDisputes(t *testing.T) {
+	var evidence url.Values
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/disputes/dp_123":
+			evidence = r.Form
+			w.Write([]byte(`{"id": "dp_123", "object": "dispute", "status": "under_review"}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/disputes/dp_123":
+			w.Write([]byte(`{"id": "dp_123", "object": "dispute", "status": "needs_response"}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/disputes":
+			w.Write([]byte(`{"object": "list", "data": [{"id": "dp_123", "object": "dispute"}, {"id": "dp_456", "object": "dispute"}], "has_more": true}`))
+		default:
+			t.Errorf("Unexpected request to %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	fiats := gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}
+	d, err := fiats.DisputeRespond("stripe", "dp_123", gopay.DisputeEvidence{
+		CustomerEmailAddress: "jane@example.com",
+		ProductDescription:   "Consulting session",
+		Submit:               true,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if d.Status != "under_review" {
+		t.Errorf("Expected dispute under review, but got %s", d.Status)
+	}
+	if evidence.Get("evidence[customer_email_address]") != "jane@example.com" ||
+		evidence.Get("evidence[product_description]") != "Consulting session" ||
+		evidence.Get("submit") != "true" || evidence.Has("evidence[customer_name]") {
+		t.Errorf("Unexpected dispute evidence params %v", evidence)
+	}
+
+	if d, err := fiats.GetDispute("stripe", "dp_123"); err != nil || d.Status != "needs_response" {
+		t.Errorf("Expected dispute needing response, but got %v (%v)", d, err)
+	}
+
+	disputes, err := fiats.ListDisputes("stripe", 2)
+	if err != nil || len(disputes) != 2 {
+		t.Errorf("Expected 2 disputes, but got %d (%v)", len(disputes), err)
+	}
+}
+
+func TestGetBalance(t *testing.T) {
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/balance":
+			if r.Header.Get("Stripe-Account") != "" {
+				t.Errorf("Expected the platform balance, but got account %s", r.Header.Get("Stripe-Account"))
+			}
+			w.Write([]byte(`{"object": "balance", "available": [{"amount": 12500, "currency": "usd"}], "pending": [{"amount": 3000, "currency": "usd"}]}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/balance_transactions/txn_123":
+			w.Write([]byte(`{"id": "txn_123", "object": "balance_transaction", "amount": 10000, "fee": 320, "net": 9680, "currency": "usd", "type": "charge"}`))
+		default:
+			t.Errorf("Unexpected request to %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	fiats := gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}
+	b, err := fiats.GetBalance("stripe")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if len(b.Available) != 1 || b.Available[0].Amount != 12500 || len(b.Pending) != 1 || b.Pending[0].Amount != 3000 {
+		t.Errorf("Unexpected balance %+v", b)
+	}
+
+	bt, err := fiats.GetBalanceTransaction("stripe", "txn_123")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if bt.Fee != 320 || bt.Net != 9680 || bt.Type != stripe.BalanceTransactionTypeCharge {
+		t.Errorf("Unexpected balance transaction %+v", bt)
+	}
+
+	if _, err := fiats.GetBalance("unknown"); !gopay.IsNotFound(err) {
+		t.Errorf("Expected an unknown service to be not found, but got %v", err)
+	}
+}
+
+func TestPayoutToBank(t *testing.T) {
+	var payoutForm, bankAccountForm url.Values
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/payouts":
+			r.ParseForm()
+			payoutForm = r.PostForm
+			w.Write([]byte(`{"id": "po_123", "object": "payout", "amount": 5000, "currency": "usd", "destination": "ba_123", "status": "pending"}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/account":
+			w.Write([]byte(`{"id": "acct_platform", "object": "account"}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/accounts/acct_platform/external_accounts":
+			r.ParseForm()
+			bankAccountForm = r.PostForm
+			w.Write([]byte(`{"id": "ba_123", "object": "bank_account", "last4": "6789", "status": "new"}`))
+		default:
+			t.Errorf("Unexpected request to %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	fiats := gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}
+	ba, err := fiats.AddBankAccount("stripe", "btok_123")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if ba.ID != "ba_123" || ba.Last4 != "6789" {
+		t.Errorf("Unexpected bank account %+v", ba)
+	}
+	if bankAccountForm.Get("external_account") != "btok_123" {
+		t.Errorf("Expected the bank token to be sent, but got %v", bankAccountForm)
+	}
+
+	p, err := fiats.PayoutToBank("stripe", "GOPAY PAYOUT", "ba_123", 5000, gopay.USD)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if p.ID != "po_123" || p.Status != stripe.PayoutStatusPending {
+		t.Errorf("Unexpected payout %+v", p)
+	}
+	if payoutForm.Get("destination") != "ba_123" || payoutForm.Get("amount") != "5000" ||
+		payoutForm.Get("currency") != "USD" || payoutForm.Get("statement_descriptor") != "GOPAY PAYOUT" {
+		t.Errorf("Unexpected payout params %v", payoutForm)
+	}
+
+	if _, err := fiats.PayoutToBank("unknown", "", "ba_123", 5000, gopay.USD); !gopay.IsNotFound(err) {
+		t.Errorf("Expected an unknown service to be not found, but got %v", err)
+	}
+}
+
+func TestAccountOnboardingStatus(t *testing.T) {
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/accounts/acct_done":
+			w.Write([]byte(`{"id": "acct_done", "object": "account", "charges_enabled": true, "payouts_enabled": true,
+				"details_submitted": true, "requirements": {"currently_due": []}}`))
+		case "/v1/accounts/acct_pending":
+			w.Write([]byte(`{"id": "acct_pending", "object": "account", "details_submitted": true,
+				"requirements": {"currently_due": ["external_account", "individual.id_number"]}}`))
+		case "/v1/accounts/acct_new":
+			w.Write([]byte(`{"id": "acct_new", "object": "account"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": {"type": "invalid_request_error", "message": "No such account"}}`))
+		}
+	})
+
+	fiats := gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}
+	cases := []struct {
+		account  string
+		expected gopay.OnboardingStatus
+	}{
+		{"acct_done", gopay.OnboardingStatus{ChargesEnabled: true, PayoutsEnabled: true, DetailsSubmitted: true, Requirements: []string{}}},
+		{"acct_pending", gopay.OnboardingStatus{DetailsSubmitted: true, Requirements: []string{"external_account", "individual.id_number"}}},
+		{"acct_new", gopay.OnboardingStatus{Requirements: []string{}}},
+	}
+	for _, c := range cases {
+		status, err := fiats.GetAccountOnboardingStatus("stripe", c.account)
+		if err != nil {
+			t.Fatalf("%s: expected no error, but got %v", c.account, err)
+		}
+		if !reflect.DeepEqual(status, c.expected) {
+			t.Errorf("%s: expected %+v, but got %+v", c.account, c.expected, status)
+		}
+	}
+
+	if _, err := fiats.GetAccountOnboardingStatus("stripe", "acct_missing"); gopay.ErrorCodeOf(err) != gopay.ErrCodeExternalService {
+		t.Errorf("Expected an external service error, but got %v", err)
+	}
+	if _, err := fiats.GetAccountOnboardingStatus("unknown", "acct_done"); !gopay.IsNotFound(err) {
+		t.Errorf("Expected an unknown service to be not found, but got %v", err)
+	}
+}
+
+func TestConnectedAccount(t *testing.T) {
+	var updateForm url.Values
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/accounts/acct_123":
+			w.Write([]byte(`{"id": "acct_123", "object": "account", "email": "seller@example.com", "country": "DE",
+				"business_type": "company", "charges_enabled": true, "payouts_enabled": false, "details_submitted": true,
+				"default_currency": "eur", "requirements": {"currently_due": ["external_account"]}}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/accounts/acct_123":
+			r.ParseForm()
+			updateForm = r.PostForm
+			w.Write([]byte(`{"id": "acct_123", "object": "account"}`))
+		default:
+			t.Errorf("Unexpected request to %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	fiats := gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}
+	details, err := fiats.GetConnectedAccountDetails("stripe", "acct_123")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	expected := gopay.ConnectedAccountDetails{
+		ID:               "acct_123",
+		Email:            "seller@example.com",
+		Country:          "DE",
+		BusinessType:     "company",
+		ChargesEnabled:   true,
+		DetailsSubmitted: true,
+		Requirements:     []string{"external_account"},
+		DefaultCurrency:  "eur",
+	}
+	if !reflect.DeepEqual(*details, expected) {
+		t.Errorf("Expected %+v, but got %+v", expected, *details)
+	}
+
+	if err := fiats.UpdateConnectedAccount("stripe", "acct_123", "", "https://example.com"); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if updateForm.Get("business_profile[url]") != "https://example.com" || updateForm.Has("email") {
+		t.Errorf("Unexpected update params %v", updateForm)
+	}
+
+	if _, err := fiats.GetConnectedAccountDetails("unknown", "acct_123"); !gopay.IsNotFound(err) {
+		t.Errorf("Expected an unknown service to be not found, but got %v", err)
+	}
+}
+
+func TestDefaultPaymentMethod(t *testing.T) {
+	defaultPM := ""
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/customers/cus_123":
+			r.ParseForm()
+			defaultPM = r.PostForm.Get("invoice_settings[default_payment_method]")
+			w.Write([]byte(`{"id": "cus_123", "object": "customer"}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/customers/cus_123":
+			if defaultPM == "" {
+				w.Write([]byte(`{"id": "cus_123", "object": "customer", "invoice_settings": {}}`))
+				return
+			}
+			fmt.Fprintf(w, `{"id": "cus_123", "object": "customer", "invoice_settings": {"default_payment_method": %q}}`, defaultPM)
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/payment_methods/pm_2":
+			w.Write([]byte(`{"id": "pm_2", "object": "payment_method", "type": "card", "card": {"last4": "4444", "brand": "mastercard"}}`))
+		default:
+			t.Errorf("Unexpected request to %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	fiats := gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}
+	if _, err := fiats.GetDefaultPaymentMethod("stripe", "cus_123"); !gopay.IsNotFound(err) {
+		t.Errorf("Expected no default payment method to be not found, but got %v", err)
+	}
+
+	if err := fiats.SetDefaultPaymentMethod("stripe", "cus_123", "pm_2"); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	pm, err := fiats.GetDefaultPaymentMethod("stripe", "cus_123")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if pm.ID != "pm_2" || pm.Card.Last4 != "4444" {
+		t.Errorf("Expected pm_2 to be the default, but got %+v", pm)
+	}
+}
+
+func TestFiatHealthCheck(t *testing.T) {
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/v1/balance" {
+			t.Errorf("Unexpected request to %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer sk_valid" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": {"type": "invalid_request_error", "message": "Invalid API Key provided"}}`))
+			return
+		}
+		w.Write([]byte(`{"object": "balance", "available": [], "pending": []}`))
+	})
+
+	fiats := gopay.Fiats{
+		{Name: "stripe", ApiKey: "sk_valid", Service: gopay.STRIPE},
+		{Name: "stripe-jp", ApiKey: "sk_revoked", Service: gopay.STRIPE},
+	}
+	results := fiats.HealthCheck(context.Background())
+	if len(results) != 2 || results["stripe"] != nil {
+		t.Errorf("Expected stripe to be healthy, but got %v", results)
+	}
+	if err := results["stripe-jp"]; !errors.Is(err, gopay.ErrFiatServiceUnreachable) {
+		t.Errorf("Expected stripe-jp to be unreachable, but got %v", err)
+	}
+
+	setupFakeDB(t, func(string, []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		return nil, nil, nil
+	}, gopay.WithFiats(fiats))
+	report := gopay.HealthCheck(context.Background())
+	if report.Healthy || len(report.Fiats) != 2 || len(report.Chains) != 0 {
+		t.Errorf("Unexpected health report %+v", report)
+	}
+	if err := report.Err(); !errors.Is(err, gopay.ErrFiatServiceUnreachable) || !strings.Contains(err.Error(), "stripe-jp") {
+		t.Errorf("Expected the report to fail because of stripe-jp, but got %v", err)
+	}
+}
+
+func TestListPaymentIntents(t *testing.T) {
+	var query url.Values
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/v1/payment_intents" {
+			t.Errorf("Unexpected request to %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		query = r.URL.Query()
+		w.Write([]byte(`{"object": "list", "url": "/v1/payment_intents", "has_more": false, "data": [
+			{"id": "pi_1", "object": "payment_intent", "status": "succeeded"},
+			{"id": "pi_2", "object": "payment_intent", "status": "requires_action"},
+			{"id": "pi_3", "object": "payment_intent", "status": "requires_action"}
+		]}`))
+	})
+
+	fiats := gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}
+	intents, err := fiats.ListPaymentIntents("stripe", "cus_123", 10, "")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if len(intents) != 3 {
+		t.Errorf("Expected 3 payment intents, but got %d", len(intents))
+	}
+	if query.Get("customer") != "cus_123" || query.Get("limit") != "10" {
+		t.Errorf("Unexpected list params %v", query)
+	}
+
+	intents, err = fiats.ListPaymentIntents("stripe", "cus_123", 1, "requires_action")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if len(intents) != 1 || intents[0].ID != "pi_2" {
+		t.Errorf("Expected only the first intent requiring action, but got %+v", intents)
+	}
+
+	if _, err := fiats.ListPaymentIntents("unknown", "cus_123", 10, ""); !gopay.IsNotFound(err) {
+		t.Errorf("Expected an unknown service to be not found, but got %v", err)
+	}
+}
+
+func TestSEPASetupIntent(t *testing.T) {
+	var create, confirm url.Values
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/setup_intents":
+			create = r.Form
+			w.Write([]byte(`{"id": "seti_123", "object": "setup_intent", "status": "requires_payment_method", "payment_method_types": ["sepa_debit"]}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/setup_intents/seti_123/confirm":
+			confirm = r.Form
+			w.Write([]byte(`{"id": "seti_123", "object": "setup_intent", "status": "succeeded", "payment_method": {"id": "` + r.Form.Get("payment_method") + `", "object": "payment_method"}, "mandate": {"id": "mandate_123", "object": "mandate"}}`))
+		default:
+			t.Errorf("Unexpected request to %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	fiats := gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}
+	si, err := fiats.CreateSEPASetupIntent("stripe", "cus_123", "payer@example.com")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if si.ID != "seti_123" {
+		t.Errorf("Expected setup intent seti_123, but got %s", si.ID)
+	}
+	if create.Get("customer") != "cus_123" || create.Get("payment_method_types[0]") != "sepa_debit" || create.Get("usage") != "off_session" || create.Get("metadata[email]") != "payer@example.com" {
+		t.Errorf("Unexpected setup intent params %v", create)
+	}
+
+	si, err = fiats.ConfirmSEPASetupIntent("stripe", "seti_123", "pm_iban")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if si.Status != stripe.SetupIntentStatusSucceeded || si.PaymentMethod == nil || si.PaymentMethod.ID != "pm_iban" {
+		t.Errorf("Expected a succeeded setup intent with payment method pm_iban, but got %+v", si)
+	}
+	if confirm.Get("payment_method") != "pm_iban" || confirm.Get("mandate_data[customer_acceptance][type]") != "offline" {
+		t.Errorf("Unexpected confirm params %v", confirm)
+	}
+
+	if _, err := fiats.CreateSEPASetupIntent("unknown", "cus_123", "payer@example.com"); !gopay.IsNotFound(err) {
+		t.Errorf("Expected an unknown service to be not found, but got %v", err)
+	}
+}
+
+func TestPaymentMethodDetails(t *testing.T) {
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/customers/cus_123":
+			w.Write([]byte(`{"id": "cus_123", "object": "customer", "invoice_settings": {"default_payment_method": "pm_card"}}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/payment_methods/pm_card":
+			w.Write([]byte(`{"id": "pm_card", "object": "payment_method", "type": "card", "customer": "cus_123", "card": {"brand": "visa", "last4": "4242", "exp_month": 4, "exp_year": 2030, "fingerprint": "fp_secret"}}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/payment_methods":
+			w.Write([]byte(`{"object": "list", "url": "/v1/payment_methods", "has_more": false, "data": [
+				{"id": "pm_card", "object": "payment_method", "type": "card", "card": {"brand": "visa", "last4": "4242", "exp_month": 4, "exp_year": 2030}},
+				{"id": "pm_bank", "object": "payment_method", "type": "us_bank_account", "us_bank_account": {"bank_name": "STRIPE TEST BANK", "last4": "6789"}}
+			]}`))
+		default:
+			t.Errorf("Unexpected request to %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	f := gopay.Fiat{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}
+	details, err := f.StripeGetPaymentMethodDetails("pm_card")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	expected := gopay.PaymentMethodDetails{ID: "pm_card", Type: "card", Last4: "4242", Brand: "visa", ExpMonth: "04", ExpYear: "2030", IsDefault: true}
+	if *details != expected {
+		t.Errorf("Expected %+v, but got %+v", expected, *details)
+	}
+
+	list, err := f.StripeListPaymentMethodDetails("cus_123")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("Expected 2 payment methods, but got %d", len(list))
+	}
+	if !list[0].IsDefault || list[1].IsDefault {
+		t.Errorf("Expected only the card to be the default, but got %+v %+v", *list[0], *list[1])
+	}
+	if list[1].Type != "us_bank_account" || list[1].Last4 != "6789" || list[1].Brand != "STRIPE TEST BANK" || list[1].ExpMonth != "" {
+		t.Errorf("Unexpected bank account details %+v", *list[1])
+	}
+}
+
+func TestNewConfig(t *testing.T) {
+	logger := new(recordingLogger)
+	fiats := gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}
+	chains := gopay.Chains{gopay.NewBSCChain("key", "0xContract", nil)}
+
+	cfg := gopay.NewConfig(
+		gopay.WithPrefix("myapp"),
+		gopay.WithFiats(fiats),
+		gopay.WithChains(chains),
+		gopay.WithLogger(logger),
+		gopay.WithWebhookSecrets(map[string]string{"stripe": "whsec_123"}),
+	)
+	if cfg.Prefix != "myapp" || len(cfg.Fiats) != 1 || len(cfg.Chains) != 1 || cfg.Logger != logger || cfg.WebhookSecrets["stripe"] != "whsec_123" {
+		t.Errorf("Unexpected config %+v", cfg)
+	}
+	if cfg.DB != nil {
+		t.Errorf("Expected no database connection, but got %v", cfg.DB)
+	}
+
+	if err := gopay.Setup(gopay.WithFiats(fiats)); err == nil || !strings.Contains(err.Error(), "database connection is required") {
+		t.Errorf("Expected Setup to validate the config, but got %v", err)
+	}
+}
+
+func TestStripeAmountRoundTrip(t *testing.T) {
+	cases := []struct {
+		amount   float64
+		currency gopay.Currency
+		minor    string
+	}{
+		{19.99, gopay.USD, "1999"},
+		{0.29, gopay.USD, "29"},
+		{1500, gopay.JPY, "1500"},
+		{42.5, gopay.EUR, "4250"},
+	}
+
+	for _, c := range cases {
+		var sent string
+		testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			switch r.URL.Path {
+			case "/v1/payment_methods":
+				w.Write([]byte(`{"object": "list", "data": [{"id": "pm_123", "object": "payment_method"}], "has_more": false}`))
+			case "/v1/payment_intents":
+				sent = r.Form.Get("amount")
+				w.Write([]byte(`{"id": "pi_123", "object": "payment_intent", "amount": ` + sent + `, "status": "succeeded"}`))
+			default:
+				t.Errorf("Unexpected request to %s", r.URL.Path)
+				w.WriteHeader(http.StatusNotFound)
+			}
+		})
+
+		f := gopay.Fiat{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}
+		info, err := f.StripePay(gopay.FiatParams{Customer: "cus_123", Amount: c.amount, Currency: c.currency})
+		if err != nil {
+			t.Fatalf("%s: expected no error, but got %v", c.currency, err)
+		}
+		if sent != c.minor {
+			t.Errorf("%s: expected %s minor units to be sent, but got %s", c.currency, c.minor, sent)
+		}
+		if info.TotalAmount != c.amount {
+			t.Errorf("%s: expected total amount %v, but got %v", c.currency, c.amount, info.TotalAmount)
+		}
+	}
+
+	if _, err := gopay.FromStripeAmount(100, "XYZ"); err == nil {
+		t.Error("Expected an error for an unsupported currency, but got nil")
+	}
+}
+
+func TestCreatePaymentMethod(t *testing.T) {
+	var form url.Values
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/payment_methods" {
+			t.Errorf("Unexpected request to %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		form = r.Form
+		w.Write([]byte(`{"id": "pm_123", "object": "payment_method", "type": "` + r.Form.Get("type") + `"}`))
+	})
+
+	fiats := gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}
+	cases := []struct {
+		params gopay.PaymentMethodCreateParams
+		want   map[string]string
+	}{
+		{
+			gopay.PaymentMethodCreateParams{Type: "card", CardToken: stripe.String("tok_visa")},
+			map[string]string{"type": "card", "card[token]": "tok_visa"},
+		},
+		{
+			gopay.PaymentMethodCreateParams{
+				Type:                        "us_bank_account",
+				FinancialConnectionsAccount: stripe.String("fca_123"),
+				BillingDetails:              &gopay.BillingDetails{Name: "Jane Doe"},
+			},
+			map[string]string{"type": "us_bank_account", "us_bank_account[financial_connections_account]": "fca_123", "billing_details[name]": "Jane Doe"},
+		},
+		{
+			gopay.PaymentMethodCreateParams{
+				Type:           "sepa_debit",
+				SEPAIban:       stripe.String("DE89370400440532013000"),
+				BillingDetails: &gopay.BillingDetails{Name: "Jane Doe", Email: "jane@example.com", Country: "DE", City: "Berlin"},
+			},
+			map[string]string{
+				"type":                              "sepa_debit",
+				"sepa_debit[iban]":                  "DE89370400440532013000",
+				"billing_details[email]":            "jane@example.com",
+				"billing_details[address][country]": "DE",
+				"billing_details[address][city]":    "Berlin",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		pm, err := fiats.CreatePaymentMethod("stripe", c.params)
+		if err != nil {
+			t.Errorf("%s: expected no error, but got %v", c.params.Type, err)
+			continue
+		}
+		if string(pm.Type) != c.params.Type {
+			t.Errorf("%s: expected a %s payment method, but got %s", c.params.Type, c.params.Type, pm.Type)
+		}
+		for key, value := range c.want {
+			if form.Get(key) != value {
+				t.Errorf("%s: expected %s=%s, but got %v", c.params.Type, key, value, form)
+			}
+		}
+		if c.params.BillingDetails != nil && form.Has("billing_details[phone]") {
+			t.Errorf("%s: expected empty billing details to be left out, but got %v", c.params.Type, form)
+		}
+	}
+
+	if _, err := fiats.CreatePaymentMethod("stripe", gopay.PaymentMethodCreateParams{Type: "sepa_debit"}); gopay.ErrorCodeOf(err) != gopay.ErrCodeValidation {
+		t.Errorf("Expected a validation error for a missing IBAN, but got %v", err)
+	}
+}
@@ -1,9 +1,49 @@
 package gopay
 
-import "github.com/jmoiron/sqlx"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/socious-io/gopay/migrate"
+	"github.com/stripe/stripe-go/v81"
+)
+
+// Migration is a database migration of the payment package; see the migrate package.
+type Migration = migrate.Migration
 
 // The global config variable holds the configuration for the application.
-var config = new(Config)
+var config = &Config{Logger: DefaultLogger{}, mu: new(sync.RWMutex)}
+
+// Logger is the logging interface used by the payment service. It can be satisfied by
+// thin adapters around structured loggers such as zap or logrus.
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+	Debugf(format string, args ...interface{})
+}
+
+// DefaultLogger is a Logger that writes to the standard log package.
+type DefaultLogger struct{}
+
+// Infof logs an informational message.
+func (DefaultLogger) Infof(format string, args ...interface{}) {
+	log.Printf("INFO: "+format, args...)
+}
+
+// Errorf logs an error message.
+func (DefaultLogger) Errorf(format string, args ...interface{}) {
+	log.Printf("ERROR: "+format, args...)
+}
+
+// Debugf logs a debug message.
+func (DefaultLogger) Debugf(format string, args ...interface{}) {
+	log.Printf("DEBUG: "+format, args...)
+}
 
 // Config represents the configuration structure for the payment service.
 type Config struct {
@@ -11,17 +51,409 @@ type Config struct {
 	Chains Chains   // Chains represents the blockchain networks supported by the service.
 	Fiats  Fiats    // Fiats represents the supported fiat services (e.g., Stripe).
 	Prefix string   // Prefix is used for table name prefix or query prefix (database-related).
+	Logger Logger   // Logger receives the service logs; DefaultLogger is used when nil.
+
+	WebhookSecrets map[string]string // WebhookSecrets maps a service name to its webhook signing secret.
+
+	VerifyOnStartup bool // VerifyOnStartup makes Setup fail if a chain's explorer API or a fiat service is unreachable; see HealthCheck.
+
+	// StripeVersionHeader identifies the gopay version on Stripe API calls. It replaces the Stripe SDK's
+	// process-wide HTTP client, so it also applies to Stripe calls made outside of gopay.
+	StripeVersionHeader bool
+
+	// Limits guarding against runaway callers; Setup applies the defaults below when they are zero.
+	MaxIdentitiesPerPayment   int // Maximum number of identities of a payment; see ErrMaxIdentitiesReached.
+	MaxTransactionsPerPayment int // Maximum number of transactions of a payment; see ErrMaxTransactionsReached.
+
+	// Optional hooks, e.g., for notifications or analytics. They are called synchronously once the change has been
+	// saved, possibly while the payment is locked, so they should not block.
+	OnPaymentStatusChange func(oldStatus, newStatus PaymentStatus, payment *Payment) // Called when a payment's saved status changes.
+	OnTransactionCreated  func(t *Transaction)                                       // Called when a transaction is created.
+	OnTransactionVerified func(t *Transaction)                                       // Called when a transaction is verified.
+
+	chainIndex ChainIndex    // chainIndex provides name-keyed lookup of Chains, built by Setup.
+	fiatIndex  FiatIndex     // fiatIndex provides name-keyed lookup of Fiats, built by Setup.
+	mu         *sync.RWMutex // mu guards Chains, Fiats and their indexes against AddChain, AddFiat and their Remove counterparts, and Logger against SetLogger; set by SetupWithConfig.
+}
+
+// Default limits applied by Setup when the Config leaves them zero.
+const (
+	DefaultMaxIdentitiesPerPayment   = 10
+	DefaultMaxTransactionsPerPayment = 100
+)
+
+// Validate checks the configuration and returns an error listing all violations at once.
+func (cfg Config) Validate() error {
+	var errs []error
+	if cfg.DB == nil {
+		errs = append(errs, fmt.Errorf("database connection is required"))
+	}
+	if cfg.MaxIdentitiesPerPayment < 0 {
+		errs = append(errs, fmt.Errorf("max identities per payment must not be negative"))
+	}
+	if cfg.MaxTransactionsPerPayment < 0 {
+		errs = append(errs, fmt.Errorf("max transactions per payment must not be negative"))
+	}
+	if err := cfg.Fiats.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := cfg.Chains.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	return validationError(errs)
+}
+
+// Option configures a Config; see NewConfig.
+type Option func(*Config)
+
+// WithDB sets the database connection.
+func WithDB(db *sqlx.DB) Option {
+	return func(cfg *Config) {
+		cfg.DB = db
+	}
+}
+
+// WithPrefix sets the table name prefix.
+func WithPrefix(prefix string) Option {
+	return func(cfg *Config) {
+		cfg.Prefix = prefix
+	}
+}
+
+// WithChains sets the supported blockchain networks.
+func WithChains(chains Chains) Option {
+	return func(cfg *Config) {
+		cfg.Chains = chains
+	}
+}
+
+// WithFiats sets the supported fiat services.
+func WithFiats(fiats Fiats) Option {
+	return func(cfg *Config) {
+		cfg.Fiats = fiats
+	}
+}
+
+// WithLogger sets the logger receiving the service logs.
+func WithLogger(logger Logger) Option {
+	return func(cfg *Config) {
+		cfg.Logger = logger
+	}
+}
+
+// WithWebhookSecrets sets the webhook signing secrets, keyed by service name.
+func WithWebhookSecrets(secrets map[string]string) Option {
+	return func(cfg *Config) {
+		cfg.WebhookSecrets = secrets
+	}
+}
+
+// WithVerifyOnStartup makes Setup check that the explorer APIs of the chains and the fiat services are reachable.
+func WithVerifyOnStartup() Option {
+	return func(cfg *Config) {
+		cfg.VerifyOnStartup = true
+	}
+}
+
+// WithStripeVersionHeader identifies the gopay version on Stripe API calls; see Config.StripeVersionHeader.
+func WithStripeVersionHeader() Option {
+	return func(cfg *Config) {
+		cfg.StripeVersionHeader = true
+	}
+}
+
+// WithMaxIdentitiesPerPayment sets the maximum number of identities of a payment.
+func WithMaxIdentitiesPerPayment(n int) Option {
+	return func(cfg *Config) {
+		cfg.MaxIdentitiesPerPayment = n
+	}
+}
+
+// WithMaxTransactionsPerPayment sets the maximum number of transactions of a payment.
+func WithMaxTransactionsPerPayment(n int) Option {
+	return func(cfg *Config) {
+		cfg.MaxTransactionsPerPayment = n
+	}
+}
+
+// WithOnPaymentStatusChange sets the hook called when a payment's saved status changes.
+func WithOnPaymentStatusChange(hook func(oldStatus, newStatus PaymentStatus, payment *Payment)) Option {
+	return func(cfg *Config) {
+		cfg.OnPaymentStatusChange = hook
+	}
+}
+
+// WithOnTransactionCreated sets the hook called when a transaction is created.
+func WithOnTransactionCreated(hook func(t *Transaction)) Option {
+	return func(cfg *Config) {
+		cfg.OnTransactionCreated = hook
+	}
+}
+
+// WithOnTransactionVerified sets the hook called when a transaction is verified.
+func WithOnTransactionVerified(hook func(t *Transaction)) Option {
+	return func(cfg *Config) {
+		cfg.OnTransactionVerified = hook
+	}
+}
+
+// NewConfig builds a Config from the given options.
+func NewConfig(opts ...Option) Config {
+	cfg := Config{mu: new(sync.RWMutex)}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
 }
 
-// Setup initializes the payment service with the provided configuration.
+// Setup initializes the payment service with the configuration built from the given options.
 // It applies migrations, sets up the configuration, and returns any errors encountered.
-func Setup(cfg Config) error {
+func Setup(opts ...Option) error {
+	return SetupWithConfig(NewConfig(opts...))
+}
+
+// SetupWithConfig is like Setup but takes a Config struct.
+func SetupWithConfig(cfg Config) error {
+	if cfg.Logger == nil {
+		cfg.Logger = DefaultLogger{}
+	}
+	if cfg.mu == nil {
+		cfg.mu = new(sync.RWMutex)
+	}
+	if cfg.MaxIdentitiesPerPayment == 0 {
+		cfg.MaxIdentitiesPerPayment = DefaultMaxIdentitiesPerPayment
+	}
+	if cfg.MaxTransactionsPerPayment == 0 {
+		cfg.MaxTransactionsPerPayment = DefaultMaxTransactionsPerPayment
+	}
+
+	// Reject misconfiguration before anything else.
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	// Index the configured services by name, rejecting duplicates.
+	chainIndex, err := cfg.Chains.BuildIndex()
+	if err != nil {
+		return err
+	}
+	fiatIndex, err := cfg.Fiats.BuildIndex()
+	if err != nil {
+		return err
+	}
+
+	// Make sure the blockchain explorers and fiat services can be reached if asked to.
+	if cfg.VerifyOnStartup {
+		if err := cfg.healthCheck(context.Background()).Err(); err != nil {
+			return err
+		}
+	}
+
 	// Run migrations using the provided database and table prefix.
-	if err := runMigrate(cfg.DB, cfg.Prefix); err != nil {
+	if err := migrate.Run(cfg.DB, cfg.Prefix, migrate.WithLogger(cfg.Logger)); err != nil {
 		return err // If migration fails, return the error.
 	}
 
+	// Identify the library version on the Stripe API calls made from now on, if asked to.
+	if cfg.StripeVersionHeader {
+		stripe.SetHTTPClient(newStripeHTTPClient())
+	}
+
 	// Set the global configuration to the provided config.
 	config = &cfg
+	config.chainIndex = chainIndex
+	config.fiatIndex = fiatIndex
 	return nil // Return nil to indicate successful setup.
 }
+
+// HealthReport is the result of HealthCheck, e.g., for a readiness probe.
+type HealthReport struct {
+	Healthy bool             // Healthy is true if every chain and fiat service is healthy.
+	Chains  map[string]error // Chains maps each chain name to its health check error, nil if healthy.
+	Fiats   map[string]error // Fiats maps each fiat service name to its health check error, nil if healthy.
+}
+
+// Err joins the errors of the unhealthy chains and fiat services, or returns nil if all are healthy.
+func (r *HealthReport) Err() error {
+	var errs []error
+	for _, results := range []map[string]error{r.Chains, r.Fiats} {
+		names := make([]string, 0, len(results))
+		for name := range results {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err := results[name]; err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// HealthCheck verifies that the configured chains' explorer APIs and fiat services are reachable, concurrently.
+func HealthCheck(ctx context.Context) *HealthReport {
+	return config.healthCheck(ctx)
+}
+
+// healthCheck checks the chains and fiat services of the configuration.
+func (cfg *Config) healthCheck(ctx context.Context) *HealthReport {
+	var (
+		report HealthReport
+		wg     sync.WaitGroup
+	)
+	chains, fiats := cfg.chains(), cfg.fiats()
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		report.Chains = chains.HealthCheck(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		report.Fiats = fiats.HealthCheck(ctx)
+	}()
+	wg.Wait()
+
+	report.Healthy = report.Err() == nil
+	return &report
+}
+
+// chains returns the configured chains. The slice is replaced rather than modified when chains are added or
+// removed, so it can be used after the lock is released.
+func (cfg *Config) chains() Chains {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return cfg.Chains
+}
+
+// fiats returns the configured fiat services; see chains.
+func (cfg *Config) fiats() Fiats {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return cfg.Fiats
+}
+
+// logger returns the configured logger, which SetLogger may replace at any time.
+func (cfg *Config) logger() Logger {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return cfg.Logger
+}
+
+// fiatServices returns the index of the configured fiat services. Like the services, it is replaced rather than
+// modified when they change.
+func (cfg *Config) fiatServices() FiatIndex {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return cfg.fiatIndex
+}
+
+// AddChain validates the chain and adds it to the configured chains. It is safe to call while payments are
+// processed, e.g., to support a new network without restarting.
+func (cfg *Config) AddChain(chain Chain) error {
+	if err := chain.Validate(); err != nil {
+		return err
+	}
+
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	chains := append(append(make(Chains, 0, len(cfg.Chains)+1), cfg.Chains...), chain)
+	index, err := chains.BuildIndex()
+	if err != nil {
+		return err
+	}
+	cfg.Chains, cfg.chainIndex = chains, index
+	return nil
+}
+
+// RemoveChain removes the chain with the given name from the configured chains. Like AddChain, it is safe to
+// call while payments are processed.
+func (cfg *Config) RemoveChain(name string) error {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	if _, ok := cfg.chainIndex.FindByName(name); !ok {
+		return newError(ErrCodeNotFound, nil, "chain %s could not found", name)
+	}
+
+	chains := make(Chains, 0, len(cfg.Chains)-1)
+	for _, c := range cfg.Chains {
+		if c.Name != name {
+			chains = append(chains, c)
+		}
+	}
+	index, err := chains.BuildIndex()
+	if err != nil {
+		return err
+	}
+	cfg.Chains, cfg.chainIndex = chains, index
+	return nil
+}
+
+// AddFiat validates the fiat service and adds it to the configured services; see AddChain.
+func (cfg *Config) AddFiat(fiat Fiat) error {
+	if err := fiat.Validate(); err != nil {
+		return err
+	}
+
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	fiats := append(append(make(Fiats, 0, len(cfg.Fiats)+1), cfg.Fiats...), fiat)
+	index, err := fiats.BuildIndex()
+	if err != nil {
+		return err
+	}
+	cfg.Fiats, cfg.fiatIndex = fiats, index
+	return nil
+}
+
+// RemoveFiat removes the fiat service with the given name from the configured services; see RemoveChain.
+func (cfg *Config) RemoveFiat(name string) error {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	if _, ok := cfg.fiatIndex.FindByName(name); !ok {
+		return newError(ErrCodeNotFound, nil, "service %s could not found", name)
+	}
+
+	fiats := make(Fiats, 0, len(cfg.Fiats)-1)
+	for _, f := range cfg.Fiats {
+		if f.Name != name {
+			fiats = append(fiats, f)
+		}
+	}
+	index, err := fiats.BuildIndex()
+	if err != nil {
+		return err
+	}
+	cfg.Fiats, cfg.fiatIndex = fiats, index
+	return nil
+}
+
+// AddChain adds a chain to the configuration set up with Setup; see Config.AddChain.
+func AddChain(chain Chain) error {
+	return config.AddChain(chain)
+}
+
+// RemoveChain removes a chain from the configuration set up with Setup; see Config.RemoveChain.
+func RemoveChain(name string) error {
+	return config.RemoveChain(name)
+}
+
+// AddFiat adds a fiat service to the configuration set up with Setup; see Config.AddFiat.
+func AddFiat(fiat Fiat) error {
+	return config.AddFiat(fiat)
+}
+
+// RemoveFiat removes a fiat service from the configuration set up with Setup; see Config.RemoveFiat.
+func RemoveFiat(name string) error {
+	return config.RemoveFiat(name)
+}
+
+// SetLogger replaces the logger used by the payment service. Passing nil restores DefaultLogger.
+func SetLogger(logger Logger) {
+	if logger == nil {
+		logger = DefaultLogger{}
+	}
+	config.mu.Lock()
+	defer config.mu.Unlock()
+	config.Logger = logger
+}
@@ -1,7 +1,17 @@
 package gopay_test
 
 import (
+	"database/sql/driver"
+	"fmt"
+	"io"
 	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/socious-io/gopay"
+	"github.com/socious-io/gopay/testutil"
 )
 
 // MockHTTPClient is a mock implementation of http.RoundTripper for unit testing
@@ -10,6 +20,14 @@ type MockHTTPClient struct {
 	Err      error
 }
 
+// roundTripFunc is an http.RoundTripper backed by a function, for tests that need per-request responses
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+// RoundTrip calls the function with the request
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
 // mockReadCloser is a mock implementation of io.ReadCloser for testing HTTP responses
 type mockReadCloser struct {
 	data []byte
@@ -21,10 +39,164 @@ func (m *MockHTTPClient) RoundTrip(req *http.Request) (*http.Response, error) {
 }
 
 func (m *mockReadCloser) Read(p []byte) (n int, err error) {
-	copy(p, m.data)
-	return len(m.data), nil
+	if len(m.data) == 0 {
+		return 0, io.EOF
+	}
+	n = copy(p, m.data)
+	m.data = m.data[n:]
+	return n, nil
 }
 
 func (m *mockReadCloser) Close() error {
 	return nil
 }
+
+// recordingLogger is a gopay.Logger that keeps every formatted line for later assertions
+type recordingLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) record(level, format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, level+": "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Infof(format string, args ...interface{}) {
+	l.record("INFO", format, args...)
+}
+
+func (l *recordingLogger) Errorf(format string, args ...interface{}) {
+	l.record("ERROR", format, args...)
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {
+	l.record("DEBUG", format, args...)
+}
+
+// contains reports whether a line with the given text has been recorded
+func (l *recordingLogger) contains(line string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, recorded := range l.lines {
+		if recorded == line {
+			return true
+		}
+	}
+	return false
+}
+
+// fakeAdvisoryLocks emulates the Postgres session advisory locks taken by Payment.Lock, which may be taken
+// from several goroutines at once.
+type fakeAdvisoryLocks struct {
+	mu   sync.Mutex
+	held map[int64]bool
+}
+
+// answer answers the advisory lock statements, reporting whether query was one of them.
+func (l *fakeAdvisoryLocks) answer(query string, args []driver.NamedValue) ([]string, [][]driver.Value, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.held == nil {
+		l.held = map[int64]bool{}
+	}
+	switch {
+	case strings.Contains(query, "pg_try_advisory_lock"):
+		key := args[0].Value.(int64)
+		locked := !l.held[key]
+		l.held[key] = true
+		return []string{"locked"}, [][]driver.Value{{locked}}, true
+	case strings.Contains(query, "pg_advisory_unlock"):
+		key := args[0].Value.(int64)
+		unlocked := l.held[key]
+		delete(l.held, key)
+		return []string{"unlocked"}, [][]driver.Value{{unlocked}}, true
+	}
+	return nil, nil, false
+}
+
+// setupFakeDB sets the payment service up with a mock database whose statements are answered by query,
+// applying the given options on top. It returns the database, e.g., to begin transactions.
+func setupFakeDB(t *testing.T, query testutil.QueryFunc, opts ...gopay.Option) *sqlx.DB {
+	t.Helper()
+	// Setup replaces the logger, so it is passed as an option rather than set beforehand
+	opts = append([]gopay.Option{gopay.WithLogger(new(recordingLogger))}, opts...)
+	return testutil.SetupMockDB(t, query, opts...).DB
+}
+
+func TestAddRemoveProviders(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		services = map[string]bool{}
+	)
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		if strings.Contains(query, "SET fiat_service_name = $1") {
+			mu.Lock()
+			services[args[0].Value.(string)] = args[1].Value != nil
+			mu.Unlock()
+			return []string{"fiat_service_name"}, [][]driver.Value{{args[0].Value}}, nil
+		}
+		return nil, nil, nil
+	})
+
+	// Register services while payments look them up
+	const n = 20
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			if err := gopay.AddFiat(gopay.Fiat{Name: fmt.Sprintf("stripe-%d", i), ApiKey: "sk_test", Service: gopay.STRIPE}); err != nil {
+				t.Errorf("Expected no error, but got %v", err)
+			}
+		}
+	}()
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// The service may not have been added yet
+			if err := (&gopay.Payment{}).SetToFiatMode(fmt.Sprintf("stripe-%d", i)); err != nil && !gopay.IsNotFound(err) {
+				t.Errorf("Expected no error, but got %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if err := (&gopay.Payment{}).SetToFiatMode("stripe-0"); err != nil || !services["stripe-0"] {
+		t.Errorf("Expected the added service to be found, but got %v", err)
+	}
+	if err := gopay.AddFiat(gopay.Fiat{Name: "stripe-0", ApiKey: "sk_test"}); gopay.ErrorCodeOf(err) != gopay.ErrCodeDuplicate {
+		t.Errorf("Expected a duplicate service to be rejected, but got %v", err)
+	}
+	if err := gopay.AddFiat(gopay.Fiat{Name: "no-key"}); gopay.ErrorCodeOf(err) != gopay.ErrCodeValidation {
+		t.Errorf("Expected an invalid service to be rejected, but got %v", err)
+	}
+	if err := gopay.RemoveFiat("stripe-0"); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if err := (&gopay.Payment{}).SetToFiatMode("stripe-0"); !gopay.IsNotFound(err) {
+		t.Errorf("Expected the removed service not to be found, but got %v", err)
+	}
+	if err := gopay.RemoveFiat("stripe-0"); !gopay.IsNotFound(err) {
+		t.Errorf("Expected removing a missing service to fail, but got %v", err)
+	}
+
+	chain := gopay.NewBSCChain("key", "0xContract", nil)
+	if err := gopay.AddChain(chain); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if err := gopay.AddChain(chain); gopay.ErrorCodeOf(err) != gopay.ErrCodeDuplicate {
+		t.Errorf("Expected a duplicate chain to be rejected, but got %v", err)
+	}
+	if err := gopay.AddChain(gopay.Chain{Name: "no-explorer"}); gopay.ErrorCodeOf(err) != gopay.ErrCodeValidation {
+		t.Errorf("Expected an invalid chain to be rejected, but got %v", err)
+	}
+	if err := gopay.RemoveChain(chain.Name); err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+	if err := gopay.RemoveChain(chain.Name); !gopay.IsNotFound(err) {
+		t.Errorf("Expected removing a missing chain to fail, but got %v", err)
+	}
+}
@@ -0,0 +1,18 @@
+package migrate
+
+import "testing"
+
+// QueryChecksum exposes queryChecksum to the external tests.
+var QueryChecksum = queryChecksum
+
+// Migrations returns the migrations run by Run.
+func Migrations() []Migration {
+	return migrations
+}
+
+// SetMigrations replaces the migrations run by Run until the test ends.
+func SetMigrations(t testing.TB, ms []Migration) {
+	original := migrations
+	migrations = ms
+	t.Cleanup(func() { migrations = original })
+}
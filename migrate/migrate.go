@@ -0,0 +1,616 @@
+// Package migrate manages the database schema of the payment package. It is run by gopay.Setup, and can
+// also be used on its own, e.g., from a CLI migration step, without pulling in the payment providers' SDKs.
+//
+// A migration command built with cobra or urfave/cli typically maps its subcommands to these functions:
+//
+//	db := sqlx.MustConnect("postgres", dsn)
+//	switch cmd {
+//	case "up":
+//		err = migrate.Run(db, prefix)
+//	case "plan":
+//		pending, err = migrate.DryRun(db, prefix) // print pending[i].Version and pending[i].Query
+//	case "status":
+//		records, err = migrate.Status(db, prefix) // print records[i].Version and records[i].AppliedAt
+//	case "down":
+//		err = migrate.Rollback(db, prefix, version)
+//	}
+//
+// The prefix must match the gopay.Config Prefix used by the application.
+package migrate
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrUnknownMigration is returned when rolling back a version that is not a known migration.
+var ErrUnknownMigration = errors.New("unknown migration")
+
+// ErrIrreversibleMigration is returned when rolling back a migration that has no down query.
+var ErrIrreversibleMigration = errors.New("migration cannot be rolled back")
+
+// ErrMigrationNotApplied is returned when rolling back a migration that has not been applied.
+var ErrMigrationNotApplied = errors.New("migration has not been applied")
+
+// Migration struct defines a migration version and its SQL query.
+type Migration struct {
+	Version   string    // Version represents the migration version.
+	Query     string    // Query is the SQL query to be executed for this migration.
+	Down      string    // Down is the SQL query reverting this migration; empty if it cannot be reverted.
+	Checksum  string    // Checksum is the hex-encoded SHA-256 of Query before the prefix is replaced, recorded when applied.
+	AppliedAt time.Time // AppliedAt is the timestamp when the migration was applied.
+}
+
+// appliedMigration is a migration recorded in the `payment_migrations` table.
+type appliedMigration struct {
+	AppliedAt time.Time
+	Checksum  sql.NullString // NULL for migrations recorded before checksums were.
+}
+
+// queryChecksum returns the checksum of a migration query; see Migration.Checksum.
+func queryChecksum(query string) string {
+	sum := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(sum[:])
+}
+
+// MigrationRecord describes whether a migration has been applied to the database.
+type MigrationRecord struct {
+	Version   string     // Version of the migration.
+	Applied   bool       // Whether the migration has been applied.
+	AppliedAt *time.Time // When the migration was applied, nil if pending.
+}
+
+// Logger receives the progress of the migrations. gopay.Logger satisfies it.
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Debugf(format string, args ...interface{})
+}
+
+// stdLogger is the Logger used by default, writing to the standard log package.
+type stdLogger struct{}
+
+func (stdLogger) Infof(format string, args ...interface{}) {
+	log.Printf("INFO: "+format, args...)
+}
+
+func (stdLogger) Debugf(format string, args ...interface{}) {
+	log.Printf("DEBUG: "+format, args...)
+}
+
+// Option customizes how migrations are run.
+type Option func(*options)
+
+// options holds the settings applied by Option.
+type options struct {
+	logger Logger
+}
+
+// WithLogger sends the migration logs to the given logger instead of the standard log package.
+func WithLogger(l Logger) Option {
+	return func(o *options) {
+		if l != nil {
+			o.logger = l
+		}
+	}
+}
+
+// newOptions applies opts over the defaults.
+func newOptions(opts []Option) options {
+	o := options{logger: stdLogger{}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// List of migrations for the payment package, including enum creation
+var migrations = []Migration{
+	// Migration 1: Create ENUM types for transaction-related data (like transaction type, payment status).
+	{
+		Version: "2024-01-01-create-enums",
+		Query: `-- Create custom ENUM types if not already created
+		CREATE TYPE gopay_transaction_type AS ENUM ('DEPOSIT', 'PAYOUT');
+		CREATE TYPE gopay_network_type AS ENUM ('EVM', 'CARDANO');
+		CREATE TYPE gopay_network_mode AS ENUM ('MAINNET', 'TESTNET');
+		CREATE TYPE gopay_currency AS ENUM ('USD', 'JPY');
+		CREATE TYPE gopay_payment_type AS ENUM ('FIAT', 'CRYPTO');
+		CREATE TYPE gopay_payment_status AS ENUM (
+			'INITIATED', 'PENDING_DEPOSIT', 'DEPOSITED', 'ON_HOLD',
+			'PAID_OUT', 'CANCELED', 'REFUNDED'
+		);`,
+	},
+	// Migration 2: Create the payments table to track payment details.
+	{
+		Version: "2024-01-02-create-payments-table",
+		Query: fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %spayments (
+			id UUID NOT NULL DEFAULT public.uuid_generate_v4() PRIMARY KEY,
+			tag TEXT,
+			description TEXT,
+			unique_ref TEXT UNIQUE NOT NULL,
+			total_amount DECIMAL(20, 6),
+			currency %s,
+			fiat_service_name VARCHAR(32),
+			crypto_currency TEXT,
+			crypto_currency_rate DECIMAL(20, 6),
+			meta JSONB,
+			status %s DEFAULT 'INITIATED',
+			type %s,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`, "{prefix}", "gopay_currency", "gopay_payment_status", "gopay_payment_type"),
+	},
+	// Migration 3: Create a table for payment identities linking payments to users.
+	{
+		Version: "2024-01-03-create-payment_identities-table",
+		Query: fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %spayment_identities (
+			id UUID NOT NULL DEFAULT public.uuid_generate_v4() PRIMARY KEY,
+			payment_id UUID REFERENCES %spayments(id) ON DELETE CASCADE,
+			identity_id UUID NOT NULL,
+			role_name TEXT,
+			account TEXT NOT NULL,
+			allocated_amount DECIMAL(20, 6),
+			meta JSONB,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`, "{prefix}", "{prefix}"),
+		Down: fmt.Sprintf(`DROP TABLE IF EXISTS %spayment_identities;`, "{prefix}"),
+	},
+	// Migration 4: Create a transactions table to track payment transactions.
+	{
+		Version: "2024-01-04-create-transactions-table",
+		Query: fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %stransactions (
+			id UUID NOT NULL DEFAULT public.uuid_generate_v4() PRIMARY KEY,
+			payment_id UUID REFERENCES %spayments(id) ON DELETE CASCADE,
+			identity_id UUID NOT NULL,
+			tx_id TEXT NOT NULL,
+			tag TEXT,
+			amount DECIMAL(20, 6),
+			fee DECIMAL(20, 6),
+			discount DECIMAL(20, 6),
+			type %s,
+			meta JSONB,
+			canceled_at TIMESTAMP,
+			verified_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`, "{prefix}", "{prefix}", "gopay_transaction_type"),
+	},
+	// Migration 5: Create the payment_migrations table to track which migrations have been applied.
+	{
+		Version: "2024-01-05-create-payment_migrations-table",
+		Query: fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %spayment_migrations (
+			version VARCHAR(50) PRIMARY KEY,
+			applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`, "{prefix}"),
+	},
+	// Migration 6: Create a trigger to update the payments as a respective transaction is created.
+	{
+		Version: "2025-01-22-create-payment-transaction-sync",
+		Query: fmt.Sprintf(`
+			CREATE TYPE %stransaction_status AS ENUM ('VERIFIED', 'CANCELED');
+			ALTER TABLE %spayments
+				ADD COLUMN transaction_status %stransaction_status;
+				
+			CREATE OR REPLACE FUNCTION update_%spayments_on_tx() RETURNS trigger
+				LANGUAGE plpgsql
+				AS $$
+			DECLARE
+				tx_status %stransaction_status;
+			BEGIN
+				tx_status := CASE
+					WHEN NEW.canceled_at IS NOT NULL THEN 'CANCELED'::%stransaction_status
+					WHEN NEW.verified_at IS NOT NULL THEN 'VERIFIED'::%stransaction_status
+					ELSE NULL
+				END;
+				UPDATE %spayments SET transaction_status=tx_status WHERE id=NEW.payment_id;
+				RETURN NEW;
+			END;
+			$$;
+
+			CREATE OR REPLACE TRIGGER update_%spayments_on_tx AFTER INSERT OR UPDATE ON %stransactions FOR EACH ROW EXECUTE FUNCTION update_gopay_payments_on_tx();
+
+			UPDATE %stransactions SET id=id;
+		`, "{prefix}", "{prefix}", "{prefix}", "{prefix}", "{prefix}", "{prefix}", "{prefix}", "{prefix}", "{prefix}", "{prefix}", "{prefix}"),
+	},
+	{
+		Version: "2025-06-02-fiat_3d_secure",
+		Query: fmt.Sprintf(`
+			ALTER TABLE %spayments ADD COLUMN client_secret varchar(120);
+			ALTER TYPE %stransaction_status ADD VALUE 'ACTION_REQUIRED';
+		`, "{prefix}", "{prefix}"),
+	},
+	{
+		Version: "2025-06-25-transaction_status",
+		Query: fmt.Sprintf(`
+			ALTER TYPE %stransaction_status ADD VALUE 'PENDING';
+			ALTER TABLE %stransactions ADD COLUMN status %stransaction_status;
+		`, "{prefix}", "{prefix}", "{prefix}"),
+	},
+	{
+		Version: "2025-07-10-transaction_dispute",
+		Query: fmt.Sprintf(`
+			ALTER TYPE %stransaction_status ADD VALUE 'DISPUTED';
+		`, "{prefix}"),
+	},
+	{
+		Version: "2025-07-15-partial_refund",
+		Query: fmt.Sprintf(`
+			ALTER TYPE gopay_transaction_type ADD VALUE 'PARTIAL_REFUND';
+			ALTER TABLE %spayments ADD COLUMN refunded_amount DECIMAL(20, 6) DEFAULT 0;
+		`, "{prefix}"),
+	},
+	{
+		Version: "2025-07-20-payments_date_indexes",
+		Query: fmt.Sprintf(`
+			CREATE INDEX IF NOT EXISTS %spayments_created_at_idx ON %spayments (created_at);
+			CREATE INDEX IF NOT EXISTS %spayments_updated_at_idx ON %spayments (updated_at);
+		`, "{prefix}", "{prefix}", "{prefix}", "{prefix}"),
+		Down: fmt.Sprintf(`
+			DROP INDEX IF EXISTS %spayments_created_at_idx;
+			DROP INDEX IF EXISTS %spayments_updated_at_idx;
+		`, "{prefix}", "{prefix}"),
+	},
+	{
+		Version: "2025-07-25-payment_link",
+		Query: fmt.Sprintf(`
+			ALTER TABLE %spayments ADD COLUMN payment_link_id TEXT;
+		`, "{prefix}"),
+		Down: fmt.Sprintf(`ALTER TABLE %spayments DROP COLUMN payment_link_id;`, "{prefix}"),
+	},
+	{
+		Version: "2025-08-01-create-payment_notes-table",
+		Query: fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %spayment_notes (
+			id UUID NOT NULL DEFAULT public.uuid_generate_v4() PRIMARY KEY,
+			payment_id UUID REFERENCES %spayments(id) ON DELETE CASCADE,
+			note TEXT NOT NULL,
+			created_by TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`, "{prefix}", "{prefix}"),
+	},
+	{
+		Version: "2025-08-05-add-currency-eur",
+		Query:   `ALTER TYPE gopay_currency ADD VALUE IF NOT EXISTS 'EUR';`,
+	},
+	{
+		Version: "2025-08-05-add-currency-gbp",
+		Query:   `ALTER TYPE gopay_currency ADD VALUE IF NOT EXISTS 'GBP';`,
+	},
+	{
+		// fiat_service_name keeps the configured Fiat.Name, the provider behind it is stored in fiat_service
+		Version: "2025-08-10-fiat_service",
+		Query: fmt.Sprintf(`
+			DO $$ BEGIN
+				CREATE TYPE gopay_fiat_service AS ENUM ('STRIPE');
+			EXCEPTION WHEN duplicate_object THEN NULL;
+			END $$;
+			ALTER TABLE %spayments ADD COLUMN fiat_service gopay_fiat_service;
+			UPDATE %spayments SET fiat_service='STRIPE' WHERE fiat_service_name IS NOT NULL;
+		`, "{prefix}", "{prefix}"),
+		Down: fmt.Sprintf(`ALTER TABLE %spayments DROP COLUMN fiat_service;`, "{prefix}"),
+	},
+	{
+		// Prevents the same on-chain or gateway transaction from being recorded twice for a payment
+		Version: "2025-08-12-transactions_payment_txid_index",
+		Query: fmt.Sprintf(`
+			CREATE UNIQUE INDEX IF NOT EXISTS %stransactions_payment_txid_idx ON %stransactions (payment_id, tx_id) WHERE tx_id != '';
+		`, "{prefix}", "{prefix}"),
+		Down: fmt.Sprintf(`DROP INDEX IF EXISTS %stransactions_payment_txid_idx;`, "{prefix}"),
+	},
+	{
+		// Manually captured payments are authorized before being deposited
+		Version: "2025-08-14-payment_status_authorized",
+		Query:   `ALTER TYPE gopay_payment_status ADD VALUE IF NOT EXISTS 'AUTHORIZED';`,
+	},
+	{
+		// Tracks when the crypto rate was last set, e.g., to expire stale rates
+		Version: "2025-08-16-payment_rate_set_at",
+		Query: fmt.Sprintf(`
+			ALTER TABLE %spayments ADD COLUMN rate_set_at TIMESTAMP;
+			UPDATE %spayments SET rate_set_at=updated_at WHERE crypto_currency_rate IS NOT NULL;
+		`, "{prefix}", "{prefix}"),
+		Down: fmt.Sprintf(`ALTER TABLE %spayments DROP COLUMN rate_set_at;`, "{prefix}"),
+	},
+	{
+		// Identities are archived rather than deleted so that the transactions made by them keep their identity
+		Version: "2025-08-18-payment_identities_archived_at",
+		Query: fmt.Sprintf(`
+			ALTER TABLE %spayment_identities ADD COLUMN archived_at TIMESTAMP;
+		`, "{prefix}"),
+		Down: fmt.Sprintf(`ALTER TABLE %spayment_identities DROP COLUMN archived_at;`, "{prefix}"),
+	},
+	{
+		Version: "2025-08-20-create-payment_annotations-table",
+		Query: fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %spayment_annotations (
+			payment_id UUID NOT NULL REFERENCES %spayments(id) ON DELETE CASCADE,
+			key TEXT NOT NULL,
+			value TEXT NOT NULL,
+			PRIMARY KEY (payment_id, key)
+		);`, "{prefix}", "{prefix}"),
+		Down: fmt.Sprintf(`DROP TABLE IF EXISTS %spayment_annotations;`, "{prefix}"),
+	},
+	{
+		// Disputed payments are frozen until the dispute is resolved
+		Version: "2025-08-22-payment_status_disputed",
+		Query:   `ALTER TYPE gopay_payment_status ADD VALUE IF NOT EXISTS 'DISPUTED';`,
+	},
+	{
+		// Canceled transactions no longer hold their transaction ID, so a failed deposit can be confirmed again
+		Version: "2025-08-24-transactions_payment_txid_index_active",
+		Query: fmt.Sprintf(`
+			DROP INDEX IF EXISTS %stransactions_payment_txid_idx;
+			CREATE UNIQUE INDEX %stransactions_payment_txid_idx ON %stransactions (payment_id, tx_id) WHERE tx_id != '' AND canceled_at IS NULL;
+		`, "{prefix}", "{prefix}", "{prefix}"),
+		Down: fmt.Sprintf(`
+			DROP INDEX IF EXISTS %stransactions_payment_txid_idx;
+			CREATE UNIQUE INDEX %stransactions_payment_txid_idx ON %stransactions (payment_id, tx_id) WHERE tx_id != '';
+		`, "{prefix}", "{prefix}", "{prefix}"),
+	},
+}
+
+// Run applies any pending migrations for the payment package.
+func Run(db *sqlx.DB, prefix string, opts ...Option) error {
+	o := newOptions(opts)
+
+	pending, err := DryRun(db, prefix)
+	if err != nil {
+		return err
+	}
+
+	// Warn about applied migrations whose query has changed since
+	if err := checkChecksums(db, prefix, o.logger); err != nil {
+		return err
+	}
+
+	// Apply pending migrations
+	for _, migration := range pending {
+		o.logger.Infof("Applying migration: %s", migration.Version)
+		o.logger.Debugf("%s", migration.Query)
+		if err := applyMigration(db, prefix, migration, o.logger); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkChecksums logs a warning for every applied migration whose query no longer matches the checksum recorded
+// when it was applied, since the change will not be applied to the database. Migrations recorded without a
+// checksum get the current one, which later runs compare against.
+func checkChecksums(db *sqlx.DB, prefix string, logger Logger) error {
+	appliedVersions, err := getAppliedMigrations(db, prefix)
+	if err != nil {
+		return fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+
+	for _, migration := range migrations {
+		applied, ok := appliedVersions[migration.Version]
+		if !ok {
+			continue
+		}
+		checksum := queryChecksum(migration.Query)
+		if !applied.Checksum.Valid {
+			query := replacePrefix(`UPDATE {prefix}payment_migrations SET checksum=$1 WHERE version=$2 AND checksum IS NULL`, prefix)
+			if _, err := db.Exec(query, checksum, migration.Version); err != nil {
+				return fmt.Errorf("failed to record checksum of migration %s: %w", migration.Version, err)
+			}
+			continue
+		}
+		if applied.Checksum.String != checksum {
+			logger.Infof("WARNING: migration %s has changed since it was applied (checksum %s, now %s); the change is not applied to the database",
+				migration.Version, applied.Checksum.String, checksum)
+		}
+	}
+	return nil
+}
+
+// DryRun returns the migrations Run would apply, in order, with their queries ready to be executed.
+// It only creates the migrations table if it does not exist yet.
+func DryRun(db *sqlx.DB, prefix string) ([]Migration, error) {
+	// Ensure the migrations table exists
+	if err := createMigrationsTable(db, prefix); err != nil {
+		return nil, fmt.Errorf("failed to create migrations table: %w", err)
+	}
+
+	// Check applied migrations
+	appliedVersions, err := getAppliedMigrations(db, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+
+	var pending []Migration
+	for _, migration := range migrations {
+		if _, applied := appliedVersions[migration.Version]; !applied {
+			migration.Checksum = queryChecksum(migration.Query)
+			migration.Query = replacePrefix(migration.Query, prefix) // Replace `{prefix}` with the actual prefix
+			migration.Down = replacePrefix(migration.Down, prefix)
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// Status lists every migration of the payment package, in order, along with whether it has been applied.
+func Status(db *sqlx.DB, prefix string) ([]MigrationRecord, error) {
+	if err := createMigrationsTable(db, prefix); err != nil {
+		return nil, fmt.Errorf("failed to create migrations table: %w", err)
+	}
+
+	appliedVersions, err := getAppliedMigrations(db, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+
+	records := make([]MigrationRecord, len(migrations))
+	for i, migration := range migrations {
+		records[i].Version = migration.Version
+		if applied, ok := appliedVersions[migration.Version]; ok {
+			records[i].Applied = true
+			records[i].AppliedAt = &applied.AppliedAt
+		}
+	}
+	return records, nil
+}
+
+// Rollback reverts an applied migration with its down query and removes it from the applied migrations,
+// so that the next Run applies it again. Migrations depending on it should be rolled back first.
+// It returns ErrIrreversibleMigration for migrations without a down query, such as those adding enum values.
+func Rollback(db *sqlx.DB, prefix, version string) error {
+	var migration *Migration
+	for i := range migrations {
+		if migrations[i].Version == version {
+			migration = &migrations[i]
+		}
+	}
+	if migration == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownMigration, version)
+	}
+	if migration.Down == "" {
+		return fmt.Errorf("%w: %s", ErrIrreversibleMigration, version)
+	}
+
+	appliedVersions, err := getAppliedMigrations(db, prefix)
+	if err != nil {
+		return fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+	if _, applied := appliedVersions[version]; !applied {
+		return fmt.Errorf("%w: %s", ErrMigrationNotApplied, version)
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to begin rollback of %s: %w", version, err)
+	}
+	if _, err := tx.Exec(replacePrefix(migration.Down, prefix)); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to roll back migration %s: %w", version, err)
+	}
+	if _, err := tx.Exec(replacePrefix(`DELETE FROM {prefix}payment_migrations WHERE version=$1`, prefix), version); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to unrecord migration %s: %w", version, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit rollback of %s: %w", version, err)
+	}
+	return nil
+}
+
+// addEnumValuePattern matches `ALTER TYPE ... ADD VALUE` statements.
+var addEnumValuePattern = regexp.MustCompile(`(?is)ALTER\s+TYPE\s+\S+\s+ADD\s+VALUE`)
+
+// applyMigration runs a migration query and records it as applied within a single transaction, so that a
+// failing migration leaves the database untouched. Queries adding enum values are run without a transaction
+// since `ALTER TYPE ... ADD VALUE` cannot run inside one before Postgres 12.
+func applyMigration(db *sqlx.DB, prefix string, migration Migration, logger Logger) error {
+	version, query := migration.Version, migration.Query
+	if addEnumValuePattern.MatchString(query) {
+		logger.Infof("Migration %s adds enum values and is applied without a transaction; it will not be rolled back on failure", version)
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("failed to apply migration %s: %w", version, err)
+		}
+		if err := recordMigration(db, prefix, version, migration.Checksum); err != nil {
+			return fmt.Errorf("failed to record migration %s: %w", version, err)
+		}
+		return nil
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to begin migration %s: %w", version, err)
+	}
+	if _, err := tx.Exec(query); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to apply migration %s: %w", version, err)
+	}
+	if err := recordMigration(tx, prefix, version, migration.Checksum); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to record migration %s: %w", version, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migration %s: %w", version, err)
+	}
+	return nil
+}
+
+// replacePrefix replaces `{prefix}` in migration queries with the actual table prefix.
+func replacePrefix(query, prefix string) string {
+	if prefix != "" {
+		prefix = fmt.Sprintf("%s_", prefix)
+	}
+	return strings.ReplaceAll(query, "{prefix}", prefix)
+}
+
+// createMigrationsTable ensures the `payment_migrations` table exists with dynamic prefix.
+func createMigrationsTable(db *sqlx.DB, prefix string) error {
+	query := replacePrefix(`
+	CREATE TABLE IF NOT EXISTS {prefix}payment_migrations (
+		version VARCHAR(50) PRIMARY KEY,
+		applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	ALTER TABLE {prefix}payment_migrations ADD COLUMN IF NOT EXISTS checksum VARCHAR(64);`, prefix)
+	if _, err := db.Exec(query); err != nil {
+		return err
+	}
+
+	// Without a prefix, migrations used to be tracked in `_payment_migrations`; carry them over
+	if prefix == "" {
+		_, err := db.Exec(legacyMigrationsTableQuery)
+		return err
+	}
+	return nil
+}
+
+// legacyMigrationsTableQuery moves the migrations recorded in `_payment_migrations`, where they were tracked when
+// no prefix was set, to `payment_migrations`.
+const legacyMigrationsTableQuery = `
+	DO $$ BEGIN
+		IF to_regclass('_payment_migrations') IS NOT NULL THEN
+			INSERT INTO payment_migrations (version, applied_at)
+			SELECT version, applied_at FROM _payment_migrations
+			ON CONFLICT (version) DO NOTHING;
+			DROP TABLE _payment_migrations;
+		END IF;
+	END $$;`
+
+// getAppliedMigrations retrieves all applied migrations, keyed by version, with dynamic prefix.
+func getAppliedMigrations(db *sqlx.DB, prefix string) (map[string]appliedMigration, error) {
+	query := replacePrefix(`SELECT version, applied_at, checksum FROM {prefix}payment_migrations`, prefix)
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[string]appliedMigration)
+	for rows.Next() {
+		var (
+			version   string
+			migration appliedMigration
+		)
+		if err := rows.Scan(&version, &migration.AppliedAt, &migration.Checksum); err != nil {
+			return nil, err
+		}
+		applied[version] = migration
+	}
+
+	return applied, rows.Err()
+}
+
+// recordMigration records a migration as applied in the `payment_migrations` table with dynamic prefix.
+func recordMigration(db sqlx.Execer, prefix, version, checksum string) error {
+	query := replacePrefix(`INSERT INTO {prefix}payment_migrations (version, checksum) VALUES ($1, $2)`, prefix)
+	_, err := db.Exec(query, version, checksum)
+	return err
+}
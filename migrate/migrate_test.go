@@ -0,0 +1,87 @@
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// declaredCurrencies returns the values of every Currency constant declared in enums.go.
+func declaredCurrencies(t *testing.T) []string {
+	file, err := parser.ParseFile(token.NewFileSet(), "../enums.go", nil, 0)
+	if err != nil {
+		t.Fatalf("Failed to parse enums.go: %v", err)
+	}
+
+	var currencies []string
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.CONST {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			vs := spec.(*ast.ValueSpec)
+			if ident, ok := vs.Type.(*ast.Ident); !ok || ident.Name != "Currency" {
+				continue
+			}
+			for _, v := range vs.Values {
+				value, _ := strconv.Unquote(v.(*ast.BasicLit).Value)
+				currencies = append(currencies, value)
+			}
+		}
+	}
+	return currencies
+}
+
+func TestCurrencyMigrations(t *testing.T) {
+	currencies := declaredCurrencies(t)
+	if len(currencies) == 0 {
+		t.Fatal("Expected Currency constants in enums.go, but found none")
+	}
+
+	for _, currency := range currencies {
+		created := fmt.Sprintf("'%s'", currency)
+		added := fmt.Sprintf("ALTER TYPE gopay_currency ADD VALUE IF NOT EXISTS '%s'", currency)
+
+		found := false
+		for _, m := range migrations {
+			for _, line := range strings.Split(m.Query, "\n") {
+				if (strings.Contains(line, "CREATE TYPE gopay_currency AS ENUM") && strings.Contains(line, created)) ||
+					strings.Contains(line, added) {
+					found = true
+				}
+			}
+		}
+		if !found {
+			t.Errorf("Expected a migration adding currency %s to gopay_currency, but found none", currency)
+		}
+	}
+}
+
+func TestAddEnumValuePattern(t *testing.T) {
+	cases := map[string]bool{
+		"ALTER TYPE gopay_currency ADD VALUE IF NOT EXISTS 'EUR';":       true,
+		"alter type transaction_status\n\tadd value 'PENDING';":          true,
+		"ALTER TABLE payments ADD COLUMN value TEXT;":                    false,
+		"CREATE TYPE gopay_network_mode AS ENUM ('MAINNET', 'TESTNET');": false,
+	}
+	for query, want := range cases {
+		if got := addEnumValuePattern.MatchString(query); got != want {
+			t.Errorf("%q: expected %v, but got %v", query, want, got)
+		}
+	}
+}
+
+func TestRollbackRequiresReversibleMigration(t *testing.T) {
+	if err := Rollback(nil, "test", "1999-01-01-missing"); !errors.Is(err, ErrUnknownMigration) {
+		t.Errorf("Expected ErrUnknownMigration, but got %v", err)
+	}
+	if err := Rollback(nil, "test", "2024-01-01-create-enums"); !errors.Is(err, ErrIrreversibleMigration) {
+		t.Errorf("Expected ErrIrreversibleMigration, but got %v", err)
+	}
+}
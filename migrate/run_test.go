@@ -0,0 +1,145 @@
+package migrate_test
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/socious-io/gopay/migrate"
+	"github.com/socious-io/gopay/testutil"
+)
+
+// newMigrationDB returns a mock database failing any statement containing "FAIL", whose queries return the
+// given applied migrations as rows of version, applied_at and checksum.
+func newMigrationDB(t *testing.T, applied ...[]driver.Value) *testutil.MockDB {
+	return testutil.NewMockDB(t, func(query string, _ []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		if strings.Contains(query, "FAIL") {
+			return nil, nil, errors.New("syntax error")
+		}
+		return []string{"version", "applied_at", "checksum"}, append([][]driver.Value(nil), applied...), nil
+	})
+}
+
+func TestRunMigrateRollsBackFailedMigration(t *testing.T) {
+	db := newMigrationDB(t)
+	migrate.SetMigrations(t, []migrate.Migration{
+		{Version: "ok", Query: "CREATE TABLE {prefix}ok (id INT);"},
+		{Version: "broken", Query: "CREATE TABLE {prefix}partial (id INT); FAIL;"},
+	})
+
+	err := migrate.Run(db.DB, "test")
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Fatalf("Expected the broken migration to fail, but got %v", err)
+	}
+
+	var okApplied, okRecorded bool
+	for _, q := range db.Committed() {
+		if strings.Contains(q, "partial") || strings.Contains(q, "FAIL") {
+			t.Errorf("Expected the failed migration to be rolled back, but %q was committed", q)
+		}
+		okApplied = okApplied || strings.Contains(q, "CREATE TABLE test_ok")
+		okRecorded = okRecorded || strings.Contains(q, "INSERT INTO test_payment_migrations")
+	}
+	if !okApplied || !okRecorded {
+		t.Errorf("Expected the preceding migration to be applied and recorded, but got %v", db.Committed())
+	}
+}
+
+func TestDryRunReplacesPrefix(t *testing.T) {
+	db := newMigrationDB(t)
+
+	pending, err := migrate.DryRun(db.DB, "test")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if len(pending) != len(migrate.Migrations()) {
+		t.Fatalf("Expected all %d migrations to be pending, but got %d", len(migrate.Migrations()), len(pending))
+	}
+	for _, m := range pending {
+		if strings.Contains(m.Query, "{prefix}") || strings.Contains(m.Down, "{prefix}") {
+			t.Errorf("%s: expected the prefix to be replaced, but got %s", m.Version, m.Query)
+		}
+	}
+	if !strings.Contains(pending[1].Query, "test_payments") {
+		t.Errorf("Expected the payments table to be prefixed, but got %s", pending[1].Query)
+	}
+}
+
+func TestRunMigrateWithoutPrefix(t *testing.T) {
+	db := newMigrationDB(t)
+	migrate.SetMigrations(t, []migrate.Migration{{Version: "ok", Query: "CREATE TABLE {prefix}ok (id INT);"}})
+
+	if err := migrate.Run(db.DB, ""); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	var created, recorded bool
+	for _, q := range db.Committed() {
+		if strings.Contains(q, "CREATE TABLE IF NOT EXISTS _payment_migrations") || strings.Contains(q, "INSERT INTO _payment_migrations") {
+			t.Errorf("Expected no leading underscore in the migrations table, but got %q", q)
+		}
+		created = created || strings.Contains(q, "CREATE TABLE IF NOT EXISTS payment_migrations")
+		recorded = recorded || strings.Contains(q, "INSERT INTO payment_migrations (version")
+	}
+	if !created || !recorded {
+		t.Errorf("Expected migrations to be tracked in payment_migrations, but got %v", db.Committed())
+	}
+}
+
+// recordingLogger keeps the messages logged by the migrations.
+type recordingLogger struct {
+	messages []string
+}
+
+func (l *recordingLogger) Infof(format string, args ...interface{}) {
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {}
+
+func TestRunMigrateChecksums(t *testing.T) {
+	migrations := []migrate.Migration{
+		{Version: "unchanged", Query: "CREATE TABLE {prefix}unchanged (id INT);"},
+		{Version: "changed", Query: "CREATE TABLE {prefix}changed (id INT, name TEXT);"},
+		{Version: "unrecorded", Query: "CREATE TABLE {prefix}unrecorded (id INT);"},
+		{Version: "pending", Query: "CREATE TABLE {prefix}pending (id INT);"},
+	}
+	migrate.SetMigrations(t, migrations)
+	now := time.Now()
+	db := newMigrationDB(t,
+		[]driver.Value{"unchanged", now, migrate.QueryChecksum(migrations[0].Query)},
+		[]driver.Value{"changed", now, migrate.QueryChecksum("CREATE TABLE {prefix}changed (id INT);")},
+		[]driver.Value{"unrecorded", now, nil},
+	)
+
+	logger := new(recordingLogger)
+	if err := migrate.Run(db.DB, "test", migrate.WithLogger(logger)); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	var warnings []string
+	for _, m := range logger.messages {
+		if strings.HasPrefix(m, "WARNING") {
+			warnings = append(warnings, m)
+		}
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "migration changed") {
+		t.Errorf("Expected a single warning about the changed migration, but got %v", warnings)
+	}
+
+	var backfilled, recorded int
+	for _, q := range db.Committed() {
+		if strings.Contains(q, "UPDATE test_payment_migrations SET checksum") {
+			backfilled++
+		}
+		if strings.Contains(q, "INSERT INTO test_payment_migrations (version, checksum)") {
+			recorded++
+		}
+	}
+	if backfilled != 1 || recorded != 1 {
+		t.Errorf("Expected the unrecorded checksum to be filled and the pending migration recorded with its checksum, but got %v", db.Committed())
+	}
+}
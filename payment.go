@@ -1,14 +1,136 @@
 package gopay
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
 	"github.com/jmoiron/sqlx/types"
 )
 
+// ErrPaymentAlreadyProcessed is returned when modifying a payment that has already been deposited or moved beyond.
+var ErrPaymentAlreadyProcessed = &Error{Code: ErrCodeInvalidStatus, Message: "payment has already been processed"}
+
+// ErrMaxIdentitiesReached is returned when adding an identity to a payment that already has
+// Config.MaxIdentitiesPerPayment identities.
+var ErrMaxIdentitiesReached = &Error{Code: ErrCodeValidation, Message: "payment has reached the maximum number of identities"}
+
+// ErrUnallocatedAmount is returned when depositing a payment whose amount is not fully allocated to identities.
+var ErrUnallocatedAmount = &Error{Code: ErrCodeValidation, Message: "payment amount is not fully allocated to identities"}
+
+// allocationEpsilon is the tolerance used when comparing allocated amounts.
+const allocationEpsilon = 0.000001
+
+// ErrFiatServiceNotSet is returned when processing a fiat payment before SetToFiatMode has been called.
+var ErrFiatServiceNotSet = &Error{Code: ErrCodeInvalidStatus, Message: "fiat service is not set, call SetToFiatMode first"}
+
+// ErrCryptoAddressNotSet is returned when processing a crypto payment before SetToCryptoMode has been called.
+var ErrCryptoAddressNotSet = &Error{Code: ErrCodeInvalidStatus, Message: "crypto address is not set, call SetToCryptoMode first"}
+
+// ErrCryptoRateNotSet is returned when reading the crypto currency rate of a payment that is not in crypto mode.
+var ErrCryptoRateNotSet = &Error{Code: ErrCodeInvalidStatus, Message: "crypto currency rate is not set, call SetToCryptoMode first"}
+
+// ErrNoClientSecret is returned when reading the client secret of a payment that does not require customer action.
+var ErrNoClientSecret = &Error{Code: ErrCodeInvalidStatus, Message: "payment has no client secret"}
+
+// ErrPaymentLocked is returned when another process is already holding the payment's lock.
+var ErrPaymentLocked = &Error{Code: ErrCodeConflict, Message: "payment is locked by another process"}
+
+// ErrNoVerifiedPayouts is returned when marking a payment as paid out before any payout has been verified.
+var ErrNoVerifiedPayouts = &Error{Code: ErrCodeInvalidStatus, Message: "payment has no verified payouts"}
+
+// ErrPaymentConflict is returned when creating a payment whose unique reference is already used by a payment
+// with a different amount, currency or type.
+var ErrPaymentConflict = &Error{Code: ErrCodeDuplicate, Message: "payment with the same unique reference already exists with different parameters"}
+
+// ErrDuplicateRef is returned when changing a payment's unique reference to one used by another payment.
+var ErrDuplicateRef = &Error{Code: ErrCodeDuplicate, Message: "unique reference is already used by another payment"}
+
+// maxUniqueRefLength is the longest unique reference accepted for a payment.
+const maxUniqueRefLength = 255
+
+// FieldError describes why a single field failed validation.
+type FieldError struct {
+	Field string // Name of the invalid field (e.g., "total_amount").
+	Err   error  // Why the field is invalid.
+}
+
+// Error returns the field name followed by the reason it is invalid.
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Field, e.Err)
+}
+
+// Unwrap returns the underlying reason so it can be matched with errors.Is.
+func (e FieldError) Unwrap() error {
+	return e.Err
+}
+
+// PaymentConflictError is returned by New when the unique reference collides with an existing payment that
+// differs from the given parameters. It matches ErrPaymentConflict with errors.Is.
+type PaymentConflictError struct {
+	Existing *Payment      // The payment already stored under the unique reference.
+	Params   PaymentParams // The parameters New was called with.
+}
+
+// Error describes how the existing payment differs from the requested one.
+func (e *PaymentConflictError) Error() string {
+	return fmt.Sprintf("%v: existing %f %s (%s), requested %f %s (%s)", ErrPaymentConflict,
+		e.Existing.TotalAmount, e.Existing.Currency, e.Existing.Type,
+		e.Params.TotalAmount, e.Params.Currency, e.Params.Type)
+}
+
+// Unwrap returns ErrPaymentConflict.
+func (e *PaymentConflictError) Unwrap() error {
+	return ErrPaymentConflict
+}
+
+// ValidationError is returned when a payment fails its pre-flight checks. It lists every invalid field so
+// that callers can report them all at once, e.g., as form errors.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+// Error lists all field errors.
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Error()
+	}
+	return "validation failed: " + strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the field errors so that errors.Is matches the sentinel errors they wrap.
+func (e *ValidationError) Unwrap() []error {
+	errs := make([]error, len(e.Fields))
+	for i, f := range e.Fields {
+		errs[i] = f
+	}
+	return errs
+}
+
+// add records an invalid field.
+func (e *ValidationError) add(field string, err error) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Err: err})
+}
+
+// errOrNil returns the validation error wrapped in an ErrCodeValidation *Error, or nil if no field was invalid.
+func (e *ValidationError) errOrNil() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return &Error{Code: ErrCodeValidation, Cause: e}
+}
+
 // Payment represents a payment transaction and its associated details.
 type Payment struct {
 	ID                 uuid.UUID          `db:"id" json:"id"`
@@ -17,19 +139,29 @@ type Payment struct {
 	UniqueRef          string             `db:"unique_ref" json:"unique_ref"`
 	TotalAmount        float64            `db:"total_amount" json:"total_amount"`
 	Currency           Currency           `db:"currency" json:"currency"`
-	FiatServiceName    *string            `db:"fiat_service_name" json:"fiat_service_name"`
+	FiatServiceName    *string            `db:"fiat_service_name" json:"fiat_service_name"` // Name of the configured Fiat (Fiat.Name), not its provider
+	FiatService        *FiatService       `db:"fiat_service" json:"fiat_service"`           // Provider behind FiatServiceName (Fiat.Service)
 	CryptoCurrency     *string            `db:"crypto_currency" json:"crypto_currency"`
 	CryptoCurrencyRate *float64           `db:"crypto_currency_rate" json:"crypto_currency_rate"`
+	RateSetAt          *time.Time         `db:"rate_set_at" json:"rate_set_at"` // When CryptoCurrencyRate was last set
 	Meta               types.JSONText     `db:"meta" json:"meta,omitempty"`
 	Status             PaymentStatus      `db:"status" json:"status"`
 	TransactionStatus  *TransactionStatus `db:"transaction_status" json:"transaction_status"`
 	ClientSecret       *string            `db:"client_secret" json:"client_secret"`
+	RefundedAmount     float64            `db:"refunded_amount" json:"refunded_amount"`
+	PaymentLinkID      *string            `db:"payment_link_id" json:"payment_link_id"`
 	Type               PaymentType        `db:"type" json:"type"`
 	CreatedAt          time.Time          `db:"created_at" json:"created_at"`
 	UpdatedAt          time.Time          `db:"updated_at" json:"updated_at"`
 
 	Identities   []PaymentIdentity `db:"-" json:"identities"`
 	Transactions []Transaction     `db:"-" json:"transactions"`
+	Notes        []PaymentNote     `db:"-" json:"notes,omitempty"`
+	Annotations  map[string]string `db:"-" json:"annotations,omitempty"` // Key-value annotations, e.g., external order IDs; see SetAnnotation.
+
+	StripeWebhookMetadata map[string]string `db:"-" json:"stripe_webhook_metadata,omitempty"` // Metadata received with the webhook event the payment was loaded from.
+
+	lockTx *sqlx.Tx // Transaction the payment was fetched in, holding its advisory lock until it ends; see FetchInTx.
 }
 
 // PaymentIdentity represents a payment identity associated with a payment.
@@ -42,6 +174,56 @@ type PaymentIdentity struct {
 	AllocatedAmount float64        `db:"allocated_amount" json:"allocated_amount"`
 	Meta            types.JSONText `db:"meta" json:"meta,omitempty"`
 	CreatedAt       time.Time      `db:"created_at" json:"created_at"`
+	ArchivedAt      *time.Time     `db:"archived_at" json:"archived_at,omitempty"` // Set once removed by ArchiveIdentities; archived identities are not loaded
+}
+
+// PaymentNote represents an operator note recorded against a payment for auditing.
+type PaymentNote struct {
+	ID        uuid.UUID `db:"id" json:"id"`
+	PaymentID uuid.UUID `db:"payment_id" json:"payment_id"`
+	Note      string    `db:"note" json:"note"`
+	CreatedBy string    `db:"created_by" json:"created_by"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// PaymentAnnotation is a key-value annotation of a payment, as stored in the payment_annotations table.
+type PaymentAnnotation struct {
+	PaymentID uuid.UUID `db:"payment_id" json:"payment_id"`
+	Key       string    `db:"key" json:"key"`
+	Value     string    `db:"value" json:"value"`
+}
+
+// PaymentEvent is a single entry in a payment's timeline as returned by History.
+type PaymentEvent struct {
+	Time        time.Time   `json:"time"`
+	EventType   string      `json:"event_type"`
+	Description string      `json:"description"`
+	Data        interface{} `json:"data,omitempty"`
+}
+
+// Event types reported by Payment.History.
+const (
+	EventCreated             = "created"
+	EventTransactionCreated  = "transaction_created"
+	EventTransactionVerified = "transaction_verified"
+	EventTransactionCanceled = "transaction_canceled"
+	EventRolledBack          = "rolled_back" // A verified deposit was canceled by Payment.Rollback.
+	EventNote                = "note"
+)
+
+// FetchOption customizes what Fetch and FetchByUniqueRef load along with the payment.
+type FetchOption func(*fetchOptions)
+
+// fetchOptions holds the settings applied by FetchOption.
+type fetchOptions struct {
+	notes bool
+}
+
+// WithNotes makes Fetch and FetchByUniqueRef also populate the payment's notes.
+func WithNotes() FetchOption {
+	return func(o *fetchOptions) {
+		o.notes = true
+	}
 }
 
 // PaymentParams holds the parameters to create a new payment.
@@ -55,6 +237,37 @@ type PaymentParams struct {
 	Meta        interface{}
 }
 
+// Validate checks the parameters of a new payment and returns a *ValidationError listing every invalid field.
+func (params PaymentParams) Validate() error {
+	verr := new(ValidationError)
+	if params.TotalAmount <= 0 {
+		verr.add("total_amount", errors.New("must be greater than 0"))
+	}
+	if !params.Currency.Valid() {
+		verr.add("currency", fmt.Errorf("unsupported currency %q", params.Currency))
+	}
+	if params.Tag == "" {
+		verr.add("tag", errors.New("is required"))
+	}
+	if params.Ref == "" {
+		verr.add("unique_ref", errors.New("is required"))
+	} else if len(params.Ref) > maxUniqueRefLength {
+		verr.add("unique_ref", fmt.Errorf("must be at most %d characters", maxUniqueRefLength))
+	}
+	return verr.errOrNil()
+}
+
+// checkConflict returns a *PaymentConflictError if the existing payment with the same unique reference differs
+// in amount, currency or type from params.
+func (params PaymentParams) checkConflict(existing *Payment) error {
+	if math.Abs(existing.TotalAmount-params.TotalAmount) > allocationEpsilon ||
+		existing.Currency != params.Currency ||
+		existing.Type != params.Type {
+		return &PaymentConflictError{Existing: existing, Params: params}
+	}
+	return nil
+}
+
 // IdentityParams holds the parameters for creating a new payment identity.
 type IdentityParams struct {
 	ID       uuid.UUID
@@ -64,6 +277,53 @@ type IdentityParams struct {
 	Meta     interface{}
 }
 
+// AllocateAmong checks that the amounts of identities add up to totalAmount. Identities with a zero amount
+// are filled from the remainder, which is split equally among them. The identities are updated in place.
+func AllocateAmong(identities []IdentityParams, totalAmount float64) error {
+	var allocated float64
+	var fill []int
+	for i, identity := range identities {
+		switch {
+		case identity.Amount < 0:
+			return newError(ErrCodeValidation, nil, "amount of identity %d must not be negative", i)
+		case identity.Amount == 0:
+			fill = append(fill, i)
+		default:
+			allocated += identity.Amount
+		}
+	}
+
+	remainder := totalAmount - allocated
+	if len(fill) == 0 {
+		if math.Abs(remainder) > allocationEpsilon {
+			return newError(ErrCodeValidation, nil, "allocated amounts sum to %f instead of %f", allocated, totalAmount)
+		}
+		return nil
+	}
+	if remainder <= allocationEpsilon {
+		return newError(ErrCodeValidation, nil, "no amount left to allocate to %d identities, %f of %f already allocated", len(fill), allocated, totalAmount)
+	}
+
+	// Give the last identity whatever is left so that the amounts add up exactly
+	share := remainder / float64(len(fill))
+	for _, i := range fill[:len(fill)-1] {
+		identities[i].Amount = share
+	}
+	identities[fill[len(fill)-1]].Amount = remainder - share*float64(len(fill)-1)
+	return nil
+}
+
+// PaymentWithIdentitiesParams holds the parameters to create a new payment along with its identities; see NewWithIdentities.
+type PaymentWithIdentitiesParams struct {
+	PaymentParams
+	Identities []IdentityParams
+}
+
+// WithIdentities returns the parameters to create the payment along with the given identities.
+func (params PaymentParams) WithIdentities(identities []IdentityParams) PaymentWithIdentitiesParams {
+	return PaymentWithIdentitiesParams{PaymentParams: params, Identities: identities}
+}
+
 // Table returns the table name for the Payment model, using the config prefix if available.
 func (Payment) Table() string {
 	if config.Prefix == "" {
@@ -80,12 +340,239 @@ func (PaymentIdentity) Table() string {
 	return fmt.Sprintf("%s_payment_identities", config.Prefix)
 }
 
+// Table returns the table name for the PaymentNote model, using the config prefix if available.
+func (PaymentNote) Table() string {
+	if config.Prefix == "" {
+		return "payment_notes"
+	}
+	return fmt.Sprintf("%s_payment_notes", config.Prefix)
+}
+
+// AddNote records an operator note against the payment and appends it to Notes.
+func (p *Payment) AddNote(createdBy, note string) (*PaymentNote, error) {
+	n := new(PaymentNote)
+
+	// SQL query with RETURNING *
+	query := `
+		INSERT INTO %s (payment_id, note, created_by)
+		VALUES ($1, $2, $3)
+		RETURNING *`
+	query = fmt.Sprintf(query, n.Table())
+	// Execute query and scan the returned row into the struct
+	if err := config.DB.QueryRowx(query, p.ID, note, createdBy).StructScan(n); err != nil {
+		return nil, newError(ErrCodeDB, err, "failed to add note")
+	}
+	p.Notes = append(p.Notes, *n)
+
+	return n, nil
+}
+
+// FetchNotes retrieves the notes recorded against the payment, oldest first, and stores them in Notes.
+func (p *Payment) FetchNotes() ([]PaymentNote, error) {
+	notes := []PaymentNote{}
+	if err := config.DB.Select(&notes, fmt.Sprintf(`SELECT * FROM %s WHERE payment_id=$1 ORDER BY created_at`, PaymentNote{}.Table()), p.ID); err != nil {
+		return nil, err
+	}
+	p.Notes = notes
+
+	return notes, nil
+}
+
+// Table returns the table name for the PaymentAnnotation model, using the config prefix if available.
+func (PaymentAnnotation) Table() string {
+	if config.Prefix == "" {
+		return "payment_annotations"
+	}
+	return fmt.Sprintf("%s_payment_annotations", config.Prefix)
+}
+
+// SetAnnotation stores value under key in the payment's annotations, replacing any existing value.
+func (p *Payment) SetAnnotation(key, value string) error {
+	if key == "" {
+		return newError(ErrCodeValidation, nil, "annotation key is required")
+	}
+
+	query := `
+		INSERT INTO %s (payment_id, key, value)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (payment_id, key) DO UPDATE SET value=EXCLUDED.value`
+	if _, err := config.DB.Exec(fmt.Sprintf(query, PaymentAnnotation{}.Table()), p.ID, key, value); err != nil {
+		return newError(ErrCodeDB, err, "failed to set annotation %s", key)
+	}
+	if p.Annotations == nil {
+		p.Annotations = map[string]string{}
+	}
+	p.Annotations[key] = value
+
+	return nil
+}
+
+// GetAnnotation returns the value stored under key in the loaded annotations and whether it exists.
+func (p *Payment) GetAnnotation(key string) (string, bool) {
+	value, ok := p.Annotations[key]
+	return value, ok
+}
+
+// DeleteAnnotation removes key from the payment's annotations. Deleting a missing key is not an error.
+func (p *Payment) DeleteAnnotation(key string) error {
+	query := fmt.Sprintf(`DELETE FROM %s WHERE payment_id=$1 AND key=$2`, PaymentAnnotation{}.Table())
+	if _, err := config.DB.Exec(query, p.ID, key); err != nil {
+		return newError(ErrCodeDB, err, "failed to delete annotation %s", key)
+	}
+	delete(p.Annotations, key)
+
+	return nil
+}
+
+// fetchAnnotations retrieves the annotations of the payment with the given ID using q.
+func fetchAnnotations(q sqlx.Queryer, paymentID uuid.UUID) (map[string]string, error) {
+	annotations := []PaymentAnnotation{}
+	query := fmt.Sprintf(`SELECT * FROM %s WHERE payment_id=$1`, PaymentAnnotation{}.Table())
+	if err := sqlx.Select(q, &annotations, query, paymentID); err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]string, len(annotations))
+	for _, a := range annotations {
+		m[a.Key] = a.Value
+	}
+	return m, nil
+}
+
+// TotalAllocated returns the sum of the amounts allocated to the payment's identities.
+func (p *Payment) TotalAllocated() float64 {
+	var total float64
+	for _, i := range p.Identities {
+		total += i.AllocatedAmount
+	}
+	return total
+}
+
+// HasIdentity reports whether the identity has been added to the payment, e.g., before calling AddIdentity.
+// Like the other lookups below, it only searches the loaded identities and does not query the database.
+func (p *Payment) HasIdentity(identityID uuid.UUID) bool {
+	_, ok := p.GetIdentity(identityID)
+	return ok
+}
+
+// GetIdentity returns the payment identity of the given identity, if loaded.
+func (p *Payment) GetIdentity(identityID uuid.UUID) (*PaymentIdentity, bool) {
+	for i := range p.Identities {
+		if p.Identities[i].IdentityID == identityID {
+			return &p.Identities[i], true
+		}
+	}
+	return nil, false
+}
+
+// GetIdentityByRole returns the first loaded payment identity with the given role.
+func (p *Payment) GetIdentityByRole(roleName string) (*PaymentIdentity, bool) {
+	for i := range p.Identities {
+		if p.Identities[i].RoleName == roleName {
+			return &p.Identities[i], true
+		}
+	}
+	return nil, false
+}
+
+// HasVerifiedDeposit reports whether the loaded transactions include a verified deposit that has not been canceled.
+func (p *Payment) HasVerifiedDeposit() bool {
+	for _, t := range p.verifiedDeposits() {
+		if t.CanceledAt == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Unallocated returns the part of the payment's total amount not allocated to any identity.
+// It is negative when the payment is over-allocated.
+func (p *Payment) Unallocated() float64 {
+	return p.TotalAmount - p.TotalAllocated()
+}
+
+// TotalFees returns the sum of the fees of the payment's verified deposits. It only looks at the loaded
+// transactions, so the payment must be loaded with Fetch or FetchFull first.
+func (p *Payment) TotalFees() float64 {
+	var total float64
+	for _, t := range p.verifiedDeposits() {
+		total += t.Fee
+	}
+	return total
+}
+
+// TotalDiscounts returns the sum of the discounts of the payment's verified deposits. Like TotalFees, it
+// requires the transactions to be loaded.
+func (p *Payment) TotalDiscounts() float64 {
+	var total float64
+	for _, t := range p.verifiedDeposits() {
+		total += t.Discount
+	}
+	return total
+}
+
+// NetAmount returns the payment's total amount minus the fees of its verified deposits; see TotalFees.
+func (p *Payment) NetAmount() float64 {
+	return p.TotalAmount - p.TotalFees()
+}
+
+// verifiedDeposits returns the loaded deposit transactions that have been verified and not rolled back since.
+func (p *Payment) verifiedDeposits() []Transaction {
+	var deposits []Transaction
+	for _, t := range p.Transactions {
+		// Deposits canceled by Rollback keep their verification time
+		if t.Type == DEPOSIT && t.VerfiedAt != nil && t.CanceledAt == nil {
+			deposits = append(deposits, t)
+		}
+	}
+	return deposits
+}
+
+// paymentJSON is Payment without its methods, so that MarshalJSON and UnmarshalJSON do not recurse.
+type paymentJSON Payment
+
+// MarshalJSON encodes the payment along with its computed amounts: total_allocated, unallocated, total_fees,
+// total_discounts and net_amount. The fees and discounts are only accurate if the transactions are loaded.
+func (p Payment) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		paymentJSON
+		TotalAllocated float64 `json:"total_allocated"`
+		Unallocated    float64 `json:"unallocated"`
+		TotalFees      float64 `json:"total_fees"`
+		TotalDiscounts float64 `json:"total_discounts"`
+		NetAmount      float64 `json:"net_amount"`
+	}{
+		paymentJSON:    paymentJSON(p),
+		TotalAllocated: p.TotalAllocated(),
+		Unallocated:    p.Unallocated(),
+		TotalFees:      p.TotalFees(),
+		TotalDiscounts: p.TotalDiscounts(),
+		NetAmount:      p.NetAmount(),
+	})
+}
+
+// UnmarshalJSON decodes a payment, ignoring the computed amounts added by MarshalJSON since they are
+// derived from the other fields. They are ignored even by decoders that disallow unknown fields.
+func (p *Payment) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, (*paymentJSON)(p))
+}
+
 // AddIdentity adds a payment identity to a payment, associating an identity with a payment and allocating an amount.
+// It returns ErrMaxIdentitiesReached if the payment already has Config.MaxIdentitiesPerPayment identities.
 func (p *Payment) AddIdentity(params IdentityParams) (*PaymentIdentity, error) {
+	return p.addIdentity(config.DB, params)
+}
+
+// addIdentity is AddIdentity running its query on q, e.g., a transaction.
+func (p *Payment) addIdentity(q sqlx.Queryer, params IdentityParams) (*PaymentIdentity, error) {
+	if len(p.Identities) >= config.MaxIdentitiesPerPayment {
+		return nil, ErrMaxIdentitiesReached
+	}
+
 	// Convert meta to JSONB
 	metaJSON, err := json.Marshal(params.Meta)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal meta: %w", err)
+		return nil, newError(ErrCodeValidation, err, "failed to marshal meta")
 	}
 
 	// Prepare PaymentIdentity struct for scanning
@@ -98,7 +585,7 @@ func (p *Payment) AddIdentity(params IdentityParams) (*PaymentIdentity, error) {
 		RETURNING *`
 	query = fmt.Sprintf(query, identity.Table())
 	// Execute query and scan the returned row into the struct
-	if err := config.DB.QueryRowx(query, p.ID, params.ID, params.RoleName, params.Amount, metaJSON, params.Account).
+	if err := q.QueryRowx(query, p.ID, params.ID, params.RoleName, params.Amount, metaJSON, params.Account).
 		StructScan(identity); err != nil {
 		return nil, err
 	}
@@ -107,36 +594,233 @@ func (p *Payment) AddIdentity(params IdentityParams) (*PaymentIdentity, error) {
 	return identity, nil
 }
 
+// FiatServiceNameStr returns the payment's fiat service name, or ErrFiatServiceNotSet if it has not been set.
+func (p *Payment) FiatServiceNameStr() (string, error) {
+	if p.FiatServiceName == nil {
+		return "", ErrFiatServiceNotSet
+	}
+	return *p.FiatServiceName, nil
+}
+
+// CryptoCurrencyAddress returns the payment's crypto token address, or ErrCryptoAddressNotSet if it has not been set.
+func (p *Payment) CryptoCurrencyAddress() (string, error) {
+	if p.CryptoCurrency == nil {
+		return "", ErrCryptoAddressNotSet
+	}
+	return *p.CryptoCurrency, nil
+}
+
+// CryptoCurrencyRateVal returns the payment's crypto currency rate, or ErrCryptoRateNotSet if it has not been set.
+func (p *Payment) CryptoCurrencyRateVal() (float64, error) {
+	if p.CryptoCurrencyRate == nil {
+		return 0, ErrCryptoRateNotSet
+	}
+	return *p.CryptoCurrencyRate, nil
+}
+
+// CryptoEquivalentAmount returns the payment's total amount converted to its crypto currency at the payment's
+// rate, or ErrCryptoRateNotSet if the rate has not been set.
+func (p *Payment) CryptoEquivalentAmount() (float64, error) {
+	rate, err := p.CryptoCurrencyRateVal()
+	if err != nil {
+		return 0, err
+	}
+	if rate <= 0 {
+		return 0, newError(ErrCodeValidation, nil, "crypto currency rate must be greater than 0")
+	}
+	return p.TotalAmount / rate, nil
+}
+
+// UpdateCryptoRate replaces the rate of a crypto payment, e.g., to refresh it after market movement, and records
+// when it was set in RateSetAt. It returns ErrPaymentAlreadyProcessed if the payment has been deposited or moved beyond.
+func (p *Payment) UpdateCryptoRate(newRate float64) error {
+	// Only crypto payments can call this
+	if p.Type != CRYPTO {
+		return newError(ErrCodeInvalidStatus, nil, "only crypto payments can call this")
+	}
+	if newRate <= 0 {
+		return newError(ErrCodeValidation, nil, "crypto currency rate must be greater than 0")
+	}
+
+	// SQL query with RETURNING *, which yields no row once the payment has been processed
+	query := `
+		UPDATE %s
+		SET crypto_currency_rate = $1, rate_set_at = NOW(), updated_at = NOW()
+		WHERE id = $2 AND status IN ($3, $4)
+		RETURNING *`
+	query = fmt.Sprintf(query, p.Table())
+	// Execute query and scan the updated row back into the Payment struct
+	if err := config.DB.QueryRowx(query, newRate, p.ID, INITIATED, PENDING_DEPOSIT).StructScan(p); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrPaymentAlreadyProcessed
+		}
+		return newError(ErrCodeDB, err, "failed to update crypto currency rate")
+	}
+
+	return nil
+}
+
+// FiatClientSecret returns the client secret the payer needs to complete a 3DS authentication, or
+// ErrNoClientSecret if the payment is not waiting for one.
+func (p *Payment) FiatClientSecret() (string, error) {
+	if p.ClientSecret == nil {
+		return "", ErrNoClientSecret
+	}
+	return *p.ClientSecret, nil
+}
+
+// CreatePaymentLink creates a hosted payment link for the payment on its fiat service, stores the link ID
+// on the payment and returns the link URL.
+func (p *Payment) CreatePaymentLink(params PaymentLinkParams) (string, error) {
+	// Only fiat payments can call this
+	if p.Type != FIAT {
+		return "", newError(ErrCodeInvalidStatus, nil, "only fiat payments can call this")
+	}
+	serviceName, err := p.FiatServiceNameStr()
+	if err != nil {
+		return "", err
+	}
+
+	link, err := config.fiatServices().CreatePaymentLink(serviceName, params)
+	if err != nil {
+		return "", err
+	}
+
+	// SQL query with RETURNING *
+	query := `
+		UPDATE %s
+		SET payment_link_id = $1, updated_at = NOW()
+		WHERE id = $2
+		RETURNING *`
+	query = fmt.Sprintf(query, p.Table())
+	// Execute query and scan the updated row back into the Payment struct
+	if err := config.DB.QueryRowx(query, link.ID, p.ID).StructScan(p); err != nil {
+		return "", newError(ErrCodeDB, err, "failed to store payment link")
+	}
+
+	return link.URL, nil
+}
+
+// Update modifies the role, account, allocated amount and metadata of an existing payment identity.
+// It returns ErrPaymentAlreadyProcessed if the payment has been deposited or moved beyond.
+func (pi *PaymentIdentity) Update(params IdentityParams) error {
+	// Ensure the payment has not been processed yet
+	var status PaymentStatus
+	if err := config.DB.Get(&status, fmt.Sprintf(`SELECT status FROM %s WHERE id=$1`, Payment{}.Table()), pi.PaymentID); err != nil {
+		return err
+	}
+	if status != INITIATED && status != PENDING_DEPOSIT {
+		return ErrPaymentAlreadyProcessed
+	}
+
+	// Convert meta to JSONB
+	metaJSON, err := json.Marshal(params.Meta)
+	if err != nil {
+		return newError(ErrCodeValidation, err, "failed to marshal meta")
+	}
+
+	// SQL query with RETURNING *
+	query := `
+		UPDATE %s
+		SET role_name=$2, account=$3, allocated_amount=$4, meta=$5
+		WHERE id=$1
+		RETURNING *`
+	query = fmt.Sprintf(query, pi.Table())
+	// Execute query and scan the updated row back into the struct
+	return config.DB.QueryRowx(query, pi.ID, params.RoleName, params.Account, params.Amount, metaJSON).StructScan(pi)
+}
+
+// ArchiveIdentities removes all identities from the payment, e.g., to reassign it to a different buyer, and
+// returns a payment pending deposit to INITIATED, both in a single database transaction. It returns
+// ErrPaymentAlreadyProcessed unless the payment is initiated or pending deposit. The payment is locked meanwhile.
+//
+// The identities are archived (soft-deleted) rather than deleted: transactions refer to the identity that made
+// them, so deleting it would lose who made the failed deposits of the payment. Archived identities are kept out
+// of the payment's identities when it is loaded, at the cost of filtering them out of every identity query.
+func (p *Payment) ArchiveIdentities() error {
+	if p.Status != INITIATED && p.Status != PENDING_DEPOSIT {
+		return ErrPaymentAlreadyProcessed
+	}
+	return p.WithLock(p.archiveIdentities)
+}
+
+// archiveIdentities archives the identities and resets the payment without locking.
+func (p *Payment) archiveIdentities() error {
+	tx, err := config.DB.Beginx()
+	if err != nil {
+		return newError(ErrCodeDB, err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf(`UPDATE %s SET archived_at=NOW() WHERE payment_id=$1 AND archived_at IS NULL`, PaymentIdentity{}.Table())
+	if _, err := tx.Exec(query, p.ID); err != nil {
+		return newError(ErrCodeDB, err, "failed to archive identities")
+	}
+
+	// A payment without identities cannot be deposited, so it goes back to the start
+	oldStatus := p.Status
+	if p.Status == PENDING_DEPOSIT {
+		query := fmt.Sprintf(`UPDATE %s SET status=$1, updated_at=NOW() WHERE id=$2 RETURNING *`, p.Table())
+		if err := tx.QueryRowx(query, INITIATED, p.ID).StructScan(p); err != nil {
+			return newError(ErrCodeDB, err, "failed to reset payment")
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return newError(ErrCodeDB, err, "failed to commit transaction")
+	}
+	p.Identities = []PaymentIdentity{}
+	p.notifyStatusChange(oldStatus)
+	return nil
+}
+
+// UpdateIdentity updates the payment identity with the given ID; see PaymentIdentity.Update.
+func (p *Payment) UpdateIdentity(identityID uuid.UUID, params IdentityParams) error {
+	for i := range p.Identities {
+		if p.Identities[i].ID == identityID {
+			return p.Identities[i].Update(params)
+		}
+	}
+	return newError(ErrCodeNotFound, nil, "identity %s is not assigned to this payment", identityID)
+}
+
 // SetToCryptoMode sets the payment to crypto mode, specifying the address and rate.
 func (p *Payment) SetToCryptoMode(address string, rate float64) error {
 	// SQL query with RETURNING *
 	query := `
 		UPDATE %s
-		SET crypto_currency = $1, crypto_currency_rate = $2, type = $3, updated_at = NOW()
+		SET crypto_currency = $1, crypto_currency_rate = $2, type = $3, rate_set_at = NOW(), updated_at = NOW()
 		WHERE id = $4
 		RETURNING *`
 	query = fmt.Sprintf(query, p.Table())
 	// Execute query and scan the returned row back into the Payment struct
 	if err := config.DB.QueryRowx(query, address, rate, CRYPTO, p.ID).StructScan(p); err != nil {
-		return fmt.Errorf("failed to set payment to crypto mode: %w", err)
+		return newError(ErrCodeDB, err, "failed to set payment to crypto mode")
 	}
 
 	return nil
 }
 
-// SetToFiatMode sets the payment to fiat mode, specifying the fiat service name.
+// SetToFiatMode sets the payment to fiat mode, specifying the name of the configured fiat service (Fiat.Name).
+// The provider behind it (Fiat.Service) is recorded as well. It returns a not found error if no fiat service
+// is configured with that name.
 func (p *Payment) SetToFiatMode(name string) error {
+	f, ok := config.fiatServices().FindByName(name)
+	if !ok {
+		return newError(ErrCodeNotFound, nil, "service %s could not found", name)
+	}
+
 	// SQL query with RETURNING *
 	query := `
 		UPDATE %s
-		SET fiat_service_name = $1, type = $2, updated_at = NOW()
-		WHERE id = $3
+		SET fiat_service_name = $1, fiat_service = $2, type = $3, updated_at = NOW()
+		WHERE id = $4
 		RETURNING *`
 	query = fmt.Sprintf(query, p.Table())
 	// Execute query and scan the updated row back into the Payment struct
-	if err := config.DB.QueryRowx(query, name, FIAT, p.ID).
+	if err := config.DB.QueryRowx(query, name, f.Service, FIAT, p.ID).
 		StructScan(p); err != nil {
-		return fmt.Errorf("failed to set payment to fiat mode: %w", err)
+		return newError(ErrCodeDB, err, "failed to set payment to fiat mode")
 	}
 
 	return nil
@@ -151,27 +835,294 @@ func (p *Payment) Update() error {
 		WHERE id = $5
 		RETURNING *`
 	query = fmt.Sprintf(query, p.Table())
+
+	// p.Status already holds the new status, so read the saved one for the status change hook
+	var oldStatus PaymentStatus
+	if config.OnPaymentStatusChange != nil {
+		statusQuery := fmt.Sprintf(`SELECT status FROM %s WHERE id=$1`, p.Table())
+		if err := config.DB.Get(&oldStatus, statusQuery, p.ID); err != nil {
+			return newError(ErrCodeDB, err, "failed to fetch payment status")
+		}
+	}
+
 	// Execute query and scan the updated row back into the Payment struct
 	if err := config.DB.QueryRowx(query, p.Status, p.Meta, p.TransactionStatus, p.ClientSecret, p.ID).
 		StructScan(p); err != nil {
-		return fmt.Errorf("failed to set payment status to %s: %w", p.Status, err)
+		return newError(ErrCodeDB, err, "failed to set payment status to %s", p.Status)
 	}
 
+	p.notifyStatusChange(oldStatus)
 	return nil
 }
 
+// notifyStatusChange calls the OnPaymentStatusChange hook if the payment's saved status differs from oldStatus.
+func (p *Payment) notifyStatusChange(oldStatus PaymentStatus) {
+	if config.OnPaymentStatusChange != nil && oldStatus != p.Status {
+		config.OnPaymentStatusChange(oldStatus, p.Status, p)
+	}
+}
+
+// SetDescription changes the payment's description, e.g., after the order it pays for has changed.
+// It returns ErrPaymentAlreadyProcessed if the payment is in a terminal status.
+func (p *Payment) SetDescription(description string) error {
+	if p.Status.IsTerminal() {
+		return ErrPaymentAlreadyProcessed
+	}
+
+	query := fmt.Sprintf(`UPDATE %s SET description=$1, updated_at=NOW() WHERE id=$2 RETURNING *`, p.Table())
+	if err := config.DB.QueryRowx(query, description, p.ID).StructScan(p); err != nil {
+		return newError(ErrCodeDB, err, "failed to set payment description")
+	}
+	return nil
+}
+
+// SetRef changes the payment's unique reference. It returns ErrDuplicateRef if another payment already uses
+// the reference and ErrPaymentAlreadyProcessed if the payment is in a terminal status.
+func (p *Payment) SetRef(ref string) error {
+	if p.Status.IsTerminal() {
+		return ErrPaymentAlreadyProcessed
+	}
+
+	verr := new(ValidationError)
+	if ref == "" {
+		verr.add("unique_ref", errors.New("is required"))
+	} else if len(ref) > maxUniqueRefLength {
+		verr.add("unique_ref", fmt.Errorf("must be at most %d characters", maxUniqueRefLength))
+	}
+	if err := verr.errOrNil(); err != nil {
+		return err
+	}
+
+	var exists bool
+	query := fmt.Sprintf(`SELECT EXISTS (SELECT 1 FROM %s WHERE unique_ref=$1 AND id!=$2)`, p.Table())
+	if err := config.DB.Get(&exists, query, ref, p.ID); err != nil {
+		return newError(ErrCodeDB, err, "failed to check unique reference")
+	}
+	if exists {
+		return ErrDuplicateRef
+	}
+
+	query = fmt.Sprintf(`UPDATE %s SET unique_ref=$1, updated_at=NOW() WHERE id=$2 RETURNING *`, p.Table())
+	if err := config.DB.QueryRowx(query, ref, p.ID).StructScan(p); err != nil {
+		return newError(ErrCodeDB, err, "failed to set payment unique reference")
+	}
+	return nil
+}
+
+// paymentLocks tracks the advisory locks held by payments in this process. The lock state is kept here rather than
+// in Payment, which is copied by value.
+var paymentLocks = struct {
+	sync.Mutex
+	held map[*Payment]*paymentLock
+}{held: map[*Payment]*paymentLock{}}
+
+// paymentLock is an advisory lock held by a payment.
+type paymentLock struct {
+	conn   *sqlx.Conn // Connection holding the advisory lock, nil while it is being acquired.
+	joined bool       // Whether WithLock calls on the payment join the lock instead of acquiring it, see WithPaymentLock.
+}
+
+// Lock acquires a Postgres advisory lock for the payment so that it is not processed concurrently.
+// The lock is bound to a dedicated connection which is held until Unlock is called, while the payment's
+// methods use other connections of config.DB: the connection pool must allow more open connections than
+// the number of payments locked at once (see sql.DB.SetMaxOpenConns), or the payment's methods will wait
+// for a connection forever.
+// Lock is not re-entrant: it returns ErrPaymentLocked if the lock is held by another process, or already
+// held by the payment, e.g., from another goroutine.
+func (p *Payment) Lock() error {
+	if p.lockedByTx() {
+		return ErrPaymentLocked
+	}
+
+	// Reserve the lock so that other goroutines sharing the payment do not acquire it as well
+	paymentLocks.Lock()
+	if _, ok := paymentLocks.held[p]; ok {
+		paymentLocks.Unlock()
+		return ErrPaymentLocked
+	}
+	l := new(paymentLock)
+	paymentLocks.held[p] = l
+	paymentLocks.Unlock()
+
+	conn, err := p.acquireLock()
+	paymentLocks.Lock()
+	defer paymentLocks.Unlock()
+	if err != nil {
+		delete(paymentLocks.held, p)
+		return err
+	}
+	l.conn = conn
+	return nil
+}
+
+// acquireLock acquires the payment's advisory lock on a dedicated connection and returns the connection.
+func (p *Payment) acquireLock() (*sqlx.Conn, error) {
+	conn, err := config.DB.Connx(context.Background())
+	if err != nil {
+		return nil, newError(ErrCodeDB, err, "failed to acquire connection")
+	}
+
+	var locked bool
+	if err := conn.GetContext(context.Background(), &locked, `SELECT pg_try_advisory_lock($1::bigint)`, p.lockKey()); err != nil {
+		conn.Close()
+		return nil, newError(ErrCodeDB, err, "failed to acquire payment lock")
+	}
+	if !locked {
+		conn.Close()
+		return nil, ErrPaymentLocked
+	}
+	return conn, nil
+}
+
+// Unlock releases the advisory lock acquired by Lock.
+func (p *Payment) Unlock() error {
+	paymentLocks.Lock()
+	l, ok := paymentLocks.held[p]
+	if !ok || l.conn == nil {
+		paymentLocks.Unlock()
+		return newError(ErrCodeInvalidStatus, nil, "payment is not locked")
+	}
+	delete(paymentLocks.held, p)
+	paymentLocks.Unlock()
+
+	defer l.conn.Close()
+	if _, err := l.conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1::bigint)`, p.lockKey()); err != nil {
+		return newError(ErrCodeDB, err, "failed to release payment lock")
+	}
+	return nil
+}
+
+// WithLock acquires the payment's lock, runs fn and releases the lock afterwards, even if fn panics.
+// See Lock for the connection pool requirement. On a payment passed by WithPaymentLock or fetched with
+// FetchInTx, whose lock is already held for the caller, fn runs within that lock instead.
+func (p *Payment) WithLock(fn func() error) (err error) {
+	if p.joinsLock() {
+		return fn()
+	}
+
+	if err := p.Lock(); err != nil {
+		return err
+	}
+	defer func() {
+		if unlockErr := p.Unlock(); err == nil {
+			err = unlockErr
+		}
+	}()
+
+	return fn()
+}
+
+// joinsLock reports whether the payment's lock is held for the caller, so that WithLock runs within it.
+func (p *Payment) joinsLock() bool {
+	if p.lockedByTx() {
+		return true
+	}
+	paymentLocks.Lock()
+	defer paymentLocks.Unlock()
+	l, ok := paymentLocks.held[p]
+	return ok && l.joined
+}
+
+// lockedByTx reports whether the payment's lock is held by the transaction it was fetched in. The lock is released
+// when the transaction ends, after which the payment locks itself again like any other.
+func (p *Payment) lockedByTx() bool {
+	if p.lockTx == nil {
+		return false
+	}
+	if _, err := p.lockTx.Exec(`SELECT 1`); errors.Is(err, sql.ErrTxDone) {
+		p.lockTx = nil
+		return false
+	}
+	return true
+}
+
+// WithPaymentLock acquires the advisory lock of the payment with the given ID, fetches its current state
+// and runs fn with it while the lock is held, so that e.g. a webhook handler and a background job
+// do not race on the same payment. Methods such as Deposit can be called on the payment passed to fn:
+// they run within the lock held for fn rather than acquiring it again, so the payment must not be shared
+// with other goroutines. See Lock for the connection pool requirement.
+func WithPaymentLock(id uuid.UUID, fn func(*Payment) error) error {
+	p := &Payment{ID: id}
+	return p.WithLock(func() error {
+		// Load the payment only once the lock is held so that fn sees the latest state
+		if err := p.Refresh(); err != nil {
+			return err
+		}
+
+		paymentLocks.Lock()
+		paymentLocks.held[p].joined = true
+		paymentLocks.Unlock()
+
+		return fn(p)
+	})
+}
+
+// lockKey derives the advisory lock key from the payment ID.
+func (p *Payment) lockKey() int64 {
+	h := fnv.New64a()
+	h.Write(p.ID[:])
+	return int64(h.Sum64())
+}
+
 // Deposit processes the fiat deposit for the payment, creating a corresponding transaction.
+// The payment is locked for the duration of the deposit.
 func (p *Payment) Deposit() error {
+	if err := p.checkDeposit(); err != nil {
+		return err
+	}
+	return p.WithLock(p.deposit)
+}
+
+// checkDeposit verifies that the payment is ready to be deposited.
+func (p *Payment) checkDeposit() error {
 	// Only fiat payments can call this
 	if p.Type != FIAT {
-		return fmt.Errorf("only fiat payments can call this")
+		return newError(ErrCodeInvalidStatus, nil, "only fiat payments can call this")
 	}
 
+	return p.ValidateForDeposit()
+}
+
+// ValidateForDeposit checks that the payment is ready to be deposited: identities are assigned, the whole
+// amount is allocated to them and the payment mode has been set. It returns a *ValidationError listing
+// every problem found, which matches ErrUnallocatedAmount, ErrFiatServiceNotSet or ErrCryptoAddressNotSet
+// with errors.Is.
+func (p *Payment) ValidateForDeposit() error {
+	verr := new(ValidationError)
+
 	// Ensure that identities are assigned before processing the deposit
 	if len(p.Identities) < 1 {
-		return fmt.Errorf("you need to assign identity first")
+		verr.add("identities", errors.New("you need to assign identity first"))
+	}
+
+	// Ensure that the whole amount is accounted for
+	if math.Abs(p.Unallocated()) > allocationEpsilon {
+		verr.add("identities", ErrUnallocatedAmount)
+	}
+
+	// Ensure that the fiat service or token address has been chosen
+	switch p.Type {
+	case FIAT:
+		if _, err := p.FiatServiceNameStr(); err != nil {
+			verr.add("fiat_service_name", err)
+		}
+	case CRYPTO:
+		if _, err := p.CryptoCurrencyAddress(); err != nil {
+			verr.add("crypto_currency", err)
+		}
 	}
 
+	return verr.errOrNil()
+}
+
+// deposit processes the fiat deposit for the payment without locking.
+func (p *Payment) deposit() error {
+	return p.payFiat(config.fiatServices().Pay, DEPOSITED)
+}
+
+// payFiat creates a deposit transaction and pays it with pay, moving the payment to status once the payment
+// is complete: DEPOSITED once charged, or AUTHORIZED once the funds are held for a later capture.
+func (p *Payment) payFiat(pay func(FiatParams) (*FiatTransactionInfo, error), status PaymentStatus) error {
 	// Create a new transaction for the deposit
 	t := &Transaction{
 		PaymentID:  p.ID,
@@ -188,99 +1139,556 @@ func (p *Payment) Deposit() error {
 		Currency:    p.Currency,
 		Description: p.Description,
 		Amount:      p.TotalAmount,
+		Metadata:    map[string]string{PaymentIDMetadataKey: p.ID.String()},
+	}
+
+	// Split the payment between the identities receiving it, the platform keeping the rest as its fee
+	if transfers := p.splitTransfers(); len(transfers) > 0 {
+		params.Transfers = transfers
+		t.Fee = params.Amount
+		for _, transfer := range transfers {
+			t.Fee -= transfer.Amount
+		}
+	}
+
+	// Create the transaction record in the database
+	if err := t.Create(); err != nil {
+		return err
+	}
+	if err := t.Pending(); err != nil {
+		return err
+	}
+
+	// Perform the fiat payment service
+	info, err := pay(params)
+	if err != nil {
+		t.Meta, _ = json.Marshal(map[string]interface{}{"info": info, "error": err.Error()})
+		t.Cancel()
+		return err
+	}
+
+	// Store info in the transaction and verify if successful
+	t.TXID = info.TXID
+	t.Meta, _ = json.Marshal(map[string]interface{}{"info": info})
+	if !info.Confirmed && !info.RequiresAction {
+		return t.Cancel()
+	}
+
+	if info.RequiresAction {
+		if err := t.ActionRequired(); err != nil {
+			return err
+		}
+		p.TransactionStatus = t.Status
+		p.ClientSecret = &info.ClientSecret
+		p.Status = ON_HOLD
+
+		return p.Update()
 	}
 
-	// Handle transfer between identities if applicable
-	if len(p.Identities) > 1 {
-		params.Transfer = &Transfer{
-			Amount:      p.Identities[1].AllocatedAmount,
-			Destination: p.Identities[1].Account,
+	if status == AUTHORIZED {
+		// The funds are only held until captured, so the transaction stays pending
+		if err := t.saveInfo(); err != nil {
+			return err
 		}
-		t.Fee = params.Amount - params.Transfer.Amount
+	} else if err := t.Verify(); err != nil {
+		return err
+	}
+
+	p.Status = status
+	return p.Update()
+}
+
+// splitTransfers returns the transfers splitting the payment between the identities receiving it, i.e., all
+// but the first identity, which pays.
+func (p *Payment) splitTransfers() []MultiTransfer {
+	if len(p.Identities) < 2 {
+		return nil
+	}
+	transfers := make([]MultiTransfer, 0, len(p.Identities)-1)
+	for _, identity := range p.Identities[1:] {
+		transfers = append(transfers, MultiTransfer{
+			Amount:      identity.AllocatedAmount,
+			Destination: identity.Account,
+			Description: identity.RoleName,
+		})
+	}
+	return transfers
+}
+
+// createSplitTransfers makes the transfers beyond the first of a split payment once its payment intent has
+// succeeded after a 3DS authentication or a capture; the first one is made by the payment intent itself.
+// Failures are logged rather than returned since the payment has been made; the transfers can be retried
+// with Fiats.CreateSplitTransfers.
+func (p *Payment) createSplitTransfers(serviceName, paymentIntentID string) {
+	transfers := p.splitTransfers()
+	if len(transfers) < 2 {
+		return
+	}
+	if _, err := config.fiatServices().CreateSplitTransfers(serviceName, paymentIntentID, p.Currency, transfers[1:]); err != nil {
+		config.logger().Errorf("failed to create split transfers of payment %s: %v", p.ID, err)
+	}
+}
+
+// Authorize holds the payment's amount on the payer's card without charging it, e.g., to charge a marketplace
+// order once it has been fulfilled. The payment becomes AUTHORIZED, or ON_HOLD if the payer has to authenticate.
+// Call Capture to charge it. The payment is locked for the duration of the authorization.
+func (p *Payment) Authorize() error {
+	if err := p.checkDeposit(); err != nil {
+		return err
+	}
+	return p.WithLock(func() error {
+		return p.payFiat(config.fiatServices().Authorize, AUTHORIZED)
+	})
+}
+
+// Capture charges an authorized payment. The amount may be lower than the authorized total amount, in which
+// case the rest is released to the payer; the captured amount is recorded in the deposit's metadata.
+// The payment then becomes DEPOSITED. The payment is locked for the duration of the capture.
+func (p *Payment) Capture(amount float64) error {
+	// Only fiat payments can call this
+	if p.Type != FIAT {
+		return newError(ErrCodeInvalidStatus, nil, "only fiat payments can call this")
+	}
+	if p.Status != AUTHORIZED {
+		return newError(ErrCodeInvalidStatus, nil, "only authorized payments can be captured")
+	}
+	if amount <= 0 || amount > p.TotalAmount+allocationEpsilon {
+		return newError(ErrCodeValidation, nil, "capture amount must be between 0 and %f", p.TotalAmount)
+	}
+	return p.WithLock(func() error {
+		return p.capture(amount)
+	})
+}
+
+// capture charges an authorized payment without locking.
+func (p *Payment) capture(amount float64) error {
+	serviceName, err := p.FiatServiceNameStr()
+	if err != nil {
+		return err
+	}
+
+	// The latest deposit holds the authorized payment intent
+	t, err := FetchLatestTransaction(p.ID, DEPOSIT)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newError(ErrCodeNotFound, nil, "this payment has no transaction available")
+	}
+	if err != nil {
+		return newError(ErrCodeDB, err, "failed to fetch transaction")
+	}
+
+	if err := config.fiatServices().Capture(serviceName, t.TXID, stripeAmount(amount, p.Currency)); err != nil {
+		return err
+	}
+
+	// Record the captured amount along with the authorization info
+	meta := map[string]interface{}{}
+	if len(t.Meta) > 0 {
+		if err := json.Unmarshal(t.Meta, &meta); err != nil {
+			return newError(ErrCodeValidation, err, "failed to unmarshal meta")
+		}
+	}
+	meta["captured_amount"] = amount
+	t.Meta, _ = json.Marshal(meta)
+	if err := t.Verify(); err != nil {
+		return err
+	}
+	p.createSplitTransfers(serviceName, t.TXID)
+
+	p.TransactionStatus = t.Status
+	p.Status = DEPOSITED
+	return p.Update()
+}
+
+// ConfirmPayment confirms an on-hold fiat payment once its payment intent has succeeded, moving it to DEPOSITED.
+// A payment authorized with Authorize moves to AUTHORIZED instead once its payment intent awaits capture.
+// The payment is locked for the duration of the confirmation.
+func (p *Payment) ConfirmPayment(paymentIntentID string) error {
+	if err := p.checkConfirmPayment(); err != nil {
+		return err
+	}
+	return p.WithLock(func() error {
+		return p.confirmPayment(paymentIntentID)
+	})
+}
+
+// confirmPayment confirms an on-hold fiat payment without locking.
+func (p *Payment) confirmPayment(paymentIntentID string) error {
+	serviceName, err := p.FiatServiceNameStr()
+	if err != nil {
+		return err
+	}
+
+	// Fetch the transaction of the payment intent, falling back to the latest deposit for
+	// transactions recorded before their payment intent ID was stored
+	t, err := p.FetchTransactionByTXID(paymentIntentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		t, err = FetchLatestTransaction(p.ID, DEPOSIT)
+		if errors.Is(err, sql.ErrNoRows) {
+			return newError(ErrCodeNotFound, nil, "this payment has no transaction available")
+		}
+	}
+	if err != nil {
+		return newError(ErrCodeDB, err, "failed to fetch transaction")
+	}
+
+	// Perform the fiat payment service
+	info, err := config.fiatServices().ConfirmPayment(FiatPaymentConfirmParams{
+		ServiceName:     serviceName,
+		PaymentIntentID: paymentIntentID,
+	})
+	if err != nil {
+		t.Meta, _ = json.Marshal(map[string]interface{}{"info": info, "error": err.Error()})
+		t.Cancel()
+		return err
+	}
+
+	// Store info in the transaction and verify if successful
+	t.Meta, _ = json.Marshal(map[string]interface{}{"info": info})
+	if !info.IsConfirmed && !info.IsAuthorized {
+		return newError(ErrCodeInvalidStatus, nil, "payment with intent ID of %s is not confirmed yet", paymentIntentID)
+	}
+
+	if info.IsAuthorized {
+		// The funds are only held until captured, so the transaction goes back to pending
+		if err := t.Pending(); err != nil {
+			return err
+		}
+		t.Meta, _ = json.Marshal(map[string]interface{}{"info": info})
+		if err := t.saveInfo(); err != nil {
+			return err
+		}
+		p.TransactionStatus = t.Status
+		p.Status = AUTHORIZED
+		return p.Update()
+	}
+
+	if err := t.Verify(); err != nil {
+		return err
+	}
+	p.createSplitTransfers(serviceName, paymentIntentID)
+
+	transactionStatus := VERIFIED
+	p.TransactionStatus = &transactionStatus
+	p.Status = DEPOSITED
+	return p.Update()
+}
+
+// checkConfirmPayment verifies that the payment is an on-hold fiat payment waiting for confirmation.
+func (p *Payment) checkConfirmPayment() error {
+	// Only fiat payments can call this
+	if p.Type != FIAT {
+		return newError(ErrCodeInvalidStatus, nil, "only fiat payments can call this")
+	}
+
+	// Ensure that the fiat service has been chosen
+	if _, err := p.FiatServiceNameStr(); err != nil {
+		return err
+	}
+
+	// Only on-hold payments waiting for customer action can be confirmed
+	if p.Status != ON_HOLD || p.TransactionStatus == nil || *p.TransactionStatus != ACTION_REQUIRED {
+		return newError(ErrCodeInvalidStatus, nil, "only on-hold payments can be confirmed")
+	}
+
+	return nil
+}
+
+// RetryDeposit restarts the deposit of an on-hold fiat payment whose payment intent can no longer be
+// completed, e.g., because its 3DS window has expired. It cancels the pending payment intent and its
+// transaction, then deposits again, which sets a new ClientSecret if the payer has to act again.
+// The payment is locked for the duration of the retry.
+func (p *Payment) RetryDeposit() error {
+	if err := p.checkConfirmPayment(); err != nil {
+		return err
+	}
+	if err := p.checkDeposit(); err != nil {
+		return err
+	}
+	return p.WithLock(p.retryDeposit)
+}
+
+// retryDeposit cancels the pending payment intent and deposits again without locking.
+func (p *Payment) retryDeposit() error {
+	serviceName, err := p.FiatServiceNameStr()
+	if err != nil {
+		return err
+	}
+
+	// The latest deposit holds the payment intent waiting for the payer's action
+	t, err := FetchLatestTransaction(p.ID, DEPOSIT)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newError(ErrCodeNotFound, nil, "this payment has no transaction available")
+	}
+	if err != nil {
+		return newError(ErrCodeDB, err, "failed to fetch transaction")
+	}
+	if t.TXID == "" {
+		return newError(ErrCodeNotFound, nil, "this payment has no payment intent to retry")
+	}
+
+	if err := config.fiatServices().CancelPaymentIntent(serviceName, t.TXID); err != nil {
+		return err
+	}
+	if err := t.Cancel(); err != nil {
+		return err
+	}
+
+	// Persist the reset so that the payment can still be deposited if the new attempt fails
+	p.TransactionStatus = t.Status
+	p.Status = PENDING_DEPOSIT
+	p.ClientSecret = nil
+	if err := p.Update(); err != nil {
+		return err
+	}
+	return p.deposit()
+}
+
+// PartialRefund refunds part of a deposited fiat payment, recording a PARTIAL_REFUND transaction.
+// The payment stays DEPOSITED; the running total is tracked in RefundedAmount. The amount is reserved in
+// RefundedAmount before the refund is made, and given back if the refund fails.
+func (p *Payment) PartialRefund(amount float64, reason string) error {
+	// Only fiat payments can call this
+	if p.Type != FIAT {
+		return newError(ErrCodeInvalidStatus, nil, "only fiat payments can call this")
+	}
+
+	if p.Status != DEPOSITED {
+		return newError(ErrCodeInvalidStatus, nil, "only deposited payments can be refunded")
+	}
+
+	serviceName, err := p.FiatServiceNameStr()
+	if err != nil {
+		return err
+	}
+
+	if amount <= 0 || amount > p.TotalAmount {
+		return newError(ErrCodeValidation, nil, "refund amount must be greater than 0 and at most %f", p.TotalAmount)
+	}
+
+	// Find the verified deposit to refund against
+	var deposit *Transaction
+	for i := range p.Transactions {
+		if p.Transactions[i].Type == DEPOSIT && p.Transactions[i].VerfiedAt != nil && p.Transactions[i].CanceledAt == nil {
+			deposit = &p.Transactions[i]
+		}
+	}
+	if deposit == nil {
+		return newError(ErrCodeNotFound, nil, "this payment has no verified deposit to refund")
+	}
+
+	// Reserve the amount before refunding, so that concurrent refunds cannot exceed the total of the payment
+	if err := p.reserveRefund(amount); err != nil {
+		return err
+	}
+
+	// Create a new transaction for the refund
+	t := &Transaction{
+		PaymentID:  p.ID,
+		IdentityID: deposit.IdentityID,
+		Tag:        string(PARTIAL_REFUND),
+		Amount:     amount,
+		Type:       PARTIAL_REFUND,
+	}
+	t.Meta, _ = json.Marshal(map[string]interface{}{"reason": reason})
+
+	// Create the transaction record in the database
+	if err := t.Create(); err != nil {
+		p.releaseRefund(amount)
+		return err
+	}
+
+	// Perform the fiat refund
+	info, err := config.fiatServices().Refund(FiatRefundParams{
+		ServiceName:     serviceName,
+		PaymentIntentID: deposit.paymentIntentID(),
+		Amount:          amount,
+		Currency:        p.Currency,
+		Reason:          reason,
+	})
+	if err != nil {
+		t.Meta, _ = json.Marshal(map[string]interface{}{"info": info, "reason": reason, "error": err.Error()})
+		t.Cancel()
+		p.releaseRefund(amount)
+		return err
+	}
+
+	// The refund has been made, so the reservation is kept even if recording it fails
+	t.TXID = info.TXID
+	t.Meta, _ = json.Marshal(map[string]interface{}{"info": info, "reason": reason})
+	if err := t.Verify(); err != nil {
+		return err
+	}
+	p.Transactions = append(p.Transactions, *t)
+
+	return nil
+}
+
+// reserveRefund atomically adds amount to the refunded total of the payment, guarding against concurrent
+// over-refunds. It returns a validation error if the refund would exceed the total of the payment.
+func (p *Payment) reserveRefund(amount float64) error {
+	query := `
+		UPDATE %s
+		SET refunded_amount = refunded_amount + $1, updated_at = NOW()
+		WHERE id = $2 AND refunded_amount + $1 <= total_amount
+		RETURNING *`
+	query = fmt.Sprintf(query, p.Table())
+	err := config.DB.QueryRowx(query, amount, p.ID).StructScan(p)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newError(ErrCodeValidation, nil, "refund of %f would exceed payment total %f (already refunded %f)", amount, p.TotalAmount, p.RefundedAmount)
+	}
+	if err != nil {
+		return newError(ErrCodeDB, err, "failed to update refunded amount")
+	}
+	return nil
+}
+
+// releaseRefund gives back an amount reserved with reserveRefund once its refund has failed. Failures are logged
+// rather than returned so that the refund's error is reported.
+func (p *Payment) releaseRefund(amount float64) {
+	query := `
+		UPDATE %s
+		SET refunded_amount = refunded_amount - $1, updated_at = NOW()
+		WHERE id = $2
+		RETURNING *`
+	query = fmt.Sprintf(query, p.Table())
+	if err := config.DB.QueryRowx(query, amount, p.ID).StructScan(p); err != nil {
+		config.logger().Errorf("failed to release refunded amount %f of payment %s: %v", amount, p.ID, err)
+	}
+}
+
+// HandleDispute records a chargeback against the transaction created for the given payment intent
+// and freezes the payment with Dispute. Use ResolveDispute once the dispute is closed.
+// The payment is locked meanwhile, and the transaction is restored if the payment cannot be disputed.
+func (p *Payment) HandleDispute(paymentIntentID, reason string) error {
+	if err := p.checkDispute(); err != nil {
+		return err
 	}
+	return p.WithLock(func() error {
+		return p.handleDispute(paymentIntentID, reason)
+	})
+}
 
-	// Create the transaction record in the database
-	if err := t.Create(); err != nil {
-		return err
+// handleDispute records a chargeback without locking.
+func (p *Payment) handleDispute(paymentIntentID, reason string) error {
+	// Find the transaction whose stored fiat info references the payment intent
+	t := new(Transaction)
+	query := fmt.Sprintf(`SELECT * FROM %s WHERE payment_id=$1 AND meta->'info'->>'tx_id'=$2`, t.Table())
+	if err := config.DB.Get(t, query, p.ID, paymentIntentID); err != nil {
+		return newError(ErrCodeDB, err, "failed to find transaction for payment intent %s", paymentIntentID)
 	}
 
-	// Perform the fiat payment service
-	info, err := config.Fiats.Pay(params)
-	if err != nil {
-		t.Meta, _ = json.Marshal(map[string]interface{}{"info": info, "error": err.Error()})
-		t.Cancel()
+	status, meta := t.Status, t.Meta
+	if err := t.Dispute(reason); err != nil {
 		return err
 	}
 
-	// Store info in the transaction and verify if successful
-	t.Meta, _ = json.Marshal(map[string]interface{}{"info": info})
-	if !info.Confirmed && !info.RequiresAction {
-		return t.Cancel()
+	// The dispute is opened against the charge, which older transactions have not recorded
+	chargeID := t.chargeID()
+	if chargeID == "" {
+		chargeID = paymentIntentID
+	}
+	if err := p.Dispute(chargeID, reason); err != nil {
+		// Do not leave the transaction disputed while the payment is not
+		if restoreErr := t.restore(status, meta); restoreErr != nil {
+			config.logger().Errorf("failed to restore transaction %s after the dispute of payment %s failed: %v", t.ID, p.ID, restoreErr)
+		}
+		return err
 	}
+	return nil
+}
 
-	if info.RequiresAction {
-		// t.Status =
-		/* if err := t.ActionRequired(); err != nil {
-			return err
-		} */
-		status := ACTION_REQUIRED
-		p.TransactionStatus = &status
-		p.ClientSecret = &info.ClientSecret
-		p.Status = ON_HOLD
+// Payment metadata keys recorded by Dispute and ResolveDispute.
+const (
+	disputeChargeIDMetaKey = "dispute_charge_id"
+	disputeReasonMetaKey   = "dispute_reason"
+	disputedFromMetaKey    = "disputed_from" // Status of the payment when the dispute was opened.
+	disputeOutcomeMetaKey  = "dispute_outcome"
+)
 
-		return p.Update()
+// metaMap decodes the payment's metadata into a map to merge keys into, empty if there is none.
+func (p *Payment) metaMap() (map[string]interface{}, error) {
+	meta := map[string]interface{}{}
+	if len(p.Meta) > 0 && string(p.Meta) != "null" {
+		if err := json.Unmarshal(p.Meta, &meta); err != nil {
+			return nil, newError(ErrCodeValidation, err, "failed to unmarshal meta")
+		}
 	}
+	return meta, nil
+}
 
-	if err := t.Verify(); err != nil {
+// Dispute freezes a charged payment while a dispute (chargeback) of chargeID is open, recording the charge and
+// reason in its metadata. Use ResolveDispute once the dispute is closed.
+func (p *Payment) Dispute(chargeID, reason string) error {
+	if err := p.checkDispute(); err != nil {
 		return err
 	}
 
-	p.Status = DEPOSITED
-	return p.Update()
-}
+	meta, err := p.metaMap()
+	if err != nil {
+		return err
+	}
+	meta[disputeChargeIDMetaKey] = chargeID
+	meta[disputeReasonMetaKey] = reason
+	meta[disputedFromMetaKey] = p.Status
+	oldStatus, oldMeta := p.Status, p.Meta
+	p.Meta, _ = json.Marshal(meta)
 
-func (p *Payment) ConfirmPayment(paymentIntentID string) error {
-	// Only fiat payments can call this
-	if p.Type != FIAT {
-		return fmt.Errorf("only fiat payments can call this")
+	p.Status = PAYMENT_DISPUTED
+	if err := p.Update(); err != nil {
+		p.Status, p.Meta = oldStatus, oldMeta
+		return err
 	}
+	return nil
+}
 
-	// Only fiat payments can call this
-	if p.Status != ON_HOLD || p.TransactionStatus == nil || *p.TransactionStatus != ACTION_REQUIRED {
-		return fmt.Errorf("only on-hold payments can be confirmed")
+// checkDispute verifies that the payment has been charged and is not already disputed.
+func (p *Payment) checkDispute() error {
+	switch p.Status {
+	case DEPOSITED, PAID_OUT:
+		return nil
+	case PAYMENT_DISPUTED:
+		return newError(ErrCodeInvalidStatus, nil, "payment is already disputed")
+	default:
+		return newError(ErrCodeInvalidStatus, nil, "only charged payments can be disputed, got %s", p.Status)
 	}
+}
 
-	//Fetch last transaction
-	if len(p.Transactions) < 1 {
-		return fmt.Errorf("this payment has no transaction available")
+// ResolveDispute closes the dispute opened with Dispute. A lost dispute refunds the payment, as the funds have gone
+// back to the payer; a won dispute returns it to the status it had when disputed, e.g., PAID_OUT. The outcome and
+// notes are recorded as a note of the payment, see History.
+func (p *Payment) ResolveDispute(won bool, notes string) error {
+	if p.Status != PAYMENT_DISPUTED {
+		return newError(ErrCodeInvalidStatus, nil, "payment is not disputed")
 	}
-	t := p.Transactions[len(p.Transactions)-1]
 
-	// Perform the fiat payment service
-	info, err := config.Fiats.ConfirmPayment(FiatPaymentConfirmParams{
-		ServiceName:     *p.FiatServiceName,
-		PaymentIntentID: paymentIntentID,
-	})
+	meta, err := p.metaMap()
 	if err != nil {
-		t.Meta, _ = json.Marshal(map[string]interface{}{"info": info, "error": err.Error()})
-		t.Cancel()
 		return err
 	}
-
-	// Store info in the transaction and verify if successful
-	t.Meta, _ = json.Marshal(map[string]interface{}{"info": info})
-	if !info.IsConfirmed {
-		return fmt.Errorf("payment with intent ID of %s is not confirmed yet", paymentIntentID)
+	outcome := "lost"
+	p.Status = REFUNDED
+	if won {
+		outcome = "won"
+		p.Status = PAID_OUT
+		if from, ok := meta[disputedFromMetaKey].(string); ok && from != "" {
+			p.Status = PaymentStatus(from)
+		}
 	}
+	meta[disputeOutcomeMetaKey] = outcome
+	p.Meta, _ = json.Marshal(meta)
 
-	if err := t.Verify(); err != nil {
+	if err := p.Update(); err != nil {
 		return err
 	}
 
-	transactionStatus := VERIFIED
-	p.TransactionStatus = &transactionStatus
-	p.Status = DEPOSITED
-	return p.Update()
+	note := fmt.Sprintf("Dispute %s", outcome)
+	if notes != "" {
+		note = fmt.Sprintf("%s: %s", note, notes)
+	}
+	if _, err := p.AddNote("gopay", note); err != nil {
+		return err
+	}
+	return nil
 }
 
 // ConfirmDeposit processes a crypto payment deposit confirmation.
@@ -288,11 +1696,46 @@ func (p *Payment) ConfirmPayment(paymentIntentID string) error {
 // retrieves the transaction info from the blockchain, and verifies the deposit.
 // If the deposit is not confirmed, the transaction is canceled.
 func (p *Payment) ConfirmDeposit(txID string, meta interface{}) error {
+	return p.ConfirmDepositCtx(context.Background(), txID, meta)
+}
+
+// ConfirmDepositCtx is like ConfirmDeposit but bounds the blockchain confirmation polling with ctx.
+// The payment is locked for the duration of the confirmation.
+func (p *Payment) ConfirmDepositCtx(ctx context.Context, txID string, meta interface{}) error {
+	if err := p.checkConfirmDeposit(); err != nil {
+		return err
+	}
+	return p.WithLock(func() error {
+		return p.confirmDeposit(ctx, txID, meta)
+	})
+}
+
+// ConfirmDepositAsync runs ConfirmDepositCtx in a goroutine and sends its result to done, which should be
+// buffered or read by the caller. The payment is checked before starting, so errors such as a wrong payment
+// type are returned directly and nothing is sent to done.
+func (p *Payment) ConfirmDepositAsync(ctx context.Context, txID string, meta interface{}, done chan<- error) error {
+	if err := p.checkConfirmDeposit(); err != nil {
+		return err
+	}
+	go func() {
+		done <- p.ConfirmDepositCtx(ctx, txID, meta)
+	}()
+	return nil
+}
+
+// checkConfirmDeposit verifies that the payment is ready for a crypto deposit confirmation.
+func (p *Payment) checkConfirmDeposit() error {
 	// Only allow CRYPTO payment types to call this method
 	if p.Type != CRYPTO {
-		return fmt.Errorf("only crypto payments can call this")
+		return newError(ErrCodeInvalidStatus, nil, "only crypto payments can call this")
 	}
 
+	return p.ValidateForDeposit()
+}
+
+// confirmDeposit processes a crypto payment deposit confirmation without locking.
+func (p *Payment) confirmDeposit(ctx context.Context, txID string, meta interface{}) error {
+
 	// Create a new transaction with deposit details
 	t := &Transaction{
 		PaymentID:  p.ID,
@@ -307,15 +1750,22 @@ func (p *Payment) ConfirmDeposit(txID string, meta interface{}) error {
 	if err := t.Create(); err != nil {
 		return err
 	}
+	if err := t.Pending(); err != nil {
+		return err
+	}
 
 	// Set up parameters for the blockchain transaction info query
 	params := CryptoParams{
 		TxHash:       txID,
 		TokenAddress: *p.CryptoCurrency,
 	}
+	// The transfer must be sent to the platform's receiving address on the token's chain
+	if c, _, ok := config.chains().FindByTokenAddress(params.TokenAddress); ok {
+		params.RecipientAddress = c.ContractAddress
+	}
 
 	// Get the transaction info from the blockchain
-	info, err := config.Chains.TransactionInfo(params)
+	info, err := config.chains().TransactionInfoCtx(ctx, params)
 	if err != nil {
 		// If there is an error, store the info and cancel the transaction
 		t.Meta, _ = json.Marshal(map[string]interface{}{"info": info, "meta": meta, "error": err.Error()})
@@ -331,7 +1781,7 @@ func (p *Payment) ConfirmDeposit(txID string, meta interface{}) error {
 	}
 
 	if info.TotalAmount < t.Amount {
-		return fmt.Errorf("transaction amount mismatch: expected %f but got %f", t.Amount, info.TotalAmount)
+		return newError(ErrCodeValidation, nil, "transaction amount mismatch: expected %f but got %f", t.Amount, info.TotalAmount)
 	}
 
 	// Verify the transaction if it's confirmed
@@ -344,72 +1794,515 @@ func (p *Payment) ConfirmDeposit(txID string, meta interface{}) error {
 	return p.Update()
 }
 
-// Fetch retrieves a payment by ID, including its associated identities and transactions.
-func Fetch(id uuid.UUID) (*Payment, error) {
+// History returns the payment's timeline in chronological order: its creation, the creation, verification and
+// cancellation of each transaction, and the operator notes. It only aggregates what is already loaded on the
+// payment, so the transactions and notes should be fetched first (e.g., with FetchFull and WithNotes).
+func (p *Payment) History() ([]PaymentEvent, error) {
+	events := []PaymentEvent{{
+		Time:        p.CreatedAt,
+		EventType:   EventCreated,
+		Description: fmt.Sprintf("%s payment of %f %s created", p.Type, p.TotalAmount, p.Currency),
+	}}
+
+	for _, t := range p.Transactions {
+		events = append(events, PaymentEvent{
+			Time:        t.CreatedAt,
+			EventType:   EventTransactionCreated,
+			Description: fmt.Sprintf("%s transaction of %f created", t.Type, t.Amount),
+			Data:        t,
+		})
+		if t.VerfiedAt != nil {
+			events = append(events, PaymentEvent{
+				Time:        *t.VerfiedAt,
+				EventType:   EventTransactionVerified,
+				Description: fmt.Sprintf("%s transaction %s verified", t.Type, t.TXID),
+				Data:        t,
+			})
+		}
+		if t.CanceledAt != nil {
+			event := PaymentEvent{
+				Time:        *t.CanceledAt,
+				EventType:   EventTransactionCanceled,
+				Description: fmt.Sprintf("%s transaction canceled", t.Type),
+				Data:        t,
+			}
+			if reason, ok := t.rollbackReason(); ok {
+				event.EventType = EventRolledBack
+				event.Description = fmt.Sprintf("%s transaction %s rolled back: %s", t.Type, t.TXID, reason)
+			}
+			events = append(events, event)
+		}
+	}
+
+	for _, n := range p.Notes {
+		events = append(events, PaymentEvent{
+			Time:        n.CreatedAt,
+			EventType:   EventNote,
+			Description: n.Note,
+			Data:        n,
+		})
+	}
+
+	// Keep the insertion order for events sharing a timestamp, so creation stays ahead of verification
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+
+	return events, nil
+}
+
+// MarkPaidOut moves a deposited payment to PAID_OUT once at least one of its payouts has been verified.
+// It returns ErrNoVerifiedPayouts if no verified payout transaction exists.
+func (p *Payment) MarkPaidOut() error {
+	if p.Status != DEPOSITED {
+		return newError(ErrCodeInvalidStatus, nil, "only deposited payments can be paid out")
+	}
+
+	var payouts int
+	query := fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE payment_id=$1 AND type=$2 AND verified_at IS NOT NULL AND canceled_at IS NULL`, Transaction{}.Table())
+	if err := config.DB.Get(&payouts, query, p.ID, PAYOUT); err != nil {
+		return newError(ErrCodeDB, err, "failed to count verified payouts")
+	}
+	if payouts == 0 {
+		return ErrNoVerifiedPayouts
+	}
+
+	p.Status = PAID_OUT
+	return p.Update()
+}
+
+// IsTerminal reports whether the payment has reached a final status; see PaymentStatus.IsTerminal.
+func (p *Payment) IsTerminal() bool {
+	return p.Status.IsTerminal()
+}
+
+// IsOverdue reports whether the payment has not reached a terminal status and has not been updated for longer
+// than cutoff; see FetchOverdue.
+func (p *Payment) IsOverdue(cutoff time.Duration) bool {
+	return !p.IsTerminal() && time.Since(p.UpdatedAt) > cutoff
+}
+
+// IsActive reports whether the payment is still in progress; see PaymentStatus.IsActive.
+func (p *Payment) IsActive() bool {
+	return p.Status.IsActive()
+}
+
+// rollbackReasonMetaKey is the transaction metadata key holding the reason of a rolled back deposit.
+const rollbackReasonMetaKey = "rollback_reason"
+
+// Rollback undoes an incorrectly recorded deposit (e.g., a wrong transaction ID or a test transaction): it cancels
+// the payment's verified deposits, recording reason in their metadata, and returns the payment to PENDING_DEPOSIT
+// so that it can be deposited again. Terminal and partially refunded payments cannot be rolled back.
+// The payment is locked for the duration of the rollback.
+func (p *Payment) Rollback(reason string) error {
+	switch {
+	case p.IsTerminal():
+		return ErrPaymentAlreadyProcessed
+	case p.Status != DEPOSITED:
+		return newError(ErrCodeInvalidStatus, nil, "only deposited payments can be rolled back")
+	case p.RefundedAmount > 0:
+		return newError(ErrCodeInvalidStatus, nil, "partially refunded payments cannot be rolled back")
+	}
+	return p.WithLock(func() error {
+		return p.rollback(reason)
+	})
+}
+
+// rollback cancels the verified deposits and resets the payment without locking.
+func (p *Payment) rollback(reason string) error {
+	deposits, err := FetchTransactionsByType(p.ID, DEPOSIT)
+	if err != nil {
+		return newError(ErrCodeDB, err, "failed to fetch deposits")
+	}
+
+	for _, t := range deposits {
+		if t.VerfiedAt == nil || t.CanceledAt != nil {
+			continue
+		}
+
+		// Merge the rollback reason into the existing metadata
+		meta := map[string]interface{}{}
+		if len(t.Meta) > 0 {
+			if err := json.Unmarshal(t.Meta, &meta); err != nil {
+				return newError(ErrCodeValidation, err, "failed to unmarshal meta")
+			}
+		}
+		meta[rollbackReasonMetaKey] = reason
+		t.Meta, _ = json.Marshal(meta)
+
+		if err := t.Cancel(); err != nil {
+			return newError(ErrCodeDB, err, "failed to cancel deposit %s", t.ID)
+		}
+	}
+
+	// Update clears neither the transaction status nor, if unchanged, the client secret, so reset them here
+	query := `
+		UPDATE %s
+		SET status = $1, transaction_status = NULL, client_secret = NULL, updated_at = NOW()
+		WHERE id = $2
+		RETURNING *`
+	query = fmt.Sprintf(query, p.Table())
+	oldStatus := p.Status
+	if err := config.DB.QueryRowx(query, PENDING_DEPOSIT, p.ID).StructScan(p); err != nil {
+		return newError(ErrCodeDB, err, "failed to roll back payment")
+	}
+
+	p.notifyStatusChange(oldStatus)
+	return nil
+}
+
+// FetchFull (re-)populates the payment's identities, transactions and annotations in place, replacing the existing ones.
+func (p *Payment) FetchFull() error {
+	identities := []PaymentIdentity{}
+	transactions := []Transaction{}
+
+	// Fetch identities associated with the payment
+	if err := config.DB.Select(&identities, fmt.Sprintf(`SELECT * FROM %s WHERE payment_id=$1 AND archived_at IS NULL`, PaymentIdentity{}.Table()), p.ID); err != nil {
+		return err
+	}
+
+	// Fetch transactions associated with the payment
+	if err := config.DB.Select(&transactions, fmt.Sprintf(`SELECT * FROM %s WHERE payment_id=$1 ORDER BY created_at`, Transaction{}.Table()), p.ID); err != nil {
+		return err
+	}
+
+	// Fetch annotations of the payment
+	annotations, err := fetchAnnotations(config.DB, p.ID)
+	if err != nil {
+		return err
+	}
+
+	p.Identities = identities
+	p.Transactions = transactions
+	p.Annotations = annotations
+	return nil
+}
+
+// FetchTransactionByTXID retrieves the payment's transaction with the given on-chain or gateway transaction ID.
+// The lookup is scoped to the payment, since a transaction ID may be submitted for several payments
+// (e.g., in a double-spend attempt). Canceled attempts may share the transaction ID of a retry, in which case the
+// transaction that has not been canceled is returned, or else the latest canceled one.
+func (p *Payment) FetchTransactionByTXID(txID string) (*Transaction, error) {
+	t := new(Transaction)
+	query := fmt.Sprintf(`
+		SELECT * FROM %s WHERE payment_id=$1 AND tx_id=$2
+		ORDER BY canceled_at IS NOT NULL, created_at DESC LIMIT 1`, t.Table())
+	if err := config.DB.Get(t, query, p.ID, txID); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Refresh re-fetches the payment row along with its identities and transactions to pick up any concurrent updates.
+func (p *Payment) Refresh() error {
+	// Fetch the payment record from the database
+	if err := config.DB.Get(p, fmt.Sprintf(`SELECT * FROM %s WHERE id=$1`, p.Table()), p.ID); err != nil {
+		return err
+	}
+
+	return p.FetchFull()
+}
+
+// applyFetchOptions loads the optional relations requested through opts.
+func (p *Payment) applyFetchOptions(opts []FetchOption) error {
+	o := new(fetchOptions)
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if o.notes {
+		if _, err := p.FetchNotes(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fetch retrieves a payment by ID, including its associated identities, transactions and annotations.
+// Pass WithNotes to also load its notes.
+func Fetch(id uuid.UUID, opts ...FetchOption) (*Payment, error) {
 	p := new(Payment)
 	// Fetch the payment record from the database
 	if err := config.DB.Get(p, fmt.Sprintf(`SELECT * FROM %s WHERE id=$1`, p.Table()), id); err != nil {
 		return nil, err
 	}
 
-	// Fetch identities associated with the payment
-	if err := config.DB.Select(&p.Identities, fmt.Sprintf(`SELECT * FROM %s WHERE payment_id=$1`, PaymentIdentity{}.Table()), id); err != nil {
+	// Fetch identities and transactions associated with the payment
+	if err := p.FetchFull(); err != nil {
 		return nil, err
 	}
 
-	// Fetch transactions associated with the payment
-	if err := config.DB.Select(&p.Transactions, fmt.Sprintf(`SELECT * FROM %s WHERE payment_id=$1`, Transaction{}.Table()), id); err != nil {
+	if err := p.applyFetchOptions(opts); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// FetchInTx retrieves a payment by ID within tx, including its associated identities and transactions,
+// holding the payment's advisory lock until tx ends. It returns ErrPaymentLocked if the lock is held by
+// another process. The transaction must be committed or rolled back by the caller.
+// Methods such as Deposit can be called on the returned payment: while tx is open they run within the lock
+// held by tx, and once it has ended they acquire the lock themselves. They write through config.DB rather
+// than tx, as their payment service calls cannot be rolled back, so their changes are kept even if tx is
+// rolled back.
+func FetchInTx(tx *sqlx.Tx, id uuid.UUID) (*Payment, error) {
+	p := &Payment{ID: id}
+	// Lock the payment until the transaction ends. An advisory lock is used rather than a row lock, which
+	// the payment's methods would block on since they write through other connections.
+	var locked bool
+	if err := tx.Get(&locked, `SELECT pg_try_advisory_xact_lock($1::bigint)`, p.lockKey()); err != nil {
+		return nil, newError(ErrCodeDB, err, "failed to acquire payment lock")
+	}
+	if !locked {
+		return nil, ErrPaymentLocked
+	}
+
+	// Fetch the payment record
+	if err := tx.Get(p, fmt.Sprintf(`SELECT * FROM %s WHERE id=$1`, p.Table()), id); err != nil {
+		return nil, err
+	}
+	p.lockTx = tx
+
+	// Fetch identities and transactions associated with the payment
+	p.Identities = []PaymentIdentity{}
+	if err := tx.Select(&p.Identities, fmt.Sprintf(`SELECT * FROM %s WHERE payment_id=$1 AND archived_at IS NULL`, PaymentIdentity{}.Table()), p.ID); err != nil {
+		return nil, err
+	}
+	p.Transactions = []Transaction{}
+	if err := tx.Select(&p.Transactions, fmt.Sprintf(`SELECT * FROM %s WHERE payment_id=$1 ORDER BY created_at`, Transaction{}.Table()), p.ID); err != nil {
+		return nil, err
+	}
+	annotations, err := fetchAnnotations(tx, p.ID)
+	if err != nil {
 		return nil, err
 	}
+	p.Annotations = annotations
 
 	return p, nil
 }
 
-// Fetch retrieves a payment by Unique Reference, including its associated identities and transactions.
-func FetchByUniqueRef(uniqueRef string) (*Payment, error) {
+// Fetch retrieves a payment by Unique Reference, including its associated identities, transactions and annotations.
+// Pass WithNotes to also load its notes.
+func FetchByUniqueRef(uniqueRef string, opts ...FetchOption) (*Payment, error) {
 	p := new(Payment)
 	// Fetch the payment record from the database
 	if err := config.DB.Get(p, fmt.Sprintf(`SELECT * FROM %s WHERE unique_ref=$1`, p.Table()), uniqueRef); err != nil {
 		return nil, err
 	}
 
-	// Fetch identities associated with the payment
-	if err := config.DB.Select(&p.Identities, fmt.Sprintf(`SELECT * FROM %s WHERE payment_id=$1`, PaymentIdentity{}.Table()), p.ID); err != nil {
+	// Fetch identities and transactions associated with the payment
+	if err := p.FetchFull(); err != nil {
 		return nil, err
 	}
 
-	// Fetch transactions associated with the payment
-	if err := config.DB.Select(&p.Transactions, fmt.Sprintf(`SELECT * FROM %s WHERE payment_id=$1`, Transaction{}.Table()), p.ID); err != nil {
+	if err := p.applyFetchOptions(opts); err != nil {
 		return nil, err
 	}
 
 	return p, nil
 }
 
+// FetchByDateRange retrieves payments created within [from, to), newest first, along with the total number of matching payments.
+func FetchByDateRange(from, to time.Time, limit, offset int) ([]Payment, int, error) {
+	return fetchPage(`created_at >= $1 AND created_at < $2`, []interface{}{from, to}, limit, offset)
+}
+
+// FetchUpdatedSince retrieves payments updated at or after since, newest first, along with the total number of matching payments.
+// It is intended for incremental synchronization such as reconciliation workers.
+func FetchUpdatedSince(since time.Time, limit, offset int) ([]Payment, int, error) {
+	return fetchPage(`updated_at >= $1`, []interface{}{since}, limit, offset)
+}
+
+// FetchOverdue retrieves up to limit payments that have not reached a terminal status and have not been updated
+// for longer than cutoff, least recently updated first, e.g., for a job monitoring stalled payments.
+func FetchOverdue(cutoff time.Duration, limit int) ([]Payment, error) {
+	query := `SELECT * FROM %s WHERE updated_at < NOW() - ?::interval AND status NOT IN (?) ORDER BY updated_at LIMIT ?`
+	query, args, err := sqlx.In(fmt.Sprintf(query, Payment{}.Table()), fmt.Sprintf("%d milliseconds", cutoff.Milliseconds()), terminalStatuses, limit)
+	if err != nil {
+		return nil, newError(ErrCodeDB, err, "failed to build overdue payments query")
+	}
+
+	payments := []Payment{}
+	if err := config.DB.Select(&payments, config.DB.Rebind(query), args...); err != nil {
+		return nil, newError(ErrCodeDB, err, "failed to fetch overdue payments")
+	}
+
+	if err := fetchRelations(payments); err != nil {
+		return nil, newError(ErrCodeDB, err, "failed to fetch overdue payment relations")
+	}
+
+	return payments, nil
+}
+
+// fetchPage retrieves a page of payments matching the where clause together with the total count,
+// batch-loading their identities and transactions.
+func fetchPage(where string, args []interface{}, limit, offset int) ([]Payment, int, error) {
+	table := Payment{}.Table()
+
+	// Count all matching payments for pagination
+	var total int
+	if err := config.DB.Get(&total, fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE %s`, table, where), args...); err != nil {
+		return nil, 0, err
+	}
+
+	// Fetch the requested page
+	payments := []Payment{}
+	query := fmt.Sprintf(`SELECT * FROM %s WHERE %s ORDER BY created_at DESC LIMIT $%d OFFSET $%d`, table, where, len(args)+1, len(args)+2)
+	if err := config.DB.Select(&payments, query, append(args, limit, offset)...); err != nil {
+		return nil, 0, err
+	}
+
+	if err := fetchRelations(payments); err != nil {
+		return nil, 0, err
+	}
+
+	return payments, total, nil
+}
+
+// fetchRelations batch-loads identities and transactions for the given payments in two queries.
+func fetchRelations(payments []Payment) error {
+	if len(payments) < 1 {
+		return nil
+	}
+
+	ids := make([]uuid.UUID, len(payments))
+	positions := make(map[uuid.UUID]int, len(payments))
+	for i, p := range payments {
+		ids[i] = p.ID
+		positions[p.ID] = i
+	}
+
+	// Fetch identities associated with the payments
+	query, args, err := sqlx.In(fmt.Sprintf(`SELECT * FROM %s WHERE payment_id IN (?) AND archived_at IS NULL`, PaymentIdentity{}.Table()), ids)
+	if err != nil {
+		return err
+	}
+	var identities []PaymentIdentity
+	if err := config.DB.Select(&identities, config.DB.Rebind(query), args...); err != nil {
+		return err
+	}
+	for _, identity := range identities {
+		i := positions[identity.PaymentID]
+		payments[i].Identities = append(payments[i].Identities, identity)
+	}
+
+	// Fetch transactions associated with the payments
+	query, args, err = sqlx.In(fmt.Sprintf(`SELECT * FROM %s WHERE payment_id IN (?)`, Transaction{}.Table()), ids)
+	if err != nil {
+		return err
+	}
+	var transactions []Transaction
+	if err := config.DB.Select(&transactions, config.DB.Rebind(query), args...); err != nil {
+		return err
+	}
+	for _, t := range transactions {
+		i := positions[t.PaymentID]
+		payments[i].Transactions = append(payments[i].Transactions, t)
+	}
+
+	return nil
+}
+
 // New creates a new payment with the specified parameters.
+// It is idempotent on params.Ref: if a payment with the same unique reference exists, its tag, description
+// and meta are updated and it is returned, unless it differs in amount, currency or type, in which case a
+// *PaymentConflictError is returned.
 func New(params PaymentParams) (*Payment, error) {
+	payment, _, err := newPayment(config.DB, params)
+	return payment, err
+}
+
+// newPayment is New running its queries on q, e.g., a transaction. It also reports whether the payment was
+// created rather than already existing.
+func newPayment(q sqlx.Queryer, params PaymentParams) (*Payment, bool, error) {
+	if err := params.Validate(); err != nil {
+		return nil, false, err
+	}
+
 	// Convert meta to JSONB
 	metaJSON, err := json.Marshal(params.Meta)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal meta: %w", err)
+		return nil, false, newError(ErrCodeValidation, err, "failed to marshal meta")
 	}
 
 	// Prepare the Payment struct for scanning
 	payment := new(Payment)
 
-	// SQL query with RETURNING *
+	// SQL query with RETURNING *, which yields no row if the unique reference is already taken
 	query := `
 		INSERT INTO %s (tag, description, unique_ref, total_amount, currency, status, type, meta)
 		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-		ON CONFLICT (unique_ref) DO UPDATE SET tag=$1 ,description=$2 ,total_amount=$4, currency=$5, status=$6, type=$7, meta=$8
+		ON CONFLICT (unique_ref) DO NOTHING
 		RETURNING *`
 
 	// Execute query and scan the returned row into the struct
 	query = fmt.Sprintf(query, payment.Table())
-	if err := config.DB.QueryRowx(query, params.Tag, params.Description, params.Ref, params.TotalAmount, params.Currency, INITIATED, params.Type, metaJSON).
+	err = q.QueryRowx(query, params.Tag, params.Description, params.Ref, params.TotalAmount, params.Currency, INITIATED, params.Type, metaJSON).
+		StructScan(payment)
+	if err == nil {
+		return payment, true, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, false, newError(ErrCodeDB, err, "failed to create payment")
+	}
+
+	// The payment already exists, e.g. on a retry; make sure it is the same payment
+	if err := sqlx.Get(q, payment, fmt.Sprintf(`SELECT * FROM %s WHERE unique_ref=$1`, payment.Table()), params.Ref); err != nil {
+		return nil, false, newError(ErrCodeDB, err, "failed to fetch existing payment")
+	}
+	if err := params.checkConflict(payment); err != nil {
+		return nil, false, err
+	}
+
+	// Only refresh the descriptive fields of the existing payment
+	query = fmt.Sprintf(`UPDATE %s SET tag=$1, description=$2, meta=$3, updated_at=NOW() WHERE id=$4 RETURNING *`, payment.Table())
+	if err := q.QueryRowx(query, params.Tag, params.Description, metaJSON, payment.ID).
 		StructScan(payment); err != nil {
-		return nil, fmt.Errorf("failed to create payment: %w", err)
+		return nil, false, newError(ErrCodeDB, err, "failed to update payment")
+	}
+
+	return payment, false, nil
+}
+
+// NewWithIdentities creates a new payment along with its identities in a single database transaction, so that
+// either all of them or none are saved. The identity amounts are checked and filled in with AllocateAmong.
+// Like New it is idempotent on params.Ref: if the payment already exists, it is returned with its existing
+// identities and params.Identities is ignored.
+func NewWithIdentities(params PaymentWithIdentitiesParams) (*Payment, error) {
+	if err := params.PaymentParams.Validate(); err != nil {
+		return nil, err
+	}
+	identities := append([]IdentityParams(nil), params.Identities...)
+	if err := AllocateAmong(identities, params.TotalAmount); err != nil {
+		return nil, err
+	}
+
+	tx, err := config.DB.BeginTxx(context.Background(), nil)
+	if err != nil {
+		return nil, newError(ErrCodeDB, err, "failed to begin transaction")
 	}
+	defer tx.Rollback()
 
+	payment, created, err := newPayment(tx, params.PaymentParams)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		for _, identity := range identities {
+			if _, err := payment.addIdentity(tx, identity); err != nil {
+				return nil, newError(ErrCodeDB, err, "failed to add identity")
+			}
+		}
+	} else {
+		payment.Identities = []PaymentIdentity{}
+		if err := tx.Select(&payment.Identities, fmt.Sprintf(`SELECT * FROM %s WHERE payment_id=$1 AND archived_at IS NULL`, PaymentIdentity{}.Table()), payment.ID); err != nil {
+			return nil, newError(ErrCodeDB, err, "failed to fetch identities")
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, newError(ErrCodeDB, err, "failed to commit transaction")
+	}
 	return payment, nil
 }
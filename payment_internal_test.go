@@ -0,0 +1,30 @@
+package gopay
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPaymentParamsCheckConflict(t *testing.T) {
+	existing := &Payment{TotalAmount: 100, Currency: USD, Type: FIAT}
+
+	if err := (PaymentParams{Tag: "retry", TotalAmount: 100, Currency: USD, Type: FIAT}).checkConflict(existing); err != nil {
+		t.Errorf("Expected matching params to reuse the payment, but got %v", err)
+	}
+
+	err := (PaymentParams{TotalAmount: 1000, Currency: USD, Type: FIAT}).checkConflict(existing)
+	if !errors.Is(err, ErrPaymentConflict) {
+		t.Fatalf("Expected ErrPaymentConflict, but got %v", err)
+	}
+	var conflict *PaymentConflictError
+	if !errors.As(err, &conflict) || conflict.Existing != existing || conflict.Params.TotalAmount != 1000 {
+		t.Errorf("Expected the conflict to carry both payments, but got %+v", conflict)
+	}
+
+	if err := (PaymentParams{TotalAmount: 100, Currency: JPY, Type: FIAT}).checkConflict(existing); !errors.Is(err, ErrPaymentConflict) {
+		t.Errorf("Expected ErrPaymentConflict for a different currency, but got %v", err)
+	}
+	if err := (PaymentParams{TotalAmount: 100, Currency: USD, Type: CRYPTO}).checkConflict(existing); !errors.Is(err, ErrPaymentConflict) {
+		t.Errorf("Expected ErrPaymentConflict for a different type, but got %v", err)
+	}
+}
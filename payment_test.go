@@ -0,0 +1,2069 @@
+package gopay_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx/types"
+	"github.com/socious-io/gopay"
+	"github.com/socious-io/gopay/testutil"
+)
+
+func TestPaymentAllocation(t *testing.T) {
+	cases := []struct {
+		name        string
+		total       float64
+		allocations []float64
+		unallocated float64
+	}{
+		{"exact", 100, []float64{70, 30}, 0},
+		{"exact with float rounding", 0.3, []float64{0.1, 0.2}, 0},
+		{"under-allocated", 100, []float64{70}, 30},
+		{"over-allocated", 100, []float64{70, 40}, -10},
+		{"no identities", 100, nil, 100},
+	}
+
+	for _, c := range cases {
+		p := &gopay.Payment{TotalAmount: c.total}
+		var allocated float64
+		for _, amount := range c.allocations {
+			p.Identities = append(p.Identities, gopay.PaymentIdentity{AllocatedAmount: amount})
+			allocated += amount
+		}
+
+		if math.Abs(p.TotalAllocated()-allocated) > 0.000001 {
+			t.Errorf("%s: expected total allocated %f, but got %f", c.name, allocated, p.TotalAllocated())
+		}
+		if math.Abs(p.Unallocated()-c.unallocated) > 0.000001 {
+			t.Errorf("%s: expected unallocated %f, but got %f", c.name, c.unallocated, p.Unallocated())
+		}
+	}
+}
+
+func TestPaymentIdentityLookups(t *testing.T) {
+	seller, platform := uuid.New(), uuid.New()
+	p := &gopay.Payment{Identities: []gopay.PaymentIdentity{
+		{IdentityID: seller, RoleName: "seller", AllocatedAmount: 90},
+		{IdentityID: platform, RoleName: "platform", AllocatedAmount: 10},
+	}}
+
+	if !p.HasIdentity(seller) || p.HasIdentity(uuid.New()) {
+		t.Errorf("Unexpected HasIdentity results")
+	}
+	if i, ok := p.GetIdentity(platform); !ok || i.RoleName != "platform" {
+		t.Errorf("Expected the platform identity, but got %+v", i)
+	}
+	if i, ok := p.GetIdentityByRole("seller"); !ok || i.IdentityID != seller {
+		t.Errorf("Expected the seller identity, but got %+v", i)
+	} else {
+		i.AllocatedAmount = 80
+		if p.Identities[0].AllocatedAmount != 80 {
+			t.Errorf("Expected the returned identity to point into the payment's identities")
+		}
+	}
+	if _, ok := p.GetIdentityByRole("referrer"); ok {
+		t.Errorf("Expected no referrer identity")
+	}
+
+	now := time.Now()
+	p.Transactions = []gopay.Transaction{
+		{Type: gopay.DEPOSIT},
+		{Type: gopay.DEPOSIT, VerfiedAt: &now, CanceledAt: &now},
+		{Type: gopay.PAYOUT, VerfiedAt: &now},
+	}
+	if p.HasVerifiedDeposit() {
+		t.Errorf("Expected no verified deposit")
+	}
+	p.Transactions = append(p.Transactions, gopay.Transaction{Type: gopay.DEPOSIT, VerfiedAt: &now})
+	if !p.HasVerifiedDeposit() {
+		t.Errorf("Expected a verified deposit")
+	}
+}
+
+func TestUpdateIdentity(t *testing.T) {
+	status := "INITIATED"
+	var updateArgs []driver.NamedValue
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		switch {
+		case strings.Contains(query, "SELECT status FROM payments WHERE id=$1"):
+			return []string{"status"}, [][]driver.Value{{status}}, nil
+		case strings.Contains(query, "UPDATE payment_identities"):
+			updateArgs = args
+			return []string{"id", "role_name", "account", "allocated_amount", "meta"},
+				[][]driver.Value{{args[0].Value, args[1].Value, args[2].Value, args[3].Value, args[4].Value}}, nil
+		}
+		return nil, nil, nil
+	})
+
+	identityID := uuid.New()
+	p := &gopay.Payment{ID: uuid.New(), Identities: []gopay.PaymentIdentity{{ID: identityID, RoleName: "seller", AllocatedAmount: 10}}}
+	params := gopay.IdentityParams{RoleName: "vendor", Account: "acct_123", Amount: 25, Meta: map[string]string{"tier": "gold"}}
+	if err := p.UpdateIdentity(identityID, params); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	identity := p.Identities[0]
+	if identity.RoleName != "vendor" || identity.Account != "acct_123" || identity.AllocatedAmount != 25 {
+		t.Errorf("Expected the identity to be updated in place, but got %+v", identity)
+	}
+	if len(updateArgs) != 5 || string(updateArgs[4].Value.([]byte)) != `{"tier":"gold"}` {
+		t.Errorf("Unexpected update arguments %v", updateArgs)
+	}
+
+	if err := p.UpdateIdentity(uuid.New(), params); !gopay.IsNotFound(err) {
+		t.Errorf("Expected an unassigned identity to be not found, but got %v", err)
+	}
+
+	status, updateArgs = "DEPOSITED", nil
+	if err := p.UpdateIdentity(identityID, gopay.IdentityParams{RoleName: "buyer"}); !errors.Is(err, gopay.ErrPaymentAlreadyProcessed) {
+		t.Errorf("Expected ErrPaymentAlreadyProcessed, but got %v", err)
+	}
+	if updateArgs != nil || p.Identities[0].RoleName != "vendor" {
+		t.Errorf("Expected a processed payment's identity to be left unchanged, but got %+v", p.Identities[0])
+	}
+}
+
+func TestPaymentFees(t *testing.T) {
+	now := time.Now()
+	p := &gopay.Payment{
+		TotalAmount: 100,
+		Transactions: []gopay.Transaction{
+			{Type: gopay.DEPOSIT, Amount: 100, Fee: 2.9, Discount: 5, VerfiedAt: &now},
+			{Type: gopay.DEPOSIT, Amount: 100, Fee: 3, Discount: 1},             // Not verified
+			{Type: gopay.PARTIAL_REFUND, Amount: 10, Fee: 0.5, VerfiedAt: &now}, // Not a deposit
+		},
+	}
+
+	if math.Abs(p.TotalFees()-2.9) > 0.000001 {
+		t.Errorf("Expected total fees 2.9, but got %f", p.TotalFees())
+	}
+	if math.Abs(p.TotalDiscounts()-5) > 0.000001 {
+		t.Errorf("Expected total discounts 5, but got %f", p.TotalDiscounts())
+	}
+	if math.Abs(p.NetAmount()-97.1) > 0.000001 {
+		t.Errorf("Expected net amount 97.1, but got %f", p.NetAmount())
+	}
+
+	empty := &gopay.Payment{TotalAmount: 100}
+	if empty.TotalFees() != 0 || empty.TotalDiscounts() != 0 || empty.NetAmount() != 100 {
+		t.Errorf("Expected no fees without transactions, but got %f fees and %f discounts", empty.TotalFees(), empty.TotalDiscounts())
+	}
+}
+
+func TestDepositRejectsUnallocatedAmount(t *testing.T) {
+	serviceName := "stripe"
+	p := &gopay.Payment{
+		TotalAmount:     100,
+		Type:            gopay.FIAT,
+		FiatServiceName: &serviceName,
+		Identities:      []gopay.PaymentIdentity{{AllocatedAmount: 60}},
+	}
+
+	if err := p.Deposit(); !errors.Is(err, gopay.ErrUnallocatedAmount) {
+		t.Errorf("Expected ErrUnallocatedAmount, but got %v", err)
+	}
+}
+
+func TestProcessingWithoutModeSet(t *testing.T) {
+	identities := []gopay.PaymentIdentity{{AllocatedAmount: 100}}
+
+	fiat := &gopay.Payment{TotalAmount: 100, Type: gopay.FIAT, Status: gopay.INITIATED, Identities: identities}
+	if err := fiat.Deposit(); !errors.Is(err, gopay.ErrFiatServiceNotSet) {
+		t.Errorf("Expected ErrFiatServiceNotSet, but got %v", err)
+	}
+
+	action := gopay.ACTION_REQUIRED
+	onHold := &gopay.Payment{TotalAmount: 100, Type: gopay.FIAT, Status: gopay.ON_HOLD, TransactionStatus: &action, Identities: identities}
+	if err := onHold.ConfirmPayment("pi_123"); !errors.Is(err, gopay.ErrFiatServiceNotSet) {
+		t.Errorf("Expected ErrFiatServiceNotSet, but got %v", err)
+	}
+
+	crypto := &gopay.Payment{TotalAmount: 100, Type: gopay.CRYPTO, Status: gopay.INITIATED, Identities: identities}
+	if err := crypto.ConfirmDeposit("0xTransactionHash", nil); !errors.Is(err, gopay.ErrCryptoAddressNotSet) {
+		t.Errorf("Expected ErrCryptoAddressNotSet, but got %v", err)
+	}
+}
+
+func TestMarkPaidOutRequiresDeposit(t *testing.T) {
+	for _, status := range []gopay.PaymentStatus{gopay.INITIATED, gopay.PENDING_DEPOSIT, gopay.PAID_OUT, gopay.REFUNDED} {
+		p := &gopay.Payment{Status: status}
+		if err := p.MarkPaidOut(); err == nil {
+			t.Errorf("%s: expected an error, but got nil", status)
+		}
+		if p.Status != status {
+			t.Errorf("%s: expected status to be unchanged, but got %s", status, p.Status)
+		}
+	}
+}
+
+func TestPaymentHistory(t *testing.T) {
+	base := time.Date(2025, 8, 1, 12, 0, 0, 0, time.UTC)
+	at := func(minutes int) *time.Time {
+		ts := base.Add(time.Duration(minutes) * time.Minute)
+		return &ts
+	}
+
+	p := &gopay.Payment{
+		Type:      gopay.FIAT,
+		CreatedAt: base,
+		Transactions: []gopay.Transaction{
+			{Type: gopay.DEPOSIT, CreatedAt: *at(10), VerfiedAt: at(30)},
+			{Type: gopay.PARTIAL_REFUND, CreatedAt: *at(5), CanceledAt: at(5)},
+		},
+		Notes: []gopay.PaymentNote{
+			{Note: "customer called", CreatedAt: *at(20)},
+			{Note: "refund requested", CreatedAt: *at(1)},
+		},
+	}
+
+	events, err := p.History()
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	want := []struct {
+		eventType string
+		time      time.Time
+	}{
+		{gopay.EventCreated, base},
+		{gopay.EventNote, *at(1)},
+		{gopay.EventTransactionCreated, *at(5)},
+		{gopay.EventTransactionCanceled, *at(5)},
+		{gopay.EventTransactionCreated, *at(10)},
+		{gopay.EventNote, *at(20)},
+		{gopay.EventTransactionVerified, *at(30)},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("Expected %d events, but got %d: %v", len(want), len(events), events)
+	}
+	for i, w := range want {
+		if events[i].EventType != w.eventType || !events[i].Time.Equal(w.time) {
+			t.Errorf("Event %d: expected %s at %v, but got %s at %v", i, w.eventType, w.time, events[i].EventType, events[i].Time)
+		}
+	}
+}
+
+func TestPaymentHistoryWithoutRelations(t *testing.T) {
+	created := time.Date(2025, 8, 1, 12, 0, 0, 0, time.UTC)
+	events, err := (&gopay.Payment{CreatedAt: created}).History()
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if len(events) != 1 || events[0].EventType != gopay.EventCreated || !events[0].Time.Equal(created) {
+		t.Errorf("Expected only the created event, but got %v", events)
+	}
+}
+
+func TestPaymentParamsValidate(t *testing.T) {
+	valid := gopay.PaymentParams{Tag: "order", Ref: "order-1", Currency: gopay.USD, TotalAmount: 10}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Expected valid params, but got %v", err)
+	}
+
+	invalid := gopay.PaymentParams{Ref: strings.Repeat("x", 256), Currency: "XXX"}
+	err := invalid.Validate()
+	var verr *gopay.ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Expected a ValidationError, but got %v", err)
+	}
+	fields := map[string]bool{}
+	for _, f := range verr.Fields {
+		fields[f.Field] = true
+	}
+	for _, field := range []string{"total_amount", "currency", "tag", "unique_ref"} {
+		if !fields[field] {
+			t.Errorf("Expected an error for %s, but got %v", field, verr.Fields)
+		}
+	}
+
+	if _, err := gopay.New(invalid); !errors.As(err, &verr) {
+		t.Errorf("Expected New to reject invalid params with a ValidationError, but got %v", err)
+	}
+}
+
+func TestAllocateAmong(t *testing.T) {
+	identities := []gopay.IdentityParams{{RoleName: "seller", Amount: 70}, {RoleName: "platform"}, {RoleName: "referrer"}}
+	if err := gopay.AllocateAmong(identities, 100); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if identities[0].Amount != 70 || identities[1].Amount != 15 || identities[2].Amount != 15 {
+		t.Errorf("Expected the remainder to be split equally, but got %+v", identities)
+	}
+
+	tests := []struct {
+		name       string
+		identities []gopay.IdentityParams
+	}{
+		{"under allocated", []gopay.IdentityParams{{Amount: 40}, {Amount: 50}}},
+		{"over allocated", []gopay.IdentityParams{{Amount: 60}, {Amount: 50}}},
+		{"nothing left to fill", []gopay.IdentityParams{{Amount: 100}, {}}},
+		{"negative amount", []gopay.IdentityParams{{Amount: 110}, {Amount: -10}}},
+	}
+	for _, tt := range tests {
+		if err := gopay.AllocateAmong(tt.identities, 100); gopay.ErrorCodeOf(err) != gopay.ErrCodeValidation {
+			t.Errorf("%s: expected a validation error, but got %v", tt.name, err)
+		}
+	}
+}
+
+func TestNewWithIdentities(t *testing.T) {
+	var amounts []float64
+	existing := false
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		switch {
+		case strings.Contains(query, "INSERT INTO payments"):
+			if existing {
+				return []string{"id"}, nil, nil
+			}
+			return []string{"unique_ref", "total_amount", "currency", "type"}, [][]driver.Value{{args[2].Value, args[3].Value, args[4].Value, args[6].Value}}, nil
+		case strings.Contains(query, "WHERE unique_ref=$1"):
+			return []string{"unique_ref", "total_amount", "currency", "type"}, [][]driver.Value{{args[0].Value, 100.0, "USD", "FIAT"}}, nil
+		case strings.Contains(query, "UPDATE payments SET tag=$1"):
+			return []string{"unique_ref", "total_amount", "currency", "type"}, [][]driver.Value{{"order-1", 100.0, "USD", "FIAT"}}, nil
+		case strings.Contains(query, "INSERT INTO payment_identities"):
+			amounts = append(amounts, args[3].Value.(float64))
+			return []string{"role_name", "allocated_amount"}, [][]driver.Value{{args[2].Value, args[3].Value}}, nil
+		case strings.Contains(query, "FROM payment_identities"):
+			return []string{"role_name", "allocated_amount"}, [][]driver.Value{{"seller", 100.0}}, nil
+		}
+		return nil, nil, nil
+	})
+
+	params := gopay.PaymentParams{Tag: "order", Ref: "order-1", Currency: gopay.USD, TotalAmount: 100, Type: gopay.FIAT}
+	identities := []gopay.IdentityParams{{RoleName: "seller", Amount: 90}, {RoleName: "platform"}}
+	p, err := gopay.NewWithIdentities(params.WithIdentities(identities))
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if len(p.Identities) != 2 || p.Identities[1].RoleName != "platform" || p.Identities[1].AllocatedAmount != 10 {
+		t.Errorf("Unexpected identities %+v", p.Identities)
+	}
+	if identities[1].Amount != 0 {
+		t.Errorf("Expected the given identities to be left untouched, but got %+v", identities)
+	}
+
+	// A retry returns the existing payment without adding the identities again
+	existing = true
+	amounts = nil
+	p, err = gopay.NewWithIdentities(params.WithIdentities(identities))
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if len(amounts) != 0 || len(p.Identities) != 1 {
+		t.Errorf("Expected the existing identities, but added %v and got %+v", amounts, p.Identities)
+	}
+
+	if _, err := gopay.NewWithIdentities(params.WithIdentities([]gopay.IdentityParams{{Amount: 50}})); gopay.ErrorCodeOf(err) != gopay.ErrCodeValidation {
+		t.Errorf("Expected unallocated identities to be rejected, but got %v", err)
+	}
+}
+
+func TestValidateForDeposit(t *testing.T) {
+	p := &gopay.Payment{TotalAmount: 100, Type: gopay.FIAT}
+	err := p.ValidateForDeposit()
+	var verr *gopay.ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Expected a ValidationError, but got %v", err)
+	}
+	if len(verr.Fields) != 3 {
+		t.Errorf("Expected 3 field errors, but got %v", verr.Fields)
+	}
+	if !errors.Is(err, gopay.ErrUnallocatedAmount) || !errors.Is(err, gopay.ErrFiatServiceNotSet) {
+		t.Errorf("Expected the error to match ErrUnallocatedAmount and ErrFiatServiceNotSet, but got %v", err)
+	}
+
+	service := "stripe"
+	p.FiatServiceName = &service
+	p.Identities = []gopay.PaymentIdentity{{AllocatedAmount: 60}, {AllocatedAmount: 50}}
+	if err := p.ValidateForDeposit(); !errors.Is(err, gopay.ErrUnallocatedAmount) {
+		t.Errorf("Expected over-allocation to be rejected, but got %v", err)
+	}
+
+	p.Identities[1].AllocatedAmount = 40
+	if err := p.ValidateForDeposit(); err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+}
+
+func TestSetRef(t *testing.T) {
+	var updated bool
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		switch {
+		case strings.Contains(query, "SELECT EXISTS"):
+			return []string{"exists"}, [][]driver.Value{{args[0].Value == "taken"}}, nil
+		case strings.Contains(query, "SET unique_ref"):
+			updated = true
+			return []string{"unique_ref", "status"}, [][]driver.Value{{args[0].Value, "INITIATED"}}, nil
+		}
+		return nil, nil, nil
+	})
+
+	p := &gopay.Payment{UniqueRef: "order-1", Status: gopay.INITIATED}
+	if err := p.SetRef("taken"); !errors.Is(err, gopay.ErrDuplicateRef) {
+		t.Errorf("Expected ErrDuplicateRef, but got %v", err)
+	}
+	if updated || p.UniqueRef != "order-1" {
+		t.Errorf("Expected the reference to be unchanged, but got %s", p.UniqueRef)
+	}
+
+	if err := p.SetRef("order-2"); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if p.UniqueRef != "order-2" {
+		t.Errorf("Expected reference order-2, but got %s", p.UniqueRef)
+	}
+}
+
+func TestSetToFiatMode(t *testing.T) {
+	var updates [][]driver.Value
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		if strings.Contains(query, "SET fiat_service_name = $1") {
+			updates = append(updates, []driver.Value{args[0].Value, args[1].Value})
+			return []string{"fiat_service_name", "fiat_service", "type"}, [][]driver.Value{{args[0].Value, args[1].Value, args[2].Value}}, nil
+		}
+		return nil, nil, nil
+	}, gopay.WithFiats(gopay.Fiats{{Name: "stripe-eu", ApiKey: "sk_test", Service: gopay.STRIPE}}))
+
+	p := &gopay.Payment{ID: uuid.New()}
+	if err := p.SetToFiatMode("stripe-eu"); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if p.Type != gopay.FIAT || p.FiatServiceName == nil || *p.FiatServiceName != "stripe-eu" {
+		t.Errorf("Expected the payment to use stripe-eu, but got %+v", p)
+	}
+	if p.FiatService == nil || *p.FiatService != gopay.STRIPE {
+		t.Errorf("Expected the provider to be recorded, but got %v", p.FiatService)
+	}
+
+	if err := p.SetToFiatMode("paypal"); !gopay.IsNotFound(err) {
+		t.Errorf("Expected an unknown service not to be found, but got %v", err)
+	}
+	if len(updates) != 1 {
+		t.Errorf("Expected the payment not to be updated with an unknown service, but got %v", updates)
+	}
+}
+
+func TestSetDescriptionAndRefRequireNonTerminalStatus(t *testing.T) {
+	for _, status := range []gopay.PaymentStatus{gopay.PAID_OUT, gopay.CANCLED, gopay.REFUNDED} {
+		p := &gopay.Payment{Description: "Old", UniqueRef: "order-1", Status: status}
+		if err := p.SetDescription("New"); !errors.Is(err, gopay.ErrPaymentAlreadyProcessed) {
+			t.Errorf("%s: expected ErrPaymentAlreadyProcessed, but got %v", status, err)
+		}
+		if err := p.SetRef("order-2"); !errors.Is(err, gopay.ErrPaymentAlreadyProcessed) {
+			t.Errorf("%s: expected ErrPaymentAlreadyProcessed, but got %v", status, err)
+		}
+		if p.Description != "Old" || p.UniqueRef != "order-1" {
+			t.Errorf("%s: expected the payment to be unchanged, but got %+v", status, p)
+		}
+	}
+}
+
+func TestConfirmDepositAsyncChecksPaymentFirst(t *testing.T) {
+	done := make(chan error, 1)
+	p := &gopay.Payment{TotalAmount: 100, Type: gopay.FIAT, Identities: []gopay.PaymentIdentity{{AllocatedAmount: 100}}}
+	if err := p.ConfirmDepositAsync(context.Background(), "0xTransactionHash", nil, done); err == nil {
+		t.Fatal("Expected fiat payments to be rejected, but got nil")
+	}
+	select {
+	case err := <-done:
+		t.Errorf("Expected nothing to be sent to done, but got %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestRetryDeposit(t *testing.T) {
+	var requests []string
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/payment_methods":
+			w.Write([]byte(`{"object": "list", "url": "/v1/payment_methods", "has_more": false, "data": [{"id": "pm_123", "object": "payment_method", "type": "card"}]}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/payment_intents/pi_old/cancel":
+			w.Write([]byte(`{"id": "pi_old", "object": "payment_intent", "status": "canceled"}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/payment_intents":
+			w.Write([]byte(`{"id": "pi_new", "object": "payment_intent", "amount": 10000, "currency": "usd", "status": "requires_action", "client_secret": "pi_new_secret"}`))
+		default:
+			t.Errorf("Unexpected request to %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	var statuses []gopay.PaymentStatus
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		switch {
+		case strings.Contains(query, "pg_try_advisory_lock"):
+			return []string{"locked"}, [][]driver.Value{{true}}, nil
+		case strings.Contains(query, "ORDER BY created_at DESC LIMIT 1"):
+			return []string{"tx_id", "status"}, [][]driver.Value{{"pi_old", string(gopay.ACTION_REQUIRED)}}, nil
+		case strings.Contains(query, "canceled_at=NOW()"):
+			return []string{"tx_id", "status"}, [][]driver.Value{{"pi_old", string(gopay.CANCELED)}}, nil
+		case strings.Contains(query, "INSERT INTO") && strings.Contains(query, "transactions"):
+			return []string{"tx_id"}, [][]driver.Value{{""}}, nil
+		case strings.Contains(query, "SET tx_id=$2, meta=$3, status=$4"):
+			return []string{"tx_id", "status"}, [][]driver.Value{{args[1].Value, args[3].Value}}, nil
+		case strings.Contains(query, "SET status=$2"):
+			return []string{"status"}, [][]driver.Value{{args[1].Value}}, nil
+		case strings.Contains(query, "client_secret = $4"):
+			statuses = append(statuses, gopay.PaymentStatus(args[0].Value.(string)))
+			return []string{"status", "client_secret"}, [][]driver.Value{{args[0].Value, args[3].Value}}, nil
+		}
+		return nil, nil, nil
+	}, gopay.WithFiats(gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}))
+
+	serviceName := "stripe"
+	secret := "pi_old_secret"
+	action := gopay.ACTION_REQUIRED
+	p := &gopay.Payment{
+		TotalAmount:       100,
+		Currency:          gopay.USD,
+		Type:              gopay.FIAT,
+		Status:            gopay.ON_HOLD,
+		TransactionStatus: &action,
+		FiatServiceName:   &serviceName,
+		ClientSecret:      &secret,
+		Identities:        []gopay.PaymentIdentity{{AllocatedAmount: 100, Account: "cus_123"}},
+	}
+	if err := p.RetryDeposit(); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	if len(requests) != 3 || requests[0] != "POST /v1/payment_intents/pi_old/cancel" || requests[2] != "POST /v1/payment_intents" {
+		t.Errorf("Expected the old intent to be canceled before a new one is created, but got %v", requests)
+	}
+	if len(statuses) != 2 || statuses[0] != gopay.PENDING_DEPOSIT || statuses[1] != gopay.ON_HOLD {
+		t.Errorf("Expected the payment to be reset to PENDING_DEPOSIT and put on hold again, but got %v", statuses)
+	}
+	if p.ClientSecret == nil || *p.ClientSecret != "pi_new_secret" {
+		t.Errorf("Expected the new client secret, but got %v", p.ClientSecret)
+	}
+
+	deposited := &gopay.Payment{Type: gopay.FIAT, Status: gopay.DEPOSITED, FiatServiceName: &serviceName}
+	if err := deposited.RetryDeposit(); gopay.ErrorCodeOf(err) != gopay.ErrCodeInvalidStatus {
+		t.Errorf("Expected only on-hold payments to be retried, but got %v", err)
+	}
+}
+
+func TestPaymentJSON(t *testing.T) {
+	verifiedAt := time.Now()
+	p := gopay.Payment{
+		TotalAmount: 100,
+		Currency:    gopay.USD,
+		Identities:  []gopay.PaymentIdentity{{AllocatedAmount: 60}, {AllocatedAmount: 30}},
+		Transactions: []gopay.Transaction{
+			{Type: gopay.DEPOSIT, Amount: 100, Fee: 5, Discount: 2, VerfiedAt: &verifiedAt},
+		},
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	expected := map[string]float64{
+		"total_amount":    100,
+		"total_allocated": 90,
+		"unallocated":     10,
+		"total_fees":      5,
+		"total_discounts": 2,
+		"net_amount":      95,
+	}
+	for field, value := range expected {
+		if fields[field] != value {
+			t.Errorf("Expected %s to be %v, but got %v", field, value, fields[field])
+		}
+	}
+
+	// A pointer is encoded the same way
+	if ptrData, _ := json.Marshal(&p); string(ptrData) != string(data) {
+		t.Errorf("Expected *Payment to be encoded like Payment, but got %s", ptrData)
+	}
+
+	var decoded gopay.Payment
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&decoded); err != nil {
+		t.Fatalf("Expected the computed fields to be ignored, but got %v", err)
+	}
+	if decoded.TotalAmount != 100 || len(decoded.Identities) != 2 || decoded.NetAmount() != 95 {
+		t.Errorf("Expected the payment to survive a round trip, but got %+v", decoded)
+	}
+}
+
+func TestPaymentNullableAccessors(t *testing.T) {
+	p := &gopay.Payment{}
+	if _, err := p.FiatClientSecret(); !errors.Is(err, gopay.ErrNoClientSecret) {
+		t.Errorf("Expected ErrNoClientSecret, but got %v", err)
+	}
+	if _, err := p.FiatServiceNameStr(); !errors.Is(err, gopay.ErrFiatServiceNotSet) {
+		t.Errorf("Expected ErrFiatServiceNotSet, but got %v", err)
+	}
+	if _, err := p.CryptoCurrencyAddress(); !errors.Is(err, gopay.ErrCryptoAddressNotSet) {
+		t.Errorf("Expected ErrCryptoAddressNotSet, but got %v", err)
+	}
+	if _, err := p.CryptoCurrencyRateVal(); !errors.Is(err, gopay.ErrCryptoRateNotSet) {
+		t.Errorf("Expected ErrCryptoRateNotSet, but got %v", err)
+	}
+
+	secret, serviceName, address, rate := "pi_123_secret", "stripe", "0xTokenAddress", 1.5
+	p = &gopay.Payment{ClientSecret: &secret, FiatServiceName: &serviceName, CryptoCurrency: &address, CryptoCurrencyRate: &rate}
+	if v, err := p.FiatClientSecret(); err != nil || v != secret {
+		t.Errorf("Expected client secret %s, but got %q (%v)", secret, v, err)
+	}
+	if v, err := p.FiatServiceNameStr(); err != nil || v != serviceName {
+		t.Errorf("Expected service name %s, but got %q (%v)", serviceName, v, err)
+	}
+	if v, err := p.CryptoCurrencyAddress(); err != nil || v != address {
+		t.Errorf("Expected address %s, but got %q (%v)", address, v, err)
+	}
+	if v, err := p.CryptoCurrencyRateVal(); err != nil || v != rate {
+		t.Errorf("Expected rate %v, but got %v (%v)", rate, v, err)
+	}
+}
+
+func TestCryptoRate(t *testing.T) {
+	var status gopay.PaymentStatus
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		if strings.Contains(query, "SET crypto_currency_rate = $1") {
+			if status != gopay.INITIATED && status != gopay.PENDING_DEPOSIT {
+				return []string{"crypto_currency_rate"}, nil, nil
+			}
+			return []string{"crypto_currency_rate", "rate_set_at"}, [][]driver.Value{{args[0].Value, time.Now()}}, nil
+		}
+		return nil, nil, nil
+	})
+
+	p := &gopay.Payment{TotalAmount: 100, Type: gopay.CRYPTO}
+	if _, err := p.CryptoEquivalentAmount(); !errors.Is(err, gopay.ErrCryptoRateNotSet) {
+		t.Errorf("Expected ErrCryptoRateNotSet, but got %v", err)
+	}
+
+	status = gopay.PENDING_DEPOSIT
+	if err := p.UpdateCryptoRate(2.5); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if p.RateSetAt == nil {
+		t.Errorf("Expected the rate update time to be set")
+	}
+	if v, err := p.CryptoEquivalentAmount(); err != nil || v != 40 {
+		t.Errorf("Expected an equivalent amount of 40, but got %v (%v)", v, err)
+	}
+
+	if err := p.UpdateCryptoRate(0); gopay.ErrorCodeOf(err) != gopay.ErrCodeValidation {
+		t.Errorf("Expected a non-positive rate to be rejected, but got %v", err)
+	}
+	status = gopay.DEPOSITED
+	if err := p.UpdateCryptoRate(3); !errors.Is(err, gopay.ErrPaymentAlreadyProcessed) {
+		t.Errorf("Expected ErrPaymentAlreadyProcessed, but got %v", err)
+	}
+	if err := (&gopay.Payment{Type: gopay.FIAT}).UpdateCryptoRate(3); gopay.ErrorCodeOf(err) != gopay.ErrCodeInvalidStatus {
+		t.Errorf("Expected fiat payments to be rejected, but got %v", err)
+	}
+}
+
+func TestArchiveIdentities(t *testing.T) {
+	var archived, reset bool
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		switch {
+		case strings.Contains(query, "pg_try_advisory_lock"):
+			return []string{"locked"}, [][]driver.Value{{true}}, nil
+		case strings.Contains(query, "SET archived_at=NOW()"):
+			archived = true
+		case strings.Contains(query, "SET status=$1"):
+			reset = true
+			return []string{"status"}, [][]driver.Value{{args[0].Value}}, nil
+		}
+		return nil, nil, nil
+	})
+
+	p := &gopay.Payment{
+		Status:     gopay.PENDING_DEPOSIT,
+		Identities: []gopay.PaymentIdentity{{ID: uuid.New(), RoleName: "buyer"}},
+	}
+	if err := p.ArchiveIdentities(); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if !archived || !reset {
+		t.Errorf("Expected the identities to be archived and the payment reset, but got archived=%v reset=%v", archived, reset)
+	}
+	if p.Status != gopay.INITIATED || len(p.Identities) != 0 {
+		t.Errorf("Expected an initiated payment without identities, but got %s with %d identities", p.Status, len(p.Identities))
+	}
+
+	p.Status = gopay.DEPOSITED
+	if err := p.ArchiveIdentities(); !errors.Is(err, gopay.ErrPaymentAlreadyProcessed) {
+		t.Errorf("Expected ErrPaymentAlreadyProcessed, but got %v", err)
+	}
+}
+
+func TestFetchFullAndRefresh(t *testing.T) {
+	var transactions [][]driver.Value
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		switch {
+		case strings.Contains(query, "SELECT * FROM payments WHERE id=$1"):
+			return []string{"id", "status"}, [][]driver.Value{{args[0].Value, "DEPOSITED"}}, nil
+		case strings.Contains(query, "SELECT * FROM payment_identities WHERE payment_id=$1"):
+			return []string{"role_name"}, [][]driver.Value{{"seller"}}, nil
+		case strings.Contains(query, "SELECT * FROM transactions WHERE payment_id=$1 ORDER BY created_at"):
+			return []string{"tx_id"}, transactions, nil
+		}
+		return nil, nil, nil
+	})
+
+	p := &gopay.Payment{
+		ID:           uuid.New(),
+		Status:       gopay.PENDING_DEPOSIT,
+		Identities:   []gopay.PaymentIdentity{{RoleName: "stale"}},
+		Transactions: []gopay.Transaction{{TXID: "stale"}},
+	}
+	if err := p.FetchFull(); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if len(p.Identities) != 1 || p.Identities[0].RoleName != "seller" {
+		t.Errorf("Expected the identities to be replaced, but got %v", p.Identities)
+	}
+	if len(p.Transactions) != 0 || p.Status != gopay.PENDING_DEPOSIT {
+		t.Errorf("Expected only the relations to be replaced, but got %v", p)
+	}
+
+	transactions = [][]driver.Value{{"pi_1"}, {"pi_2"}}
+	if err := p.Refresh(); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if p.Status != gopay.DEPOSITED || len(p.Transactions) != 2 || p.Transactions[1].TXID != "pi_2" {
+		t.Errorf("Expected the payment and its transactions to be reloaded, but got %v", p)
+	}
+}
+
+func TestPaymentNotes(t *testing.T) {
+	var notes [][]driver.Value
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		switch {
+		case strings.Contains(query, "SELECT * FROM payments WHERE id=$1"):
+			return []string{"id"}, [][]driver.Value{{args[0].Value}}, nil
+		case strings.Contains(query, "INSERT INTO payment_notes"):
+			note := []driver.Value{args[0].Value, args[1].Value, args[2].Value}
+			notes = append(notes, note)
+			return []string{"payment_id", "note", "created_by"}, [][]driver.Value{note}, nil
+		case strings.Contains(query, "SELECT * FROM payment_notes WHERE payment_id=$1 ORDER BY created_at"):
+			return []string{"payment_id", "note", "created_by"}, notes, nil
+		}
+		return nil, nil, nil
+	})
+
+	p := &gopay.Payment{ID: uuid.New()}
+	n, err := p.AddNote("ops@example.com", "Customer called about the delay")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if n.PaymentID != p.ID || n.CreatedBy != "ops@example.com" || len(p.Notes) != 1 {
+		t.Errorf("Expected the note to be recorded and appended, but got %+v", n)
+	}
+	if _, err := p.AddNote("ops@example.com", "Refund approved"); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	fetched, err := gopay.Fetch(p.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if fetched.Notes != nil {
+		t.Errorf("Expected notes to be loaded only on request, but got %v", fetched.Notes)
+	}
+	fetched, err = gopay.Fetch(p.ID, gopay.WithNotes())
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if len(fetched.Notes) != 2 || fetched.Notes[0].Note != "Customer called about the delay" || fetched.Notes[1].Note != "Refund approved" {
+		t.Errorf("Expected both notes oldest first, but got %v", fetched.Notes)
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	stored := map[string]string{"shopify_id": "123"}
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		switch {
+		case strings.Contains(query, "SELECT * FROM payments WHERE id=$1"):
+			return []string{"status"}, [][]driver.Value{{"INITIATED"}}, nil
+		case strings.Contains(query, "SELECT * FROM payment_annotations"):
+			var rows [][]driver.Value
+			for k, v := range stored {
+				rows = append(rows, []driver.Value{k, v})
+			}
+			return []string{"key", "value"}, rows, nil
+		case strings.Contains(query, "INSERT INTO payment_annotations"):
+			stored[args[1].Value.(string)] = args[2].Value.(string)
+		case strings.Contains(query, "DELETE FROM payment_annotations"):
+			delete(stored, args[1].Value.(string))
+		}
+		return nil, nil, nil
+	})
+
+	p := &gopay.Payment{ID: uuid.New()}
+	if err := p.Refresh(); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if v, ok := p.GetAnnotation("shopify_id"); !ok || v != "123" {
+		t.Errorf("Expected the stored annotation to be loaded, but got %q (%v)", v, ok)
+	}
+
+	if err := p.SetAnnotation("external_order_id", "XYZ"); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if v, _ := p.GetAnnotation("external_order_id"); v != "XYZ" || stored["external_order_id"] != "XYZ" {
+		t.Errorf("Expected the annotation to be set and stored, but got %q", v)
+	}
+	if err := p.SetAnnotation("", "value"); gopay.ErrorCodeOf(err) != gopay.ErrCodeValidation {
+		t.Errorf("Expected an empty key to be rejected, but got %v", err)
+	}
+
+	if err := p.DeleteAnnotation("shopify_id"); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if _, ok := p.GetAnnotation("shopify_id"); ok || stored["shopify_id"] != "" {
+		t.Errorf("Expected the annotation to be deleted, but got %v", p.Annotations)
+	}
+}
+
+func TestOverdue(t *testing.T) {
+	var args []driver.NamedValue
+	setupFakeDB(t, func(query string, a []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		if strings.Contains(query, "::interval AND status NOT IN") {
+			args = a
+			return []string{"status"}, [][]driver.Value{{"PENDING_DEPOSIT"}}, nil
+		}
+		return nil, nil, nil
+	})
+
+	payments, err := gopay.FetchOverdue(2*time.Hour, 10)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if len(payments) != 1 || payments[0].Status != gopay.PENDING_DEPOSIT {
+		t.Errorf("Expected the overdue payment, but got %v", payments)
+	}
+	if len(args) != 5 || args[0].Value != "7200000 milliseconds" || args[4].Value != int64(10) {
+		t.Errorf("Unexpected query arguments %v", args)
+	}
+
+	setupFakeDB(t, func(query string, a []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		if strings.Contains(query, "::interval AND status NOT IN") {
+			return nil, nil, errors.New("connection reset")
+		}
+		return nil, nil, nil
+	})
+	if _, err := gopay.FetchOverdue(2*time.Hour, 10); gopay.ErrorCodeOf(err) != gopay.ErrCodeDB {
+		t.Errorf("Expected a database error, but got %v", err)
+	}
+
+	stale := time.Now().Add(-3 * time.Hour)
+	cases := []struct {
+		name    string
+		payment gopay.Payment
+		overdue bool
+	}{
+		{"stale pending", gopay.Payment{Status: gopay.PENDING_DEPOSIT, UpdatedAt: stale}, true},
+		{"stale deposited", gopay.Payment{Status: gopay.DEPOSITED, UpdatedAt: stale}, true},
+		{"recent pending", gopay.Payment{Status: gopay.PENDING_DEPOSIT, UpdatedAt: time.Now()}, false},
+		{"stale paid out", gopay.Payment{Status: gopay.PAID_OUT, UpdatedAt: stale}, false},
+	}
+	for _, c := range cases {
+		if got := c.payment.IsOverdue(2 * time.Hour); got != c.overdue {
+			t.Errorf("%s: expected overdue %v, but got %v", c.name, c.overdue, got)
+		}
+	}
+}
+
+func TestFetchByDateRangeAndUpdatedSince(t *testing.T) {
+	first, second := uuid.New(), uuid.New()
+	var pageQuery string
+	var pageArgs []driver.NamedValue
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		switch {
+		case strings.Contains(query, "SELECT COUNT(*) FROM payments"):
+			return []string{"count"}, [][]driver.Value{{int64(5)}}, nil
+		case strings.Contains(query, "SELECT * FROM payments"):
+			pageQuery, pageArgs = query, args
+			return []string{"id"}, [][]driver.Value{{second.String()}, {first.String()}}, nil
+		case strings.Contains(query, "SELECT * FROM payment_identities WHERE payment_id IN"):
+			return []string{"payment_id", "role_name"}, [][]driver.Value{{first.String(), "seller"}}, nil
+		case strings.Contains(query, "SELECT * FROM transactions WHERE payment_id IN"):
+			return []string{"payment_id", "tx_id"}, [][]driver.Value{{second.String(), "pi_1"}, {second.String(), "pi_2"}}, nil
+		}
+		return nil, nil, nil
+	})
+
+	from, to := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)
+	payments, total, err := gopay.FetchByDateRange(from, to, 2, 2)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if total != 5 || len(payments) != 2 || payments[0].ID != second || payments[1].ID != first {
+		t.Fatalf("Expected the second page of 5 payments, but got %d: %v", total, payments)
+	}
+	if len(payments[0].Transactions) != 2 || len(payments[0].Identities) != 0 {
+		t.Errorf("Expected the transactions to be attached to their payment, but got %v", payments[0])
+	}
+	if len(payments[1].Identities) != 1 || payments[1].Identities[0].RoleName != "seller" || len(payments[1].Transactions) != 0 {
+		t.Errorf("Expected the identity to be attached to its payment, but got %v", payments[1])
+	}
+	if !strings.Contains(pageQuery, "created_at >= $1 AND created_at < $2 ORDER BY created_at DESC LIMIT $3 OFFSET $4") ||
+		len(pageArgs) != 4 || pageArgs[0].Value != from || pageArgs[1].Value != to {
+		t.Errorf("Unexpected page query %q with %v", pageQuery, pageArgs)
+	}
+
+	since := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	if _, _, err := gopay.FetchUpdatedSince(since, 10, 0); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if !strings.Contains(pageQuery, "updated_at >= $1 ORDER BY created_at DESC LIMIT $2 OFFSET $3") ||
+		len(pageArgs) != 3 || pageArgs[0].Value != since || pageArgs[1].Value != int64(10) {
+		t.Errorf("Unexpected page query %q with %v", pageQuery, pageArgs)
+	}
+}
+
+func TestPaymentLimits(t *testing.T) {
+	var transactions int64
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		switch {
+		case strings.Contains(query, "INSERT INTO payment_identities"):
+			return []string{"role_name"}, [][]driver.Value{{args[2].Value}}, nil
+		case strings.Contains(query, "INSERT INTO transactions"):
+			// The insert counts the payment's transactions against its limit
+			if !strings.Contains(query, "(SELECT COUNT(*) FROM transactions WHERE payment_id=$1) < $10") || transactions >= args[9].Value.(int64) {
+				return nil, nil, nil
+			}
+			transactions++
+			return []string{"tx_id"}, [][]driver.Value{{args[2].Value}}, nil
+		}
+		return nil, nil, nil
+	}, gopay.WithMaxIdentitiesPerPayment(10), gopay.WithMaxTransactionsPerPayment(3))
+
+	p := &gopay.Payment{ID: uuid.New()}
+	for i := 0; i < 10; i++ {
+		if _, err := p.AddIdentity(gopay.IdentityParams{ID: uuid.New(), RoleName: "seller"}); err != nil {
+			t.Fatalf("Identity %d: expected no error, but got %v", i+1, err)
+		}
+	}
+	if _, err := p.AddIdentity(gopay.IdentityParams{ID: uuid.New(), RoleName: "seller"}); !errors.Is(err, gopay.ErrMaxIdentitiesReached) {
+		t.Errorf("Expected ErrMaxIdentitiesReached for the 11th identity, but got %v", err)
+	}
+	if len(p.Identities) != 10 {
+		t.Errorf("Expected 10 identities, but got %d", len(p.Identities))
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := (&gopay.Transaction{PaymentID: p.ID, TXID: fmt.Sprintf("tx_%d", i)}).Create(); err != nil {
+			t.Fatalf("Transaction %d: expected no error, but got %v", i+1, err)
+		}
+	}
+	if err := (&gopay.Transaction{PaymentID: p.ID, TXID: "tx_3"}).Create(); !errors.Is(err, gopay.ErrMaxTransactionsReached) {
+		t.Errorf("Expected ErrMaxTransactionsReached for the 4th transaction, but got %v", err)
+	}
+}
+
+func TestDispute(t *testing.T) {
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		switch {
+		case strings.Contains(query, "SET status = $1, meta=$2"):
+			return []string{"status", "meta"}, [][]driver.Value{{args[0].Value, args[1].Value}}, nil
+		case strings.Contains(query, "INSERT INTO payment_notes"):
+			return []string{"note", "created_by"}, [][]driver.Value{{args[1].Value, args[2].Value}}, nil
+		}
+		return nil, nil, nil
+	})
+
+	cases := []struct {
+		name   string
+		status gopay.PaymentStatus
+		won    bool
+		want   gopay.PaymentStatus
+		note   string
+	}{
+		{"won", gopay.PAID_OUT, true, gopay.PAID_OUT, "Dispute won: evidence accepted"},
+		{"won before payout", gopay.DEPOSITED, true, gopay.DEPOSITED, "Dispute won: evidence accepted"},
+		{"lost", gopay.PAID_OUT, false, gopay.REFUNDED, "Dispute lost: evidence accepted"},
+	}
+	for _, c := range cases {
+		p := &gopay.Payment{ID: uuid.New(), Status: c.status, Meta: types.JSONText(`{"order": "123"}`)}
+		if err := p.Dispute("ch_123", "fraudulent"); err != nil {
+			t.Fatalf("%s: expected no error, but got %v", c.name, err)
+		}
+		if p.Status != gopay.PAYMENT_DISPUTED || p.IsTerminal() {
+			t.Errorf("%s: expected a frozen, non-terminal payment, but got %s", c.name, p.Status)
+		}
+		var meta map[string]string
+		json.Unmarshal(p.Meta, &meta)
+		if meta["dispute_charge_id"] != "ch_123" || meta["dispute_reason"] != "fraudulent" || meta["order"] != "123" {
+			t.Errorf("%s: expected the dispute to be merged into meta, but got %s", c.name, p.Meta)
+		}
+		if err := p.Dispute("ch_123", "fraudulent"); gopay.ErrorCodeOf(err) != gopay.ErrCodeInvalidStatus {
+			t.Errorf("%s: expected a disputed payment not to be disputed again, but got %v", c.name, err)
+		}
+
+		if err := p.ResolveDispute(c.won, "evidence accepted"); err != nil {
+			t.Fatalf("%s: expected no error, but got %v", c.name, err)
+		}
+		if p.Status != c.want {
+			t.Errorf("%s: expected status %s, but got %s", c.name, c.want, p.Status)
+		}
+		if len(p.Notes) != 1 || p.Notes[0].Note != c.note {
+			t.Errorf("%s: expected note %q, but got %v", c.name, c.note, p.Notes)
+		}
+		if err := p.ResolveDispute(c.won, ""); gopay.ErrorCodeOf(err) != gopay.ErrCodeInvalidStatus {
+			t.Errorf("%s: expected a resolved dispute not to be resolved again, but got %v", c.name, err)
+		}
+	}
+
+	for _, status := range []gopay.PaymentStatus{gopay.INITIATED, gopay.ON_HOLD} {
+		if err := (&gopay.Payment{Status: status}).Dispute("ch_123", "fraudulent"); gopay.ErrorCodeOf(err) != gopay.ErrCodeInvalidStatus {
+			t.Errorf("Expected an uncharged %s payment not to be disputed, but got %v", status, err)
+		}
+	}
+}
+
+func TestHandleDispute(t *testing.T) {
+	var transactionStatus interface{}
+	var locks fakeAdvisoryLocks
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		if columns, rows, ok := locks.answer(query, args); ok {
+			return columns, rows, nil
+		}
+		switch {
+		case strings.Contains(query, "meta->'info'->>'tx_id'=$2"):
+			return []string{"tx_id", "meta"}, [][]driver.Value{{"pi_123", `{"info": {"tx_id": "pi_123", "charge_id": "ch_123"}}`}}, nil
+		case strings.Contains(query, "SET meta=$2, status=$3"):
+			transactionStatus = args[2].Value
+			return []string{"meta", "status"}, [][]driver.Value{{args[1].Value, args[2].Value}}, nil
+		case strings.Contains(query, "SET status = $1, meta=$2"):
+			return []string{"status", "meta"}, [][]driver.Value{{args[0].Value, args[1].Value}}, nil
+		case strings.Contains(query, "INSERT INTO payment_notes"):
+			return []string{"note", "created_by"}, [][]driver.Value{{args[1].Value, args[2].Value}}, nil
+		}
+		return nil, nil, nil
+	})
+
+	p := &gopay.Payment{ID: uuid.New(), Status: gopay.DEPOSITED}
+	if err := p.HandleDispute("pi_123", "fraudulent"); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if transactionStatus != string(gopay.DISPUTED) {
+		t.Errorf("Expected the transaction to be disputed, but got %v", transactionStatus)
+	}
+	if p.Status != gopay.PAYMENT_DISPUTED {
+		t.Errorf("Expected status DISPUTED, but got %s", p.Status)
+	}
+	var meta map[string]string
+	json.Unmarshal(p.Meta, &meta)
+	if meta["dispute_charge_id"] != "ch_123" || meta["dispute_reason"] != "fraudulent" {
+		t.Errorf("Expected the dispute of the charge to be recorded, but got %s", p.Meta)
+	}
+
+	// The chargeback goes through the same resolution as any dispute
+	if err := p.HandleDispute("pi_123", "fraudulent"); gopay.ErrorCodeOf(err) != gopay.ErrCodeInvalidStatus {
+		t.Errorf("Expected a disputed payment not to be disputed again, but got %v", err)
+	}
+	if err := p.ResolveDispute(true, ""); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if p.Status != gopay.DEPOSITED {
+		t.Errorf("Expected status DEPOSITED, but got %s", p.Status)
+	}
+}
+
+func TestHandleDisputeRestoresTransaction(t *testing.T) {
+	var transactionStatuses []interface{}
+	var locks fakeAdvisoryLocks
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		if columns, rows, ok := locks.answer(query, args); ok {
+			return columns, rows, nil
+		}
+		switch {
+		case strings.Contains(query, "meta->'info'->>'tx_id'=$2"):
+			return []string{"tx_id", "status", "meta"}, [][]driver.Value{{"pi_123", string(gopay.VERIFIED), `{"info": {"tx_id": "pi_123"}}`}}, nil
+		case strings.Contains(query, "SET meta=$2, status=$3"):
+			transactionStatuses = append(transactionStatuses, args[2].Value)
+			return []string{"meta", "status"}, [][]driver.Value{{args[1].Value, args[2].Value}}, nil
+		case strings.Contains(query, "SET status = $1, meta=$2"):
+			return nil, nil, errors.New("connection reset")
+		}
+		return nil, nil, nil
+	})
+
+	p := &gopay.Payment{ID: uuid.New(), Status: gopay.DEPOSITED}
+	if err := p.HandleDispute("pi_123", "fraudulent"); gopay.ErrorCodeOf(err) != gopay.ErrCodeDB {
+		t.Fatalf("Expected the payment update to fail, but got %v", err)
+	}
+	if p.Status != gopay.DEPOSITED {
+		t.Errorf("Expected status DEPOSITED, but got %s", p.Status)
+	}
+	if len(transactionStatuses) != 2 || transactionStatuses[0] != string(gopay.DISPUTED) || transactionStatuses[1] != string(gopay.VERIFIED) {
+		t.Errorf("Expected the transaction to be disputed then restored, but got %v", transactionStatuses)
+	}
+}
+
+func TestHandleDisputeLookup(t *testing.T) {
+	var lookups [][]driver.Value
+	var locks fakeAdvisoryLocks
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		if columns, rows, ok := locks.answer(query, args); ok {
+			return columns, rows, nil
+		}
+		switch {
+		case strings.Contains(query, "WHERE payment_id=$1 AND meta->'info'->>'tx_id'=$2"):
+			lookups = append(lookups, []driver.Value{args[0].Value, args[1].Value})
+			// Transactions recorded without info have a null meta
+			if args[1].Value == "pi_123" {
+				return []string{"tx_id", "meta"}, [][]driver.Value{{"pi_123", "null"}}, nil
+			}
+		case strings.Contains(query, "SET meta=$2, status=$3"):
+			return []string{"meta", "status"}, [][]driver.Value{{args[1].Value, args[2].Value}}, nil
+		case strings.Contains(query, "SET status = $1, meta=$2"):
+			return []string{"status", "meta"}, [][]driver.Value{{args[0].Value, args[1].Value}}, nil
+		}
+		return nil, nil, nil
+	})
+
+	p := &gopay.Payment{ID: uuid.New(), Status: gopay.DEPOSITED}
+	if err := p.HandleDispute("pi_unknown", "fraudulent"); gopay.ErrorCodeOf(err) != gopay.ErrCodeDB || p.Status != gopay.DEPOSITED {
+		t.Errorf("Expected a dispute of an unknown payment intent to fail, but got %v", err)
+	}
+	if err := p.HandleDispute("pi_123", "fraudulent"); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if p.Status != gopay.PAYMENT_DISPUTED {
+		t.Errorf("Expected status DISPUTED, but got %s", p.Status)
+	}
+
+	// The lookup is scoped to the payment and matches the payment intent stored in the transaction's info
+	if len(lookups) != 2 || lookups[1][0] != p.ID.String() || lookups[1][1] != "pi_123" {
+		t.Errorf("Expected lookups by payment and payment intent, but got %v", lookups)
+	}
+	var meta map[string]string
+	json.Unmarshal(p.Meta, &meta)
+	if meta["dispute_charge_id"] != "pi_123" {
+		t.Errorf("Expected the payment intent to stand for the unrecorded charge, but got %s", p.Meta)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	var canceledMeta []string
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		switch {
+		case strings.Contains(query, "pg_try_advisory_lock"):
+			return []string{"locked"}, [][]driver.Value{{true}}, nil
+		case strings.Contains(query, "WHERE payment_id=$1 AND type=$2 ORDER BY created_at"):
+			columns := []string{"tx_id", "meta", "verified_at", "canceled_at"}
+			return columns, [][]driver.Value{
+				{"0xWrong", `{"info": {}}`, time.Now(), nil},
+				{"0xCanceled", `{}`, nil, time.Now()},
+			}, nil
+		case strings.Contains(query, "canceled_at=NOW()"):
+			canceledMeta = append(canceledMeta, string(args[1].Value.([]byte)))
+			return []string{"tx_id", "meta", "canceled_at"}, [][]driver.Value{{"0xWrong", args[1].Value, time.Now()}}, nil
+		case strings.Contains(query, "transaction_status = NULL"):
+			return []string{"status", "transaction_status", "client_secret"}, [][]driver.Value{{args[0].Value, nil, nil}}, nil
+		}
+		return nil, nil, nil
+	})
+
+	for _, status := range []gopay.PaymentStatus{gopay.PAID_OUT, gopay.REFUNDED} {
+		if err := (&gopay.Payment{Status: status}).Rollback("test"); !errors.Is(err, gopay.ErrPaymentAlreadyProcessed) {
+			t.Errorf("%s: expected ErrPaymentAlreadyProcessed, but got %v", status, err)
+		}
+	}
+	if err := (&gopay.Payment{Status: gopay.PENDING_DEPOSIT}).Rollback("test"); gopay.ErrorCodeOf(err) != gopay.ErrCodeInvalidStatus {
+		t.Errorf("Expected only deposited payments to be rolled back, but got %v", err)
+	}
+	if err := (&gopay.Payment{Status: gopay.DEPOSITED, RefundedAmount: 10}).Rollback("test"); gopay.ErrorCodeOf(err) != gopay.ErrCodeInvalidStatus {
+		t.Errorf("Expected partially refunded payments not to be rolled back, but got %v", err)
+	}
+	if len(canceledMeta) != 0 {
+		t.Fatalf("Expected nothing to be canceled by rejected rollbacks, but got %v", canceledMeta)
+	}
+
+	verified := gopay.VERIFIED
+	secret := "pi_123_secret"
+	p := &gopay.Payment{Status: gopay.DEPOSITED, TransactionStatus: &verified, ClientSecret: &secret}
+	if err := p.Rollback("wrong transaction hash"); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if len(canceledMeta) != 1 || !strings.Contains(canceledMeta[0], `"rollback_reason":"wrong transaction hash"`) || !strings.Contains(canceledMeta[0], `"info"`) {
+		t.Errorf("Expected only the verified deposit to be canceled with the reason, but got %v", canceledMeta)
+	}
+	if p.Status != gopay.PENDING_DEPOSIT || p.TransactionStatus != nil || p.ClientSecret != nil {
+		t.Errorf("Expected the payment to be reset, but got %s %v %v", p.Status, p.TransactionStatus, p.ClientSecret)
+	}
+}
+
+func TestFeesAfterRollback(t *testing.T) {
+	type row struct {
+		id            string
+		fee, discount float64
+		canceledAt    interface{}
+	}
+	rows := []*row{{id: uuid.NewString(), fee: 3, discount: 1}}
+	columns := []string{"id", "type", "fee", "discount", "meta", "verified_at", "canceled_at"}
+	values := func() [][]driver.Value {
+		var values [][]driver.Value
+		for _, r := range rows {
+			values = append(values, []driver.Value{r.id, "DEPOSIT", r.fee, r.discount, `{}`, time.Now(), r.canceledAt})
+		}
+		return values
+	}
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		switch {
+		case strings.Contains(query, "pg_try_advisory_lock"):
+			return []string{"locked"}, [][]driver.Value{{true}}, nil
+		case strings.Contains(query, "SELECT * FROM payments WHERE id=$1"):
+			return []string{"id", "status", "total_amount"}, [][]driver.Value{{args[0].Value, "DEPOSITED", 100.0}}, nil
+		case strings.Contains(query, "SELECT * FROM transactions WHERE payment_id=$1"):
+			return columns, values(), nil
+		case strings.Contains(query, "canceled_at=NOW()"):
+			for _, r := range rows {
+				if r.id == args[0].Value {
+					r.canceledAt = time.Now()
+				}
+			}
+			return []string{"canceled_at"}, [][]driver.Value{{time.Now()}}, nil
+		case strings.Contains(query, "transaction_status = NULL"):
+			return []string{"status"}, [][]driver.Value{{args[0].Value}}, nil
+		}
+		return nil, nil, nil
+	})
+
+	p := &gopay.Payment{ID: uuid.New(), Status: gopay.DEPOSITED, TotalAmount: 100}
+	if err := p.Rollback("wrong transaction hash"); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	// The payment is deposited again once the correct transaction is submitted
+	rows = append(rows, &row{id: uuid.NewString(), fee: 2, discount: 0.5})
+	if err := p.Refresh(); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if len(p.Transactions) != 2 || p.Transactions[0].CanceledAt == nil || p.Transactions[0].VerfiedAt == nil {
+		t.Fatalf("Expected the rolled back and the new deposit, but got %+v", p.Transactions)
+	}
+	if p.TotalFees() != 2 || p.TotalDiscounts() != 0.5 || p.NetAmount() != 98 {
+		t.Errorf("Expected only the new deposit to count, but got %v fees, %v discounts and %v net", p.TotalFees(), p.TotalDiscounts(), p.NetAmount())
+	}
+}
+
+func TestPaymentHistoryRollback(t *testing.T) {
+	created := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	verified, canceled := created.Add(time.Minute), created.Add(time.Hour)
+	p := &gopay.Payment{
+		CreatedAt: created,
+		Transactions: []gopay.Transaction{{
+			TXID:       "0xWrong",
+			Type:       gopay.DEPOSIT,
+			Meta:       []byte(`{"rollback_reason": "test transaction"}`),
+			CreatedAt:  created,
+			VerfiedAt:  &verified,
+			CanceledAt: &canceled,
+		}},
+	}
+
+	events, err := p.History()
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	last := events[len(events)-1]
+	if last.EventType != gopay.EventRolledBack || !strings.Contains(last.Description, "test transaction") {
+		t.Errorf("Expected a rolled back event with the reason, but got %+v", last)
+	}
+}
+
+func TestStatusChangeHooks(t *testing.T) {
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/payment_methods":
+			w.Write([]byte(`{"object": "list", "url": "/v1/payment_methods", "has_more": false, "data": [{"id": "pm_123", "object": "payment_method", "type": "card"}]}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/payment_intents":
+			w.Write([]byte(`{"id": "pi_123", "object": "payment_intent", "amount": 100, "currency": "usd", "status": "succeeded"}`))
+		default:
+			t.Errorf("Unexpected request to %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	var (
+		changes  []string
+		created  []string
+		verified []string
+	)
+	token := gopay.CryptoToken{Name: "Ether", Symbol: "ETH", Address: "0xTokenAddress", Decimals: 18}
+	chains := gopay.Chains{{
+		Name:            "Ethereum",
+		Explorer:        "https://api.etherscan.io/api",
+		ContractAddress: "0xToAddress",
+		Type:            gopay.EVM,
+		Tokens:          []gopay.CryptoToken{token},
+		HTTPClient: &http.Client{Transport: &MockHTTPClient{
+			Response: &http.Response{StatusCode: http.StatusOK, Body: mockEtherscanResponseBody()},
+		}},
+	}}
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		switch {
+		case strings.Contains(query, "pg_try_advisory_lock"):
+			return []string{"locked"}, [][]driver.Value{{true}}, nil
+		case strings.Contains(query, "SELECT status FROM"):
+			return []string{"status"}, [][]driver.Value{{string(gopay.INITIATED)}}, nil
+		case strings.Contains(query, "INSERT INTO") && strings.Contains(query, "tx_id, tag"):
+			return []string{"tx_id"}, [][]driver.Value{{args[2].Value}}, nil
+		case strings.Contains(query, "verified_at=NOW()"):
+			return []string{"tx_id", "status"}, [][]driver.Value{{args[1].Value, args[3].Value}}, nil
+		case strings.Contains(query, "SET status=$2"):
+			return []string{"status"}, [][]driver.Value{{args[1].Value}}, nil
+		case strings.Contains(query, "client_secret = $4"):
+			return []string{"status"}, [][]driver.Value{{args[0].Value}}, nil
+		}
+		return nil, nil, nil
+	},
+		gopay.WithFiats(gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}),
+		gopay.WithChains(chains),
+		gopay.WithOnPaymentStatusChange(func(oldStatus, newStatus gopay.PaymentStatus, p *gopay.Payment) {
+			changes = append(changes, fmt.Sprintf("%s %s->%s", p.Type, oldStatus, newStatus))
+		}),
+		gopay.WithOnTransactionCreated(func(tx *gopay.Transaction) {
+			created = append(created, tx.TXID)
+		}),
+		gopay.WithOnTransactionVerified(func(tx *gopay.Transaction) {
+			verified = append(verified, tx.TXID)
+		}),
+	)
+
+	serviceName := "stripe"
+	fiat := &gopay.Payment{
+		TotalAmount:     1,
+		Currency:        gopay.USD,
+		Type:            gopay.FIAT,
+		Status:          gopay.INITIATED,
+		FiatServiceName: &serviceName,
+		Identities:      []gopay.PaymentIdentity{{AllocatedAmount: 1, Account: "cus_123"}},
+	}
+	if err := fiat.Deposit(); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	address := token.Address
+	crypto := &gopay.Payment{
+		TotalAmount:    1,
+		Type:           gopay.CRYPTO,
+		Status:         gopay.INITIATED,
+		CryptoCurrency: &address,
+		Identities:     []gopay.PaymentIdentity{{AllocatedAmount: 1}},
+	}
+	if err := crypto.ConfirmDeposit("0xTransactionHash", nil); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	expected := []string{"FIAT INITIATED->DEPOSITED", "CRYPTO INITIATED->DEPOSITED"}
+	if fmt.Sprint(changes) != fmt.Sprint(expected) {
+		t.Errorf("Expected status changes %v, but got %v", expected, changes)
+	}
+	if fmt.Sprint(created) != "[ 0xTransactionHash]" {
+		t.Errorf("Expected both deposits to be reported as created, but got %q", created)
+	}
+	if fmt.Sprint(verified) != "[pi_123 0xTransactionHash]" {
+		t.Errorf("Expected both deposits to be reported as verified, but got %q", verified)
+	}
+}
+
+func TestFetchTransactionByTXID(t *testing.T) {
+	var query string
+	setupFakeDB(t, func(q string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		if strings.Contains(q, "payment_id=$1 AND tx_id=$2") {
+			query = q
+			if args[1].Value == "0xTransactionHash" {
+				return []string{"tx_id", "status"}, [][]driver.Value{{"0xTransactionHash", string(gopay.VERIFIED)}}, nil
+			}
+		}
+		return nil, nil, nil
+	})
+
+	p := &gopay.Payment{ID: uuid.New()}
+	tx, err := p.FetchTransactionByTXID("0xTransactionHash")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if tx.TXID != "0xTransactionHash" || tx.Status == nil || *tx.Status != gopay.VERIFIED {
+		t.Errorf("Expected the verified transaction, but got %+v", tx)
+	}
+	if !strings.Contains(query, "ORDER BY canceled_at IS NOT NULL") {
+		t.Errorf("Expected transactions that have not been canceled to come first, but got %s", query)
+	}
+
+	if _, err := p.FetchTransactionByTXID("0xUnknownHash"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected sql.ErrNoRows, but got %v", err)
+	}
+}
+
+func TestConfirmDepositRetryAfterCancel(t *testing.T) {
+	token := gopay.CryptoToken{Name: "Ether", Symbol: "ETH", Address: "0xTokenAddress", Decimals: 18}
+	chains := gopay.Chains{{
+		Name:            "Ethereum",
+		Explorer:        "https://api.etherscan.io/api",
+		ContractAddress: "0xToAddress",
+		Type:            gopay.EVM,
+		Tokens:          []gopay.CryptoToken{token},
+		HTTPClient: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Body: mockEtherscanResponseBody()}, nil
+		})},
+	}}
+
+	// Enforce the unique index on the transaction IDs of the transactions that have not been canceled
+	type row struct {
+		id       string
+		txID     string
+		canceled bool
+	}
+	var rows []*row
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		switch {
+		case strings.Contains(query, "pg_try_advisory_lock"):
+			return []string{"locked"}, [][]driver.Value{{true}}, nil
+		case strings.Contains(query, "INSERT INTO") && strings.Contains(query, "tx_id, tag"):
+			for _, r := range rows {
+				if r.txID == args[2].Value && !r.canceled {
+					return nil, nil, errors.New(`duplicate key value violates unique constraint "transactions_payment_txid_idx"`)
+				}
+			}
+			r := &row{id: uuid.NewString(), txID: fmt.Sprint(args[2].Value)}
+			rows = append(rows, r)
+			return []string{"id", "tx_id"}, [][]driver.Value{{r.id, r.txID}}, nil
+		case strings.Contains(query, "canceled_at=NOW()"):
+			for _, r := range rows {
+				if r.id == args[0].Value {
+					r.canceled = true
+				}
+			}
+			return []string{"id", "status"}, [][]driver.Value{{args[0].Value, args[2].Value}}, nil
+		case strings.Contains(query, "verified_at=NOW()"):
+			return []string{"tx_id", "status"}, [][]driver.Value{{args[1].Value, args[3].Value}}, nil
+		case strings.Contains(query, "SET status=$2"):
+			return []string{"status"}, [][]driver.Value{{args[1].Value}}, nil
+		case strings.Contains(query, "client_secret = $4"):
+			return []string{"status"}, [][]driver.Value{{args[0].Value}}, nil
+		}
+		return nil, nil, nil
+	}, gopay.WithChains(chains))
+
+	address := token.Address
+	p := &gopay.Payment{
+		TotalAmount:    1,
+		Type:           gopay.CRYPTO,
+		Status:         gopay.INITIATED,
+		CryptoCurrency: &address,
+		Identities:     []gopay.PaymentIdentity{{AllocatedAmount: 1}},
+	}
+	// The first attempt gives up before the transfer is confirmed
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := p.ConfirmDepositCtx(ctx, "0xTransactionHash", nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the first attempt to be canceled, but got %v", err)
+	}
+	if len(rows) != 1 || !rows[0].canceled {
+		t.Fatalf("Expected the failed attempt's transaction to be canceled, but got %+v", rows)
+	}
+
+	if err := p.ConfirmDeposit("0xTransactionHash", nil); err != nil {
+		t.Fatalf("Expected the retry with the same hash to succeed, but got %v", err)
+	}
+	if len(rows) != 2 || rows[1].canceled {
+		t.Errorf("Expected a new transaction for the retry, but got %+v", rows)
+	}
+	if p.Status != gopay.DEPOSITED {
+		t.Errorf("Expected status DEPOSITED, but got %s", p.Status)
+	}
+}
+
+func TestPartialRefund(t *testing.T) {
+	var (
+		refunds  []string
+		failNext bool
+	)
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/refunds" {
+			t.Errorf("Unexpected request to %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if failNext {
+			failNext = false
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": {"type": "invalid_request_error", "message": "charge already refunded"}}`))
+			return
+		}
+		refunds = append(refunds, r.Form.Get("amount"))
+		amount := r.Form.Get("amount")
+		w.Write([]byte(fmt.Sprintf(`{"id": "re_%d", "object": "refund", "amount": %s, "currency": "usd", "status": "succeeded"}`, len(refunds), amount)))
+	})
+
+	// Apply the guarded update of the refunded amount like the database would
+	var (
+		refunded float64
+		verified int
+		canceled int
+	)
+	const total = 100.0
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		switch {
+		case strings.Contains(query, "refunded_amount + $1 <= total_amount"):
+			amount := args[0].Value.(float64)
+			if refunded+amount > total {
+				return []string{"refunded_amount"}, nil, nil
+			}
+			refunded += amount
+			return []string{"refunded_amount"}, [][]driver.Value{{refunded}}, nil
+		case strings.Contains(query, "refunded_amount = refunded_amount - $1"):
+			refunded -= args[0].Value.(float64)
+			return []string{"refunded_amount"}, [][]driver.Value{{refunded}}, nil
+		case strings.Contains(query, "INSERT INTO") && strings.Contains(query, "tx_id, tag"):
+			return []string{"type"}, [][]driver.Value{{string(gopay.PARTIAL_REFUND)}}, nil
+		case strings.Contains(query, "verified_at=NOW()"):
+			verified++
+			return []string{"tx_id", "type"}, [][]driver.Value{{args[1].Value, string(gopay.PARTIAL_REFUND)}}, nil
+		case strings.Contains(query, "canceled_at=NOW()"):
+			canceled++
+			return []string{"status"}, [][]driver.Value{{args[2].Value}}, nil
+		}
+		return nil, nil, nil
+	}, gopay.WithFiats(gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}))
+
+	serviceName := "stripe"
+	now := time.Now()
+	p := &gopay.Payment{
+		ID:              uuid.New(),
+		TotalAmount:     total,
+		Currency:        gopay.USD,
+		Type:            gopay.FIAT,
+		Status:          gopay.DEPOSITED,
+		FiatServiceName: &serviceName,
+		Transactions: []gopay.Transaction{{
+			Type:      gopay.DEPOSIT,
+			TXID:      "pi_123",
+			Meta:      types.JSONText(`{"info": {"tx_id": "pi_123"}}`),
+			VerfiedAt: &now,
+		}},
+	}
+
+	if err := p.PartialRefund(150, "too much"); gopay.ErrorCodeOf(err) != gopay.ErrCodeValidation {
+		t.Errorf("Expected refunding more than the total to fail validation, but got %v", err)
+	}
+
+	// Several partial refunds add up to the total
+	for _, amount := range []float64{30, 50} {
+		if err := p.PartialRefund(amount, "damaged"); err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+	}
+	if p.RefundedAmount != 80 {
+		t.Errorf("Expected 80 to be refunded, but got %f", p.RefundedAmount)
+	}
+	if fmt.Sprint(refunds) != "[3000 5000]" {
+		t.Errorf("Expected refunds of 3000 and 5000 cents, but got %v", refunds)
+	}
+
+	// The guard refuses to exceed the total before anything is refunded
+	if err := p.PartialRefund(30, "damaged"); gopay.ErrorCodeOf(err) != gopay.ErrCodeValidation {
+		t.Errorf("Expected the over-refund to fail validation, but got %v", err)
+	}
+	if len(refunds) != 2 {
+		t.Errorf("Expected no refund to be made past the total, but got %v", refunds)
+	}
+
+	// A failed refund gives back its reservation
+	failNext = true
+	if err := p.PartialRefund(20, "damaged"); err == nil {
+		t.Fatal("Expected the refund to fail")
+	}
+	if refunded != 80 || p.RefundedAmount != 80 {
+		t.Errorf("Expected the failed refund to be released, but got %f refunded", refunded)
+	}
+	if canceled != 1 {
+		t.Errorf("Expected the failed refund's transaction to be canceled, but got %d", canceled)
+	}
+
+	if err := p.PartialRefund(20, "damaged"); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if refunded != total || verified != 3 {
+		t.Errorf("Expected the payment to be fully refunded by 3 refunds, but got %f by %d", refunded, verified)
+	}
+}
+
+func TestAuthorizeAndCapture(t *testing.T) {
+	var captureMethod, capturedAmount string
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/payment_methods":
+			w.Write([]byte(`{"object": "list", "url": "/v1/payment_methods", "has_more": false, "data": [{"id": "pm_123", "object": "payment_method", "type": "card"}]}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/payment_intents":
+			captureMethod = r.Form.Get("capture_method")
+			w.Write([]byte(`{"id": "pi_123", "object": "payment_intent", "amount": 10000, "currency": "usd", "status": "requires_capture"}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/payment_intents/pi_123/capture":
+			capturedAmount = r.Form.Get("amount_to_capture")
+			w.Write([]byte(`{"id": "pi_123", "object": "payment_intent", "amount": 10000, "amount_received": 8000, "currency": "usd", "status": "succeeded"}`))
+		default:
+			t.Errorf("Unexpected request to %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	var verifiedMeta string
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		switch {
+		case strings.Contains(query, "pg_try_advisory_lock"):
+			return []string{"locked"}, [][]driver.Value{{true}}, nil
+		case strings.Contains(query, "INSERT INTO") && strings.Contains(query, "tx_id, tag"):
+			return []string{"tx_id"}, [][]driver.Value{{""}}, nil
+		case strings.Contains(query, "SET tx_id=$2, meta=$3 WHERE"):
+			return []string{"tx_id", "status"}, [][]driver.Value{{args[1].Value, string(gopay.PENDING)}}, nil
+		case strings.Contains(query, "ORDER BY created_at DESC LIMIT 1"):
+			return []string{"tx_id", "meta"}, [][]driver.Value{{"pi_123", `{"info": {"tx_id": "pi_123"}}`}}, nil
+		case strings.Contains(query, "verified_at=NOW()"):
+			verifiedMeta = string(args[2].Value.([]byte))
+			return []string{"tx_id", "status"}, [][]driver.Value{{args[1].Value, args[3].Value}}, nil
+		case strings.Contains(query, "SET status=$2"):
+			return []string{"status"}, [][]driver.Value{{args[1].Value}}, nil
+		case strings.Contains(query, "client_secret = $4"):
+			return []string{"status"}, [][]driver.Value{{args[0].Value}}, nil
+		}
+		return nil, nil, nil
+	}, gopay.WithFiats(gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}))
+
+	serviceName := "stripe"
+	p := &gopay.Payment{
+		TotalAmount:     100,
+		Currency:        gopay.USD,
+		Type:            gopay.FIAT,
+		Status:          gopay.INITIATED,
+		FiatServiceName: &serviceName,
+		Identities:      []gopay.PaymentIdentity{{AllocatedAmount: 100, Account: "cus_123"}},
+	}
+	if err := p.Capture(100); gopay.ErrorCodeOf(err) != gopay.ErrCodeInvalidStatus {
+		t.Errorf("Expected only authorized payments to be captured, but got %v", err)
+	}
+
+	if err := p.Authorize(); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if captureMethod != "manual" {
+		t.Errorf("Expected a manually captured payment intent, but got %q", captureMethod)
+	}
+	if p.Status != gopay.AUTHORIZED {
+		t.Errorf("Expected status AUTHORIZED, but got %s", p.Status)
+	}
+
+	if err := p.Capture(150); gopay.ErrorCodeOf(err) != gopay.ErrCodeValidation {
+		t.Errorf("Expected capturing more than the total amount to fail, but got %v", err)
+	}
+	if err := p.Capture(80); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if capturedAmount != "8000" {
+		t.Errorf("Expected 8000 cents to be captured, but got %q", capturedAmount)
+	}
+	if !strings.Contains(verifiedMeta, `"captured_amount":80`) {
+		t.Errorf("Expected the captured amount in the deposit metadata, but got %s", verifiedMeta)
+	}
+	if p.Status != gopay.DEPOSITED {
+		t.Errorf("Expected status DEPOSITED, but got %s", p.Status)
+	}
+}
+
+func TestAuthorizeWith3DSThenConfirmAndCapture(t *testing.T) {
+	var captured bool
+	testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/payment_methods":
+			w.Write([]byte(`{"object": "list", "url": "/v1/payment_methods", "has_more": false, "data": [{"id": "pm_123", "object": "payment_method", "type": "card"}]}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/payment_intents":
+			w.Write([]byte(`{"id": "pi_123", "object": "payment_intent", "amount": 10000, "currency": "usd", "status": "requires_action", "client_secret": "pi_123_secret"}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/payment_intents/pi_123":
+			w.Write([]byte(`{"id": "pi_123", "object": "payment_intent", "amount": 10000, "currency": "usd", "status": "requires_capture"}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/payment_intents/pi_123/capture":
+			captured = true
+			w.Write([]byte(`{"id": "pi_123", "object": "payment_intent", "amount": 10000, "amount_received": 10000, "currency": "usd", "status": "succeeded"}`))
+		default:
+			t.Errorf("Unexpected request to %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	var transactionStatuses []string
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		switch {
+		case strings.Contains(query, "pg_try_advisory_lock"):
+			return []string{"locked"}, [][]driver.Value{{true}}, nil
+		case strings.Contains(query, "INSERT INTO") && strings.Contains(query, "tx_id, tag"):
+			return []string{"tx_id"}, [][]driver.Value{{""}}, nil
+		case strings.Contains(query, "SET tx_id=$2, meta=$3, status=$4 WHERE"):
+			transactionStatuses = append(transactionStatuses, fmt.Sprint(args[3].Value))
+			return []string{"tx_id", "status"}, [][]driver.Value{{args[1].Value, args[3].Value}}, nil
+		case strings.Contains(query, "SET tx_id=$2, meta=$3 WHERE"):
+			return []string{"tx_id", "status"}, [][]driver.Value{{args[1].Value, string(gopay.PENDING)}}, nil
+		case strings.Contains(query, "payment_id=$1 AND tx_id=$2"):
+			return []string{"tx_id", "status"}, [][]driver.Value{{"pi_123", string(gopay.ACTION_REQUIRED)}}, nil
+		case strings.Contains(query, "ORDER BY created_at DESC LIMIT 1"):
+			return []string{"tx_id", "status"}, [][]driver.Value{{"pi_123", string(gopay.PENDING)}}, nil
+		case strings.Contains(query, "verified_at=NOW()"):
+			transactionStatuses = append(transactionStatuses, fmt.Sprint(args[3].Value))
+			return []string{"tx_id", "status"}, [][]driver.Value{{args[1].Value, args[3].Value}}, nil
+		case strings.Contains(query, "SET status=$2"):
+			transactionStatuses = append(transactionStatuses, fmt.Sprint(args[1].Value))
+			return []string{"status"}, [][]driver.Value{{args[1].Value}}, nil
+		case strings.Contains(query, "client_secret = $4"):
+			return []string{"status"}, [][]driver.Value{{args[0].Value}}, nil
+		}
+		return nil, nil, nil
+	}, gopay.WithFiats(gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}))
+
+	serviceName := "stripe"
+	p := &gopay.Payment{
+		TotalAmount:     100,
+		Currency:        gopay.USD,
+		Type:            gopay.FIAT,
+		Status:          gopay.INITIATED,
+		FiatServiceName: &serviceName,
+		Identities:      []gopay.PaymentIdentity{{AllocatedAmount: 100, Account: "cus_123"}},
+	}
+
+	// The payer has to authenticate before the funds are held
+	if err := p.Authorize(); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if p.Status != gopay.ON_HOLD {
+		t.Fatalf("Expected status ON_HOLD, but got %s", p.Status)
+	}
+	if p.ClientSecret == nil || *p.ClientSecret != "pi_123_secret" {
+		t.Errorf("Expected the client secret to be set, but got %v", p.ClientSecret)
+	}
+
+	// Once authenticated, the payment intent awaits capture
+	if err := p.ConfirmPayment("pi_123"); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if p.Status != gopay.AUTHORIZED {
+		t.Fatalf("Expected status AUTHORIZED, but got %s", p.Status)
+	}
+	if p.TransactionStatus == nil || *p.TransactionStatus != gopay.PENDING {
+		t.Errorf("Expected the transaction to be pending until captured, but got %v", p.TransactionStatus)
+	}
+	if captured {
+		t.Error("Expected the payment not to be captured on confirmation")
+	}
+
+	if err := p.Capture(100); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if !captured {
+		t.Error("Expected the payment intent to be captured")
+	}
+	if p.Status != gopay.DEPOSITED {
+		t.Errorf("Expected status DEPOSITED, but got %s", p.Status)
+	}
+
+	expected := fmt.Sprint([]gopay.TransactionStatus{gopay.PENDING, gopay.ACTION_REQUIRED, gopay.PENDING, gopay.VERIFIED})
+	if fmt.Sprint(transactionStatuses) != expected {
+		t.Errorf("Expected transaction statuses %s, but got %s", expected, transactionStatuses)
+	}
+}
+
+func TestDepositTransactionStatuses(t *testing.T) {
+	cases := []struct {
+		name     string
+		intent   string // Stripe's answer to creating the payment intent
+		fails    bool
+		status   gopay.PaymentStatus
+		expected []gopay.TransactionStatus
+	}{
+		{"succeeded", `{"id": "pi_123", "object": "payment_intent", "amount": 10000, "currency": "usd", "status": "succeeded"}`,
+			false, gopay.DEPOSITED, []gopay.TransactionStatus{gopay.PENDING, gopay.VERIFIED}},
+		{"requires payment method", `{"id": "pi_123", "object": "payment_intent", "amount": 10000, "currency": "usd", "status": "requires_payment_method"}`,
+			true, gopay.INITIATED, []gopay.TransactionStatus{gopay.PENDING, gopay.CANCELED}},
+	}
+	for _, c := range cases {
+		testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Method == http.MethodGet && r.URL.Path == "/v1/payment_methods":
+				w.Write([]byte(`{"object": "list", "url": "/v1/payment_methods", "has_more": false, "data": [{"id": "pm_123", "object": "payment_method", "type": "card"}]}`))
+			case r.Method == http.MethodPost && r.URL.Path == "/v1/payment_intents":
+				w.Write([]byte(c.intent))
+			default:
+				t.Errorf("%s: unexpected request to %s %s", c.name, r.Method, r.URL.Path)
+				w.WriteHeader(http.StatusNotFound)
+			}
+		})
+
+		var statuses []gopay.TransactionStatus
+		setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+			switch {
+			case strings.Contains(query, "pg_try_advisory_lock"):
+				return []string{"locked"}, [][]driver.Value{{true}}, nil
+			case strings.Contains(query, "INSERT INTO") && strings.Contains(query, "tx_id, tag"):
+				// Transactions are created without a status of their own
+				return []string{"tx_id"}, [][]driver.Value{{""}}, nil
+			case strings.Contains(query, "SET status=$2 WHERE"):
+				statuses = append(statuses, gopay.TransactionStatus(fmt.Sprint(args[1].Value)))
+				return []string{"status"}, [][]driver.Value{{args[1].Value}}, nil
+			case strings.Contains(query, "verified_at=NOW()"):
+				statuses = append(statuses, gopay.TransactionStatus(fmt.Sprint(args[3].Value)))
+				return []string{"tx_id", "status"}, [][]driver.Value{{args[1].Value, args[3].Value}}, nil
+			case strings.Contains(query, "canceled_at=NOW()"):
+				statuses = append(statuses, gopay.TransactionStatus(fmt.Sprint(args[2].Value)))
+				return []string{"status"}, [][]driver.Value{{args[2].Value}}, nil
+			case strings.Contains(query, "client_secret = $4"):
+				return []string{"status"}, [][]driver.Value{{args[0].Value}}, nil
+			}
+			return nil, nil, nil
+		}, gopay.WithFiats(gopay.Fiats{{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}}))
+
+		serviceName := "stripe"
+		p := &gopay.Payment{
+			TotalAmount:     100,
+			Currency:        gopay.USD,
+			Type:            gopay.FIAT,
+			Status:          gopay.INITIATED,
+			FiatServiceName: &serviceName,
+			Identities:      []gopay.PaymentIdentity{{AllocatedAmount: 100, Account: "cus_123"}},
+		}
+		if err := p.Deposit(); (err != nil) != c.fails {
+			t.Fatalf("%s: expected failure %v, but got %v", c.name, c.fails, err)
+		}
+		if p.Status != c.status {
+			t.Errorf("%s: expected status %s, but got %s", c.name, c.status, p.Status)
+		}
+		if fmt.Sprint(statuses) != fmt.Sprint(c.expected) {
+			t.Errorf("%s: expected transaction statuses %v, but got %v", c.name, c.expected, statuses)
+		}
+	}
+}
+
+func TestLockIsNotReentrant(t *testing.T) {
+	var locks fakeAdvisoryLocks
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		columns, rows, _ := locks.answer(query, args)
+		return columns, rows, nil
+	})
+
+	p := &gopay.Payment{ID: uuid.New()}
+	if err := p.Lock(); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if err := p.Lock(); !errors.Is(err, gopay.ErrPaymentLocked) {
+		t.Errorf("Expected a locked payment not to be locked again, but got %v", err)
+	}
+	if err := p.WithLock(func() error { return nil }); !errors.Is(err, gopay.ErrPaymentLocked) {
+		t.Errorf("Expected WithLock not to join a lock acquired by Lock, but got %v", err)
+	}
+	if err := (&gopay.Payment{ID: p.ID}).Lock(); !errors.Is(err, gopay.ErrPaymentLocked) {
+		t.Errorf("Expected another payment value not to acquire the lock, but got %v", err)
+	}
+	if err := p.Unlock(); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if err := p.Unlock(); gopay.ErrorCodeOf(err) != gopay.ErrCodeInvalidStatus {
+		t.Errorf("Expected an unlocked payment not to be unlocked again, but got %v", err)
+	}
+}
+
+func TestLockMutualExclusion(t *testing.T) {
+	var locks fakeAdvisoryLocks
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		columns, rows, _ := locks.answer(query, args)
+		return columns, rows, nil
+	})
+
+	// Goroutines either share a payment or hold their own value of it, locking it with WithLock or Lock
+	id := uuid.New()
+	shared := &gopay.Payment{ID: id}
+	var (
+		wg      sync.WaitGroup
+		inside  atomic.Int32
+		overlap atomic.Bool
+		runs    atomic.Int32
+	)
+	critical := func() error {
+		if inside.Add(1) > 1 {
+			overlap.Store(true)
+		}
+		time.Sleep(time.Millisecond)
+		inside.Add(-1)
+		runs.Add(1)
+		return nil
+	}
+	for i := 0; i < 8; i++ {
+		p := shared
+		if i%2 == 1 {
+			p = &gopay.Payment{ID: id}
+		}
+		withLock := i%4 < 2
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				var err error
+				if withLock {
+					err = p.WithLock(critical)
+				} else if err = p.Lock(); err == nil {
+					critical()
+					err = p.Unlock()
+				}
+				if !errors.Is(err, gopay.ErrPaymentLocked) {
+					if err != nil {
+						t.Errorf("Expected no error, but got %v", err)
+					}
+					return
+				}
+				runtime.Gosched()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if overlap.Load() {
+		t.Error("Expected the lock to be held by one goroutine at a time")
+	}
+	if runs.Load() != 8 {
+		t.Errorf("Expected every goroutine to acquire the lock once, but got %d", runs.Load())
+	}
+}
+
+func TestWithPaymentLock(t *testing.T) {
+	var locks fakeAdvisoryLocks
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		if columns, rows, ok := locks.answer(query, args); ok {
+			return columns, rows, nil
+		}
+		if strings.Contains(query, "SELECT * FROM payments WHERE id=$1") {
+			return []string{"id", "status"}, [][]driver.Value{{args[0].Value, string(gopay.DEPOSITED)}}, nil
+		}
+		return nil, nil, nil
+	})
+
+	id := uuid.New()
+	var nested bool
+	err := gopay.WithPaymentLock(id, func(p *gopay.Payment) error {
+		if p.Status != gopay.DEPOSITED {
+			t.Errorf("Expected the payment to be loaded, but got status %s", p.Status)
+		}
+		// The payment's methods run within the lock held for fn
+		if err := p.WithLock(func() error {
+			nested = true
+			return nil
+		}); err != nil {
+			t.Errorf("Expected WithLock to join the lock, but got %v", err)
+		}
+		if err := (&gopay.Payment{ID: id}).WithLock(func() error { return nil }); !errors.Is(err, gopay.ErrPaymentLocked) {
+			t.Errorf("Expected other payment values to be locked out, but got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if !nested {
+		t.Error("Expected the nested WithLock to run")
+	}
+
+	// The lock is released once fn returns, even if it fails
+	fnErr := errors.New("failed")
+	if err := gopay.WithPaymentLock(id, func(*gopay.Payment) error { return fnErr }); !errors.Is(err, fnErr) {
+		t.Errorf("Expected the error of fn, but got %v", err)
+	}
+	if err := (&gopay.Payment{ID: id}).WithLock(func() error { return nil }); err != nil {
+		t.Errorf("Expected the lock to be released, but got %v", err)
+	}
+}
+
+func TestFetchInTx(t *testing.T) {
+	var (
+		xactLocked   = true
+		paymentQuery string
+		sessionLocks int
+	)
+	db := setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		switch {
+		case strings.Contains(query, "pg_try_advisory_xact_lock"):
+			return []string{"locked"}, [][]driver.Value{{xactLocked}}, nil
+		case strings.Contains(query, "pg_try_advisory_lock"):
+			sessionLocks++
+			return []string{"locked"}, [][]driver.Value{{true}}, nil
+		case strings.Contains(query, "FROM payments WHERE id=$1"):
+			paymentQuery = query
+			return []string{"id", "status"}, [][]driver.Value{{args[0].Value, string(gopay.DEPOSITED)}}, nil
+		case strings.Contains(query, "FROM payment_identities WHERE payment_id=$1"):
+			return []string{"account"}, [][]driver.Value{{"cus_123"}}, nil
+		}
+		return nil, nil, nil
+	})
+
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	defer tx.Rollback()
+
+	id := uuid.New()
+	p, err := gopay.FetchInTx(tx, id)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if p.ID != id || p.Status != gopay.DEPOSITED || len(p.Identities) != 1 {
+		t.Errorf("Expected the payment with its identities, but got %+v", p)
+	}
+	// A row lock would block the payment's methods, which write through other connections
+	if strings.Contains(paymentQuery, "FOR UPDATE") {
+		t.Errorf("Expected the payment not to be locked by row, but got %s", paymentQuery)
+	}
+
+	// The payment's methods run within the lock held by the transaction
+	if err := p.WithLock(func() error { return nil }); err != nil {
+		t.Errorf("Expected WithLock to join the transaction's lock, but got %v", err)
+	}
+	if sessionLocks != 0 {
+		t.Errorf("Expected no other lock to be acquired, but got %d", sessionLocks)
+	}
+	if err := p.Lock(); !errors.Is(err, gopay.ErrPaymentLocked) {
+		t.Errorf("Expected Lock to report the transaction's lock, but got %v", err)
+	}
+
+	xactLocked = false
+	if _, err := gopay.FetchInTx(tx, id); !errors.Is(err, gopay.ErrPaymentLocked) {
+		t.Errorf("Expected ErrPaymentLocked, but got %v", err)
+	}
+
+	// The transaction's lock is released once it ends, so the payment's methods lock it again
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if err := p.WithLock(func() error { return nil }); err != nil || sessionLocks != 1 {
+		t.Errorf("Expected WithLock to acquire the lock after the transaction ended, but got %v with %d locks", err, sessionLocks)
+	}
+	if err := p.Lock(); err != nil {
+		t.Fatalf("Expected the payment to be lockable after the transaction ended, but got %v", err)
+	}
+	if err := p.Unlock(); err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package testutil
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/socious-io/gopay"
+)
+
+// QueryFunc answers a statement sent to a mock database with the columns and rows of its result.
+// Returning no columns yields an empty result, e.g., for migrations.
+type QueryFunc func(query string, args []driver.NamedValue) (columns []string, rows [][]driver.Value, err error)
+
+// MockDB is a database whose statements are answered by a QueryFunc instead of a Postgres server.
+type MockDB struct {
+	*sqlx.DB
+
+	mu        sync.Mutex
+	committed []string
+}
+
+// Committed returns the statements run outside of a transaction or in a committed one, in order.
+// Statements that failed or whose transaction was rolled back are left out.
+func (db *MockDB) Committed() []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([]string(nil), db.committed...)
+}
+
+var mockDBCount atomic.Int64
+
+// NewMockDB returns a database answering every statement through query. Transactions only affect which
+// statements are reported by Committed. The database is closed when the test ends.
+func NewMockDB(t testing.TB, query QueryFunc) *MockDB {
+	t.Helper()
+
+	db := new(MockDB)
+	name := fmt.Sprintf("gopay-mock-%d", mockDBCount.Add(1))
+	sql.Register(name, &mockDriver{db: db, query: query})
+	db.DB = sqlx.MustOpen(name, "")
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// SetupMockDB sets gopay up with a database answering every statement through query, applying the given
+// options on top. It returns the database, e.g., to begin transactions.
+func SetupMockDB(t testing.TB, query QueryFunc, opts ...gopay.Option) *MockDB {
+	t.Helper()
+
+	db := NewMockDB(t, query)
+	if err := gopay.Setup(append([]gopay.Option{gopay.WithDB(db.DB)}, opts...)...); err != nil {
+		t.Fatalf("Failed to set up the mock database: %v", err)
+	}
+	return db
+}
+
+// mockDriver is a database/sql driver answering every statement through its QueryFunc.
+type mockDriver struct {
+	db    *MockDB
+	query QueryFunc
+}
+
+func (d *mockDriver) Open(string) (driver.Conn, error) {
+	return &mockConn{driver: d}, nil
+}
+
+// mockConn runs the statements of a mockDriver, keeping those of the current transaction until it is committed.
+type mockConn struct {
+	driver  *mockDriver
+	pending []string
+	inTx    bool
+}
+
+func (c *mockConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements are not supported")
+}
+
+func (c *mockConn) Close() error { return nil }
+
+func (c *mockConn) Begin() (driver.Tx, error) {
+	c.inTx = true
+	return c, nil
+}
+
+func (c *mockConn) Commit() error {
+	c.driver.db.mu.Lock()
+	defer c.driver.db.mu.Unlock()
+	c.driver.db.committed = append(c.driver.db.committed, c.pending...)
+	c.pending, c.inTx = nil, false
+	return nil
+}
+
+func (c *mockConn) Rollback() error {
+	c.pending, c.inTx = nil, false
+	return nil
+}
+
+// run answers the statement and records it once it has succeeded.
+func (c *mockConn) run(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+	columns, rows, err := c.driver.query(query, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.inTx {
+		c.pending = append(c.pending, query)
+	} else {
+		c.driver.db.mu.Lock()
+		c.driver.db.committed = append(c.driver.db.committed, query)
+		c.driver.db.mu.Unlock()
+	}
+	return columns, rows, nil
+}
+
+func (c *mockConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if _, _, err := c.run(query, args); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c *mockConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	columns, rows, err := c.run(query, args)
+	if err != nil {
+		return nil, err
+	}
+	// Like a real database, always count a row, so tests only answer the counts they care about
+	if columns == nil && strings.HasPrefix(strings.TrimSpace(query), "SELECT COUNT(*)") {
+		return &mockRows{columns: []string{"count"}, rows: [][]driver.Value{{int64(0)}}}, nil
+	}
+	return &mockRows{columns: columns, rows: rows}, nil
+}
+
+// mockRows is the result set of a QueryFunc.
+type mockRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *mockRows) Columns() []string { return r.columns }
+func (r *mockRows) Close() error      { return nil }
+
+func (r *mockRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
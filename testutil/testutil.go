@@ -0,0 +1,93 @@
+// Package testutil provides helpers for testing code built on top of gopay without reaching
+// a real database, block explorers or payment providers.
+package testutil
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/socious-io/gopay"
+	"github.com/stripe/stripe-go/v81"
+)
+
+// MockContractAddress is the contract address used by chains created with NewMockChain.
+const MockContractAddress = "0x0000000000000000000000000000000000000001"
+
+// NewMockChain returns an EVM chain whose explorer is a local server listing the given token transfers.
+// Transfers without a contract address or recipient are filled in with the chain's contract address,
+// so they pass the recipient check done on deposit confirmation, and transfers without confirmations
+// are reported as confirmed. The server is closed when the test ends.
+func NewMockChain(t testing.TB, token gopay.CryptoToken, transfers ...gopay.EvmTokenTransferResponse) gopay.Chain {
+	t.Helper()
+
+	for i := range transfers {
+		if transfers[i].ContractAddress == "" {
+			transfers[i].ContractAddress = token.Address
+		}
+		if transfers[i].To == "" {
+			transfers[i].To = MockContractAddress
+		}
+		if transfers[i].Confirmations == "" {
+			transfers[i].Confirmations = "12"
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := transfers
+		// Serve direct lookups with the matching transfer only
+		if txHash := r.URL.Query().Get("txhash"); txHash != "" {
+			result = nil
+			for _, transfer := range transfers {
+				if strings.EqualFold(transfer.Hash, txHash) {
+					result = append(result, transfer)
+				}
+			}
+		}
+
+		response := map[string]interface{}{"status": "1", "message": "OK", "result": result}
+		if len(result) == 0 {
+			response = map[string]interface{}{"status": "0", "message": "No transactions found", "result": []interface{}{}}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}))
+	t.Cleanup(server.Close)
+
+	return gopay.Chain{
+		Name:            "mock",
+		Explorer:        server.URL,
+		ContractAddress: MockContractAddress,
+		Tokens:          []gopay.CryptoToken{token},
+		Type:            gopay.EVM,
+		Mode:            gopay.TESTNET,
+		ApiKey:          "mock",
+		HTTPClient:      server.Client(),
+	}
+}
+
+// NewMockFiat returns a Stripe fiat service whose API calls are served by the given handler.
+// The handler receives the raw Stripe API requests (e.g. POST /v1/payment_intents) and is expected to
+// answer with Stripe-shaped JSON. The default Stripe backend is restored when the test ends.
+func NewMockFiat(t testing.TB, handler http.HandlerFunc) gopay.Fiat {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	stripe.SetBackend(stripe.APIBackend, stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+		URL:               stripe.String(server.URL),
+		MaxNetworkRetries: stripe.Int64(0),
+		LeveledLogger:     &stripe.LeveledLogger{Level: stripe.LevelNull},
+	}))
+	t.Cleanup(func() {
+		stripe.SetBackend(stripe.APIBackend, nil)
+		server.Close()
+	})
+
+	return gopay.Fiat{
+		Name:    "MOCK_STRIPE",
+		ApiKey:  "sk_test_mock",
+		Service: gopay.STRIPE,
+	}
+}
@@ -0,0 +1,105 @@
+package testutil_test
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/socious-io/gopay"
+	"github.com/socious-io/gopay/testutil"
+)
+
+func TestNewMockChain(t *testing.T) {
+	token := gopay.CryptoToken{Name: "USD Coin", Symbol: "USDC", Address: "0xtoken", Decimals: 6}
+	chain := testutil.NewMockChain(t, token, gopay.EvmTokenTransferResponse{
+		Hash:         "0xabc",
+		From:         "0xsender",
+		Value:        "1500000",
+		TokenDecimal: "6",
+		TimeStamp:    "1700000000",
+	})
+
+	if err := chain.Validate(); err != nil {
+		t.Fatalf("Expected a valid chain, but got %v", err)
+	}
+
+	info, err := chain.GetTXInfo(context.Background(), "0xabc", token)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if info.TotalAmount != 1.5 {
+		t.Errorf("Expected amount 1.5, but got %v", info.TotalAmount)
+	}
+	if info.To != testutil.MockContractAddress {
+		t.Errorf("Expected recipient %s, but got %s", testutil.MockContractAddress, info.To)
+	}
+}
+
+func TestNewMockFiat(t *testing.T) {
+	fiat := testutil.NewMockFiat(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/customers" {
+			t.Errorf("Expected request to /v1/customers, but got %s", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "cus_mock", "object": "customer"}`))
+	})
+
+	customer, err := fiat.AddCustomer("jane@example.com")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if customer.ID != "cus_mock" {
+		t.Errorf("Expected customer cus_mock, but got %s", customer.ID)
+	}
+}
+
+func TestNewMockDB(t *testing.T) {
+	db := testutil.NewMockDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		if strings.Contains(query, "FAIL") {
+			return nil, nil, errors.New("syntax error")
+		}
+		return []string{"id"}, [][]driver.Value{{int64(1)}}, nil
+	})
+
+	var id int
+	if err := db.Get(&id, `SELECT id FROM payments`); err != nil || id != 1 {
+		t.Fatalf("Expected id 1, but got %d (%v)", id, err)
+	}
+	if _, err := db.Exec(`FAIL`); err == nil {
+		t.Error("Expected the failing statement to fail")
+	}
+
+	tx := db.MustBegin()
+	tx.MustExec(`UPDATE payments SET status='REFUNDED'`)
+	tx.Rollback()
+	tx = db.MustBegin()
+	tx.MustExec(`UPDATE payments SET status='PAID_OUT'`)
+	tx.Commit()
+
+	want := []string{`SELECT id FROM payments`, `UPDATE payments SET status='PAID_OUT'`}
+	if got := db.Committed(); len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Expected committed statements %v, but got %v", want, got)
+	}
+}
+
+func TestSetupMockDB(t *testing.T) {
+	testutil.SetupMockDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		if strings.Contains(query, "SELECT * FROM payments WHERE id=$1") {
+			return []string{"id", "status"}, [][]driver.Value{{args[0].Value, string(gopay.DEPOSITED)}}, nil
+		}
+		return nil, nil, nil
+	})
+
+	id := uuid.New()
+	p, err := gopay.Fetch(id)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if p.ID != id || p.Status != gopay.DEPOSITED {
+		t.Errorf("Expected deposited payment %s, but got %s %s", id, p.ID, p.Status)
+	}
+}
@@ -0,0 +1,33 @@
+package gopay
+
+import "strings"
+
+// Well-known tokens, ready to be used in a Chain's Tokens list.
+var (
+	USDCEthereum = CryptoToken{Name: "USD Coin", Symbol: "USDC", Address: "0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48", Decimals: 6}
+	USDTEthereum = CryptoToken{Name: "Tether USD", Symbol: "USDT", Address: "0xdAC17F958D2ee523a2206206994597C13D831ec7", Decimals: 6}
+	DAIEthereum  = CryptoToken{Name: "Dai Stablecoin", Symbol: "DAI", Address: "0x6B175474E89094C44Da98b954EedeAC495271d0F", Decimals: 18}
+	USDCPolygon  = CryptoToken{Name: "USD Coin", Symbol: "USDC", Address: "0x3c499c542cEF5E3811e1192ce70d8cC03d5c3359", Decimals: 6}
+	USDTTron     = CryptoToken{Name: "Tether USD", Symbol: "USDT", Address: "TR7NHqjeKQxGTCi8q8ZY4pL8otSzgjLj6t", Decimals: 6}
+
+	// NativeETH is Ether itself, which is not a token contract and is identified by NativeTokenAddress.
+	NativeETH = CryptoToken{Name: "Ether", Symbol: "ETH", Address: NativeTokenAddress, Decimals: 18}
+)
+
+// knownTokens maps chain names to the well-known tokens issued on them.
+var knownTokens = map[string][]CryptoToken{
+	"ETHEREUM": {USDCEthereum, USDTEthereum, DAIEthereum, NativeETH},
+	"POLYGON":  {USDCPolygon},
+	"TRON":     {USDTTron},
+}
+
+// KnownToken looks up a well-known token by its symbol on the given chain (e.g., "USDC" on "ethereum").
+// Both symbol and chain name are matched case-insensitively.
+func KnownToken(symbol, chainName string) (CryptoToken, bool) {
+	for _, t := range knownTokens[strings.ToUpper(chainName)] {
+		if strings.EqualFold(t.Symbol, symbol) {
+			return t, true
+		}
+	}
+	return CryptoToken{}, false
+}
@@ -0,0 +1,46 @@
+package gopay_test
+
+import (
+	"testing"
+
+	"github.com/socious-io/gopay"
+)
+
+func TestKnownTokens(t *testing.T) {
+	cases := []struct {
+		symbol   string
+		chain    string
+		address  string
+		decimals int
+	}{
+		{"USDC", "ethereum", "0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48", 6},
+		{"USDT", "Ethereum", "0xdAC17F958D2ee523a2206206994597C13D831ec7", 6},
+		{"dai", "ETHEREUM", "0x6B175474E89094C44Da98b954EedeAC495271d0F", 18},
+		{"ETH", "ethereum", gopay.NativeTokenAddress, 18},
+		{"USDC", "polygon", "0x3c499c542cEF5E3811e1192ce70d8cC03d5c3359", 6},
+		{"USDT", "tron", "TR7NHqjeKQxGTCi8q8ZY4pL8otSzgjLj6t", 6},
+	}
+
+	for _, c := range cases {
+		token, ok := gopay.KnownToken(c.symbol, c.chain)
+		if !ok {
+			t.Errorf("%s on %s: expected a known token, but found none", c.symbol, c.chain)
+			continue
+		}
+		if token.Address != c.address {
+			t.Errorf("%s on %s: expected address %s, but got %s", c.symbol, c.chain, c.address, token.Address)
+		}
+		if token.Decimals != c.decimals {
+			t.Errorf("%s on %s: expected %d decimals, but got %d", c.symbol, c.chain, c.decimals, token.Decimals)
+		}
+		if err := token.Validate(); err != nil {
+			t.Errorf("%s on %s: expected a valid token, but got %v", c.symbol, c.chain, err)
+		}
+	}
+
+	for _, c := range [][2]string{{"DAI", "polygon"}, {"USDC", "cardano"}, {"XYZ", "ethereum"}} {
+		if _, ok := gopay.KnownToken(c[0], c[1]); ok {
+			t.Errorf("%s on %s: expected no known token, but found one", c[0], c[1])
+		}
+	}
+}
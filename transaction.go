@@ -1,6 +1,9 @@
 package gopay
 
 import (
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
@@ -8,23 +11,30 @@ import (
 	"github.com/jmoiron/sqlx/types"
 )
 
+// ErrTransactionNotVerified is returned when correcting the fee or discount of a transaction that is not verified.
+var ErrTransactionNotVerified = &Error{Code: ErrCodeInvalidStatus, Message: "transaction is not verified"}
+
+// ErrMaxTransactionsReached is returned when creating a transaction for a payment that already has
+// Config.MaxTransactionsPerPayment transactions.
+var ErrMaxTransactionsReached = &Error{Code: ErrCodeValidation, Message: "payment has reached the maximum number of transactions"}
+
 // Transaction represents a financial transaction related to a payment.
 // It includes details about the transaction ID, amount, fees, discounts, and the associated payment and identity.
 type Transaction struct {
-	ID         uuid.UUID       `db:"id" json:"id"`                   // Unique transaction identifier
-	PaymentID  uuid.UUID       `db:"payment_id" json:"-"`            // Associated payment ID (hidden in JSON)
-	IdentityID uuid.UUID       `db:"identity_id" json:"identity_id"` // Associated identity ID
-	TXID       string          `db:"tx_id" json:"tx_id"`             // Transaction ID (e.g., blockchain TX ID)
-	Tag        string          `db:"tag" json:"tag"`                 // Tag associated with the transaction
-	Amount     float64         `db:"amount" json:"amount"`           // Transaction amount
-	Fee        float64         `db:"fee" json:"fee"`                 // Fee applied to the transaction
-	Discount   float64         `db:"discount" json:"discount"`       // Discount applied to the transaction
-	Status     *string         `db:"status" json:"status"`
-	Type       TransactionType `db:"type" json:"type"`               // Type of the transaction (e.g., deposit, withdrawal)
-	Meta       types.JSONText  `db:"meta" json:"meta"`               // Metadata associated with the transaction
-	CanceledAt *time.Time      `db:"canceled_at" json:"canceled_at"` // Cancellation timestamp, if applicable
-	VerfiedAt  *time.Time      `db:"verified_at" json:"verified_at"` // Verification timestamp
-	CreatedAt  time.Time       `db:"created_at" json:"created_at"`   // Transaction creation timestamp
+	ID         uuid.UUID          `db:"id" json:"id"`                   // Unique transaction identifier
+	PaymentID  uuid.UUID          `db:"payment_id" json:"-"`            // Associated payment ID (hidden in JSON)
+	IdentityID uuid.UUID          `db:"identity_id" json:"identity_id"` // Associated identity ID
+	TXID       string             `db:"tx_id" json:"tx_id"`             // Transaction ID (e.g., blockchain TX ID)
+	Tag        string             `db:"tag" json:"tag"`                 // Tag associated with the transaction
+	Amount     float64            `db:"amount" json:"amount"`           // Transaction amount
+	Fee        float64            `db:"fee" json:"fee"`                 // Fee applied to the transaction
+	Discount   float64            `db:"discount" json:"discount"`       // Discount applied to the transaction
+	Status     *TransactionStatus `db:"status" json:"status"`           // Status of the transaction (e.g., pending, verified)
+	Type       TransactionType    `db:"type" json:"type"`               // Type of the transaction (e.g., deposit, withdrawal)
+	Meta       types.JSONText     `db:"meta" json:"meta"`               // Metadata associated with the transaction
+	CanceledAt *time.Time         `db:"canceled_at" json:"canceled_at"` // Cancellation timestamp, if applicable
+	VerfiedAt  *time.Time         `db:"verified_at" json:"verified_at"` // Verification timestamp
+	CreatedAt  time.Time          `db:"created_at" json:"created_at"`   // Transaction creation timestamp
 }
 
 // Table returns the table name for the Transaction struct, including a prefix if defined in config.
@@ -35,51 +45,227 @@ func (Transaction) Table() string {
 	return fmt.Sprintf("%s_transactions", config.Prefix) // Prefixed table name
 }
 
+// FetchTransactionsByType retrieves all transactions of the given type for a payment, oldest first.
+func FetchTransactionsByType(paymentID uuid.UUID, txType TransactionType) ([]Transaction, error) {
+	transactions := []Transaction{}
+	query := fmt.Sprintf(`SELECT * FROM %s WHERE payment_id=$1 AND type=$2 ORDER BY created_at`, Transaction{}.Table())
+	if err := config.DB.Select(&transactions, query, paymentID, txType); err != nil {
+		return nil, err
+	}
+	return transactions, nil
+}
+
+// FetchLatestTransaction retrieves the most recent transaction of the given type for a payment.
+func FetchLatestTransaction(paymentID uuid.UUID, txType TransactionType) (*Transaction, error) {
+	t := new(Transaction)
+	query := fmt.Sprintf(`SELECT * FROM %s WHERE payment_id=$1 AND type=$2 ORDER BY created_at DESC LIMIT 1`, t.Table())
+	if err := config.DB.Get(t, query, paymentID, txType); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// FetchUnverifiedTransactions retrieves the transactions of a payment that were neither verified nor canceled,
+// which is useful for identifying stalled payments.
+func FetchUnverifiedTransactions(paymentID uuid.UUID) ([]Transaction, error) {
+	transactions := []Transaction{}
+	query := fmt.Sprintf(`SELECT * FROM %s WHERE payment_id=$1 AND verified_at IS NULL AND canceled_at IS NULL ORDER BY created_at`, Transaction{}.Table())
+	if err := config.DB.Select(&transactions, query, paymentID); err != nil {
+		return nil, err
+	}
+	return transactions, nil
+}
+
 // Create inserts a new transaction into the database, using the fields in the Transaction struct.
-// It returns an error if the insert fails.
+// It returns ErrMaxTransactionsReached if the payment already has Config.MaxTransactionsPerPayment transactions,
+// or an error if the insert fails.
 func (t *Transaction) Create() error {
-	// SQL query to insert a new transaction
+	// SQL query to insert a new transaction, refusing to grow the payment's transactions without bound.
+	// The transactions are counted by the insert itself so that concurrent inserts cannot exceed the limit.
 	query := `
-		INSERT INTO %s (
+		INSERT INTO %[1]s (
 			payment_id, identity_id, tx_id, tag, amount, fee, discount, type, meta
-		) VALUES (
+		) SELECT
 			$1, $2, $3, $4, $5, $6, $7, $8, $9
-		) RETURNING *
+		WHERE (SELECT COUNT(*) FROM %[1]s WHERE payment_id=$1) < $10
+		RETURNING *
 	`
 	query = fmt.Sprintf(query, t.Table())
 
 	// Execute the insert query and scan the result back into the struct
-	return config.DB.QueryRowx(query, t.PaymentID, t.IdentityID, t.TXID, t.Tag, t.Amount, t.Fee, t.Discount, t.Type, t.Meta).
+	err := config.DB.QueryRowx(query, t.PaymentID, t.IdentityID, t.TXID, t.Tag, t.Amount, t.Fee, t.Discount, t.Type, t.Meta, config.MaxTransactionsPerPayment).
 		StructScan(t)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrMaxTransactionsReached
+	}
+	if err != nil {
+		return err
+	}
+
+	if config.OnTransactionCreated != nil {
+		config.OnTransactionCreated(t)
+	}
+	return nil
 }
 
-// Verify updates the transaction's status to verified, setting the transaction ID, metadata, and verification timestamp.
+// Verify updates the transaction's status from pending to verified, setting the transaction ID, metadata, and verification timestamp.
 // It returns an error if the update fails.
 func (t *Transaction) Verify() error {
 	// SQL query to update a transaction as verified
-	query := `UPDATE %s SET tx_id=$2, meta=$3, verified_at=NOW() WHERE id=$1 RETURNING *`
+	query := `UPDATE %s SET tx_id=$2, meta=$3, status=$4, verified_at=NOW() WHERE id=$1 RETURNING *`
 	query = fmt.Sprintf(query, t.Table())
 
 	// Execute the update query and scan the result back into the struct
-	return config.DB.QueryRowx(query, t.ID, t.TXID, t.Meta).StructScan(t)
+	if err := config.DB.QueryRowx(query, t.ID, t.TXID, t.Meta, VERIFIED).StructScan(t); err != nil {
+		return err
+	}
+
+	if config.OnTransactionVerified != nil {
+		config.OnTransactionVerified(t)
+	}
+	return nil
 }
 
-// Cancel sets the canceled timestamp for a transaction and updates its metadata.
+// Cancel sets the transaction's status to canceled along with the canceled timestamp, and updates its metadata.
 // It returns an error if the cancel operation fails.
 func (t *Transaction) Cancel() error {
 	// SQL query to update a transaction as canceled
-	query := `UPDATE %s SET meta=$2, canceled_at=NOW() WHERE id=$1 RETURNING *`
+	query := `UPDATE %s SET meta=$2, status=$3, canceled_at=NOW() WHERE id=$1 RETURNING *`
 	query = fmt.Sprintf(query, t.Table())
 
 	// Execute the update query and scan the result back into the struct
-	return config.DB.QueryRowx(query, t.ID, t.Meta).StructScan(t)
+	return config.DB.QueryRowx(query, t.ID, t.Meta, CANCELED).StructScan(t)
 }
 
-func (t *Transaction) ActionRequired() error {
-	// SQL query to update a transaction as verified
-	query := `UPDATE %s SET tx_id=$2, meta=$3, status='ACTION_REQUIRED' WHERE id=$1 RETURNING *`
+// Pending marks the transaction as submitted but not yet confirmed. It is the initial state of a deposit,
+// which then moves to VERIFIED, CANCELED or ACTION_REQUIRED.
+// It returns an error if the update fails.
+func (t *Transaction) Pending() error {
+	// SQL query to update a transaction as pending
+	query := `UPDATE %s SET status=$2 WHERE id=$1 RETURNING *`
+	query = fmt.Sprintf(query, t.Table())
+
+	// Execute the update query and scan the result back into the struct
+	return config.DB.QueryRowx(query, t.ID, PENDING).StructScan(t)
+}
+
+// saveInfo stores the transaction ID and metadata received from the payment service without changing the status.
+// It returns an error if the update fails.
+func (t *Transaction) saveInfo() error {
+	// SQL query to update the transaction ID and metadata
+	query := `UPDATE %s SET tx_id=$2, meta=$3 WHERE id=$1 RETURNING *`
 	query = fmt.Sprintf(query, t.Table())
 
 	// Execute the update query and scan the result back into the struct
 	return config.DB.QueryRowx(query, t.ID, t.TXID, t.Meta).StructScan(t)
 }
+
+func (t *Transaction) ActionRequired() error {
+	// SQL query to update a transaction as requiring action
+	query := `UPDATE %s SET tx_id=$2, meta=$3, status=$4 WHERE id=$1 RETURNING *`
+	query = fmt.Sprintf(query, t.Table())
+
+	// Execute the update query and scan the result back into the struct
+	return config.DB.QueryRowx(query, t.ID, t.TXID, t.Meta, ACTION_REQUIRED).StructScan(t)
+}
+
+// Dispute marks the transaction as disputed (e.g., after a chargeback) and records the reason in its metadata.
+// It returns an error if the update fails.
+func (t *Transaction) Dispute(reason string) error {
+	// Merge the dispute reason into the existing metadata
+	meta := map[string]interface{}{}
+	if len(t.Meta) > 0 {
+		if err := json.Unmarshal(t.Meta, &meta); err != nil {
+			return newError(ErrCodeValidation, err, "failed to unmarshal meta")
+		}
+	}
+	// A null meta unmarshals into a nil map
+	if meta == nil {
+		meta = map[string]interface{}{}
+	}
+	meta["dispute_reason"] = reason
+	t.Meta, _ = json.Marshal(meta)
+
+	// SQL query to update a transaction as disputed
+	query := `UPDATE %s SET meta=$2, status=$3 WHERE id=$1 RETURNING *`
+	query = fmt.Sprintf(query, t.Table())
+
+	// Execute the update query and scan the result back into the struct
+	return config.DB.QueryRowx(query, t.ID, t.Meta, DISPUTED).StructScan(t)
+}
+
+// restore sets the transaction's status and metadata back to the given ones, e.g., to undo Dispute.
+func (t *Transaction) restore(status *TransactionStatus, meta types.JSONText) error {
+	query := `UPDATE %s SET meta=$2, status=$3 WHERE id=$1 RETURNING *`
+	query = fmt.Sprintf(query, t.Table())
+
+	return config.DB.QueryRowx(query, t.ID, meta, status).StructScan(t)
+}
+
+// UpdateFee corrects the fee of a verified transaction, e.g., once the actual Stripe fee is known from its
+// balance transaction. It returns ErrTransactionNotVerified if the transaction is not verified or has been canceled.
+func (t *Transaction) UpdateFee(fee float64) error {
+	return t.updateAmount("fee", fee)
+}
+
+// UpdateDiscount corrects the discount of a verified transaction. Like UpdateFee, it returns
+// ErrTransactionNotVerified if the transaction is not verified or has been canceled.
+func (t *Transaction) UpdateDiscount(discount float64) error {
+	return t.updateAmount("discount", discount)
+}
+
+// updateAmount sets the given amount column of the transaction, provided that it is verified and not canceled.
+func (t *Transaction) updateAmount(column string, value float64) error {
+	// SQL query to update the amount of a verified transaction
+	query := `UPDATE %s SET %s=$1 WHERE id=$2 AND verified_at IS NOT NULL AND canceled_at IS NULL RETURNING *`
+	query = fmt.Sprintf(query, t.Table(), column)
+
+	// Execute the update query and scan the result back into the struct
+	err := config.DB.QueryRowx(query, value, t.ID).StructScan(t)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrTransactionNotVerified
+	}
+	return err
+}
+
+// rollbackReason returns the reason recorded by Payment.Rollback in the transaction metadata, if any.
+func (t Transaction) rollbackReason() (string, bool) {
+	var meta map[string]interface{}
+	if err := json.Unmarshal(t.Meta, &meta); err != nil {
+		return "", false
+	}
+	reason, ok := meta[rollbackReasonMetaKey].(string)
+	return reason, ok
+}
+
+// chargeID extracts the fiat charge ID recorded in the transaction metadata, if any.
+func (t Transaction) chargeID() string {
+	var meta struct {
+		Info struct {
+			ChargeID string `json:"charge_id"`
+		} `json:"info"`
+	}
+	if err := json.Unmarshal(t.Meta, &meta); err != nil {
+		return ""
+	}
+	return meta.Info.ChargeID
+}
+
+// paymentIntentID extracts the fiat payment intent ID recorded in the transaction metadata, if any.
+func (t Transaction) paymentIntentID() string {
+	var meta struct {
+		Info struct {
+			TXID          string `json:"tx_id"`
+			PaymentIntent *struct {
+				ID string `json:"id"`
+			} `json:"payment_intent"`
+		} `json:"info"`
+	}
+	if err := json.Unmarshal(t.Meta, &meta); err != nil {
+		return ""
+	}
+	if meta.Info.PaymentIntent != nil && meta.Info.PaymentIntent.ID != "" {
+		return meta.Info.PaymentIntent.ID
+	}
+	return meta.Info.TXID
+}
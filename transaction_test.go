@@ -0,0 +1,149 @@
+package gopay_test
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/socious-io/gopay"
+)
+
+func TestTransactionUpdateFee(t *testing.T) {
+	verified := uuid.New()
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		if !strings.Contains(query, "verified_at IS NOT NULL AND canceled_at IS NULL") {
+			return nil, nil, nil
+		}
+		// Only the verified transaction matches the update
+		if args[1].Value != verified.String() {
+			return []string{"fee", "discount"}, nil, nil
+		}
+		if strings.Contains(query, "SET fee=$1") {
+			return []string{"fee", "discount"}, [][]driver.Value{{args[0].Value, 0.0}}, nil
+		}
+		return []string{"fee", "discount"}, [][]driver.Value{{3.2, args[0].Value}}, nil
+	})
+
+	tx := &gopay.Transaction{ID: verified, Fee: 3}
+	if err := tx.UpdateFee(3.2); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if tx.Fee != 3.2 {
+		t.Errorf("Expected fee 3.2, but got %v", tx.Fee)
+	}
+	if err := tx.UpdateDiscount(1.5); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if tx.Discount != 1.5 {
+		t.Errorf("Expected discount 1.5, but got %v", tx.Discount)
+	}
+
+	pending := &gopay.Transaction{ID: uuid.New(), Fee: 3}
+	if err := pending.UpdateFee(3.2); !errors.Is(err, gopay.ErrTransactionNotVerified) {
+		t.Errorf("Expected ErrTransactionNotVerified, but got %v", err)
+	}
+	if err := pending.UpdateDiscount(1); !errors.Is(err, gopay.ErrTransactionNotVerified) {
+		t.Errorf("Expected ErrTransactionNotVerified, but got %v", err)
+	}
+	if pending.Fee != 3 {
+		t.Errorf("Expected the fee to be unchanged, but got %v", pending.Fee)
+	}
+}
+
+func TestTransactionDispute(t *testing.T) {
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		if strings.Contains(query, "SET meta=$2, status=$3") {
+			return []string{"meta", "status"}, [][]driver.Value{{args[1].Value, args[2].Value}}, nil
+		}
+		return nil, nil, nil
+	})
+
+	for _, meta := range []string{"", "null", `{"info": {"tx_id": "pi_123"}}`} {
+		tx := &gopay.Transaction{ID: uuid.New(), Meta: []byte(meta)}
+		if err := tx.Dispute("fraudulent"); err != nil {
+			t.Fatalf("%q: expected no error, but got %v", meta, err)
+		}
+		var got map[string]interface{}
+		json.Unmarshal(tx.Meta, &got)
+		if got["dispute_reason"] != "fraudulent" || tx.Status == nil || *tx.Status != gopay.DISPUTED {
+			t.Errorf("%q: expected a disputed transaction with its reason, but got %s", meta, tx.Meta)
+		}
+		if meta != "" && meta != "null" && got["info"] == nil {
+			t.Errorf("%q: expected the existing meta to be kept, but got %s", meta, tx.Meta)
+		}
+	}
+}
+
+func TestTransactionLookups(t *testing.T) {
+	// Transactions of the payment, oldest first
+	rows := []struct {
+		txID, txType       string
+		verified, canceled bool
+	}{
+		{"pi_1", "DEPOSIT", false, true},
+		{"pi_2", "DEPOSIT", true, false},
+		{"po_1", "PAYOUT", false, false},
+		{"pi_3", "DEPOSIT", false, false},
+	}
+	paymentID := uuid.New()
+	setupFakeDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		if !strings.Contains(query, "SELECT * FROM transactions WHERE payment_id=$1") || args[0].Value != paymentID.String() {
+			return nil, nil, nil
+		}
+		var result [][]driver.Value
+		for _, r := range rows {
+			switch {
+			case strings.Contains(query, "type=$2") && r.txType != args[1].Value:
+			case strings.Contains(query, "verified_at IS NULL AND canceled_at IS NULL") && (r.verified || r.canceled):
+			default:
+				result = append(result, []driver.Value{r.txID, r.txType})
+			}
+		}
+		if strings.Contains(query, "ORDER BY created_at DESC LIMIT 1") && len(result) > 0 {
+			result = result[len(result)-1:]
+		}
+		return []string{"tx_id", "type"}, result, nil
+	})
+
+	txIDs := func(transactions []gopay.Transaction) []string {
+		ids := []string{}
+		for _, tx := range transactions {
+			ids = append(ids, tx.TXID)
+		}
+		return ids
+	}
+
+	deposits, err := gopay.FetchTransactionsByType(paymentID, gopay.DEPOSIT)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if ids := strings.Join(txIDs(deposits), ","); ids != "pi_1,pi_2,pi_3" {
+		t.Errorf("Expected the deposits oldest first, but got %s", ids)
+	}
+
+	latest, err := gopay.FetchLatestTransaction(paymentID, gopay.PAYOUT)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if latest.TXID != "po_1" || latest.Type != gopay.PAYOUT {
+		t.Errorf("Expected the latest payout, but got %+v", latest)
+	}
+	if latest, err = gopay.FetchLatestTransaction(paymentID, gopay.DEPOSIT); err != nil || latest.TXID != "pi_3" {
+		t.Errorf("Expected the latest deposit, but got %+v, %v", latest, err)
+	}
+	if _, err := gopay.FetchLatestTransaction(paymentID, gopay.PARTIAL_REFUND); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected no refund to be found, but got %v", err)
+	}
+
+	unverified, err := gopay.FetchUnverifiedTransactions(paymentID)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if ids := strings.Join(txIDs(unverified), ","); ids != "po_1,pi_3" {
+		t.Errorf("Expected the transactions neither verified nor canceled, but got %s", ids)
+	}
+}
@@ -1,6 +1,9 @@
 package gopay
 
 import (
+	"context"
+	"encoding/hex"
+	"fmt"
 	"math/big"
 	"strconv"
 	"strings"
@@ -13,21 +16,35 @@ func fromStrTimestampToTime(valueStr string) time.Time {
 
 }
 
-func fromStrTokenValueToNumber(valueStr string, tokenDecimal string) float64 {
+// fromStrTokenValueToNumber converts a raw token value in the token's smallest unit into a decimal amount.
+// The value may be a base-10 integer, a hex integer prefixed with 0x, or in scientific notation (e.g., 1.5e18).
+func fromStrTokenValueToNumber(valueStr string, tokenDecimal string) (float64, error) {
+	valueStr = strings.TrimSpace(valueStr)
 	tokenDecimal = strings.TrimSpace(tokenDecimal)
 
 	// Convert the value to big.Int
 	value := new(big.Int)
-	_, success := value.SetString(valueStr, 10)
-	if !success {
-		return -1
+	switch {
+	case strings.HasPrefix(valueStr, "0x") || strings.HasPrefix(valueStr, "0X"):
+		if _, success := value.SetString(valueStr[2:], 16); !success {
+			return 0, newError(ErrCodeValidation, nil, "invalid hex token value %q", valueStr)
+		}
+	case strings.ContainsAny(valueStr, "eE"):
+		f, err := strconv.ParseFloat(valueStr, 64)
+		if err != nil {
+			return 0, newError(ErrCodeValidation, err, "invalid token value %q", valueStr)
+		}
+		big.NewFloat(f).Int(value)
+	default:
+		if _, success := value.SetString(valueStr, 10); !success {
+			return 0, newError(ErrCodeValidation, nil, "invalid token value %q", valueStr)
+		}
 	}
 
 	// Convert tokenDecimal to an integer
 	decimal := new(big.Int)
-	_, success = decimal.SetString(tokenDecimal, 10)
-	if !success {
-		return -1
+	if _, success := decimal.SetString(tokenDecimal, 10); !success {
+		return 0, newError(ErrCodeValidation, nil, "invalid token decimal %q", tokenDecimal)
 	}
 
 	// Compute the factor (10^decimal)
@@ -38,9 +55,104 @@ func fromStrTokenValueToNumber(valueStr string, tokenDecimal string) float64 {
 
 	// Convert to float64 and return the result
 	floatResult, _ := result.Float64()
-	return floatResult
+	return floatResult, nil
 }
 
-func matchAddress(addr1, addr2 string) bool {
-	return strings.Contains(strings.ToLower(addr1), strings.ToLower(addr2))
+// MatchAddress reports whether a token address or unit reported by the explorer of a network of the given type
+// identifies the configured token address. See matchCardanoAddress for the forms accepted on Cardano.
+func MatchAddress(networkType NetworkType, unit, tokenAddress string) bool {
+	switch networkType {
+	case EVM:
+		return strings.EqualFold(unit, tokenAddress)
+	case CARDANO:
+		return matchCardanoAddress(unit, tokenAddress)
+	default:
+		return strings.Contains(strings.ToLower(tokenAddress), strings.ToLower(unit))
+	}
+}
+
+// cardanoPolicyIDLength is the length of a hex-encoded Cardano minting policy ID, which prefixes asset units.
+const cardanoPolicyIDLength = 56
+
+// cip67LabelLength is the length of a hex-encoded CIP-67 asset name label, e.g., "0014df10" for CIP-68 tokens.
+const cip67LabelLength = 8
+
+// matchCardanoAddress reports whether a Blockfrost unit, i.e., "lovelace" or a policy ID followed by a hex-encoded
+// asset name, is the token configured as:
+//   - NativeTokenAddress for ADA, or the unit itself;
+//   - the policy ID alone, matching every asset of the policy;
+//   - "<policyID>.<assetName>", with the asset name hex-encoded or human readable. A CIP-67 label prefixing the
+//     asset name (as on CIP-68 tokens) may be left out of the human-readable name.
+func matchCardanoAddress(unit, tokenAddress string) bool {
+	if tokenAddress == NativeTokenAddress {
+		return unit == "lovelace"
+	}
+	if strings.EqualFold(unit, tokenAddress) {
+		return true
+	}
+	if len(unit) < cardanoPolicyIDLength {
+		return false
+	}
+
+	policyID, assetName := unit[:cardanoPolicyIDLength], unit[cardanoPolicyIDLength:]
+	tokenPolicyID, tokenAssetName, hasName := strings.Cut(tokenAddress, ".")
+	if !strings.EqualFold(policyID, tokenPolicyID) {
+		return false
+	}
+	if !hasName || strings.EqualFold(assetName, tokenAssetName) {
+		return true
+	}
+
+	names := []string{assetName}
+	if len(assetName) >= cip67LabelLength && assetName[0] == '0' && assetName[cip67LabelLength-1] == '0' {
+		names = append(names, assetName[cip67LabelLength:])
+	}
+	for _, name := range names {
+		if decoded, err := hex.DecodeString(name); err == nil && string(decoded) == tokenAssetName {
+			return true
+		}
+	}
+	return false
+}
+
+// sleepContext pauses for the given duration, returning early with the context error if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// sleepBeforeRetry waits d before the next of attempts tries, returning at once after the last one.
+func sleepBeforeRetry(ctx context.Context, attempt, attempts int, d time.Duration) error {
+	if attempt+1 >= attempts {
+		return nil
+	}
+	return sleepContext(ctx, d)
+}
+
+// prefixErrors flattens a (possibly joined) error into its individual errors, prefixing each one.
+func prefixErrors(prefix string, err error) []error {
+	if err == nil {
+		return nil
+	}
+
+	// Look through the *Error wrapping joined validation errors
+	if e, ok := err.(*Error); ok && e.Message == "" {
+		return prefixErrors(prefix, e.Cause)
+	}
+
+	var errs []error
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, e := range joined.Unwrap() {
+			errs = append(errs, prefixErrors(prefix, e)...)
+		}
+		return errs
+	}
+	return append(errs, fmt.Errorf("%s: %w", prefix, err))
 }
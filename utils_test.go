@@ -0,0 +1,77 @@
+package gopay
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFromStrTokenValueToNumber(t *testing.T) {
+	cases := []struct {
+		name     string
+		value    string
+		decimals string
+		want     float64
+		wantErr  bool
+	}{
+		{"decimal", "1000000000000000000", "18", 1, false},
+		{"decimal with fraction", "1500000", "6", 1.5, false},
+		{"hex", "0xDE0B6B3A7640000", "18", 1, false},
+		{"hex lowercase prefix", "0Xde0b6b3a7640000", "18", 1, false},
+		{"scientific", "1.5e18", "18", 1.5, false},
+		{"scientific uppercase", "2E6", "6", 2, false},
+		{"very large integer", "123456789000000000000000000000000000000", "18", 123456789000000000000, false},
+		{"zero decimals", "42", "0", 42, false},
+		{"invalid", "not-a-number", "18", 0, true},
+		{"invalid hex", "0xZZ", "18", 0, true},
+		{"invalid scientific", "1.5e", "18", 0, true},
+		{"empty", "", "18", 0, true},
+		{"invalid decimals", "1000", "abc", 0, true},
+	}
+
+	for _, c := range cases {
+		got, err := fromStrTokenValueToNumber(c.value, c.decimals)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: expected error %v, but got %v", c.name, c.wantErr, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%s: expected %f, but got %f", c.name, c.want, got)
+		}
+	}
+}
+
+func TestMatchAddress(t *testing.T) {
+	const (
+		policyID = "c48cbb3d5e57ed56e276bc45f99ab39abe94e6cd7ac39fb402da47ad"
+		usdm     = policyID + "0014df105553444d" // CIP-68 label followed by "USDM"
+		hosky    = "a0028f350aaabe0545fdcb56b039bfb08e4bb4d8c4d7c3c7d481c235" + "484f534b59"
+	)
+
+	cases := []struct {
+		name         string
+		networkType  NetworkType
+		unit         string
+		tokenAddress string
+		want         bool
+	}{
+		{"cardano exact", CARDANO, usdm, usdm, true},
+		{"cardano exact uppercase", CARDANO, usdm, strings.ToUpper(usdm), true},
+		{"cardano policy ID", CARDANO, usdm, policyID, true},
+		{"cardano other policy ID", CARDANO, hosky, policyID, false},
+		{"cardano hex asset name", CARDANO, hosky, hosky[:56] + ".484f534b59", true},
+		{"cardano readable asset name", CARDANO, hosky, hosky[:56] + ".HOSKY", true},
+		{"cardano readable CIP-68 asset name", CARDANO, usdm, policyID + ".USDM", true},
+		{"cardano other asset name", CARDANO, hosky, hosky[:56] + ".USDM", false},
+		{"cardano native", CARDANO, "lovelace", NativeTokenAddress, true},
+		{"cardano native token", CARDANO, usdm, NativeTokenAddress, false},
+		{"cardano lovelace token", CARDANO, "lovelace", usdm, false},
+		{"evm case insensitive", EVM, "0xa0b86991c6218b36c1d19d4a2e9eb0ce3606eb48", "0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48", true},
+		{"evm prefix", EVM, "0xa0b8", "0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48", false},
+	}
+
+	for _, c := range cases {
+		if got := MatchAddress(c.networkType, c.unit, c.tokenAddress); got != c.want {
+			t.Errorf("%s: expected %v, but got %v", c.name, c.want, got)
+		}
+	}
+}
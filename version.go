@@ -0,0 +1,69 @@
+package gopay
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/stripe/stripe-go/v81"
+)
+
+// Version is the version of the gopay library.
+const Version = "0.1.0"
+
+// stripeModulePath is the module path of the Stripe SDK, used to look up its version in the build info.
+const stripeModulePath = "github.com/stripe/stripe-go/v81"
+
+// BuildInfo describes the versions of the library and its main dependencies, e.g., for support requests.
+type BuildInfo struct {
+	GopayVersion     string `json:"gopay_version"`      // Version of gopay.
+	StripeSDKVersion string `json:"stripe_sdk_version"` // Version of the stripe-go module the binary was built with.
+	GoVersion        string `json:"go_version"`         // Version of the Go runtime.
+}
+
+// GetBuildInfo returns the versions of gopay, the Stripe SDK and the Go runtime in use.
+func GetBuildInfo() BuildInfo {
+	info := BuildInfo{
+		GopayVersion:     Version,
+		StripeSDKVersion: "v" + stripe.ClientVersion, // Fallback when the binary has no module information
+		GoVersion:        runtime.Version(),
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range bi.Deps {
+			if dep.Path == stripeModulePath {
+				if dep.Replace != nil {
+					dep = dep.Replace
+				}
+				info.StripeSDKVersion = dep.Version
+				break
+			}
+		}
+	}
+	return info
+}
+
+// versionHeader is the header identifying the gopay version on outbound Stripe API calls.
+const versionHeader = "X-Gopay-Version"
+
+// versionTransport is an http.RoundTripper adding the gopay version header to every request.
+type versionTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip adds the version header to a copy of the request and sends it with the base transport.
+func (t versionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set(versionHeader, Version)
+	return t.base.RoundTrip(req)
+}
+
+// newStripeHTTPClient returns the HTTP client used for Stripe API calls, with the same timeout as the
+// Stripe SDK's default client.
+func newStripeHTTPClient() *http.Client {
+	return &http.Client{
+		Timeout:   80 * time.Second,
+		Transport: versionTransport{base: http.DefaultTransport},
+	}
+}
@@ -0,0 +1,57 @@
+package gopay_test
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/socious-io/gopay"
+	"github.com/socious-io/gopay/testutil"
+	"github.com/stripe/stripe-go/v81"
+)
+
+func TestGetBuildInfo(t *testing.T) {
+	info := gopay.GetBuildInfo()
+	if info.GopayVersion != gopay.Version {
+		t.Errorf("Expected gopay version %s, but got %s", gopay.Version, info.GopayVersion)
+	}
+	if !strings.HasPrefix(info.StripeSDKVersion, "v81.") {
+		t.Errorf("Expected a v81 Stripe SDK version, but got %s", info.StripeSDKVersion)
+	}
+	if info.GoVersion != runtime.Version() {
+		t.Errorf("Expected Go version %s, but got %s", runtime.Version(), info.GoVersion)
+	}
+}
+
+func TestStripeVersionHeader(t *testing.T) {
+	var header string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("X-Gopay-Version")
+		w.Write([]byte(`{"object": "balance", "available": [], "pending": []}`))
+	}
+	f := gopay.Fiat{Name: "stripe", ApiKey: "sk_test", Service: gopay.STRIPE}
+
+	// The Stripe SDK's HTTP client is left alone unless asked for
+	setupFakeDB(t, func(string, []driver.NamedValue) ([]string, [][]driver.Value, error) { return nil, nil, nil })
+	testutil.NewMockFiat(t, handler)
+	if _, err := f.StripeGetBalance(); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if header != "" {
+		t.Errorf("Expected no X-Gopay-Version by default, but got %q", header)
+	}
+
+	// The backend picks the HTTP client up when it is created, so it is mocked again after Setup
+	setupFakeDB(t, func(string, []driver.NamedValue) ([]string, [][]driver.Value, error) { return nil, nil, nil }, gopay.WithStripeVersionHeader())
+	t.Cleanup(func() { stripe.SetHTTPClient(&http.Client{Timeout: 80 * time.Second}) })
+	testutil.NewMockFiat(t, handler)
+	if _, err := f.StripeGetBalance(); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if header != gopay.Version {
+		t.Errorf("Expected X-Gopay-Version %s, but got %q", gopay.Version, header)
+	}
+}
@@ -0,0 +1,118 @@
+package gopay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v81"
+	"github.com/stripe/stripe-go/v81/webhook"
+)
+
+// PaymentIDMetadataKey is the metadata key under which the gopay payment ID is attached to payment intents,
+// so that webhook events can be correlated back to payments.
+const PaymentIDMetadataKey = "gopay_payment_id"
+
+// WebhookEvent is a verified webhook event received from a fiat service.
+type WebhookEvent struct {
+	ID        string            `json:"id"`         // Event ID on the payment provider's system.
+	Type      string            `json:"type"`       // Event type (e.g., "payment_intent.succeeded").
+	ObjectID  string            `json:"object_id"`  // ID of the object the event is about (e.g., the payment intent ID).
+	PaymentID *uuid.UUID        `json:"payment_id"` // The gopay payment the event belongs to, if known.
+	Metadata  map[string]string `json:"metadata"`   // Metadata attached to the object the event is about.
+	Raw       stripe.Event      `json:"-"`          // The raw event as received.
+}
+
+// VerifyWebhookSignature verifies that a webhook payload was signed by the named service using the
+// secret configured in Config.WebhookSecrets. Configured fiat services are verified using their provider's
+// signature scheme (e.g., Stripe's), while any other service is expected to send a hex-encoded HMAC-SHA256
+// of the payload.
+// It does not require the payment to be known, so it can be used in HTTP middleware.
+func VerifyWebhookSignature(serviceName string, payload []byte, signature string) error {
+	secret, ok := config.WebhookSecrets[serviceName]
+	if !ok || secret == "" {
+		return newError(ErrCodeNotFound, nil, "webhook secret for service %s could not found", serviceName)
+	}
+
+	if f, ok := config.fiatServices().FindByName(serviceName); ok {
+		switch f.Service {
+		// TODO: add new webhook signature services here.
+		default:
+			// Default to Stripe if no specific service is added.
+			if err := webhook.ValidatePayload(payload, signature, secret); err != nil {
+				return newError(ErrCodeValidation, err, "invalid webhook signature")
+			}
+			return nil
+		}
+	}
+
+	// Custom services sign the raw payload with HMAC-SHA256
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return newError(ErrCodeValidation, err, "invalid webhook signature")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return newError(ErrCodeValidation, nil, "invalid webhook signature")
+	}
+	return nil
+}
+
+// HandleWebhook verifies a Stripe webhook payload and extracts the metadata of the object it is about,
+// including the gopay payment ID set when the payment intent was created.
+func HandleWebhook(serviceName string, payload []byte, signature string) (*WebhookEvent, error) {
+	if err := VerifyWebhookSignature(serviceName, payload, signature); err != nil {
+		return nil, err
+	}
+
+	var raw stripe.Event
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		return nil, newError(ErrCodeValidation, err, "failed to parse webhook event")
+	}
+
+	event := &WebhookEvent{
+		ID:       raw.ID,
+		Type:     string(raw.Type),
+		Metadata: map[string]string{},
+		Raw:      raw,
+	}
+	if raw.Data == nil {
+		return event, nil
+	}
+
+	var object struct {
+		ID       string            `json:"id"`
+		Metadata map[string]string `json:"metadata"`
+	}
+	if err := json.Unmarshal(raw.Data.Raw, &object); err != nil {
+		return nil, newError(ErrCodeValidation, err, "failed to parse webhook object")
+	}
+	event.ObjectID = object.ID
+	for k, v := range object.Metadata {
+		event.Metadata[k] = v
+	}
+
+	if id, err := uuid.Parse(event.Metadata[PaymentIDMetadataKey]); err == nil {
+		event.PaymentID = &id
+	}
+
+	return event, nil
+}
+
+// Payment fetches the payment the event belongs to and populates its StripeWebhookMetadata.
+func (e WebhookEvent) Payment() (*Payment, error) {
+	if e.PaymentID == nil {
+		return nil, newError(ErrCodeNotFound, nil, "webhook event %s is not linked to a payment", e.ID)
+	}
+
+	p, err := Fetch(*e.PaymentID)
+	if err != nil {
+		return nil, err
+	}
+	p.StripeWebhookMetadata = e.Metadata
+
+	return p, nil
+}
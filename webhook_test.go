@@ -0,0 +1,94 @@
+package gopay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"testing"
+
+	"github.com/stripe/stripe-go/v81/webhook"
+)
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	original := config
+	defer func() { config = original }()
+
+	config = &Config{
+		Logger:         DefaultLogger{},
+		WebhookSecrets: map[string]string{"stripe": "whsec_test", "custom": "custom_secret"},
+		fiatIndex:      FiatIndex{"stripe": &Fiat{Name: "stripe", Service: STRIPE}},
+		mu:             new(sync.RWMutex),
+	}
+
+	payload := []byte(`{"id": "evt_test", "object": "event"}`)
+	tampered := []byte(`{"id": "evt_test", "object": "event", "amount": 1}`)
+
+	// Stripe signature scheme
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: payload, Secret: "whsec_test"})
+	if err := VerifyWebhookSignature("stripe", payload, signed.Header); err != nil {
+		t.Errorf("Expected valid stripe signature, but got %v", err)
+	}
+	if err := VerifyWebhookSignature("stripe", tampered, signed.Header); err == nil {
+		t.Errorf("Expected tampered stripe payload to fail verification")
+	}
+
+	// HMAC-SHA256 signature scheme
+	mac := hmac.New(sha256.New, []byte("custom_secret"))
+	mac.Write(payload)
+	signature := hex.EncodeToString(mac.Sum(nil))
+	if err := VerifyWebhookSignature("custom", payload, signature); err != nil {
+		t.Errorf("Expected valid custom signature, but got %v", err)
+	}
+	if err := VerifyWebhookSignature("custom", tampered, signature); err == nil {
+		t.Errorf("Expected tampered custom payload to fail verification")
+	}
+
+	if err := VerifyWebhookSignature("unknown", payload, signature); err == nil {
+		t.Errorf("Expected unknown service to fail verification")
+	}
+}
+
+func TestHandleWebhook(t *testing.T) {
+	original := config
+	defer func() { config = original }()
+
+	config = &Config{
+		Logger:         DefaultLogger{},
+		WebhookSecrets: map[string]string{"stripe": "whsec_test"},
+		fiatIndex:      FiatIndex{"stripe": &Fiat{Name: "stripe", Service: STRIPE}},
+		mu:             new(sync.RWMutex),
+	}
+
+	payload := []byte(`{
+		"id": "evt_test",
+		"object": "event",
+		"type": "payment_intent.succeeded",
+		"data": {
+			"object": {
+				"id": "pi_test",
+				"object": "payment_intent",
+				"metadata": {"gopay_payment_id": "8a1f7c2e-5b3d-4e6f-9a0b-1c2d3e4f5a6b", "order": "42"}
+			}
+		}
+	}`)
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: payload, Secret: "whsec_test"})
+
+	event, err := HandleWebhook("stripe", payload, signed.Header)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if event.Type != "payment_intent.succeeded" || event.ObjectID != "pi_test" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+	if event.PaymentID == nil || event.PaymentID.String() != "8a1f7c2e-5b3d-4e6f-9a0b-1c2d3e4f5a6b" {
+		t.Errorf("Expected payment ID to be extracted, but got %v", event.PaymentID)
+	}
+	if event.Metadata["order"] != "42" {
+		t.Errorf("Expected metadata to be extracted, but got %v", event.Metadata)
+	}
+
+	if _, err := HandleWebhook("stripe", payload, "t=1,v1=invalid"); err == nil {
+		t.Errorf("Expected invalid signature to be rejected")
+	}
+}